@@ -0,0 +1,64 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	CapIMAP4rev1 = "IMAP4rev1"
+	CapIMAP4rev2 = "IMAP4rev2"
+)
+
+// CapabilitySet is a set of capability names. Capability names are case
+// insensitive (RFC 3501 9.), so lookups ignore case; the original spelling
+// sent by the server is kept for display.
+type CapabilitySet map[string]string
+
+func NewCapabilitySet(caps []string) CapabilitySet {
+	set := CapabilitySet{}
+
+	for _, cap := range caps {
+		set.Add(cap)
+	}
+
+	return set
+}
+
+func (set CapabilitySet) Add(cap string) {
+	if cap == "" {
+		return
+	}
+
+	set[strings.ToUpper(cap)] = cap
+}
+
+func (set CapabilitySet) Has(cap string) bool {
+	_, found := set[strings.ToUpper(cap)]
+	return found
+}
+
+func (set CapabilitySet) Strings() []string {
+	caps := make([]string, 0, len(set))
+	for _, cap := range set {
+		caps = append(caps, cap)
+	}
+
+	sort.Strings(caps)
+	return caps
+}
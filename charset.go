@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// CharsetEncoder transcodes UTF-8 data to a charset. It is used to encode the
+// strings of search keys.
+type CharsetEncoder func(charset string, data []byte) ([]byte, error)
+
+// EncodeCharset transcodes UTF-8 data to US-ASCII, ISO-8859-1 or UTF-8.
+// Applications can support other charsets by setting Client.CharsetEncoder,
+// e.g. using golang.org/x/text/encoding.
+func EncodeCharset(charset string, data []byte) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("invalid UTF-8 data")
+	}
+
+	switch strings.ToUpper(charset) {
+	case "US-ASCII":
+		for _, b := range data {
+			if b >= 0x80 {
+				return nil, fmt.Errorf("non-ASCII character")
+			}
+		}
+
+		return data, nil
+
+	case "ISO-8859-1":
+		edata := make([]byte, 0, len(data))
+
+		for _, r := range string(data) {
+			if r > 0xff {
+				return nil, fmt.Errorf("character %q cannot be "+
+					"encoded in %s", r, charset)
+			}
+
+			edata = append(edata, byte(r))
+		}
+
+		return edata, nil
+
+	case "UTF-8":
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
+
+// isASCIISearchKey indicates whether a search key only contains ASCII
+// characters, in which case it does not require a charset.
+func isASCIISearchKey(key SearchKey) bool {
+	for _, arg := range key {
+		var data []byte
+
+		switch targ := arg.(type) {
+		case string:
+			data = []byte(targ)
+		case []byte:
+			data = targ
+		case Literal:
+			data = targ
+		}
+
+		for _, b := range data {
+			if b >= 0x80 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// encodeSearchKey returns the charset and search key to send for a search
+// key containing UTF-8 strings. UTF-8 is used if the key contains non-ASCII
+// strings and no charset is provided. Literals are transcoded to the charset.
+func (c *Client) encodeSearchKey(charset string, key SearchKey) (string, SearchKey, error) {
+	if charset == "" {
+		if isASCIISearchKey(key) {
+			return "", key, nil
+		}
+
+		charset = "UTF-8"
+	}
+
+	ekey := make(SearchKey, len(key))
+
+	for i, arg := range key {
+		if literal, ok := arg.(Literal); ok {
+			data, err := c.CharsetEncoder(charset, literal)
+			if err != nil {
+				return "", nil, fmt.Errorf("cannot encode search "+
+					"string %q: %v", literal, err)
+			}
+
+			arg = Literal(data)
+		}
+
+		ekey[i] = arg
+	}
+
+	return charset, ekey, nil
+}
+
+// retryCharset returns the charset to use when a command was rejected with a
+// BADCHARSET response code, i.e. the first charset supported by the server
+// which can be used to encode the search key.
+func (c *Client) retryCharset(err error, charset string, key SearchKey) (string, bool) {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Text.Code != "BADCHARSET" {
+		return "", false
+	}
+
+	charsets, _ := statusErr.Text.CodeData.([]string)
+
+	for _, charset2 := range charsets {
+		if strings.EqualFold(charset2, charset) {
+			continue
+		}
+
+		if _, _, err := c.encodeSearchKey(charset2, key); err == nil {
+			return charset2, true
+		}
+	}
+
+	return "", false
+}
+
+// sendCharsetCommand calls sendFn with a charset and the search key encoded
+// in this charset. If the server rejects the charset, sendFn is called again
+// with a charset the server supports.
+func (c *Client) sendCharsetCommand(charset string, key SearchKey, sendFn func(string, SearchKey) error) error {
+	charset, ekey, err := c.encodeSearchKey(charset, key)
+	if err != nil {
+		return err
+	}
+
+	err = sendFn(charset, ekey)
+
+	if charset2, retry := c.retryCharset(err, charset, key); retry {
+		_, ekey, _ = c.encodeSearchKey(charset2, key)
+		err = sendFn(charset2, ekey)
+	}
+
+	return err
+}
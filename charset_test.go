@@ -0,0 +1,88 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeCharset(t *testing.T) {
+	tests := []struct {
+		charset string
+		str     string
+		data    string
+	}{
+		{"US-ASCII", "hello", "hello"},
+		{"utf-8", "café", "café"},
+		{"ISO-8859-1", "café", "caf\xe9"},
+	}
+
+	for _, test := range tests {
+		data, err := EncodeCharset(test.charset, []byte(test.str))
+		if err != nil {
+			t.Errorf("cannot encode %q in %s: %v", test.str,
+				test.charset, err)
+			continue
+		}
+
+		if string(data) != test.data {
+			t.Errorf("%q was encoded in %s as %q instead of %q",
+				test.str, test.charset, data, test.data)
+		}
+	}
+
+	invalidTests := []struct {
+		charset string
+		str     string
+	}{
+		{"US-ASCII", "café"},
+		{"ISO-8859-1", "10 €"},
+		{"UTF-8", "\xff"},
+		{"KOI8-R", "hello"},
+	}
+
+	for _, test := range invalidTests {
+		if _, err := EncodeCharset(test.charset, []byte(test.str)); err == nil {
+			t.Errorf("encoded %q in %s", test.str, test.charset)
+		}
+	}
+}
+
+func TestReadResponseBadCharset(t *testing.T) {
+	tests := []struct {
+		data     string
+		charsets []string
+	}{
+		{"c1 NO [BADCHARSET] unsupported charset\r\n", []string{}},
+		{"c1 NO [BADCHARSET (US-ASCII \"UTF-8\")] unsupported charset\r\n",
+			[]string{"US-ASCII", "UTF-8"}},
+	}
+
+	for _, test := range tests {
+		resp, err := ReadResponse(NewStream(bytes.NewReader([]byte(test.data))))
+		if err != nil {
+			t.Errorf("cannot read %q: %v", test.data, err)
+			continue
+		}
+
+		text := resp.(*ResponseStatus).Response.(*ResponseNo).Text
+		if !reflect.DeepEqual(text.CodeData, test.charsets) {
+			t.Errorf("%q was parsed as %#v", test.data, text.CodeData)
+		}
+	}
+}
@@ -20,8 +20,14 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"math"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // ---------------------------------------------------------------------------
@@ -36,6 +42,16 @@ const (
 	ClientStateLogout           ClientState = "logout"
 )
 
+// ---------------------------------------------------------------------------
+//  Protocol revision
+// ---------------------------------------------------------------------------
+type ProtocolRevision string
+
+const (
+	IMAP4rev1 ProtocolRevision = "IMAP4rev1" // RFC 3501
+	IMAP4rev2 ProtocolRevision = "IMAP4rev2" // RFC 9051
+)
+
 // ---------------------------------------------------------------------------
 //  Client
 // ---------------------------------------------------------------------------
@@ -57,10 +73,45 @@ type Client struct {
 
 	State ClientState
 
-	Caps map[string]bool
+	Caps     CapabilitySet
+	Revision ProtocolRevision
+
+	// Extensions enabled with ENABLE (RFC 5161)
+	Enabled CapabilitySet
 
 	Tag int
 
+	// Logger, if set, receives a trace of all data sent and received at
+	// debug level. Literals are truncated to LogMaxLiteralSize bytes and
+	// credentials are redacted.
+	Logger            *slog.Logger
+	LogMaxLiteralSize int
+
+	// Observer, if set, is notified of each command sent
+	Observer Observer
+
+	// Limits on data sent by the server; zero means no limit. When a
+	// limit is exceeded, the command fails with a *LimitError and the
+	// connection is closed.
+	MaxLineLength          int
+	MaxLiteralSize         int
+	MaxNestingDepth        int
+	MaxResponsesPerCommand int
+	MaxBytesPerCommand     int
+
+	// Commands operating on a sequence set are split in several commands
+	// if their line would be longer than MaxCommandLength bytes. Zero
+	// means no limit.
+	MaxCommandLength int
+
+	// CharsetEncoder transcodes the strings of search keys to the charset
+	// used for SEARCH, SORT and THREAD commands.
+	CharsetEncoder CharsetEncoder
+
+	bytesRead    int64
+	bytesWritten int64
+	cmdReader    *commandReader
+
 	stopChan chan int
 	cmdChan  chan Command
 	respChan chan *CommandResponse
@@ -71,13 +122,27 @@ func NewClient() *Client {
 		Host: "localhost",
 		Port: 143,
 
-		State: ClientStateDisconnected,
+		State:    ClientStateDisconnected,
+		Revision: IMAP4rev1,
+
+		LogMaxLiteralSize: DefaultLogMaxLiteralSize,
+
+		MaxLineLength:          DefaultMaxLineLength,
+		MaxLiteralSize:         DefaultMaxLiteralSize,
+		MaxNestingDepth:        DefaultMaxNestingDepth,
+		MaxResponsesPerCommand: DefaultMaxResponsesPerCommand,
+		MaxBytesPerCommand:     DefaultMaxBytesPerCommand,
+
+		MaxCommandLength: DefaultMaxCommandLength,
+
+		CharsetEncoder: EncodeCharset,
 	}
 }
 
 func (c *Client) Connect() error {
-	addr := fmt.Sprintf("%s:%d", c.Host, c.Port)
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
 
+	var conn net.Conn
 	var err error
 	if c.TLS {
 		var caCerts *x509.CertPool
@@ -106,16 +171,50 @@ func (c *Client) Connect() error {
 			Certificates: []tls.Certificate{cert},
 		}
 
-		c.Conn, err = tls.Dial("tcp", addr, &cfg)
+		conn, err = tls.Dial("tcp", addr, &cfg)
 	} else {
-		c.Conn, err = net.Dial("tcp", addr)
+		conn, err = net.Dial("tcp", addr)
 	}
 	if err != nil {
 		return err
 	}
 
-	c.Stream = NewStream(c.Conn)
-	c.Writer = NewBufferedWriter(c.Conn)
+	if err := c.ConnectConn(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	return nil
+}
+
+// ConnectConn initializes the connection on an already established network
+// connection, e.g. one end of a net.Pipe. The greeting is read and the client
+// authenticates if necessary, as with Connect.
+func (c *Client) ConnectConn(conn net.Conn) error {
+	c.Conn = conn
+
+	c.cmdReader = &commandReader{r: c.Conn, remaining: -1}
+
+	var r io.Reader = &countingReader{r: c.cmdReader, count: &c.bytesRead}
+	var w io.Writer = &countingWriter{w: c.Conn, count: &c.bytesWritten}
+
+	if c.Logger != nil {
+		trace := newProtocolTrace(c.Logger, c.LogMaxLiteralSize)
+
+		r = trace.Reader(r)
+		w = trace.Writer(w)
+	}
+
+	c.Stream = NewStream(r)
+	c.Stream.MaxLineLength = c.MaxLineLength
+	c.Stream.MaxLiteralSize = c.MaxLiteralSize
+	c.Stream.MaxNestingDepth = c.MaxNestingDepth
+
+	c.Writer = NewBufferedWriter(w)
+
+	c.Caps = nil
+	c.Revision = IMAP4rev1
+	c.Enabled = CapabilitySet{}
 
 	if err := c.processGreeting(); err != nil {
 		return err
@@ -125,46 +224,88 @@ func (c *Client) Connect() error {
 	c.cmdChan = make(chan Command)
 	c.respChan = make(chan *CommandResponse)
 
-	go c.main()
+	go c.main(c.stopChan, c.cmdChan, c.respChan)
+
+	// We need capabilities to select an authentication mechanism; if the
+	// greeting did not contain them, ask for them.
+	if c.Caps == nil {
+		if err := c.fetchCaps(); err != nil {
+			c.abortConnection()
+			return err
+		}
+	}
 
 	if c.State == ClientStateNotAuthenticated {
 		if err := c.authenticate(); err != nil {
-			c.stopChan <- 1
+			c.abortConnection()
+			return err
+		}
+	}
+
+	// Capabilities usually change after authentication. Most servers
+	// send the new list with the tagged response to AUTHENTICATE; we only
+	// have to ask for it when they do not.
+	if c.Caps == nil {
+		if err := c.fetchCaps(); err != nil {
+			c.abortConnection()
 			return err
 		}
 	}
 
-	if err := c.fetchCaps(); err != nil {
-		c.stopChan <- 1
+	if err := c.selectRevision(); err != nil {
+		c.abortConnection()
 		return err
 	}
 
 	return nil
 }
 
-func (c *Client) main() {
+// main processes commands until the connection is stopped. Channels are
+// passed as arguments since they are replaced when the client reconnects.
+func (c *Client) main(stopChan chan int, cmdChan chan Command, respChan chan *CommandResponse) {
 loop:
 	for {
 		select {
-		case <-c.stopChan:
+		case <-stopChan:
 			break loop
 
-		case cmd := <-c.cmdChan:
-			c.respChan <- c.processCommand(cmd)
+		case cmd := <-cmdChan:
+			respChan <- c.observeCommand(cmd)
 		}
 	}
 
-	close(c.stopChan)
-	close(c.cmdChan)
-	close(c.respChan)
+	close(stopChan)
+	close(cmdChan)
+	close(respChan)
 }
 
 func (c *Client) processCommand(cmd Command) *CommandResponse {
 	cmdResp := &CommandResponse{}
 
+	c.cmdReader.reset(c.MaxBytesPerCommand)
+	defer c.cmdReader.reset(0)
+
+	nbResponses := 0
+
+	readResponse := func() (Response, error) {
+		nbResponses++
+		if max := c.MaxResponsesPerCommand; max > 0 && nbResponses > max {
+			return nil, &LimitError{Limit: "response count",
+				Max: int64(max)}
+		}
+
+		return ReadResponse(c.Stream)
+	}
+
 	sendLiteral := func(l Literal) error {
 		data := []byte(l)
 
+		if c.nonSyncLiteral(len(data)) {
+			fmt.Fprintf(c.Writer, "{%d+}\r\n", len(data))
+			c.Writer.Append(data)
+			return nil
+		}
+
 		fmt.Fprintf(c.Writer, "{%d}\r\n", len(data))
 		if err := c.Writer.Flush(); err != nil {
 			return err
@@ -174,7 +315,7 @@ func (c *Client) processCommand(cmd Command) *CommandResponse {
 
 	loop:
 		for {
-			resp, err := ReadResponse(c.Stream)
+			resp, err := readResponse()
 			if err != nil {
 				return err
 			}
@@ -211,7 +352,7 @@ func (c *Client) processCommand(cmd Command) *CommandResponse {
 
 	// Send a new tag
 	c.Tag++
-	fmt.Fprintf(c.Writer, "c%07d ", c.Tag)
+	c.Writer.AppendString(formatTag(c.Tag) + " ")
 
 	// Send the command
 	args := cmd.Args()
@@ -220,6 +361,14 @@ func (c *Client) processCommand(cmd Command) *CommandResponse {
 			c.Writer.AppendString(" ")
 		}
 
+		// Mailbox names containing CR or LF cannot be quoted; this
+		// can only happen with UTF-8 names since modified UTF-7
+		// encodes control characters.
+		if name, ok := arg.(MailboxName); ok && c.utf8MailboxNames() &&
+			strings.ContainsAny(string(name), "\r\n") {
+			arg = Literal(name)
+		}
+
 		switch targ := arg.(type) {
 		case []byte:
 			c.Writer.Append(targ)
@@ -227,6 +376,10 @@ func (c *Client) processCommand(cmd Command) *CommandResponse {
 		case string:
 			c.Writer.AppendString(targ)
 
+		case MailboxName:
+			name := MailboxNameEncode(string(targ), c.utf8MailboxNames())
+			c.Writer.Append(name)
+
 		case Literal:
 			if err := sendLiteral(targ); err != nil {
 				cmdResp.Error = err
@@ -261,7 +414,7 @@ func (c *Client) processCommand(cmd Command) *CommandResponse {
 
 loop:
 	for {
-		resp, err := ReadResponse(c.Stream)
+		resp, err := readResponse()
 		if err != nil {
 			cmdResp.Error = err
 			return cmdResp
@@ -280,6 +433,19 @@ loop:
 			}
 
 		case *ResponseStatus:
+			if bye, ok := tresp.Response.(*ResponseBye); ok {
+				// The server sends an untagged BYE response
+				// before the tagged response to LOGOUT.
+				if _, ok := cmd.(*CommandLogout); ok {
+					cmdResp.Data = append(cmdResp.Data, bye)
+					continue
+				}
+
+				cmdResp.Error = fmt.Errorf("server shutting "+
+					"down: %v", bye.Text.Text)
+				break loop
+			}
+
 			cmdResp.Status = tresp
 			break loop
 
@@ -296,43 +462,109 @@ loop:
 	return cmdResp
 }
 
+// commandLength returns the length of the command line sent for a command,
+// including the tag and the final \r\n.
+func (c *Client) commandLength(cmd Command) int {
+	length := len(formatTag(c.Tag+1)) + 1
+
+	for i, arg := range cmd.Args() {
+		if i > 0 {
+			length++
+		}
+
+		switch targ := arg.(type) {
+		case []byte:
+			length += len(targ)
+		case string:
+			length += len(targ)
+		case MailboxName:
+			name := MailboxNameEncode(string(targ), c.utf8MailboxNames())
+			length += len(name)
+		case Literal:
+			length += len(fmt.Sprintf("{%d}\r\n", len(targ))) + len(targ)
+		}
+	}
+
+	return length + 2
+}
+
+// sendSplitCommand sends a command operating on a sequence set, splitting the
+// set so that command lines are not longer than MaxCommandLength. The setFn
+// function is called to update the command with each part of the set, and
+// sendFn to send it.
+func (c *Client) sendSplitCommand(cmd Command, set SequenceSet, setFn func(SequenceSet), sendFn func() error) error {
+	parts := []SequenceSet{set}
+
+	if c.MaxCommandLength > 0 {
+		setFn(NewSequenceSet())
+		max := c.MaxCommandLength - c.commandLength(cmd)
+
+		setFn(set)
+		if c.commandLength(cmd) > c.MaxCommandLength {
+			parts = set.Split(max)
+		}
+	}
+
+	for _, part := range parts {
+		setFn(part)
+
+		if err := sendFn(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nonSyncLiteral indicates whether a literal can be sent without waiting for
+// a continuation request (RFC 7888). IMAP4rev2 includes LITERAL-.
+func (c *Client) nonSyncLiteral(size int) bool {
+	if c.HasCap("LITERAL+") {
+		return true
+	}
+
+	if c.HasCap("LITERAL-") || c.Revision == IMAP4rev2 {
+		return size <= MaxNonSyncLiteralSize
+	}
+
+	return false
+}
+
 func (c *Client) processGreeting() error {
 	resp, err := ReadResponse(c.Stream)
 	if err != nil {
-		return err
+		return fmt.Errorf("cannot read greeting: %w", err)
 	}
 
-	var caps []string
-	hasCaps := false
-
+	var text *ResponseText
 	authenticated := false
 
 	switch tresp := resp.(type) {
 	case *ResponseOk:
-		if tresp.Text.Code == "CAPABILITY" {
-			hasCaps = true
-			caps = tresp.Text.CodeData.([]string)
-		}
+		text = tresp.Text
 
 	case *ResponsePreAuth:
+		text = tresp.Text
 		authenticated = true
-		if tresp.Text.Code == "CAPABILITY" {
-			hasCaps = true
-			caps = tresp.Text.CodeData.([]string)
-		}
 
 	case *ResponseBye:
 		return fmt.Errorf("server shutting down: %v", tresp.Text.Text)
 
+	case *ResponseStatus:
+		// "* BYE" is read as an untagged status response
+		if bye, ok := tresp.Response.(*ResponseBye); ok {
+			return fmt.Errorf("server shutting down: %v",
+				bye.Text.Text)
+		}
+
+		return fmt.Errorf("unexpected %s status response in greeting",
+			tresp.ResponseName)
+
 	default:
-		return fmt.Errorf("invalid greeting %#v", resp)
+		return fmt.Errorf("unexpected greeting %#v", resp)
 	}
 
-	if hasCaps {
-		if err := c.processCaps(caps); err != nil {
-			return err
-		}
-	}
+	c.processCapsCode(text)
 
 	if authenticated {
 		c.State = ClientStateAuthenticated
@@ -383,6 +615,10 @@ func (c *Client) authenticate() error {
 		return fmt.Errorf("unknown authentication mechanism")
 	}
 
+	// Capabilities obtained before authentication are not valid anymore;
+	// SendCommand will pick up the new ones if the server sends them.
+	c.Caps = nil
+
 	if _, _, err := c.SendCommand(cmd); err != nil {
 		return err
 	}
@@ -391,42 +627,98 @@ func (c *Client) authenticate() error {
 	return nil
 }
 
+// selectRevision switches to IMAP4rev2 if the server supports it. Servers
+// supporting both revisions start in IMAP4rev1 mode and require an ENABLE
+// command (RFC 9051 2.3); servers only supporting IMAP4rev2 do not.
+func (c *Client) selectRevision() error {
+	if !c.HasCap(CapIMAP4rev2) {
+		return nil
+	}
+
+	if c.HasCap(CapIMAP4rev1) {
+		if _, err := c.SendCommandEnable(CapIMAP4rev2); err != nil {
+			return fmt.Errorf("cannot enable %s: %v", CapIMAP4rev2, err)
+		}
+
+		if !c.IsEnabled(CapIMAP4rev2) {
+			return nil
+		}
+	}
+
+	c.Revision = IMAP4rev2
+	c.Stream.MailboxNameUTF8 = true
+
+	return nil
+}
+
+func (c *Client) IsEnabled(ext string) bool {
+	return c.Enabled.Has(ext)
+}
+
+// utf8MailboxNames indicates whether mailbox names are sent and received as
+// UTF-8 strings instead of modified UTF-7.
+func (c *Client) utf8MailboxNames() bool {
+	return c.Revision == IMAP4rev2 || c.IsEnabled("UTF8=ACCEPT")
+}
+
 func (c *Client) fetchCaps() error {
 	cmd := &CommandCapability{}
-	resps, _, err := c.SendCommand(cmd)
-	if err != nil {
+	if _, _, err := c.SendCommand(cmd); err != nil {
 		return err
 	}
 
-	for _, resp := range resps {
-		tresp, ok := resp.(*ResponseCapability)
-		if ok {
-			if err := c.processCaps(tresp.Caps); err != nil {
-				return err
-			}
-		}
+	if c.Caps == nil {
+		return errors.New("no capability data sent by server")
 	}
 
 	return nil
 }
 
-func (c *Client) processCaps(caps []string) error {
-	c.Caps = make(map[string]bool)
+// processCaps replaces the current set of capabilities. Servers are supposed
+// to advertise IMAP4rev1 or IMAP4rev2, but some of them do not; we do not
+// refuse to talk to them since there is nothing better to do than assume
+// IMAP4rev1.
+func (c *Client) processCaps(caps []string) {
+	c.Caps = NewCapabilitySet(caps)
+}
 
-	for _, cap := range caps {
-		c.Caps[cap] = true
+func (c *Client) processCapsCode(text *ResponseText) {
+	if text == nil || text.Code != "CAPABILITY" {
+		return
 	}
 
-	if _, found := c.Caps["IMAP4rev1"]; !found {
-		return fmt.Errorf("missing IMAP4rev1 capability")
+	if caps, ok := text.CodeData.([]string); ok {
+		c.processCaps(caps)
 	}
+}
 
-	return nil
+func (c *Client) processCapsResponses(resps []Response, status *ResponseStatus) {
+	for _, resp := range resps {
+		if tresp, ok := resp.(*ResponseCapability); ok {
+			c.processCaps(tresp.Caps)
+		}
+	}
+
+	if status != nil {
+		if tresp, ok := status.Response.(*ResponseOk); ok {
+			c.processCapsCode(tresp.Text)
+		}
+	}
 }
 
 func (c *Client) HasCap(cap string) bool {
-	_, found := c.Caps[cap]
-	return found
+	return c.Caps.Has(cap)
+}
+
+// StatusError is returned when the server rejects a command with a NO or BAD
+// status response.
+type StatusError struct {
+	Status string // either "NO" or "BAD"
+	Text   *ResponseText
+}
+
+func (err *StatusError) Error() string {
+	return err.Text.Text
 }
 
 func (c *Client) SendCommand(cmd Command) ([]Response, *ResponseStatus, error) {
@@ -437,6 +729,16 @@ func (c *Client) SendCommand(cmd Command) ([]Response, *ResponseStatus, error) {
 	c.cmdChan <- cmd
 	resp := <-c.respChan
 
+	// After a limit error, part of the response has not been read and we
+	// cannot resynchronize with the server.
+	var limitErr *LimitError
+	if errors.As(resp.Error, &limitErr) {
+		c.disconnect()
+		return nil, nil, resp.Error
+	}
+
+	c.processCapsResponses(resp.Data, resp.Status)
+
 	var err error = nil
 
 	if resp.Error != nil {
@@ -444,9 +746,9 @@ func (c *Client) SendCommand(cmd Command) ([]Response, *ResponseStatus, error) {
 	} else if resp.Status != nil {
 		switch status := resp.Status.Response.(type) {
 		case *ResponseNo:
-			err = errors.New(status.Text.Text)
+			err = &StatusError{Status: "NO", Text: status.Text}
 		case *ResponseBad:
-			err = errors.New(status.Text.Text)
+			err = &StatusError{Status: "BAD", Text: status.Text}
 		}
 	}
 
@@ -472,6 +774,10 @@ func (c *Client) SendCommandList(ref, pattern string) (*ResponseSetList, error)
 		Pattern: pattern,
 	}
 
+	if c.hasSpecialUseReturnOption() {
+		cmd.ReturnOptions = []string{"SPECIAL-USE"}
+	}
+
 	rs := &ResponseSetList{}
 
 	if err := c.SendCommandWithResponseSet(cmd, rs); err != nil {
@@ -481,6 +787,74 @@ func (c *Client) SendCommandList(ref, pattern string) (*ResponseSetList, error)
 	return rs, nil
 }
 
+// SendCommandListStatus lists mailboxes and returns their status. If the
+// server does not support LIST-STATUS, the status of each selectable mailbox
+// is obtained with a STATUS command.
+func (c *Client) SendCommandListStatus(ref, pattern string, items []string) (*ResponseSetList, error) {
+	if c.Revision != IMAP4rev2 && !c.HasCap("LIST-STATUS") {
+		rs, err := c.SendCommandList(ref, pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range rs.Mailboxes {
+			mbox := &rs.Mailboxes[i]
+
+			if !mbox.IsSelectable() {
+				continue
+			}
+
+			srs, err := c.SendCommandStatus(mbox.Name, items)
+			if err != nil {
+				return nil, err
+			}
+
+			mbox.Status = &srs.Status
+		}
+
+		return rs, nil
+	}
+
+	cmd := &CommandList{
+		Ref:          ref,
+		Pattern:      pattern,
+		ReturnStatus: items,
+	}
+
+	if c.hasSpecialUseReturnOption() {
+		cmd.ReturnOptions = []string{"SPECIAL-USE"}
+	}
+
+	rs := &ResponseSetList{}
+
+	if err := c.SendCommandWithResponseSet(cmd, rs); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (c *Client) hasSpecialUseReturnOption() bool {
+	// SPECIAL-USE and LIST-EXTENDED are part of IMAP4rev2
+	return c.Revision == IMAP4rev2 ||
+		(c.HasCap("SPECIAL-USE") && c.HasCap("LIST-EXTENDED"))
+}
+
+func (c *Client) SendCommandStatus(mailboxName string, items []string) (*ResponseSetStatus, error) {
+	cmd := &CommandStatus{
+		MailboxName: mailboxName,
+		Items:       items,
+	}
+
+	rs := &ResponseSetStatus{}
+
+	if err := c.SendCommandWithResponseSet(cmd, rs); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
 func (c *Client) SendCommandLSub(ref, pattern string) (*ResponseSetLSub, error) {
 	cmd := &CommandLSub{
 		Ref:     ref,
@@ -508,6 +882,35 @@ func (c *Client) SendCommandCreate(mailboxName string) error {
 	return nil
 }
 
+// SendCommandCreateIfMissing creates a mailbox unless it already exists.
+// Since mailbox names can contain LIST wildcards, the mailbox is created
+// first; if the server rejects the command without an ALREADYEXISTS response
+// code (RFC 5530), the mailbox is looked up by its exact name.
+func (c *Client) SendCommandCreateIfMissing(mailboxName string) error {
+	err := c.SendCommandCreate(mailboxName)
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != "NO" {
+		return err
+	} else if statusErr.Text.Code == "ALREADYEXISTS" {
+		return nil
+	}
+
+	rs, err2 := c.SendCommandList("", mailboxName)
+	if err2 != nil {
+		return err
+	}
+
+	for _, mbox := range rs.Mailboxes {
+		if mbox.Name == mailboxName || (strings.EqualFold(mbox.Name,
+			"INBOX") && strings.EqualFold(mailboxName, "INBOX")) {
+			return nil
+		}
+	}
+
+	return err
+}
+
 func (c *Client) SendCommandDelete(mailboxName string) error {
 	cmd := &CommandDelete{
 		MailboxName: mailboxName,
@@ -560,6 +963,7 @@ func (c *Client) SendCommandUnsubscribe(mailboxName string) error {
 func (c *Client) SendCommandExamine(mailboxName string) (*ResponseSetExamine, error) {
 	cmd := &CommandExamine{
 		MailboxName: mailboxName,
+		CondStore:   c.HasCap("CONDSTORE"),
 	}
 
 	rs := &ResponseSetExamine{}
@@ -574,6 +978,36 @@ func (c *Client) SendCommandExamine(mailboxName string) (*ResponseSetExamine, er
 func (c *Client) SendCommandSelect(mailboxName string) (*ResponseSetSelect, error) {
 	cmd := &CommandSelect{
 		MailboxName: mailboxName,
+		CondStore:   c.HasCap("CONDSTORE"),
+	}
+
+	rs := &ResponseSetSelect{}
+
+	if err := c.SendCommandWithResponseSet(cmd, rs); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// SendCommandSelectQResync selects a mailbox and resynchronizes it using
+// QRESYNC (RFC 7162). The response set contains the UIDs of the messages
+// expunged since the mod-sequence in params and the messages whose flags
+// changed. QRESYNC is enabled first if necessary.
+func (c *Client) SendCommandSelectQResync(mailboxName string, params *QResyncParams) (*ResponseSetSelect, error) {
+	if !c.IsEnabled("QRESYNC") {
+		if _, err := c.SendCommandEnable("QRESYNC"); err != nil {
+			return nil, err
+		}
+
+		if !c.IsEnabled("QRESYNC") {
+			return nil, errors.New("QRESYNC not supported by server")
+		}
+	}
+
+	cmd := &CommandSelect{
+		MailboxName: mailboxName,
+		QResync:     params,
 	}
 
 	rs := &ResponseSetSelect{}
@@ -602,18 +1036,498 @@ func (c *Client) SendCommandLogout() error {
 		return err
 	}
 
+	// The server closes the connection after LOGOUT
+	c.disconnect()
+
 	return nil
 }
 
+// abortConnection stops the client after a failure during connection; the
+// network connection itself is closed by the caller.
+func (c *Client) abortConnection() {
+	// A limit error has already stopped the client
+	if c.State == ClientStateDisconnected {
+		return
+	}
+
+	c.stopChan <- 1
+}
+
+func (c *Client) disconnect() {
+	c.stopChan <- 1
+	c.Conn.Close()
+
+	c.State = ClientStateDisconnected
+}
+
 func (c *Client) SendCommandSearch(charset string, key SearchKey) (*ResponseSetSearch, error) {
+	return c.SendCommandSearchReturn(charset, key, nil)
+}
+
+// SendCommandSearchReturn sends a UID SEARCH command with a list of ESEARCH
+// return options (RFC 4731). If options contains SearchReturnSave, the result
+// is kept by the server and can be referred to with
+// NewSequenceSetSearchResult() in subsequent commands (RFC 5182).
+func (c *Client) SendCommandSearchReturn(charset string, key SearchKey, options []SearchReturnOption) (*ResponseSetSearch, error) {
+	rev2 := c.Revision == IMAP4rev2
+	save := hasSearchReturnOption(options, SearchReturnSave)
+
+	if options != nil && !c.HasCap("ESEARCH") && !rev2 {
+		return nil, errors.New("ESEARCH not supported by server")
+	}
+
+	if save && !c.HasCap("SEARCHRES") && !rev2 {
+		return nil, errors.New("SEARCHRES not supported by server")
+	}
+
+	var rs *ResponseSetSearch
+
+	err := c.sendCharsetCommand(charset, key, func(charset string, key SearchKey) error {
+		var err error
+		rs, err = c.sendCommandSearch(charset, key, options)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (c *Client) sendCommandSearch(charset string, key SearchKey, options []SearchReturnOption) (*ResponseSetSearch, error) {
+	save := hasSearchReturnOption(options, SearchReturnSave)
+
 	cmd := &CommandSearch{
 		Charset: charset,
 		Key:     key,
 		UID:     true,
+		Return:  options,
 	}
 
 	rs := &ResponseSetSearch{}
 
+	// Searching a large set of UIDs can be split since the UID key
+	// applies to the whole search. A saved result would only contain the
+	// matches of the last part.
+	var set SequenceSet
+
+	idx := searchKeyUIDIndex(key)
+	if idx >= 0 && !save {
+		set, _ = ParseSequenceSet(commandArgString(key, idx+1))
+	}
+
+	if set == nil {
+		if err := c.SendCommandWithResponseSet(cmd, rs); err != nil {
+			return nil, err
+		}
+
+		return rs, nil
+	}
+
+	setFn := func(set SequenceSet) {
+		setData, _ := set.MarshalText()
+
+		cmd.Key = append(append(append(SearchKey{}, key[:idx+1]...),
+			setData), key[idx+2:]...)
+	}
+
+	err := c.sendSplitCommand(cmd, set, setFn, func() error {
+		prs := &ResponseSetSearch{}
+		if err := c.SendCommandWithResponseSet(cmd, prs); err != nil {
+			return err
+		}
+
+		rs.merge(prs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// SendCommandSort sends a UID SORT command (RFC 5256) and returns the UIDs of
+// matching messages ordered according to the criteria.
+func (c *Client) SendCommandSort(criteria []SortCriterion, charset string, key SearchKey) (*ResponseSetSort, error) {
+	if !c.HasCap("SORT") {
+		return nil, errors.New("SORT not supported by server")
+	}
+
+	for _, criterion := range criteria {
+		switch criterion.Key {
+		case SortKeyDisplayFrom, SortKeyDisplayTo:
+			if !c.HasCap("SORT=DISPLAY") {
+				return nil, errors.New("SORT=DISPLAY not " +
+					"supported by server")
+			}
+		}
+	}
+
+	cmd := &CommandSort{
+		Criteria: criteria,
+		UID:      true,
+	}
+
+	rs := &ResponseSetSort{}
+
+	err := c.sendCharsetCommand(charset, key, func(charset string, key SearchKey) error {
+		cmd.Charset = charset
+		cmd.Key = key
+
+		return c.SendCommandWithResponseSet(cmd, rs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// SendCommandThread sends a UID THREAD command (RFC 5256) and returns the
+// threads of matching messages. If the server does not support the REFERENCES
+// algorithm, messages are searched, fetched and threaded on the client side.
+func (c *Client) SendCommandThread(algorithm ThreadAlgorithm, charset string, key SearchKey) (*ResponseSetThread, error) {
+	if !c.HasCap("THREAD=" + string(algorithm)) {
+		if algorithm == ThreadReferences {
+			return c.threadReferences(charset, key)
+		}
+
+		return nil, fmt.Errorf("THREAD=%s not supported by server",
+			algorithm)
+	}
+
+	cmd := &CommandThread{
+		Algorithm: algorithm,
+		UID:       true,
+	}
+
+	rs := &ResponseSetThread{}
+
+	err := c.sendCharsetCommand(charset, key, func(charset string, key SearchKey) error {
+		cmd.Charset = charset
+		cmd.Key = key
+
+		return c.SendCommandWithResponseSet(cmd, rs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (c *Client) threadReferences(charset string, key SearchKey) (*ResponseSetThread, error) {
+	srs, err := c.SendCommandSearch(charset, key)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &ResponseSetThread{Threads: []*Thread{}}
+
+	if len(srs.MessageIds) == 0 {
+		return rs, nil
+	}
+
+	frs, err := c.SendCommandFetch(srs.MessageIds, ThreadFetchItems)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*ThreadMessage, len(frs.Messages))
+	for i, fmsg := range frs.Messages {
+		msgs[i], err = NewThreadMessageFromFetch(fmsg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rs.Threads = ThreadByReferences(msgs)
+
+	return rs, nil
+}
+
+// SendCommandEnable enables a set of extensions and returns the ones the
+// server actually enabled. Extensions which are not advertised by the server
+// are not sent. Enabled extensions are added to c.Enabled.
+func (c *Client) SendCommandEnable(exts ...string) ([]string, error) {
+	if c.State != ClientStateAuthenticated {
+		return nil, errors.New("extensions can only be enabled " +
+			"in authenticated state")
+	}
+
+	if !c.HasCap("ENABLE") && !c.HasCap(CapIMAP4rev2) {
+		return nil, errors.New("ENABLE not supported by server")
+	}
+
+	cmd := &CommandEnable{}
+	for _, ext := range exts {
+		if c.HasCap(ext) && !c.IsEnabled(ext) {
+			cmd.Extensions = append(cmd.Extensions, ext)
+		}
+	}
+
+	if len(cmd.Extensions) == 0 {
+		return []string{}, nil
+	}
+
+	rs := &ResponseSetEnable{}
+
+	if err := c.SendCommandWithResponseSet(cmd, rs); err != nil {
+		return nil, err
+	}
+
+	for _, ext := range rs.Extensions {
+		c.Enabled.Add(ext)
+	}
+
+	if c.utf8MailboxNames() {
+		c.Stream.MailboxNameUTF8 = true
+	}
+
+	return rs.Extensions, nil
+}
+
+func (c *Client) SendCommandFetch(set SequenceSet, items []string) (*ResponseSetFetch, error) {
+	return c.SendCommandFetchChangedSince(set, items, 0)
+}
+
+// SendCommandFetchChangedSince fetches messages whose mod-sequence is
+// greater than modSeq (CONDSTORE, RFC 7162). The MODSEQ item is always
+// returned in this case.
+func (c *Client) SendCommandFetchChangedSince(set SequenceSet, items []string, modSeq uint64) (*ResponseSetFetch, error) {
+	cmd := &CommandFetch{
+		Set:          set,
+		Items:        items,
+		UID:          true,
+		ChangedSince: modSeq,
+	}
+
+	return c.sendCommandFetch(cmd)
+}
+
+// SendCommandFetchVanished is similar to SendCommandFetchChangedSince but
+// also reports the UIDs of the messages expunged since modSeq (QRESYNC, RFC
+// 7162). QRESYNC must have been enabled.
+func (c *Client) SendCommandFetchVanished(set SequenceSet, items []string, modSeq uint64) (*ResponseSetFetch, error) {
+	cmd := &CommandFetch{
+		Set:          set,
+		Items:        items,
+		UID:          true,
+		ChangedSince: modSeq,
+		Vanished:     true,
+	}
+
+	return c.sendCommandFetch(cmd)
+}
+
+func (c *Client) sendCommandFetch(cmd *CommandFetch) (*ResponseSetFetch, error) {
+	rs := &ResponseSetFetch{}
+
+	setFn := func(set SequenceSet) {
+		cmd.Set = set
+	}
+
+	err := c.sendSplitCommand(cmd, cmd.Set, setFn, func() error {
+		prs := &ResponseSetFetch{}
+		if err := c.SendCommandWithResponseSet(cmd, prs); err != nil {
+			return err
+		}
+
+		rs.merge(prs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (c *Client) SendCommandStore(set SequenceSet, mode StoreMode, flags []string) (*ResponseSetStore, error) {
+	return c.SendCommandStoreUnchangedSince(set, mode, flags, 0)
+}
+
+// SendCommandStoreUnchangedSince only updates messages whose mod-sequence is
+// lower or equal to modSeq (CONDSTORE, RFC 7162). Messages which were not
+// updated are listed in the Modified field of the response set.
+func (c *Client) SendCommandStoreUnchangedSince(set SequenceSet, mode StoreMode, flags []string, modSeq uint64) (*ResponseSetStore, error) {
+	cmd := &CommandStore{
+		Set:            set,
+		Mode:           mode,
+		Flags:          flags,
+		UID:            true,
+		UnchangedSince: modSeq,
+	}
+
+	rs := &ResponseSetStore{}
+
+	setFn := func(set SequenceSet) {
+		cmd.Set = set
+	}
+
+	err := c.sendSplitCommand(cmd, set, setFn, func() error {
+		prs := &ResponseSetStore{}
+		if err := c.SendCommandWithResponseSet(cmd, prs); err != nil {
+			return err
+		}
+
+		rs.merge(prs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (c *Client) SendCommandCopy(set SequenceSet, mailboxName string) error {
+	cmd := &CommandCopy{
+		Set:         set,
+		MailboxName: mailboxName,
+		UID:         true,
+	}
+
+	setFn := func(set SequenceSet) {
+		cmd.Set = set
+	}
+
+	return c.sendSplitCommand(cmd, set, setFn, func() error {
+		_, _, err := c.SendCommand(cmd)
+		return err
+	})
+}
+
+// SendCommandMove moves messages to another mailbox. If the server does not
+// support MOVE (RFC 6851), messages are copied, marked as deleted and
+// expunged; see SendCommandDeleteMessages.
+func (c *Client) SendCommandMove(set SequenceSet, mailboxName string) error {
+	if !c.HasCap("MOVE") && c.Revision != IMAP4rev2 {
+		if !c.hasUIDExpunge() {
+			if err := c.checkDeletedMessages(set); err != nil {
+				return err
+			}
+		}
+
+		if err := c.SendCommandCopy(set, mailboxName); err != nil {
+			return err
+		}
+
+		return c.deleteMessages(set)
+	}
+
+	cmd := &CommandMove{
+		Set:         set,
+		MailboxName: mailboxName,
+		UID:         true,
+	}
+
+	setFn := func(set SequenceSet) {
+		cmd.Set = set
+	}
+
+	return c.sendSplitCommand(cmd, set, setFn, func() error {
+		_, _, err := c.SendCommand(cmd)
+		return err
+	})
+}
+
+// SendCommandExpunge expunges messages marked as deleted. If uids is not
+// empty, only these messages are expunged; this requires UIDPLUS (RFC 4315)
+// or IMAP4rev2.
+func (c *Client) SendCommandExpunge(uids SequenceSet) error {
+	if len(uids) > 0 && !c.HasCap("UIDPLUS") && c.Revision != IMAP4rev2 {
+		return errors.New("UIDPLUS not supported by server")
+	}
+
+	cmd := &CommandExpunge{
+		UIDs: uids,
+	}
+
+	if len(uids) == 0 {
+		_, _, err := c.SendCommand(cmd)
+		return err
+	}
+
+	setFn := func(set SequenceSet) {
+		cmd.UIDs = set
+	}
+
+	return c.sendSplitCommand(cmd, uids, setFn, func() error {
+		_, _, err := c.SendCommand(cmd)
+		return err
+	})
+}
+
+// SendCommandDeleteMessages marks messages as deleted and expunges them. If
+// the server does not support UID EXPUNGE, EXPUNGE removes all messages
+// marked as deleted in the mailbox; the command therefore fails without
+// modifying anything if messages not in uids are already marked as deleted.
+func (c *Client) SendCommandDeleteMessages(uids SequenceSet) error {
+	return c.deleteMessages(uids)
+}
+
+func (c *Client) deleteMessages(uids SequenceSet) error {
+	uidExpunge := c.hasUIDExpunge()
+
+	if !uidExpunge {
+		if err := c.checkDeletedMessages(uids); err != nil {
+			return err
+		}
+	}
+
+	flags := []string{MessageFlagDeleted}
+
+	if _, err := c.SendCommandStore(uids, StoreModeAdd, flags); err != nil {
+		return err
+	}
+
+	if !uidExpunge {
+		uids = nil
+	}
+
+	return c.SendCommandExpunge(uids)
+}
+
+func (c *Client) hasUIDExpunge() bool {
+	return c.HasCap("UIDPLUS") || c.Revision == IMAP4rev2
+}
+
+// checkDeletedMessages returns an error if messages other than the ones in
+// uids are marked as deleted in the selected mailbox, i.e. if EXPUNGE would
+// remove messages we were not asked to delete. Since the largest UID in use
+// is unknown, '*' is considered to be larger than any UID, and entries which
+// cannot be resolved, such as '$', never match; both can only cause false
+// positives.
+func (c *Client) checkDeletedMessages(uids SequenceSet) error {
+	rs, err := c.SendCommandSearch("", SearchKeyDeleted())
+	if err != nil {
+		return err
+	}
+
+	// The set comes from the server and can contain arbitrarily large
+	// ranges: never expand it.
+	others := rs.MessageIds.Difference(uids)
+	if len(others) > 0 {
+		return fmt.Errorf("cannot expunge messages without UIDPLUS: "+
+			"%d other messages are marked as deleted",
+			others.Len(math.MaxUint32))
+	}
+
+	return nil
+}
+
+func (c *Client) SendCommandAppend(mailboxName string, flags []string, date time.Time, message []byte) (*ResponseSetAppend, error) {
+	cmd := &CommandAppend{
+		MailboxName: mailboxName,
+		Flags:       flags,
+		Date:        date,
+		Message:     message,
+	}
+
+	rs := &ResponseSetAppend{}
+
 	if err := c.SendCommandWithResponseSet(cmd, rs); err != nil {
 		return nil, err
 	}
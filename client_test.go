@@ -0,0 +1,1061 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/go-imapc"
+	"github.com/galdor/go-imapc/imaptest"
+)
+
+const testMessage = "From: bob@example.com\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: %s\r\n" +
+	"Message-ID: <%s@example.com>\r\n" +
+	"\r\n" +
+	"Hello.\r\n"
+
+func newTestServer(t *testing.T) *imaptest.Server {
+	return newTestServerWithCaps(t, imaptest.DefaultCaps)
+}
+
+func newTestServerWithCaps(t *testing.T, caps []string) *imaptest.Server {
+	srv := imaptest.NewServer()
+	srv.Caps = append([]string{}, caps...)
+	srv.AddUser("alice", "secret")
+
+	inbox := srv.Mailbox("INBOX")
+	date := time.Date(2016, 10, 4, 12, 30, 0, 0, time.UTC)
+
+	for _, subject := range []string{"foo", "bar", "baz"} {
+		data := strings.Replace(testMessage, "%s", subject, -1)
+		inbox.Append([]byte(data), nil, date)
+	}
+
+	srv.AddMailbox("Sent", imapc.MailboxFlagSent)
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+
+	return srv
+}
+
+func newTestClient(srv *imaptest.Server) *imapc.Client {
+	client := srv.NewClient()
+	client.Login = "alice"
+	client.Password = "secret"
+
+	return client
+}
+
+func connectTestClient(t *testing.T, srv *imaptest.Server) *imapc.Client {
+	client := newTestClient(srv)
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	return client
+}
+
+func TestClientConnect(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+
+	if client.State != imapc.ClientStateAuthenticated {
+		t.Errorf("client is in state %v", client.State)
+	}
+
+	if !client.HasCap("UIDPLUS") {
+		t.Errorf("missing capabilities %v", client.Caps.Strings())
+	}
+
+	if err := client.SendCommandLogout(); err != nil {
+		t.Fatalf("cannot logout: %v", err)
+	}
+
+	if client.State != imapc.ClientStateDisconnected {
+		t.Errorf("client is in state %v after logout", client.State)
+	}
+}
+
+func TestClientConnectPipe(t *testing.T) {
+	srv := imaptest.NewServer()
+	srv.PreAuth = true
+	defer srv.Close()
+
+	client := imapc.NewClient()
+	if err := client.ConnectConn(srv.Pipe()); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	if client.State != imapc.ClientStateAuthenticated {
+		t.Errorf("client is in state %v", client.State)
+	}
+
+	if err := client.SendCommandLogout(); err != nil {
+		t.Fatalf("cannot logout: %v", err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	srv := imaptest.NewServer()
+	srv.PreAuth = true
+	srv.Caps = append(srv.Caps, "X-FOO")
+	defer srv.Close()
+
+	client := imapc.NewClient()
+	if err := client.ConnectConn(srv.Pipe()); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	if !client.HasCap("X-FOO") {
+		t.Errorf("missing capabilities %v", client.Caps.Strings())
+	}
+
+	if err := client.SendCommandLogout(); err != nil {
+		t.Fatalf("cannot logout: %v", err)
+	}
+
+	// The greeting of the second server does not contain capabilities
+	srv2 := imaptest.NewServer()
+	srv2.Greeting = "* PREAUTH imaptest ready, no capabilities sent"
+	defer srv2.Close()
+
+	if err := client.ConnectConn(srv2.Pipe()); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+	defer client.SendCommandLogout()
+
+	if client.HasCap("X-FOO") {
+		t.Errorf("capabilities of the previous connection were kept")
+	}
+
+	if !client.HasCap("UIDPLUS") {
+		t.Errorf("missing capabilities %v", client.Caps.Strings())
+	}
+}
+
+func TestClientConnectErrors(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := srv.NewClient()
+	client.Login = "alice"
+	client.Password = "invalid"
+
+	if err := client.Connect(); err == nil {
+		t.Errorf("authenticated with an invalid password")
+	}
+
+	srv2 := imaptest.NewServer()
+	srv2.Greeting = "* BYE too many connections"
+
+	if err := srv2.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+	defer srv2.Close()
+
+	client = srv2.NewClient()
+	if err := client.Connect(); err == nil {
+		t.Errorf("connected despite a BYE greeting")
+	} else if !strings.Contains(err.Error(), "too many connections") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	srv3 := imaptest.NewServer()
+	srv3.Greeting = "* OK " + strings.Repeat("x", 10000)
+
+	if err := srv3.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+	defer srv3.Close()
+
+	client = srv3.NewClient()
+	client.MaxLineLength = 1024
+
+	var limitErr *imapc.LimitError
+	if err := client.Connect(); !errors.As(err, &limitErr) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestClientList(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	rs, err := client.SendCommandList("", "*")
+	if err != nil {
+		t.Fatalf("cannot list mailboxes: %v", err)
+	}
+
+	names := []string{}
+	for _, mbox := range rs.Mailboxes {
+		names = append(names, mbox.Name)
+
+		if mbox.Name == "Sent" &&
+			mbox.SpecialUse() != imapc.MailboxFlagSent {
+			t.Errorf("invalid flags for Sent: %v", mbox.Flags)
+		}
+	}
+
+	if !reflect.DeepEqual(names, []string{"INBOX", "Sent"}) {
+		t.Errorf("invalid mailboxes %v", names)
+	}
+}
+
+func TestClientSelect(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	rs, err := client.SendCommandSelect("INBOX")
+	if err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	inbox := srv.Mailbox("INBOX")
+
+	if rs.Exists != 3 {
+		t.Errorf("invalid number of messages %d", rs.Exists)
+	}
+
+	if rs.UIDValidity != inbox.UIDValidity {
+		t.Errorf("invalid uid validity %d", rs.UIDValidity)
+	}
+
+	if rs.UIDNext != 4 {
+		t.Errorf("invalid next uid %d", rs.UIDNext)
+	}
+
+	if _, err := client.SendCommandSelect("Unknown"); err == nil {
+		t.Errorf("selected a mailbox which does not exist")
+	}
+}
+
+func TestClientSearch(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	key := imapc.SearchKeyOr(imapc.SearchKeySubject("foo"),
+		imapc.SearchKeySubject("baz"))
+
+	rs, err := client.SendCommandSearch("", key)
+	if err != nil {
+		t.Fatalf("cannot search messages: %v", err)
+	}
+
+	if ids := rs.MessageIds.String(); ids != "1,3" {
+		t.Errorf("invalid search results %s", ids)
+	}
+}
+
+func TestClientSearchReturn(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	key := imapc.SearchKeyOr(imapc.SearchKeySubject("foo"),
+		imapc.SearchKeySubject("baz"))
+
+	options := []imapc.SearchReturnOption{
+		imapc.SearchReturnMin,
+		imapc.SearchReturnMax,
+		imapc.SearchReturnCount,
+	}
+
+	rs, err := client.SendCommandSearchReturn("", key, options)
+	if err != nil {
+		t.Fatalf("cannot search messages: %v", err)
+	}
+
+	if rs.Min != 1 || rs.Max != 3 || rs.Count != 2 {
+		t.Errorf("invalid search results min:%d max:%d count:%d",
+			rs.Min, rs.Max, rs.Count)
+	}
+
+	if len(rs.MessageIds) != 0 {
+		t.Errorf("unexpected message ids %v", rs.MessageIds)
+	}
+
+	// Saved search result
+	options = []imapc.SearchReturnOption{imapc.SearchReturnSave}
+
+	key = imapc.SearchKeySubject("baz")
+	if _, err := client.SendCommandSearchReturn("", key, options); err != nil {
+		t.Fatalf("cannot search messages: %v", err)
+	}
+
+	set := imapc.NewSequenceSetSearchResult()
+
+	_, err = client.SendCommandStore(set, imapc.StoreModeAdd,
+		[]string{imapc.MessageFlagFlagged})
+	if err != nil {
+		t.Fatalf("cannot store flags: %v", err)
+	}
+
+	rs, err = client.SendCommandSearch("",
+		imapc.SearchKeyFlagged())
+	if err != nil {
+		t.Fatalf("cannot search messages: %v", err)
+	}
+
+	if ids := rs.MessageIds.String(); ids != "3" {
+		t.Errorf("invalid search results %s", ids)
+	}
+
+	fetchRS, err := client.SendCommandFetch(set, []string{"UID"})
+	if err != nil {
+		t.Fatalf("cannot fetch messages: %v", err)
+	}
+
+	if len(fetchRS.Messages) != 1 || fetchRS.Messages[0].UID != 3 {
+		t.Errorf("invalid fetched messages %#v", fetchRS.Messages)
+	}
+}
+
+func TestClientSearchCharset(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	srv.Charsets = []string{"US-ASCII", "ISO-8859-1"}
+
+	data := strings.Replace(testMessage, "%s", "café", -1)
+	srv.Mailbox("INBOX").Append([]byte(data), nil, time.Now())
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	// UTF-8 is rejected by the server, the search is sent again using
+	// ISO-8859-1.
+	for _, charset := range []string{"", "UTF-8", "ISO-8859-1"} {
+		rs, err := client.SendCommandSearch(charset,
+			imapc.SearchKeySubject("Café"))
+		if err != nil {
+			t.Fatalf("cannot search messages with charset %q: %v",
+				charset, err)
+		}
+
+		if ids := rs.MessageIds.String(); ids != "4" {
+			t.Errorf("invalid search results %s with charset %q",
+				ids, charset)
+		}
+	}
+
+	_, err := client.SendCommandSearch("", imapc.SearchKeySubject("10 €"))
+
+	var statusErr *imapc.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Text.Code != "BADCHARSET" {
+		t.Errorf("invalid error %v", err)
+	}
+}
+
+func TestClientSortThread(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	srv.Handle("THREAD", func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+		sess.WriteLine("* THREAD (1 (2)(3))")
+		return nil
+	})
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	tests := []struct {
+		criteria []imapc.SortCriterion
+		ids      []uint32
+	}{
+		{[]imapc.SortCriterion{{Key: imapc.SortKeySubject}},
+			[]uint32{2, 3, 1}},
+		{[]imapc.SortCriterion{{Key: imapc.SortKeySubject, Reverse: true}},
+			[]uint32{1, 3, 2}},
+		{[]imapc.SortCriterion{{Key: imapc.SortKeyArrival},
+			{Key: imapc.SortKeySize, Reverse: true}},
+			[]uint32{1, 2, 3}},
+	}
+
+	for _, test := range tests {
+		rs, err := client.SendCommandSort(test.criteria, "",
+			imapc.SearchKeyAll())
+		if err != nil {
+			t.Fatalf("cannot sort messages: %v", err)
+		}
+
+		if !reflect.DeepEqual(rs.MessageIds, test.ids) {
+			t.Errorf("messages sorted by %v: %v", test.criteria,
+				rs.MessageIds)
+		}
+	}
+
+	rs, err := client.SendCommandThread(imapc.ThreadReferences, "",
+		imapc.SearchKeyAll())
+	if err != nil {
+		t.Fatalf("cannot thread messages: %v", err)
+	}
+
+	if len(rs.Threads) != 1 || rs.Threads[0].String() != "(1 (2)(3))" {
+		t.Errorf("invalid threads %#v", rs.Threads)
+	}
+
+	_, err = client.SendCommandThread(imapc.ThreadOrderedSubject, "",
+		imapc.SearchKeyAll())
+	if err == nil {
+		t.Errorf("sent THREAD with an unsupported algorithm")
+	}
+}
+
+func TestClientThreadFallback(t *testing.T) {
+	date := time.Date(2016, 10, 4, 12, 30, 0, 0, time.UTC)
+
+	headers := []string{
+		"Message-ID: <a@example.com>\r\nSubject: foo\r\n",
+		"Message-ID: <b@example.com>\r\nSubject: bar\r\n",
+		"Message-ID: <c@example.com>\r\nSubject: Re: foo\r\n" +
+			"In-Reply-To: <a@example.com>\r\n",
+		"Message-ID: <d@example.com>\r\nSubject: Re: bar\r\n" +
+			"References: <x@example.com>\r\n",
+	}
+
+	threads := map[bool]string{}
+
+	for _, serverThreads := range []bool{true, false} {
+		srv := newTestServer(t)
+		defer srv.Close()
+
+		if !serverThreads {
+			caps := []string{}
+			for _, cap := range srv.Caps {
+				if cap != "THREAD=REFERENCES" {
+					caps = append(caps, cap)
+				}
+			}
+
+			srv.Caps = caps
+		}
+
+		mbox := srv.AddMailbox("Threads")
+
+		for i, header := range headers {
+			data := header + "\r\nHello.\r\n"
+			mbox.Append([]byte(data), nil,
+				date.Add(time.Duration(i)*time.Hour))
+		}
+
+		client := connectTestClient(t, srv)
+		defer client.SendCommandLogout()
+
+		if _, err := client.SendCommandSelect("Threads"); err != nil {
+			t.Fatalf("cannot select mailbox: %v", err)
+		}
+
+		rs, err := client.SendCommandThread(imapc.ThreadReferences, "",
+			imapc.SearchKeyAll())
+		if err != nil {
+			t.Fatalf("cannot thread messages: %v", err)
+		}
+
+		for _, thread := range rs.Threads {
+			threads[serverThreads] += thread.String()
+		}
+	}
+
+	if threads[true] != "(1 3)(2 4)" {
+		t.Errorf("invalid threads %q", threads[true])
+	}
+
+	if threads[false] != threads[true] {
+		t.Errorf("messages were threaded as %q on the client side "+
+			"and %q on the server side", threads[false], threads[true])
+	}
+}
+
+func TestClientFetchStore(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	set := imapc.SequenceSet{imapc.SequenceNumber(2)}
+
+	_, err := client.SendCommandStore(set, imapc.StoreModeAdd,
+		[]string{imapc.MessageFlagFlagged})
+	if err != nil {
+		t.Fatalf("cannot store flags: %v", err)
+	}
+
+	items := []string{"FLAGS", "BODY.PEEK[HEADER.FIELDS (SUBJECT)]"}
+
+	rs, err := client.SendCommandFetch(set, items)
+	if err != nil {
+		t.Fatalf("cannot fetch messages: %v", err)
+	}
+
+	if len(rs.Messages) != 1 {
+		t.Fatalf("invalid number of messages %d", len(rs.Messages))
+	}
+
+	msg := rs.Messages[0]
+
+	if msg.UID != 2 {
+		t.Errorf("invalid uid %d", msg.UID)
+	}
+
+	if !reflect.DeepEqual(msg.Flags, []string{imapc.MessageFlagFlagged}) {
+		t.Errorf("invalid flags %v", msg.Flags)
+	}
+
+	header := string(msg.Section(items[1]))
+	if header != "Subject: bar\r\n\r\n" {
+		t.Errorf("invalid header %q", header)
+	}
+}
+
+func TestClientAppendMove(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	data := []byte(strings.Replace(testMessage, "%s", "qux", -1))
+	date := time.Date(2016, 10, 5, 8, 0, 0, 0, time.UTC)
+
+	ars, err := client.SendCommandAppend("INBOX",
+		[]string{imapc.MessageFlagSeen}, date, data)
+	if err != nil {
+		t.Fatalf("cannot append message: %v", err)
+	}
+
+	if ars.UID != 4 {
+		t.Errorf("invalid uid %d", ars.UID)
+	}
+
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	set := imapc.SequenceSet{imapc.SequenceNumber(4)}
+
+	if err := client.SendCommandMove(set, "Sent"); err != nil {
+		t.Fatalf("cannot move message: %v", err)
+	}
+
+	if n := len(srv.Mailbox("INBOX").Messages); n != 3 {
+		t.Errorf("%d messages left in INBOX", n)
+	}
+
+	sent := srv.Mailbox("Sent")
+	if len(sent.Messages) != 1 {
+		t.Fatalf("%d messages in Sent", len(sent.Messages))
+	}
+
+	msg := sent.Messages[0]
+
+	if !msg.InternalDate.Equal(date) {
+		t.Errorf("invalid internal date %v", msg.InternalDate)
+	}
+
+	if !msg.HasFlag(imapc.MessageFlagSeen) {
+		t.Errorf("invalid flags %v", msg.Flags)
+	}
+
+	if err := client.SendCommandMove(set, "Unknown"); err == nil {
+		t.Errorf("moved a message to a mailbox which does not exist")
+	}
+}
+
+func capsWithoutUIDPlus() []string {
+	caps := []string{}
+	for _, cap := range imaptest.DefaultCaps {
+		if cap != "UIDPLUS" && cap != "MOVE" {
+			caps = append(caps, cap)
+		}
+	}
+
+	return caps
+}
+
+func TestClientDeleteMessagesWithoutUIDPlus(t *testing.T) {
+	srv := newTestServerWithCaps(t, capsWithoutUIDPlus())
+	defer srv.Close()
+
+	inbox := srv.Mailbox("INBOX")
+	inbox.Messages[0].AddFlags([]string{imapc.MessageFlagDeleted})
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	set := imapc.SequenceSet{imapc.SequenceNumber(2)}
+
+	// Message 1 is marked as deleted, EXPUNGE would remove it
+	if err := client.SendCommandDeleteMessages(set); err == nil {
+		t.Errorf("deleted messages while another one was marked " +
+			"as deleted")
+	}
+
+	if err := client.SendCommandMove(set, "Sent"); err == nil {
+		t.Errorf("moved messages while another one was marked " +
+			"as deleted")
+	}
+
+	if n := len(inbox.Messages); n != 3 {
+		t.Errorf("%d messages left in INBOX", n)
+	}
+
+	if inbox.Messages[1].HasFlag(imapc.MessageFlagDeleted) {
+		t.Errorf("message marked as deleted")
+	}
+
+	if n := len(srv.Mailbox("Sent").Messages); n != 0 {
+		t.Errorf("%d messages in Sent", n)
+	}
+
+	// Once the message is deleted, there is nothing else to expunge
+	if err := client.SendCommandDeleteMessages(
+		imapc.SequenceSet{imapc.SequenceNumber(1)}); err != nil {
+		t.Fatalf("cannot delete message: %v", err)
+	}
+
+	if err := client.SendCommandMove(set, "Sent"); err != nil {
+		t.Fatalf("cannot move message: %v", err)
+	}
+
+	if n := len(inbox.Messages); n != 1 {
+		t.Errorf("%d messages left in INBOX", n)
+	}
+
+	if n := len(srv.Mailbox("Sent").Messages); n != 1 {
+		t.Errorf("%d messages in Sent", n)
+	}
+}
+
+func TestClientDeleteMessagesHugeDeletedSet(t *testing.T) {
+	srv := newTestServerWithCaps(t, capsWithoutUIDPlus())
+	defer srv.Close()
+
+	srv.Handle("SEARCH", func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+		sess.WriteLine("* ESEARCH (TAG \"" + cmd.Tag + "\") UID " +
+			"ALL 1:4294967295")
+		return nil
+	})
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	set := imapc.SequenceSet{imapc.NewSequenceRange(2, 3)}
+
+	err := client.SendCommandDeleteMessages(set)
+	if err == nil {
+		t.Fatalf("deleted messages while others were marked as deleted")
+	}
+
+	if !strings.Contains(err.Error(), "4294967293 other messages") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestClientCreateIfMissing(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	if err := client.SendCommandCreateIfMissing("Sent"); err != nil {
+		t.Errorf("cannot create existing mailbox: %v", err)
+	}
+
+	if err := client.SendCommandCreateIfMissing("Sen%"); err != nil {
+		t.Errorf("cannot create mailbox: %v", err)
+	} else if srv.Mailbox("Sen%") == nil {
+		t.Errorf("mailbox not created")
+	}
+
+	// Servers which do not support response codes
+	srv.Handle("CREATE", func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+		return imaptest.No("", "cannot create mailbox")
+	})
+
+	if err := client.SendCommandCreateIfMissing("Sent"); err != nil {
+		t.Errorf("cannot create existing mailbox: %v", err)
+	}
+
+	if err := client.SendCommandCreateIfMissing("S%"); err == nil {
+		t.Errorf("created mailbox despite the server refusing it")
+	}
+}
+
+func TestClientCommandErrors(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	srv.Handle("CREATE", func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+		return imaptest.No("OVERQUOTA", "quota exceeded")
+	})
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	err := client.SendCommandCreate("Archives")
+	if err == nil {
+		t.Fatalf("created a mailbox despite a NO response")
+	}
+
+	if err.Error() != "quota exceeded" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if srv.Mailbox("Archives") != nil {
+		t.Errorf("mailbox created despite the handler")
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*imapc.Client)
+		handler imaptest.HandlerFunc
+		limit   string
+	}{
+		{
+			name: "line length",
+			setup: func(c *imapc.Client) {
+				c.MaxLineLength = 1024
+			},
+			handler: func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+				sess.WriteLine("* STATUS INBOX (MESSAGES %s)",
+					strings.Repeat("1", 100000))
+				return imaptest.OK("", "STATUS completed")
+			},
+			limit: "line length",
+		},
+		{
+			name: "line length with short tokens",
+			setup: func(c *imapc.Client) {
+				c.MaxLineLength = 1024
+			},
+			handler: func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+				sess.WriteLine("* SEARCH%s",
+					strings.Repeat(" 1", 100000))
+				return imaptest.OK("", "STATUS completed")
+			},
+			limit: "line length",
+		},
+		{
+			name: "line length in search return data",
+			setup: func(c *imapc.Client) {
+				c.MaxLineLength = 1024
+			},
+			handler: func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+				sess.WriteLine("* ESEARCH UID ALL 1%s",
+					strings.Repeat(",1", 100000))
+				return imaptest.OK("", "STATUS completed")
+			},
+			limit: "line length",
+		},
+		{
+			name: "line length with literals",
+			setup: func(c *imapc.Client) {
+				c.MaxLineLength = 1024
+			},
+			handler: func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+				sess.WriteLine("* 1 FETCH (X (%s))",
+					strings.Repeat("{1}\r\na ", 100000))
+				return imaptest.OK("", "STATUS completed")
+			},
+			limit: "line length",
+		},
+		{
+			name: "literal size",
+			setup: func(c *imapc.Client) {
+				c.MaxLiteralSize = 1024
+			},
+			handler: func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+				sess.WriteLine("* STATUS {100000}")
+				return imaptest.OK("", "STATUS completed")
+			},
+			limit: "literal size",
+		},
+		{
+			name: "nesting depth",
+			setup: func(c *imapc.Client) {
+				c.MaxNestingDepth = 10
+			},
+			handler: func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+				sess.WriteLine("* 1 FETCH (X %s)",
+					strings.Repeat("(", 20))
+				return imaptest.OK("", "STATUS completed")
+			},
+			limit: "nesting depth",
+		},
+		{
+			name: "response count",
+			setup: func(c *imapc.Client) {
+				c.MaxResponsesPerCommand = 10
+			},
+			handler: func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+				for i := 0; i < 100; i++ {
+					sess.WriteLine("* STATUS INBOX (MESSAGES 3)")
+				}
+				return imaptest.OK("", "STATUS completed")
+			},
+			limit: "response count",
+		},
+		{
+			name: "command size",
+			setup: func(c *imapc.Client) {
+				c.MaxBytesPerCommand = 4096
+			},
+			handler: func(sess *imaptest.Session, cmd *imaptest.Command) *imaptest.Status {
+				for i := 0; i < 1000; i++ {
+					sess.WriteLine("* STATUS INBOX (MESSAGES 3)")
+				}
+				return imaptest.OK("", "STATUS completed")
+			},
+			limit: "command size",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+
+			srv.Handle("STATUS", test.handler)
+
+			client := newTestClient(srv)
+			test.setup(client)
+
+			if err := client.Connect(); err != nil {
+				t.Fatalf("cannot connect: %v", err)
+			}
+
+			_, err := client.SendCommandStatus("INBOX",
+				[]string{"MESSAGES"})
+
+			var limitErr *imapc.LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if limitErr.Limit != test.limit {
+				t.Errorf("unexpected limit %q", limitErr.Limit)
+			}
+
+			if client.State != imapc.ClientStateDisconnected {
+				t.Errorf("client is in state %v", client.State)
+			}
+		})
+	}
+}
+
+type commandCounter struct {
+	counts map[string]int
+}
+
+func (o *commandCounter) CommandStarted(info *imapc.CommandInfo) {
+}
+
+func (o *commandCounter) CommandDone(info *imapc.CommandInfo) {
+	o.counts[info.Name]++
+}
+
+func TestClientSplitCommands(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	counter := &commandCounter{counts: map[string]int{}}
+
+	client := newTestClient(srv)
+	client.MaxCommandLength = 100
+	client.Observer = counter
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+	defer client.SendCommandLogout()
+
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	// Odd UIDs cannot be merged into ranges
+	uids := []uint32{}
+	for uid := uint32(1); uid < 200; uid += 2 {
+		uids = append(uids, uid)
+	}
+
+	set := imapc.NewSequenceSetFromNumbers(uids)
+
+	key := append(imapc.SearchKeyUID(set), imapc.SearchKeyAll()...)
+
+	srs, err := client.SendCommandSearch("", key)
+	if err != nil {
+		t.Fatalf("cannot search messages: %v", err)
+	}
+
+	if ids := srs.MessageIds.String(); ids != "1,3" {
+		t.Errorf("invalid search results %s", ids)
+	}
+
+	_, err = client.SendCommandStore(set, imapc.StoreModeAdd,
+		[]string{imapc.MessageFlagFlagged})
+	if err != nil {
+		t.Fatalf("cannot store flags: %v", err)
+	}
+
+	frs, err := client.SendCommandFetch(set, []string{"FLAGS"})
+	if err != nil {
+		t.Fatalf("cannot fetch messages: %v", err)
+	}
+
+	if len(frs.Messages) != 2 {
+		t.Fatalf("invalid number of messages %d", len(frs.Messages))
+	}
+
+	for _, msg := range frs.Messages {
+		if !reflect.DeepEqual(msg.Flags, []string{imapc.MessageFlagFlagged}) {
+			t.Errorf("invalid flags %v for message %d", msg.Flags,
+				msg.UID)
+		}
+	}
+
+	for _, name := range []string{"UID SEARCH", "UID STORE", "UID FETCH"} {
+		if counter.counts[name] < 2 {
+			t.Errorf("%s was sent %d times", name, counter.counts[name])
+		}
+	}
+}
+
+func TestClientNonSyncLiterals(t *testing.T) {
+	tests := []struct {
+		cap      string
+		literals []string
+	}{
+		{"", []string{"{5}", "{5002}"}},
+		{"LITERAL-", []string{"{5+}", "{5002}"}},
+		{"LITERAL+", []string{"{5+}", "{5002+}"}},
+	}
+
+	for _, test := range tests {
+		caps := imaptest.DefaultCaps
+		if test.cap != "" {
+			caps = append(append([]string{}, caps...), test.cap)
+		}
+
+		srv := newTestServerWithCaps(t, caps)
+
+		var buf bytes.Buffer
+
+		handlerOptions := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+		client := newTestClient(srv)
+		client.Logger = slog.New(slog.NewTextHandler(&buf, handlerOptions))
+
+		if err := client.Connect(); err != nil {
+			t.Fatalf("cannot connect: %v", err)
+		}
+
+		if _, err := client.SendCommandSelect("INBOX"); err != nil {
+			t.Fatalf("cannot select mailbox: %v", err)
+		}
+
+		rs, err := client.SendCommandSearch("",
+			imapc.SearchKeySubject("\r\nfoo"))
+		if err != nil {
+			t.Fatalf("cannot search messages: %v", err)
+		}
+
+		if len(rs.MessageIds) != 0 {
+			t.Errorf("invalid search results %v", rs.MessageIds)
+		}
+
+		message := "Subject: literal\r\n\r\n" +
+			strings.Repeat("x", 4980) + "\r\n"
+
+		_, err = client.SendCommandAppend("INBOX", nil, time.Time{},
+			[]byte(message))
+		if err != nil {
+			t.Fatalf("cannot append message: %v", err)
+		}
+
+		if err := client.SendCommandLogout(); err != nil {
+			t.Fatalf("cannot logout: %v", err)
+		}
+
+		srv.Close()
+
+		trace := buf.String()
+
+		for _, literal := range test.literals {
+			if !strings.Contains(trace, literal+"\"") {
+				t.Errorf("literal %s not found in trace with "+
+					"capability %q:\n%s", literal, test.cap,
+					trace)
+			}
+		}
+	}
+}
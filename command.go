@@ -16,11 +16,15 @@
 package imapc
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Command interface {
@@ -36,6 +40,11 @@ type CommandResponse struct {
 
 type Literal []byte
 
+// MailboxName is a command argument containing a mailbox name. It is encoded
+// when the command is sent, since the encoding depends on the protocol
+// revision in use.
+type MailboxName string
+
 // ---------------------------------------------------------------------------
 //  Command: AUTHENTICATE
 // ---------------------------------------------------------------------------
@@ -114,19 +123,82 @@ func (c *CommandCapability) Continue(w *BufferedWriter, r *ResponseContinuation)
 type CommandList struct {
 	Ref     string
 	Pattern string
+
+	// LIST-EXTENDED (RFC 5258)
+	SelectionOptions []string
+	ReturnOptions    []string
+
+	// LIST-STATUS (RFC 5819)
+	ReturnStatus []string
 }
 
 func (c *CommandList) Args() []interface{} {
-	ref := MailboxNameEncode(c.Ref)
-	pattern := MailboxNameEncode(c.Pattern)
+	ref := MailboxName(c.Ref)
+	pattern := MailboxName(c.Pattern)
+
+	args := []interface{}{"LIST"}
 
-	return []interface{}{"LIST", ref, pattern}
+	if len(c.SelectionOptions) > 0 {
+		args = append(args, listArg(c.SelectionOptions))
+	}
+
+	args = append(args, ref, pattern)
+
+	returnOptions := append([]string{}, c.ReturnOptions...)
+	if len(c.ReturnStatus) > 0 {
+		returnOptions = append(returnOptions,
+			"STATUS "+listArg(c.ReturnStatus))
+	}
+
+	if len(returnOptions) > 0 {
+		args = append(args, "RETURN", listArg(returnOptions))
+	}
+
+	return args
 }
 
 func (c *CommandList) Continue(w *BufferedWriter, r *ResponseContinuation) error {
 	return nil
 }
 
+// ---------------------------------------------------------------------------
+//  Command: STATUS
+// ---------------------------------------------------------------------------
+type CommandStatus struct {
+	MailboxName string
+	Items       []string
+}
+
+func (c *CommandStatus) Args() []interface{} {
+	mailboxName := MailboxName(c.MailboxName)
+
+	return []interface{}{"STATUS", mailboxName, listArg(c.Items)}
+}
+
+func (c *CommandStatus) Continue(w *BufferedWriter, r *ResponseContinuation) error {
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Command: ENABLE (RFC 5161)
+// ---------------------------------------------------------------------------
+type CommandEnable struct {
+	Extensions []string
+}
+
+func (c *CommandEnable) Args() []interface{} {
+	args := []interface{}{"ENABLE"}
+	for _, ext := range c.Extensions {
+		args = append(args, ext)
+	}
+
+	return args
+}
+
+func (c *CommandEnable) Continue(w *BufferedWriter, r *ResponseContinuation) error {
+	return nil
+}
+
 // ---------------------------------------------------------------------------
 //  Command: LSUB
 // ---------------------------------------------------------------------------
@@ -136,8 +208,8 @@ type CommandLSub struct {
 }
 
 func (c *CommandLSub) Args() []interface{} {
-	ref := MailboxNameEncode(c.Ref)
-	pattern := MailboxNameEncode(c.Pattern)
+	ref := MailboxName(c.Ref)
+	pattern := MailboxName(c.Pattern)
 
 	return []interface{}{"LSUB", ref, pattern}
 }
@@ -154,7 +226,7 @@ type CommandCreate struct {
 }
 
 func (c *CommandCreate) Args() []interface{} {
-	mbox := MailboxNameEncode(c.MailboxName)
+	mbox := MailboxName(c.MailboxName)
 
 	return []interface{}{"CREATE", mbox}
 }
@@ -171,7 +243,7 @@ type CommandDelete struct {
 }
 
 func (c *CommandDelete) Args() []interface{} {
-	mbox := MailboxNameEncode(c.MailboxName)
+	mbox := MailboxName(c.MailboxName)
 
 	return []interface{}{"DELETE", mbox}
 }
@@ -189,8 +261,8 @@ type CommandRename struct {
 }
 
 func (c *CommandRename) Args() []interface{} {
-	mbox := MailboxNameEncode(c.MailboxName)
-	newName := MailboxNameEncode(c.MailboxNewName)
+	mbox := MailboxName(c.MailboxName)
+	newName := MailboxName(c.MailboxNewName)
 
 	return []interface{}{"RENAME", mbox, newName}
 }
@@ -207,7 +279,7 @@ type CommandSubscribe struct {
 }
 
 func (c *CommandSubscribe) Args() []interface{} {
-	mbox := MailboxNameEncode(c.MailboxName)
+	mbox := MailboxName(c.MailboxName)
 
 	return []interface{}{"SUBSCRIBE", mbox}
 }
@@ -224,7 +296,7 @@ type CommandUnsubscribe struct {
 }
 
 func (c *CommandUnsubscribe) Args() []interface{} {
-	mbox := MailboxNameEncode(c.MailboxName)
+	mbox := MailboxName(c.MailboxName)
 
 	return []interface{}{"UNSUBSCRIBE", mbox}
 }
@@ -233,17 +305,76 @@ func (c *CommandUnsubscribe) Continue(w *BufferedWriter, r *ResponseContinuation
 	return nil
 }
 
+// ---------------------------------------------------------------------------
+//  QRESYNC parameters (RFC 7162)
+// ---------------------------------------------------------------------------
+type QResyncParams struct {
+	UIDValidity uint32
+	ModSeq      uint64
+
+	// Optional
+	KnownUIDs SequenceSet
+
+	// Optional message sequence match data; both sets must have the
+	// same number of messages.
+	KnownSequenceNumbers SequenceSet
+	KnownSequenceUIDs    SequenceSet
+}
+
+func (p *QResyncParams) String() string {
+	buf := bytes.NewBuffer([]byte{})
+
+	fmt.Fprintf(buf, "QRESYNC (%d %d", p.UIDValidity, p.ModSeq)
+
+	if len(p.KnownUIDs) > 0 {
+		fmt.Fprintf(buf, " %v", p.KnownUIDs)
+	}
+
+	if len(p.KnownSequenceNumbers) > 0 && len(p.KnownSequenceUIDs) > 0 {
+		fmt.Fprintf(buf, " (%v %v)",
+			p.KnownSequenceNumbers, p.KnownSequenceUIDs)
+	}
+
+	buf.WriteByte(')')
+
+	return buf.String()
+}
+
+func selectParams(condStore bool, qresync *QResyncParams) []interface{} {
+	params := []string{}
+
+	if condStore {
+		params = append(params, "CONDSTORE")
+	}
+
+	if qresync != nil {
+		params = append(params, qresync.String())
+	}
+
+	if len(params) == 0 {
+		return nil
+	}
+
+	return []interface{}{listArg(params)}
+}
+
 // ---------------------------------------------------------------------------
 //  Command: EXAMINE
 // ---------------------------------------------------------------------------
 type CommandExamine struct {
 	MailboxName string
+
+	// CONDSTORE and QRESYNC (RFC 7162)
+	CondStore bool
+	QResync   *QResyncParams
 }
 
 func (c *CommandExamine) Args() []interface{} {
-	mailboxName := MailboxNameEncode(c.MailboxName)
+	mailboxName := MailboxName(c.MailboxName)
 
-	return []interface{}{"EXAMINE", mailboxName}
+	args := []interface{}{"EXAMINE", mailboxName}
+
+	return append(args, selectParams(c.CondStore, c.QResync)...)
 }
 
 func (c *CommandExamine) Continue(w *BufferedWriter, r *ResponseContinuation) error {
@@ -255,12 +386,18 @@ func (c *CommandExamine) Continue(w *BufferedWriter, r *ResponseContinuation) er
 // ---------------------------------------------------------------------------
 type CommandSelect struct {
 	MailboxName string
+
+	// CONDSTORE and QRESYNC (RFC 7162)
+	CondStore bool
+	QResync   *QResyncParams
 }
 
 func (c *CommandSelect) Args() []interface{} {
-	mailboxName := MailboxNameEncode(c.MailboxName)
+	mailboxName := MailboxName(c.MailboxName)
 
-	return []interface{}{"SELECT", mailboxName}
+	args := []interface{}{"SELECT", mailboxName}
+
+	return append(args, selectParams(c.CondStore, c.QResync)...)
 }
 
 func (c *CommandSelect) Continue(w *BufferedWriter, r *ResponseContinuation) error {
@@ -296,10 +433,35 @@ func (c *CommandLogout) Continue(w *BufferedWriter, r *ResponseContinuation) err
 // ---------------------------------------------------------------------------
 //  Command: SEARCH
 // ---------------------------------------------------------------------------
+type SearchReturnOption string
+
+// ESEARCH (RFC 4731) and SEARCHRES (RFC 5182)
+const (
+	SearchReturnMin   SearchReturnOption = "MIN"
+	SearchReturnMax   SearchReturnOption = "MAX"
+	SearchReturnCount SearchReturnOption = "COUNT"
+	SearchReturnAll   SearchReturnOption = "ALL"
+	SearchReturnSave  SearchReturnOption = "SAVE"
+)
+
+func hasSearchReturnOption(options []SearchReturnOption, option SearchReturnOption) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+
+	return false
+}
+
 type CommandSearch struct {
 	Charset string
 	Key     SearchKey
 	UID     bool
+
+	// ESEARCH (RFC 4731), ignored if nil; an empty list is equivalent
+	// to ALL
+	Return []SearchReturnOption
 }
 
 func (c *CommandSearch) Args() []interface{} {
@@ -311,6 +473,15 @@ func (c *CommandSearch) Args() []interface{} {
 
 	args = append(args, "SEARCH")
 
+	if c.Return != nil {
+		options := make([]string, len(c.Return))
+		for i, option := range c.Return {
+			options[i] = string(option)
+		}
+
+		args = append(args, "RETURN", listArg(options))
+	}
+
 	if c.Charset != "" {
 		args = append(args, "CHARSET", AStringEncode(c.Charset))
 	}
@@ -321,3 +492,308 @@ func (c *CommandSearch) Args() []interface{} {
 func (c *CommandSearch) Continue(w *BufferedWriter, r *ResponseContinuation) error {
 	return nil
 }
+
+// ---------------------------------------------------------------------------
+//  Command: SORT
+// ---------------------------------------------------------------------------
+type SortKey string
+
+const (
+	SortKeyArrival SortKey = "ARRIVAL"
+	SortKeyCC      SortKey = "CC"
+	SortKeyDate    SortKey = "DATE"
+	SortKeyFrom    SortKey = "FROM"
+	SortKeySize    SortKey = "SIZE"
+	SortKeySubject SortKey = "SUBJECT"
+	SortKeyTo      SortKey = "TO"
+
+	// SORT=DISPLAY (RFC 5957)
+	SortKeyDisplayFrom SortKey = "DISPLAYFROM"
+	SortKeyDisplayTo   SortKey = "DISPLAYTO"
+)
+
+type SortCriterion struct {
+	Key     SortKey
+	Reverse bool
+}
+
+func (c SortCriterion) String() string {
+	if c.Reverse {
+		return "REVERSE " + string(c.Key)
+	}
+
+	return string(c.Key)
+}
+
+type CommandSort struct {
+	Criteria []SortCriterion
+	Charset  string // UTF-8 if empty
+	Key      SearchKey
+	UID      bool
+}
+
+func (c *CommandSort) Args() []interface{} {
+	args := []interface{}{}
+
+	if c.UID {
+		args = append(args, "UID")
+	}
+
+	criteria := make([]string, len(c.Criteria))
+	for i, criterion := range c.Criteria {
+		criteria[i] = criterion.String()
+	}
+
+	charset := c.Charset
+	if charset == "" {
+		charset = "UTF-8"
+	}
+
+	args = append(args, "SORT", listArg(criteria), AStringEncode(charset))
+
+	return append(args, c.Key...)
+}
+
+func (c *CommandSort) Continue(w *BufferedWriter, r *ResponseContinuation) error {
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Command: THREAD
+// ---------------------------------------------------------------------------
+type ThreadAlgorithm string
+
+const (
+	ThreadOrderedSubject ThreadAlgorithm = "ORDEREDSUBJECT"
+	ThreadReferences     ThreadAlgorithm = "REFERENCES"
+)
+
+type CommandThread struct {
+	Algorithm ThreadAlgorithm
+	Charset   string // UTF-8 if empty
+	Key       SearchKey
+	UID       bool
+}
+
+func (c *CommandThread) Args() []interface{} {
+	args := []interface{}{}
+
+	if c.UID {
+		args = append(args, "UID")
+	}
+
+	charset := c.Charset
+	if charset == "" {
+		charset = "UTF-8"
+	}
+
+	args = append(args, "THREAD", string(c.Algorithm),
+		AStringEncode(charset))
+
+	return append(args, c.Key...)
+}
+
+func (c *CommandThread) Continue(w *BufferedWriter, r *ResponseContinuation) error {
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Command: FETCH
+// ---------------------------------------------------------------------------
+type CommandFetch struct {
+	Set   SequenceSet
+	Items []string
+	UID   bool
+
+	// CONDSTORE (RFC 7162), ignored if zero
+	ChangedSince uint64
+
+	// QRESYNC (RFC 7162), requires ChangedSince and UID
+	Vanished bool
+}
+
+func (c *CommandFetch) Args() []interface{} {
+	args := []interface{}{}
+
+	if c.UID {
+		args = append(args, "UID")
+	}
+
+	set, _ := c.Set.Compact().MarshalText()
+	args = append(args, "FETCH", set, listArg(c.Items))
+
+	if c.ChangedSince > 0 {
+		modifiers := []string{"CHANGEDSINCE " +
+			strconv.FormatUint(c.ChangedSince, 10)}
+
+		if c.Vanished {
+			modifiers = append(modifiers, "VANISHED")
+		}
+
+		args = append(args, listArg(modifiers))
+	}
+
+	return args
+}
+
+func (c *CommandFetch) Continue(w *BufferedWriter, r *ResponseContinuation) error {
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Command: STORE
+// ---------------------------------------------------------------------------
+type StoreMode string
+
+const (
+	StoreModeSet    StoreMode = "FLAGS"
+	StoreModeAdd    StoreMode = "+FLAGS"
+	StoreModeRemove StoreMode = "-FLAGS"
+)
+
+type CommandStore struct {
+	Set    SequenceSet
+	Mode   StoreMode
+	Flags  []string
+	Silent bool
+	UID    bool
+
+	// CONDSTORE (RFC 7162), ignored if zero
+	UnchangedSince uint64
+}
+
+func (c *CommandStore) Args() []interface{} {
+	args := []interface{}{}
+
+	if c.UID {
+		args = append(args, "UID")
+	}
+
+	set, _ := c.Set.Compact().MarshalText()
+	args = append(args, "STORE", set)
+
+	if c.UnchangedSince > 0 {
+		modifier := "UNCHANGEDSINCE " +
+			strconv.FormatUint(c.UnchangedSince, 10)
+		args = append(args, listArg([]string{modifier}))
+	}
+
+	item := string(c.Mode)
+	if c.Silent {
+		item += ".SILENT"
+	}
+
+	return append(args, item, listArg(c.Flags))
+}
+
+func (c *CommandStore) Continue(w *BufferedWriter, r *ResponseContinuation) error {
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Command: COPY
+// ---------------------------------------------------------------------------
+type CommandCopy struct {
+	Set         SequenceSet
+	MailboxName string
+	UID         bool
+}
+
+func (c *CommandCopy) Args() []interface{} {
+	args := []interface{}{}
+
+	if c.UID {
+		args = append(args, "UID")
+	}
+
+	set, _ := c.Set.Compact().MarshalText()
+	mailboxName := MailboxName(c.MailboxName)
+
+	return append(args, "COPY", set, mailboxName)
+}
+
+func (c *CommandCopy) Continue(w *BufferedWriter, r *ResponseContinuation) error {
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Command: MOVE (RFC 6851)
+// ---------------------------------------------------------------------------
+type CommandMove struct {
+	Set         SequenceSet
+	MailboxName string
+	UID         bool
+}
+
+func (c *CommandMove) Args() []interface{} {
+	args := []interface{}{}
+
+	if c.UID {
+		args = append(args, "UID")
+	}
+
+	set, _ := c.Set.Compact().MarshalText()
+	mailboxName := MailboxName(c.MailboxName)
+
+	return append(args, "MOVE", set, mailboxName)
+}
+
+func (c *CommandMove) Continue(w *BufferedWriter, r *ResponseContinuation) error {
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Command: EXPUNGE
+// ---------------------------------------------------------------------------
+type CommandExpunge struct {
+	// UIDPLUS (RFC 4315), only expunge these messages if set
+	UIDs SequenceSet
+}
+
+func (c *CommandExpunge) Args() []interface{} {
+	if len(c.UIDs) == 0 {
+		return []interface{}{"EXPUNGE"}
+	}
+
+	set, _ := c.UIDs.Compact().MarshalText()
+	return []interface{}{"UID", "EXPUNGE", set}
+}
+
+func (c *CommandExpunge) Continue(w *BufferedWriter, r *ResponseContinuation) error {
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Command: APPEND
+// ---------------------------------------------------------------------------
+type CommandAppend struct {
+	MailboxName string
+	Flags       []string
+	Date        time.Time // optional
+	Message     []byte
+}
+
+func (c *CommandAppend) Args() []interface{} {
+	mailboxName := MailboxName(c.MailboxName)
+
+	args := []interface{}{"APPEND", mailboxName}
+
+	if len(c.Flags) > 0 {
+		args = append(args, listArg(c.Flags))
+	}
+
+	if !c.Date.IsZero() {
+		date := c.Date.Format(IMAPDateTimeFormat)
+		args = append(args, QuotedStringEncode(date))
+	}
+
+	return append(args, Literal(c.Message))
+}
+
+func (c *CommandAppend) Continue(w *BufferedWriter, r *ResponseContinuation) error {
+	return nil
+}
+
+func listArg(values []string) string {
+	return "(" + strings.Join(values, " ") + ")"
+}
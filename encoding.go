@@ -15,14 +15,189 @@
 
 package imapc
 
-const IMAPDateFormat = "02-Jan-2006"
+import (
+	"strings"
+	"time"
+)
+
+const (
+	IMAPDateFormat     = "02-Jan-2006"
+	IMAPDateTimeFormat = "_2-Jan-2006 15:04:05 -0700"
+)
 
 type MailboxList struct {
 	Flags              []string
 	HierarchyDelimiter rune
 	Name               string
+
+	// Extended data (RFC 5258)
+	OldName   string
+	ChildInfo []string
+
+	// Only set when requested with LIST-STATUS (RFC 5819)
+	Status *MailboxStatus
+}
+
+type MailboxStatus struct {
+	Messages    uint32
+	Recent      uint32
+	UIDNext     uint32
+	UIDValidity uint32
+	Unseen      uint32
+
+	// IMAP4rev2 (RFC 9051)
+	Deleted uint32
+	Size    uint64
+}
+
+const (
+	MailboxFlagNoInferiors   = "\\Noinferiors"
+	MailboxFlagNoSelect      = "\\Noselect"
+	MailboxFlagMarked        = "\\Marked"
+	MailboxFlagUnmarked      = "\\Unmarked"
+	MailboxFlagNonExistent   = "\\NonExistent"
+	MailboxFlagSubscribed    = "\\Subscribed"
+	MailboxFlagRemote        = "\\Remote"
+	MailboxFlagHasChildren   = "\\HasChildren"
+	MailboxFlagHasNoChildren = "\\HasNoChildren"
+
+	// SPECIAL-USE (RFC 6154)
+	MailboxFlagAll     = "\\All"
+	MailboxFlagArchive = "\\Archive"
+	MailboxFlagDrafts  = "\\Drafts"
+	MailboxFlagFlagged = "\\Flagged"
+	MailboxFlagJunk    = "\\Junk"
+	MailboxFlagSent    = "\\Sent"
+	MailboxFlagTrash   = "\\Trash"
+)
+
+var SpecialUseMailboxFlags = []string{
+	MailboxFlagAll,
+	MailboxFlagArchive,
+	MailboxFlagDrafts,
+	MailboxFlagFlagged,
+	MailboxFlagJunk,
+	MailboxFlagSent,
+	MailboxFlagTrash,
+}
+
+func (mbox *MailboxList) HasFlag(flag string) bool {
+	for _, f := range mbox.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsSelectable returns false for mailboxes which cannot be selected,
+// including the ones which do not exist but are listed because they have
+// children (\NonExistent implies \Noselect, RFC 5258 3.4).
+func (mbox *MailboxList) IsSelectable() bool {
+	return !mbox.HasFlag(MailboxFlagNoSelect) &&
+		!mbox.HasFlag(MailboxFlagNonExistent)
+}
+
+// SpecialUse returns the special use flag of the mailbox, or an empty string
+// if it does not have one.
+func (mbox *MailboxList) SpecialUse() string {
+	for _, flag := range SpecialUseMailboxFlags {
+		if mbox.HasFlag(flag) {
+			return flag
+		}
+	}
+
+	return ""
+}
+
+type Message struct {
+	SequenceNumber uint32
+
+	UID          uint32
+	Flags        []string
+	InternalDate time.Time
+	Size         uint32
+
+	// CONDSTORE (RFC 7162)
+	ModSeq uint64
+
+	// Body sections indexed by their normalized name, e.g. "BODY[]" or
+	// "BODY[HEADER.FIELDS (MESSAGE-ID)]".
+	Sections map[string][]byte
+
+	// Items we do not decode, indexed by their upper case name
+	Items map[string]interface{}
+}
+
+func (m *Message) merge(m2 *Message) {
+	if m2.UID != 0 {
+		m.UID = m2.UID
+	}
+
+	if m2.Flags != nil {
+		m.Flags = m2.Flags
+	}
+
+	if !m2.InternalDate.IsZero() {
+		m.InternalDate = m2.InternalDate
+	}
+
+	if m2.Size != 0 {
+		m.Size = m2.Size
+	}
+
+	if m2.ModSeq != 0 {
+		m.ModSeq = m2.ModSeq
+	}
+
+	for name, data := range m2.Sections {
+		if m.Sections == nil {
+			m.Sections = map[string][]byte{}
+		}
+		m.Sections[name] = data
+	}
+
+	for name, value := range m2.Items {
+		if m.Items == nil {
+			m.Items = map[string]interface{}{}
+		}
+		m.Items[name] = value
+	}
+}
+
+// Section returns the content of a body section, using the name used to
+// fetch it, e.g. "BODY.PEEK[HEADER]".
+func (m *Message) Section(name string) []byte {
+	return m.Sections[FetchSectionName(name)]
+}
+
+// FetchSectionName normalizes the name of a body section fetch item so that
+// it matches the name sent back by the server.
+func FetchSectionName(name string) string {
+	name = strings.ToUpper(name)
+	name = strings.Replace(name, "BODY.PEEK[", "BODY[", 1)
+	name = strings.Replace(name, "BINARY.PEEK[", "BINARY[", 1)
+
+	// Partial fetches are returned with the origin only
+	if idx := strings.LastIndexByte(name, '<'); idx >= 0 {
+		if dot := strings.IndexByte(name[idx:], '.'); dot >= 0 {
+			name = name[:idx+dot] + ">"
+		}
+	}
+
+	return name
 }
 
+const (
+	MessageFlagSeen     = "\\Seen"
+	MessageFlagAnswered = "\\Answered"
+	MessageFlagFlagged  = "\\Flagged"
+	MessageFlagDeleted  = "\\Deleted"
+	MessageFlagDraft    = "\\Draft"
+	MessageFlagRecent   = "\\Recent"
+)
+
 func QuotedStringEncode(str string) []byte {
 	return QuotedStringEncodeByteString([]byte(str))
 }
@@ -52,14 +227,45 @@ func AStringEncode(s string) []byte {
 }
 
 func AStringEncodeByteString(bs []byte) []byte {
-	if ByteStringAll(bs, IsAtomChar) {
+	if len(bs) > 0 && ByteStringAll(bs, IsAtomChar) {
 		return bs
 	} else {
 		return QuotedStringEncodeByteString(bs)
 	}
 }
 
-func MailboxNameEncode(s string) []byte {
+// AStringArg returns a command argument for a string: an atom if possible, a
+// quoted string if the string only contains 7-bit characters other than CR and
+// LF, or a literal otherwise. NUL characters cannot be sent in any form and
+// are removed.
+func AStringArg(str string) interface{} {
+	str = strings.ReplaceAll(str, "\x00", "")
+
+	if !isQuotableString(str) {
+		return Literal(str)
+	}
+
+	return AStringEncode(str)
+}
+
+func isQuotableString(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if c := str[i]; c == 0 || c >= 0x80 || c == '\r' || c == '\n' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MailboxNameEncode encodes a mailbox name as a quoted string. Names are
+// encoded using modified UTF-7 unless utf8 is true, i.e. when IMAP4rev2 or
+// UTF8=ACCEPT is in use.
+func MailboxNameEncode(s string, utf8 bool) []byte {
+	if utf8 {
+		return QuotedStringEncode(s)
+	}
+
 	return QuotedStringEncodeByteString(ModifiedUTF7Encode([]byte(s)))
 }
 
@@ -17,6 +17,7 @@ package imapc
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 )
 
@@ -42,3 +43,27 @@ func TestQuotedStringEncode(t *testing.T) {
 		}
 	}
 }
+
+func TestAStringArg(t *testing.T) {
+	tests := []struct {
+		str string
+		arg interface{}
+	}{
+		{``, []byte(`""`)},
+		{`foo`, []byte(`foo`)},
+		{`foo bar`, []byte(`"foo bar"`)},
+		{`a"b`, []byte(`"a\"b"`)},
+		{"a\r\nb", Literal("a\r\nb")},
+		{"a\x00b", []byte(`ab`)},
+		{"a\x00\r\n", Literal("a\r\n")},
+		{`café`, Literal(`café`)},
+	}
+
+	for _, test := range tests {
+		arg := AStringArg(test.str)
+		if !reflect.DeepEqual(arg, test.arg) {
+			t.Errorf("%q was encoded as %#v instead of %#v",
+				test.str, arg, test.arg)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func FuzzReadResponse(f *testing.F) {
+	seeds := []string{
+		"* OK [CAPABILITY IMAP4rev1 AUTH=PLAIN] ready\r\n",
+		"* PREAUTH [CAPABILITY IMAP4rev2] ready\r\n",
+		"* BYE shutting down\r\n",
+		"* CAPABILITY IMAP4rev1 IMAP4rev2 ENABLE\r\n",
+		"* LIST (\\HasNoChildren \\Sent) \"/\" \"Sent\"\r\n",
+		"* LIST () NIL INBOX (\"CHILDINFO\" (\"SUBSCRIBED\"))\r\n",
+		"* LSUB () \".\" {5}\r\nINBOX\r\n",
+		"* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)\r\n",
+		"* 3 EXISTS\r\n* 0 RECENT\r\n* 2 EXPUNGE\r\n",
+		"* OK [UIDVALIDITY 3857529045] UIDs valid\r\n",
+		"* OK [UIDNEXT 4392] predicted next UID\r\n",
+		"* OK [UNSEEN 12] first unseen\r\n",
+		"* OK [PERMANENTFLAGS (\\Deleted \\Seen \\*)] limited\r\n",
+		"* OK [HIGHESTMODSEQ 715194045007] ok\r\n",
+		"* SEARCH 2 84 882\r\n",
+		"* SEARCH 2 5 (MODSEQ 917162500)\r\n",
+		"* ESEARCH (TAG \"c1\") UID MIN 2 MAX 9 COUNT 3 ALL 2,5:9\r\n",
+		"* SORT 2 84 882\r\n",
+		"* THREAD (2)(3 6 (4 23)(44 7 96))((3)(5))\r\n",
+		"* STATUS blurdybloop (MESSAGES 231 UIDNEXT 44292)\r\n",
+		"* ENABLED CONDSTORE QRESYNC\r\n",
+		"* VANISHED (EARLIER) 41,43:116,118,120:211\r\n",
+		"* 12 FETCH (UID 2 FLAGS (\\Seen) MODSEQ (12) " +
+			"INTERNALDATE \"17-Jul-1996 02:44:25 -0700\" " +
+			"RFC822.SIZE 4286 BODY[HEADER.FIELDS (SUBJECT)] " +
+			"{15}\r\nSubject: foo\r\n\r\n)\r\n",
+		"c0000001 OK [APPENDUID 38505 3955] APPEND completed\r\n",
+		"c0000002 OK [MODIFIED 7,9] conditional STORE failed\r\n",
+		"c0000003 NO [TRYCREATE] no such mailbox\r\n",
+		"c0000004 NO [BADCHARSET (US-ASCII \"UTF-8\")] charset\r\n",
+		"c0000004 BAD command unknown\r\n",
+		"+ ready\r\n",
+		"* OK [UNSEEN] missing code data\r\n",
+		"* 1 FETCH (BODY[] {2000000000}\r\ntruncated",
+		"* 1 FETCH (X " + strings.Repeat("(", 100000) + "\r\n",
+		"* THREAD " + strings.Repeat("(", 100000) + "\r\n",
+	}
+
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := NewStream(bytes.NewReader(data))
+
+		resps := []Response{}
+		var status *ResponseStatus
+
+		for i := 0; i < 100; i++ {
+			resp, err := ReadResponse(s)
+			if err != nil {
+				break
+			}
+
+			_ = resp.GoString()
+
+			if tresp, ok := resp.(*ResponseStatus); ok {
+				status = tresp
+			} else {
+				resps = append(resps, resp)
+			}
+		}
+
+		responseSets := []ResponseSet{
+			&ResponseSetList{},
+			&ResponseSetLSub{},
+			&ResponseSetStatus{},
+			&ResponseSetEnable{},
+			&ResponseSetExamine{},
+			&ResponseSetSelect{},
+			&ResponseSetSearch{},
+			&ResponseSetSort{},
+			&ResponseSetThread{},
+			&ResponseSetFetch{},
+			&ResponseSetStore{},
+			&ResponseSetAppend{},
+		}
+
+		for _, rs := range responseSets {
+			rs.Init(resps, status)
+		}
+	})
+}
+
+func FuzzParseSearchString(f *testing.F) {
+	seeds := []string{
+		"ALL",
+		"FROM \"bob\" SINCE 1-Feb-1994 NOT TO alice",
+		"UID 100:200 (OR FROM alice SUBJECT {1}\r\nx) YOUNGER 60",
+		"OR SEEN (FLAGGED UNDELETED)",
+		"HEADER X-Spam \"yes\" LARGER 1024",
+		"UID 1:5,7,9:* KEYWORD $Forwarded",
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		ParseSearchString(s)
+	})
+}
+
+func FuzzParseSearchQuery(f *testing.F) {
+	seeds := []string{
+		"ALL",
+		"UID 100:200 (OR FROM alice SUBJECT {1}\r\nx) YOUNGER 60",
+		"NOT NOT (SEEN (KEYWORD $Junk)) NEW",
+		"MODSEQ \"/flags/\\\\Draft\" all 620162338",
+		"HEADER X-Spam \"yes (maybe)\" SENTBEFORE 2016-10-04",
+		"(SUBJECT )",
+		"(SUBJECT \r\n)",
+		"MODSEQ \"\" all 0",
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		node, err := ParseSearchQuery(s)
+		if err != nil {
+			return
+		}
+
+		str := node.String()
+
+		node2, err := ParseSearchQuery(str)
+		if err != nil {
+			t.Fatalf("cannot parse %q (formatted from %q): %v",
+				str, s, err)
+		}
+
+		if !reflect.DeepEqual(node, node2) {
+			t.Fatalf("%q was parsed as %#v then as %#v", s, node,
+				node2)
+		}
+	})
+}
+
+func FuzzModifiedUTF7Decode(f *testing.F) {
+	seeds := []string{
+		"INBOX",
+		"&AKM-",
+		"~peter/mail/&U,BTFw-/&ZeVnLIqe-",
+		"&-",
+		"&Jjo-!",
+		"&00-",
+		"\xfe",
+	}
+
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, err := ModifiedUTF7Decode(data)
+		if err != nil {
+			return
+		}
+
+		encoded := ModifiedUTF7Encode(decoded)
+
+		redecoded, err := ModifiedUTF7Decode(encoded)
+		if err != nil {
+			t.Fatalf("cannot decode %q (encoded from %q): %v",
+				encoded, decoded, err)
+		}
+
+		if !bytes.Equal(decoded, redecoded) {
+			t.Fatalf("%q was decoded as %q then as %q", data,
+				decoded, redecoded)
+		}
+	})
+}
+
+func FuzzParseSequenceSet(f *testing.F) {
+	seeds := []string{"1", "*", "1:*", "2,4:7,9,12:*", "4294967295"}
+
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		set, err := ParseSequenceSet(string(data))
+		if err != nil {
+			return
+		}
+
+		text, err := set.MarshalText()
+		if err != nil {
+			t.Fatalf("cannot encode %#v: %v", set, err)
+		}
+
+		set2, err := ParseSequenceSet(string(text))
+		if err != nil {
+			t.Fatalf("cannot parse %q (encoded from %q): %v",
+				text, data, err)
+		}
+
+		if set.String() != set2.String() {
+			t.Fatalf("%q was parsed as %v then as %v", data, set,
+				set2)
+		}
+	})
+}
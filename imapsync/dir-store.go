@@ -0,0 +1,388 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapsync
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+var ErrUnknownMailbox = errors.New("unknown mailbox")
+
+// DirStore stores data in a directory:
+//
+//	<dir>/changes.json
+//	<dir>/mailboxes/<hex-name>/mailbox.json
+//	<dir>/mailboxes/<hex-name>/bodies/<uid>.eml
+//
+// Mailbox names are hex encoded since they can contain any character,
+// including path separators.
+type DirStore struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+type dirStoreMailbox struct {
+	State    MailboxState
+	Messages []*MessageState
+}
+
+type dirStoreChanges struct {
+	LastId  uint64
+	Changes []*Change
+}
+
+func NewDirStore(path string) (*DirStore, error) {
+	if err := os.MkdirAll(filepath.Join(path, "mailboxes"), 0700); err != nil {
+		return nil, err
+	}
+
+	s := &DirStore{
+		Path: path,
+	}
+
+	return s, nil
+}
+
+func (s *DirStore) Mailboxes() ([]*MailboxState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := ioutil.ReadDir(filepath.Join(s.Path, "mailboxes"))
+	if err != nil {
+		return nil, err
+	}
+
+	mboxes := []*MailboxState{}
+
+	for _, entry := range entries {
+		name, err := hex.DecodeString(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		mbox, err := s.loadMailbox(string(name))
+		if err != nil {
+			return nil, err
+		} else if mbox == nil {
+			continue
+		}
+
+		mboxes = append(mboxes, &mbox.State)
+	}
+
+	return mboxes, nil
+}
+
+func (s *DirStore) Mailbox(name string) (*MailboxState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, err := s.loadMailbox(name)
+	if err != nil || mbox == nil {
+		return nil, err
+	}
+
+	return &mbox.State, nil
+}
+
+func (s *DirStore) PutMailbox(state *MailboxState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, err := s.loadMailbox(state.Name)
+	if err != nil {
+		return err
+	}
+
+	if mbox == nil {
+		dirPath := filepath.Join(s.mailboxPath(state.Name), "bodies")
+		if err := os.MkdirAll(dirPath, 0700); err != nil {
+			return err
+		}
+
+		mbox = &dirStoreMailbox{}
+	}
+
+	mbox.State = *state
+
+	return s.saveMailbox(mbox)
+}
+
+func (s *DirStore) DeleteMailbox(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return os.RemoveAll(s.mailboxPath(name))
+}
+
+func (s *DirStore) Messages(mailbox string) ([]*MessageState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, err := s.loadMailbox(mailbox)
+	if err != nil {
+		return nil, err
+	} else if mbox == nil {
+		return nil, ErrUnknownMailbox
+	}
+
+	return mbox.Messages, nil
+}
+
+func (s *DirStore) PutMessages(mailbox string, msgs []*MessageState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, err := s.loadMailbox(mailbox)
+	if err != nil {
+		return err
+	} else if mbox == nil {
+		return ErrUnknownMailbox
+	}
+
+	index := map[uint32]int{}
+	for i, msg := range mbox.Messages {
+		index[msg.UID] = i
+	}
+
+	for _, msg := range msgs {
+		if i, found := index[msg.UID]; found {
+			mbox.Messages[i] = msg
+		} else {
+			index[msg.UID] = len(mbox.Messages)
+			mbox.Messages = append(mbox.Messages, msg)
+		}
+	}
+
+	sortMessages(mbox.Messages)
+
+	return s.saveMailbox(mbox)
+}
+
+func (s *DirStore) DeleteMessages(mailbox string, uids []uint32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, err := s.loadMailbox(mailbox)
+	if err != nil {
+		return err
+	} else if mbox == nil {
+		return ErrUnknownMailbox
+	}
+
+	deleted := map[uint32]bool{}
+	for _, uid := range uids {
+		deleted[uid] = true
+
+		err := os.Remove(s.bodyPath(mailbox, uid))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	msgs := []*MessageState{}
+	for _, msg := range mbox.Messages {
+		if !deleted[msg.UID] {
+			msgs = append(msgs, msg)
+		}
+	}
+	mbox.Messages = msgs
+
+	return s.saveMailbox(mbox)
+}
+
+func (s *DirStore) HasBody(mailbox string, uid uint32) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := os.Stat(s.bodyPath(mailbox, uid)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *DirStore) Body(mailbox string, uid uint32) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := ioutil.ReadFile(s.bodyPath(mailbox, uid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (s *DirStore) PutBody(mailbox string, uid uint32, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return writeFileAtomically(s.bodyPath(mailbox, uid), data)
+}
+
+func (s *DirStore) Changes() ([]*Change, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changes, err := s.loadChanges()
+	if err != nil {
+		return nil, err
+	}
+
+	return changes.Changes, nil
+}
+
+func (s *DirStore) QueueChange(change *Change) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changes, err := s.loadChanges()
+	if err != nil {
+		return err
+	}
+
+	changes.LastId++
+	change.Id = changes.LastId
+
+	changes.Changes = append(changes.Changes, change)
+
+	return s.saveChanges(changes)
+}
+
+func (s *DirStore) DeleteChange(id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changes, err := s.loadChanges()
+	if err != nil {
+		return err
+	}
+
+	for i, change := range changes.Changes {
+		if change.Id == id {
+			changes.Changes = append(changes.Changes[:i],
+				changes.Changes[i+1:]...)
+			break
+		}
+	}
+
+	return s.saveChanges(changes)
+}
+
+func (s *DirStore) mailboxPath(name string) string {
+	return filepath.Join(s.Path, "mailboxes",
+		hex.EncodeToString([]byte(name)))
+}
+
+func (s *DirStore) bodyPath(mailbox string, uid uint32) string {
+	fileName := strconv.FormatUint(uint64(uid), 10) + ".eml"
+	return filepath.Join(s.mailboxPath(mailbox), "bodies", fileName)
+}
+
+func (s *DirStore) loadMailbox(name string) (*dirStoreMailbox, error) {
+	filePath := filepath.Join(s.mailboxPath(name), "mailbox.json")
+
+	mbox := &dirStoreMailbox{}
+	if found, err := readJSONFile(filePath, mbox); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, nil
+	}
+
+	return mbox, nil
+}
+
+func (s *DirStore) saveMailbox(mbox *dirStoreMailbox) error {
+	filePath := filepath.Join(s.mailboxPath(mbox.State.Name),
+		"mailbox.json")
+	return writeJSONFile(filePath, mbox)
+}
+
+func (s *DirStore) loadChanges() (*dirStoreChanges, error) {
+	filePath := filepath.Join(s.Path, "changes.json")
+
+	changes := &dirStoreChanges{}
+	if _, err := readJSONFile(filePath, changes); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func (s *DirStore) saveChanges(changes *dirStoreChanges) error {
+	return writeJSONFile(filepath.Join(s.Path, "changes.json"), changes)
+}
+
+func readJSONFile(filePath string, value interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if err := json.Unmarshal(data, value); err != nil {
+		return false, fmt.Errorf("cannot decode %s: %v", filePath, err)
+	}
+
+	return true, nil
+}
+
+func writeJSONFile(filePath string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(filePath, data)
+}
+
+// writeFileAtomically writes data to a temporary file and renames it so that
+// an interrupted write never leaves a truncated file behind.
+func writeFileAtomically(filePath string, data []byte) error {
+	tmpPath := filePath + ".tmp"
+
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
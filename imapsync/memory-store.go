@@ -0,0 +1,237 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapsync
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps everything in memory. It is mostly useful for tests and
+// short lived processes.
+type MemoryStore struct {
+	mutex sync.Mutex
+
+	mailboxes map[string]*memoryMailbox
+	changes   []*Change
+	changeId  uint64
+}
+
+type memoryMailbox struct {
+	State    MailboxState
+	Messages map[uint32]MessageState
+	Bodies   map[uint32][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mailboxes: map[string]*memoryMailbox{},
+	}
+}
+
+func (s *MemoryStore) Mailboxes() ([]*MailboxState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mboxes := make([]*MailboxState, 0, len(s.mailboxes))
+	for _, mbox := range s.mailboxes {
+		state := mbox.State
+		mboxes = append(mboxes, &state)
+	}
+
+	sort.Slice(mboxes, func(i, j int) bool {
+		return mboxes[i].Name < mboxes[j].Name
+	})
+
+	return mboxes, nil
+}
+
+func (s *MemoryStore) Mailbox(name string) (*MailboxState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, found := s.mailboxes[name]
+	if !found {
+		return nil, nil
+	}
+
+	state := mbox.State
+	return &state, nil
+}
+
+func (s *MemoryStore) PutMailbox(state *MailboxState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, found := s.mailboxes[state.Name]
+	if !found {
+		mbox = &memoryMailbox{
+			Messages: map[uint32]MessageState{},
+			Bodies:   map[uint32][]byte{},
+		}
+		s.mailboxes[state.Name] = mbox
+	}
+
+	mbox.State = *state
+	return nil
+}
+
+func (s *MemoryStore) DeleteMailbox(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.mailboxes, name)
+	return nil
+}
+
+func (s *MemoryStore) Messages(mailbox string) ([]*MessageState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, found := s.mailboxes[mailbox]
+	if !found {
+		return nil, ErrUnknownMailbox
+	}
+
+	msgs := make([]*MessageState, 0, len(mbox.Messages))
+	for _, msg := range mbox.Messages {
+		msg := msg
+		msg.Flags = append([]string{}, msg.Flags...)
+		msgs = append(msgs, &msg)
+	}
+
+	sortMessages(msgs)
+	return msgs, nil
+}
+
+func (s *MemoryStore) PutMessages(mailbox string, msgs []*MessageState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, found := s.mailboxes[mailbox]
+	if !found {
+		return ErrUnknownMailbox
+	}
+
+	for _, msg := range msgs {
+		m := *msg
+		m.Flags = append([]string{}, msg.Flags...)
+		mbox.Messages[msg.UID] = m
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteMessages(mailbox string, uids []uint32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, found := s.mailboxes[mailbox]
+	if !found {
+		return ErrUnknownMailbox
+	}
+
+	for _, uid := range uids {
+		delete(mbox.Messages, uid)
+		delete(mbox.Bodies, uid)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) HasBody(mailbox string, uid uint32) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, found := s.mailboxes[mailbox]
+	if !found {
+		return false, ErrUnknownMailbox
+	}
+
+	_, found = mbox.Bodies[uid]
+	return found, nil
+}
+
+func (s *MemoryStore) Body(mailbox string, uid uint32) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, found := s.mailboxes[mailbox]
+	if !found {
+		return nil, ErrUnknownMailbox
+	}
+
+	return mbox.Bodies[uid], nil
+}
+
+func (s *MemoryStore) PutBody(mailbox string, uid uint32, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mbox, found := s.mailboxes[mailbox]
+	if !found {
+		return ErrUnknownMailbox
+	}
+
+	mbox.Bodies[uid] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *MemoryStore) Changes() ([]*Change, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changes := make([]*Change, len(s.changes))
+	for i, change := range s.changes {
+		c := *change
+		changes[i] = &c
+	}
+
+	return changes, nil
+}
+
+func (s *MemoryStore) QueueChange(change *Change) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.changeId++
+	change.Id = s.changeId
+
+	c := *change
+	s.changes = append(s.changes, &c)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteChange(id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, change := range s.changes {
+		if change.Id == id {
+			s.changes = append(s.changes[:i], s.changes[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func sortMessages(msgs []*MessageState) {
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].UID < msgs[j].UID
+	})
+}
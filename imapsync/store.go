@@ -0,0 +1,102 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapsync
+
+import (
+	"time"
+)
+
+type MailboxState struct {
+	Name               string
+	HierarchyDelimiter rune
+
+	UIDValidity   uint32
+	UIDNext       uint32
+	HighestModSeq uint64 // zero if CONDSTORE is not available
+}
+
+type MessageState struct {
+	UID          uint32
+	Flags        []string
+	InternalDate time.Time
+	Size         uint32
+	ModSeq       uint64
+}
+
+func (m *MessageState) HasFlag(flag string) bool {
+	for _, f := range m.Flags {
+		if f == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ---------------------------------------------------------------------------
+//  Local changes
+// ---------------------------------------------------------------------------
+type ChangeType string
+
+const (
+	ChangeTypeAddFlags    ChangeType = "add-flags"
+	ChangeTypeRemoveFlags ChangeType = "remove-flags"
+	ChangeTypeMove        ChangeType = "move"
+	ChangeTypeDelete      ChangeType = "delete"
+)
+
+// Change is a local modification which has not been sent to the server yet.
+// UIDValidity is the UIDVALIDITY value of the mailbox when the change was
+// queued; if the server reports a different value, UIDs refer to other
+// messages and the change is dropped.
+type Change struct {
+	Id          uint64 // set by the store
+	Type        ChangeType
+	Mailbox     string
+	UIDValidity uint32
+	UIDs        []uint32
+
+	Flags       []string // add-flags and remove-flags only
+	Destination string   // move only
+}
+
+// ---------------------------------------------------------------------------
+//  Store
+// ---------------------------------------------------------------------------
+
+// Store is the interface implemented by local storage backends. Methods
+// looking up a single object return nil if the object does not exist.
+type Store interface {
+	Mailboxes() ([]*MailboxState, error)
+	Mailbox(name string) (*MailboxState, error)
+	PutMailbox(mbox *MailboxState) error
+
+	// DeleteMailbox deletes a mailbox and all its messages
+	DeleteMailbox(name string) error
+
+	Messages(mailbox string) ([]*MessageState, error)
+	PutMessages(mailbox string, msgs []*MessageState) error
+	DeleteMessages(mailbox string, uids []uint32) error
+
+	HasBody(mailbox string, uid uint32) (bool, error)
+	Body(mailbox string, uid uint32) ([]byte, error)
+	PutBody(mailbox string, uid uint32, data []byte) error
+
+	// Changes returns pending changes in the order they were queued
+	Changes() ([]*Change, error)
+	QueueChange(change *Change) error
+	DeleteChange(id uint64) error
+}
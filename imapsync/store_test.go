@@ -0,0 +1,144 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapsync
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "imapsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	dirStore, err := NewDirStore(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"dir":    dirStore,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, store)
+		})
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	mbox := &MailboxState{
+		Name:               "foo/bar",
+		HierarchyDelimiter: '/',
+		UIDValidity:        42,
+		UIDNext:            4,
+	}
+
+	if err := store.PutMailbox(mbox); err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2016, 11, 25, 10, 0, 0, 0, time.UTC)
+	msgs := []*MessageState{
+		{UID: 3, Flags: []string{"\\Seen"}, InternalDate: date},
+		{UID: 1, Flags: []string{}, InternalDate: date},
+	}
+
+	if err := store.PutMessages(mbox.Name, msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutBody(mbox.Name, 3, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteMessages(mbox.Name, []uint32{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	mbox2, err := store.Mailbox(mbox.Name)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(mbox, mbox2) {
+		t.Errorf("mailbox was stored as %#v instead of %#v", mbox2, mbox)
+	}
+
+	msgs2, err := store.Messages(mbox.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs2) != 1 || msgs2[0].UID != 3 ||
+		!msgs2[0].HasFlag("\\Seen") ||
+		!msgs2[0].InternalDate.Equal(date) {
+		t.Errorf("invalid messages %#v", msgs2)
+	}
+
+	body, err := store.Body(mbox.Name, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(body) != "foo" {
+		t.Errorf("invalid body %q", body)
+	}
+
+	if err := store.QueueChange(&Change{Type: ChangeTypeDelete}); err != nil {
+		t.Fatal(err)
+	}
+
+	change := &Change{Type: ChangeTypeMove, UIDValidity: 42,
+		Destination: "baz"}
+	if err := store.QueueChange(change); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := store.Changes()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 2 {
+		t.Fatalf("%d changes stored instead of 2", len(changes))
+	}
+
+	if err := store.DeleteChange(changes[0].Id); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err = store.Changes()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 1 || changes[0].Id != change.Id ||
+		changes[0].UIDValidity != 42 {
+		t.Errorf("invalid changes %#v", changes)
+	}
+
+	if err := store.DeleteMailbox(mbox.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	mboxes, err := store.Mailboxes()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(mboxes) != 0 {
+		t.Errorf("mailbox was not deleted")
+	}
+}
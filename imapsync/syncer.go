@@ -0,0 +1,708 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapsync
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/galdor/go-imapc"
+)
+
+// Syncer synchronizes a local store with an IMAP account. Mailboxes are
+// synchronized incrementally using QRESYNC or CONDSTORE when the server
+// supports them, and by comparing the flags of all messages otherwise. Local
+// changes are queued in the store and sent to the server before
+// synchronizing mailboxes.
+type Syncer struct {
+	Client *imapc.Client
+	Store  Store
+
+	// FetchBodies enables the download of message bodies
+	FetchBodies bool
+
+	// BatchSize is the maximum number of bodies fetched with a single
+	// command.
+	BatchSize int
+
+	// Logger, if set, receives a warning for each queued change dropped
+	// because the server rejected it.
+	Logger *slog.Logger
+
+	selected            string
+	selectedUIDValidity uint32
+}
+
+func NewSyncer(client *imapc.Client, store Store) *Syncer {
+	return &Syncer{
+		Client: client,
+		Store:  store,
+
+		BatchSize: 50,
+	}
+}
+
+func (s *Syncer) Sync() error {
+	if err := s.ReplayChanges(); err != nil {
+		return err
+	}
+
+	return s.SyncMailboxes()
+}
+
+// SyncMailboxes synchronizes all selectable mailboxes and deletes local
+// mailboxes which do not exist on the server anymore.
+func (s *Syncer) SyncMailboxes() error {
+	rs, err := s.Client.SendCommandList("", "*")
+	if err != nil {
+		return err
+	}
+
+	remote := map[string]bool{}
+
+	for _, mbox := range rs.Mailboxes {
+		if !mbox.IsSelectable() {
+			continue
+		}
+
+		remote[mbox.Name] = true
+
+		if err := s.SyncMailbox(mbox.Name); err != nil {
+			return fmt.Errorf("cannot synchronize mailbox %q: %v",
+				mbox.Name, err)
+		}
+
+		if mbox.HierarchyDelimiter != 0 {
+			state, err := s.Store.Mailbox(mbox.Name)
+			if err != nil {
+				return err
+			}
+
+			state.HierarchyDelimiter = mbox.HierarchyDelimiter
+			if err := s.Store.PutMailbox(state); err != nil {
+				return err
+			}
+		}
+	}
+
+	locals, err := s.Store.Mailboxes()
+	if err != nil {
+		return err
+	}
+
+	for _, local := range locals {
+		if !remote[local.Name] {
+			if err := s.Store.DeleteMailbox(local.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Syncer) SyncMailbox(name string) error {
+	local, err := s.Store.Mailbox(name)
+	if err != nil {
+		return err
+	}
+
+	qresync := local != nil && local.HighestModSeq > 0 &&
+		s.Client.HasCap("QRESYNC")
+
+	var rs *imapc.ResponseSetSelect
+
+	// A failed SELECT closes the mailbox selected before
+	s.selected = ""
+
+	if qresync {
+		msgs, err := s.Store.Messages(name)
+		if err != nil {
+			return err
+		}
+
+		uids := imapc.NewSequenceSetFromNumbers(messageUIDs(msgs))
+
+		params := &imapc.QResyncParams{
+			UIDValidity: local.UIDValidity,
+			ModSeq:      local.HighestModSeq,
+			KnownUIDs:   uids,
+		}
+
+		rs, err = s.Client.SendCommandSelectQResync(name, params)
+		if err != nil {
+			return err
+		}
+	} else {
+		rs, err = s.Client.SendCommandSelect(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.selected = name
+	s.selectedUIDValidity = rs.UIDValidity
+
+	var delimiter rune
+	if local != nil {
+		delimiter = local.HierarchyDelimiter
+	}
+
+	if local != nil && local.UIDValidity != rs.UIDValidity {
+		// Local UIDs are meaningless now
+		if err := s.Store.DeleteMailbox(name); err != nil {
+			return err
+		}
+
+		local = nil
+	}
+
+	state := &MailboxState{
+		Name:               name,
+		HierarchyDelimiter: delimiter,
+
+		UIDValidity:   rs.UIDValidity,
+		UIDNext:       rs.UIDNext,
+		HighestModSeq: rs.HighestModSeq,
+	}
+
+	firstNewUID := uint32(1)
+
+	if local == nil {
+		// Store the mailbox without UIDNEXT and HIGHESTMODSEQ so that
+		// an interrupted synchronization is resumed with a full
+		// synchronization.
+		initialState := *state
+		initialState.UIDNext = 0
+		initialState.HighestModSeq = 0
+
+		if err := s.Store.PutMailbox(&initialState); err != nil {
+			return err
+		}
+	} else {
+		firstNewUID = local.UIDNext
+		if firstNewUID == 0 {
+			firstNewUID = 1
+		}
+	}
+
+	if rs.Exists == 0 {
+		if err := s.deleteAllMessages(name); err != nil {
+			return err
+		}
+	} else if local != nil {
+		switch {
+		case qresync:
+			err = s.applyQResyncDelta(name, rs)
+		case local.HighestModSeq > 0 && rs.HighestModSeq > 0:
+			err = s.syncChangedMessages(name, local.HighestModSeq)
+		default:
+			err = s.syncAllFlags(name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if rs.Exists > 0 && (local == nil || rs.UIDNext != local.UIDNext) {
+		err := s.fetchNewMessages(name, firstNewUID, rs.HighestModSeq > 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.FetchBodies {
+		if err := s.fetchMissingBodies(name); err != nil {
+			return err
+		}
+	}
+
+	return s.Store.PutMailbox(state)
+}
+
+func (s *Syncer) fetchNewMessages(mailbox string, firstUID uint32, modSeq bool) error {
+	items := []string{"UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+	if modSeq {
+		items = append(items, "MODSEQ")
+	}
+
+	set := imapc.SequenceSet{
+		imapc.NewSequenceRange(imapc.SequenceNumber(firstUID),
+			imapc.SequenceStar),
+	}
+
+	rs, err := s.Client.SendCommandFetch(set, items)
+	if err != nil {
+		return err
+	}
+
+	msgs := []*MessageState{}
+
+	for _, msg := range rs.Messages {
+		// "n:*" matches the last message even if its UID is lower
+		// than n.
+		if msg.UID < firstUID {
+			continue
+		}
+
+		msgs = append(msgs, newMessageState(msg))
+	}
+
+	return s.Store.PutMessages(mailbox, msgs)
+}
+
+func (s *Syncer) applyQResyncDelta(mailbox string, rs *imapc.ResponseSetSelect) error {
+	locals, err := s.Store.Messages(mailbox)
+	if err != nil {
+		return err
+	}
+
+	deleted := []uint32{}
+	for _, msg := range locals {
+		if rs.Vanished.Contains(msg.UID, 0) {
+			deleted = append(deleted, msg.UID)
+		}
+	}
+
+	if err := s.Store.DeleteMessages(mailbox, deleted); err != nil {
+		return err
+	}
+
+	return s.updateMessages(mailbox, locals, rs.Changed)
+}
+
+func (s *Syncer) syncChangedMessages(mailbox string, modSeq uint64) error {
+	locals, err := s.Store.Messages(mailbox)
+	if err != nil {
+		return err
+	}
+
+	// CONDSTORE does not tell us which messages were expunged, so we
+	// have to compare the list of UIDs.
+	srs, err := s.Client.SendCommandSearch("", imapc.SearchKeyAll())
+	if err != nil {
+		return err
+	}
+
+	deleted := []uint32{}
+	for _, msg := range locals {
+		if !srs.MessageIds.Contains(msg.UID, 0) {
+			deleted = append(deleted, msg.UID)
+		}
+	}
+
+	if err := s.Store.DeleteMessages(mailbox, deleted); err != nil {
+		return err
+	}
+
+	set := imapc.SequenceSet{
+		imapc.NewSequenceRange(1, imapc.SequenceStar),
+	}
+	items := []string{"UID", "FLAGS"}
+
+	frs, err := s.Client.SendCommandFetchChangedSince(set, items, modSeq)
+	if err != nil {
+		return err
+	}
+
+	return s.updateMessages(mailbox, locals, frs.Messages)
+}
+
+func (s *Syncer) syncAllFlags(mailbox string) error {
+	locals, err := s.Store.Messages(mailbox)
+	if err != nil {
+		return err
+	}
+
+	set := imapc.SequenceSet{
+		imapc.NewSequenceRange(1, imapc.SequenceStar),
+	}
+	items := []string{"UID", "FLAGS"}
+
+	rs, err := s.Client.SendCommandFetch(set, items)
+	if err != nil {
+		return err
+	}
+
+	remote := map[uint32]bool{}
+	for _, msg := range rs.Messages {
+		remote[msg.UID] = true
+	}
+
+	deleted := []uint32{}
+	for _, msg := range locals {
+		if !remote[msg.UID] {
+			deleted = append(deleted, msg.UID)
+		}
+	}
+
+	if err := s.Store.DeleteMessages(mailbox, deleted); err != nil {
+		return err
+	}
+
+	return s.updateMessages(mailbox, locals, rs.Messages)
+}
+
+// updateMessages updates the flags and mod-sequences of known messages.
+// Unknown messages are ignored: they are new messages and will be fetched
+// with all their attributes.
+func (s *Syncer) updateMessages(mailbox string, locals []*MessageState, remotes []*imapc.Message) error {
+	index := map[uint32]*MessageState{}
+	for _, msg := range locals {
+		index[msg.UID] = msg
+	}
+
+	updated := []*MessageState{}
+
+	for _, remote := range remotes {
+		local, found := index[remote.UID]
+		if !found {
+			continue
+		}
+
+		flags := sessionlessFlags(remote.Flags)
+
+		if !equalFlags(local.Flags, flags) ||
+			(remote.ModSeq != 0 && local.ModSeq != remote.ModSeq) {
+			local.Flags = flags
+			if remote.ModSeq != 0 {
+				local.ModSeq = remote.ModSeq
+			}
+
+			updated = append(updated, local)
+		}
+	}
+
+	if len(updated) == 0 {
+		return nil
+	}
+
+	return s.Store.PutMessages(mailbox, updated)
+}
+
+func (s *Syncer) deleteAllMessages(mailbox string) error {
+	locals, err := s.Store.Messages(mailbox)
+	if err != nil {
+		return err
+	}
+
+	return s.Store.DeleteMessages(mailbox, messageUIDs(locals))
+}
+
+func (s *Syncer) fetchMissingBodies(mailbox string) error {
+	locals, err := s.Store.Messages(mailbox)
+	if err != nil {
+		return err
+	}
+
+	uids := []uint32{}
+	for _, msg := range locals {
+		found, err := s.Store.HasBody(mailbox, msg.UID)
+		if err != nil {
+			return err
+		} else if !found {
+			uids = append(uids, msg.UID)
+		}
+	}
+
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(uids)
+	}
+
+	for len(uids) > 0 {
+		n := batchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+
+		set := imapc.NewSequenceSetFromNumbers(uids[:n])
+		items := []string{"UID", "BODY.PEEK[]"}
+
+		rs, err := s.Client.SendCommandFetch(set, items)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range rs.Messages {
+			data := msg.Section("BODY.PEEK[]")
+			if data == nil {
+				continue
+			}
+
+			if err := s.Store.PutBody(mailbox, msg.UID, data); err != nil {
+				return err
+			}
+		}
+
+		uids = uids[n:]
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Local changes
+// ---------------------------------------------------------------------------
+func (s *Syncer) AddFlags(mailbox string, uids []uint32, flags []string) error {
+	err := s.updateLocalFlags(mailbox, uids, func(msg *MessageState) {
+		msg.Flags = mergeFlags(msg.Flags, flags, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.queueChange(&Change{
+		Type:    ChangeTypeAddFlags,
+		Mailbox: mailbox,
+		UIDs:    uids,
+		Flags:   flags,
+	})
+}
+
+func (s *Syncer) RemoveFlags(mailbox string, uids []uint32, flags []string) error {
+	err := s.updateLocalFlags(mailbox, uids, func(msg *MessageState) {
+		msg.Flags = mergeFlags(msg.Flags, nil, flags)
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.queueChange(&Change{
+		Type:    ChangeTypeRemoveFlags,
+		Mailbox: mailbox,
+		UIDs:    uids,
+		Flags:   flags,
+	})
+}
+
+// Move removes messages from the local mailbox; they will appear in the
+// destination mailbox once it is synchronized.
+func (s *Syncer) Move(mailbox string, uids []uint32, destination string) error {
+	if err := s.Store.DeleteMessages(mailbox, uids); err != nil {
+		return err
+	}
+
+	return s.queueChange(&Change{
+		Type:        ChangeTypeMove,
+		Mailbox:     mailbox,
+		UIDs:        uids,
+		Destination: destination,
+	})
+}
+
+func (s *Syncer) Delete(mailbox string, uids []uint32) error {
+	if err := s.Store.DeleteMessages(mailbox, uids); err != nil {
+		return err
+	}
+
+	return s.queueChange(&Change{
+		Type:    ChangeTypeDelete,
+		Mailbox: mailbox,
+		UIDs:    uids,
+	})
+}
+
+// queueChange records the UIDVALIDITY value of the mailbox in the change and
+// queues it.
+func (s *Syncer) queueChange(change *Change) error {
+	mbox, err := s.Store.Mailbox(change.Mailbox)
+	if err != nil {
+		return err
+	} else if mbox == nil {
+		return fmt.Errorf("unknown mailbox %q", change.Mailbox)
+	}
+
+	change.UIDValidity = mbox.UIDValidity
+
+	return s.Store.QueueChange(change)
+}
+
+func (s *Syncer) updateLocalFlags(mailbox string, uids []uint32, fn func(*MessageState)) error {
+	locals, err := s.Store.Messages(mailbox)
+	if err != nil {
+		return err
+	}
+
+	selected := map[uint32]bool{}
+	for _, uid := range uids {
+		selected[uid] = true
+	}
+
+	msgs := []*MessageState{}
+	for _, msg := range locals {
+		if selected[msg.UID] {
+			fn(msg)
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return s.Store.PutMessages(mailbox, msgs)
+}
+
+// ReplayChanges sends queued local changes to the server. Changes are
+// removed from the store once they have been applied, so replaying can be
+// interrupted and resumed. Changes queued before the UIDVALIDITY value of
+// their mailbox changed are dropped, and so are changes rejected by the
+// server, e.g. because their mailbox was deleted or renamed: they would be
+// rejected again on every replay.
+func (s *Syncer) ReplayChanges() error {
+	changes, err := s.Store.Changes()
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if err := s.replayChange(change); err != nil {
+			var statusErr *imapc.StatusError
+			if !errors.As(err, &statusErr) {
+				return fmt.Errorf("cannot replay change %d: %v",
+					change.Id, err)
+			}
+
+			if s.Logger != nil {
+				s.Logger.Warn("dropping change rejected by the "+
+					"server", "id", change.Id,
+					"mailbox", change.Mailbox, "error", err)
+			}
+		}
+
+		if err := s.Store.DeleteChange(change.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Syncer) replayChange(change *Change) error {
+	if len(change.UIDs) == 0 {
+		return nil
+	}
+
+	if s.selected != change.Mailbox {
+		// A failed SELECT closes the mailbox selected before
+		s.selected = ""
+
+		rs, err := s.Client.SendCommandSelect(change.Mailbox)
+		if err != nil {
+			return err
+		}
+
+		s.selected = change.Mailbox
+		s.selectedUIDValidity = rs.UIDValidity
+	}
+
+	// The mailbox was recreated or renumbered since the change was
+	// queued; applying it would affect unrelated messages.
+	if change.UIDValidity != s.selectedUIDValidity {
+		return nil
+	}
+
+	set := imapc.NewSequenceSetFromNumbers(change.UIDs)
+
+	switch change.Type {
+	case ChangeTypeAddFlags:
+		_, err := s.Client.SendCommandStore(set, imapc.StoreModeAdd,
+			change.Flags)
+		return err
+
+	case ChangeTypeRemoveFlags:
+		_, err := s.Client.SendCommandStore(set, imapc.StoreModeRemove,
+			change.Flags)
+		return err
+
+	case ChangeTypeMove:
+		return s.Client.SendCommandMove(set, change.Destination)
+
+	case ChangeTypeDelete:
+		return s.Client.SendCommandDeleteMessages(set)
+
+	default:
+		return fmt.Errorf("unknown change type %q", change.Type)
+	}
+}
+
+// ---------------------------------------------------------------------------
+//  Utils
+// ---------------------------------------------------------------------------
+func newMessageState(msg *imapc.Message) *MessageState {
+	return &MessageState{
+		UID:          msg.UID,
+		Flags:        sessionlessFlags(msg.Flags),
+		InternalDate: msg.InternalDate,
+		Size:         msg.Size,
+		ModSeq:       msg.ModSeq,
+	}
+}
+
+func messageUIDs(msgs []*MessageState) []uint32 {
+	uids := make([]uint32, len(msgs))
+	for i, msg := range msgs {
+		uids[i] = msg.UID
+	}
+
+	return uids
+}
+
+// sessionlessFlags removes \Recent, which only makes sense for the current
+// session.
+func sessionlessFlags(flags []string) []string {
+	return mergeFlags(nil, flags, []string{imapc.MessageFlagRecent})
+}
+
+func mergeFlags(flags, added, removed []string) []string {
+	set := map[string]bool{}
+	for _, flag := range flags {
+		set[flag] = true
+	}
+
+	for _, flag := range added {
+		set[flag] = true
+	}
+
+	for _, flag := range removed {
+		delete(set, flag)
+	}
+
+	result := make([]string, 0, len(set))
+	for flag := range set {
+		result = append(result, flag)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func equalFlags(flags1, flags2 []string) bool {
+	flags1 = mergeFlags(nil, flags1, nil)
+	flags2 = mergeFlags(nil, flags2, nil)
+
+	if len(flags1) != len(flags2) {
+		return false
+	}
+
+	for i := range flags1 {
+		if flags1[i] != flags2[i] {
+			return false
+		}
+	}
+
+	return true
+}
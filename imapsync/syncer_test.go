@@ -0,0 +1,460 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapsync
+
+import (
+	"bytes"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/go-imapc"
+	"github.com/galdor/go-imapc/imaptest"
+)
+
+const testMessage = "From: bob@example.com\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: %s\r\n" +
+	"\r\n" +
+	"Hello.\r\n"
+
+func newTestServer(t *testing.T, caps ...string) *imaptest.Server {
+	srv := imaptest.NewServer()
+	srv.Caps = append(srv.Caps, caps...)
+	srv.AddUser("alice", "secret")
+
+	inbox := srv.Mailbox("INBOX")
+	date := time.Date(2016, 10, 4, 12, 30, 0, 0, time.UTC)
+
+	inbox.Append(testMessageData("foo"), []string{"\\Seen"}, date)
+	inbox.Append(testMessageData("bar"), nil, date)
+	inbox.Append(testMessageData("baz"), nil, date)
+
+	srv.AddMailbox("Archive")
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+
+	return srv
+}
+
+func testMessageData(subject string) []byte {
+	return []byte(strings.Replace(testMessage, "%s", subject, -1))
+}
+
+func connectTestClient(t *testing.T, srv *imaptest.Server) *imapc.Client {
+	client := srv.NewClient()
+	client.Login = "alice"
+	client.Password = "secret"
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	return client
+}
+
+type commandCounter struct {
+	counts map[string]int
+}
+
+func (o *commandCounter) CommandStarted(info *imapc.CommandInfo) {
+}
+
+func (o *commandCounter) CommandDone(info *imapc.CommandInfo) {
+	o.counts[info.Name]++
+}
+
+func TestSyncerSync(t *testing.T) {
+	tests := []struct {
+		name     string
+		caps     []string
+		commands map[string]int // expected counts for the second sync
+	}{
+		{
+			name:     "full",
+			commands: map[string]int{"UID SEARCH": 0, "ENABLE": 0},
+		},
+		{
+			name:     "condstore",
+			caps:     []string{"CONDSTORE"},
+			commands: map[string]int{"UID SEARCH": 1, "ENABLE": 0},
+		},
+		{
+			name:     "qresync",
+			caps:     []string{"CONDSTORE", "QRESYNC"},
+			commands: map[string]int{"UID SEARCH": 0, "ENABLE": 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testSyncerSync(t, test.caps, test.commands)
+		})
+	}
+}
+
+func testSyncerSync(t *testing.T, caps []string, commands map[string]int) {
+	srv := newTestServer(t, caps...)
+	defer srv.Close()
+
+	store := NewMemoryStore()
+
+	sync := func() {
+		client := connectTestClient(t, srv)
+		defer client.SendCommandLogout()
+
+		syncer := NewSyncer(client, store)
+		syncer.FetchBodies = true
+
+		if err := syncer.Sync(); err != nil {
+			t.Fatalf("cannot synchronize: %v", err)
+		}
+	}
+
+	sync()
+
+	checkLocalMailbox(t, store, "INBOX", map[uint32][]string{
+		1: {"\\Seen"},
+		2: {},
+		3: {},
+	})
+	checkLocalMailbox(t, store, "Archive", map[uint32][]string{})
+
+	body, err := store.Body("INBOX", 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(body) != string(testMessageData("bar")) {
+		t.Errorf("invalid body %q", body)
+	}
+
+	// Modify the account with another client
+	client := connectTestClient(t, srv)
+
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	_, err = client.SendCommandStore(
+		imapc.SequenceSet{imapc.SequenceNumber(1)},
+		imapc.StoreModeAdd, []string{"\\Flagged"})
+	if err != nil {
+		t.Fatalf("cannot store flags: %v", err)
+	}
+
+	err = client.SendCommandDeleteMessages(
+		imapc.SequenceSet{imapc.SequenceNumber(2)})
+	if err != nil {
+		t.Fatalf("cannot delete message: %v", err)
+	}
+
+	_, err = client.SendCommandAppend("INBOX", []string{"\\Draft"},
+		time.Time{}, testMessageData("qux"))
+	if err != nil {
+		t.Fatalf("cannot append message: %v", err)
+	}
+
+	if err := client.SendCommandDelete("Archive"); err != nil {
+		t.Fatalf("cannot delete mailbox: %v", err)
+	}
+
+	client.SendCommandLogout()
+
+	// Synchronize again and check which strategy was used
+	counter := &commandCounter{counts: map[string]int{}}
+
+	func() {
+		client := connectTestClient(t, srv)
+		defer client.SendCommandLogout()
+
+		client.Observer = counter
+
+		syncer := NewSyncer(client, store)
+		syncer.FetchBodies = true
+
+		if err := syncer.Sync(); err != nil {
+			t.Fatalf("cannot synchronize: %v", err)
+		}
+	}()
+
+	for name, count := range commands {
+		if counter.counts[name] != count {
+			t.Errorf("%d %s commands sent instead of %d",
+				counter.counts[name], name, count)
+		}
+	}
+
+	checkLocalMailbox(t, store, "INBOX", map[uint32][]string{
+		1: {"\\Flagged", "\\Seen"},
+		3: {},
+		4: {"\\Draft"},
+	})
+
+	if mbox, err := store.Mailbox("Archive"); err != nil {
+		t.Fatal(err)
+	} else if mbox != nil {
+		t.Errorf("deleted mailbox still stored locally")
+	}
+
+	mbox, err := store.Mailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := srv.Mailbox("INBOX")
+
+	if mbox.UIDNext != remote.UIDNext {
+		t.Errorf("invalid uidnext %d", mbox.UIDNext)
+	}
+
+	if len(caps) > 0 && mbox.HighestModSeq != remote.HighestModSeq {
+		t.Errorf("invalid highest mod-sequence %d", mbox.HighestModSeq)
+	}
+
+	if found, err := store.HasBody("INBOX", 4); err != nil {
+		t.Fatal(err)
+	} else if !found {
+		t.Errorf("body of the new message not fetched")
+	}
+}
+
+func TestSyncerReplayChanges(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	store := NewMemoryStore()
+	syncer := NewSyncer(client, store)
+
+	if err := syncer.Sync(); err != nil {
+		t.Fatalf("cannot synchronize: %v", err)
+	}
+
+	err := syncer.AddFlags("INBOX", []uint32{2}, []string{"\\Flagged"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = syncer.RemoveFlags("INBOX", []uint32{1}, []string{"\\Seen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syncer.Move("INBOX", []uint32{3}, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syncer.Delete("INBOX", []uint32{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Local changes are visible before being sent
+	checkLocalMailbox(t, store, "INBOX", map[uint32][]string{
+		2: {"\\Flagged"},
+	})
+
+	if err := syncer.Sync(); err != nil {
+		t.Fatalf("cannot synchronize: %v", err)
+	}
+
+	if changes, err := store.Changes(); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Errorf("%d changes left after replay", len(changes))
+	}
+
+	checkRemoteMailbox(t, srv, "INBOX", map[uint32][]string{
+		2: {"\\Flagged"},
+	})
+	checkRemoteMailbox(t, srv, "Archive", map[uint32][]string{
+		1: {},
+	})
+
+	checkLocalMailbox(t, store, "INBOX", map[uint32][]string{
+		2: {"\\Flagged"},
+	})
+	checkLocalMailbox(t, store, "Archive", map[uint32][]string{
+		1: {},
+	})
+}
+
+func TestSyncerReplayChangesUIDValidity(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	archive := srv.Mailbox("Archive")
+	archive.Append(testMessageData("foo"), nil, time.Time{})
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	store := NewMemoryStore()
+	syncer := NewSyncer(client, store)
+
+	if err := syncer.Sync(); err != nil {
+		t.Fatalf("cannot synchronize: %v", err)
+	}
+
+	if err := syncer.Delete("Archive", []uint32{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recreate the mailbox: the UID of the new message is the UID of the
+	// message we deleted locally.
+	if err := client.SendCommandDelete("Archive"); err != nil {
+		t.Fatalf("cannot delete mailbox: %v", err)
+	}
+
+	if err := client.SendCommandCreate("Archive"); err != nil {
+		t.Fatalf("cannot create mailbox: %v", err)
+	}
+
+	_, err := client.SendCommandAppend("Archive", nil, time.Time{},
+		testMessageData("bar"))
+	if err != nil {
+		t.Fatalf("cannot append message: %v", err)
+	}
+
+	if err := syncer.Sync(); err != nil {
+		t.Fatalf("cannot synchronize: %v", err)
+	}
+
+	if changes, err := store.Changes(); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Errorf("%d changes left after replay", len(changes))
+	}
+
+	checkRemoteMailbox(t, srv, "Archive", map[uint32][]string{
+		1: {},
+	})
+	checkLocalMailbox(t, store, "Archive", map[uint32][]string{
+		1: {},
+	})
+
+	mbox, err := store.Mailbox("Archive")
+	if err != nil {
+		t.Fatal(err)
+	} else if mbox.UIDValidity != srv.Mailbox("Archive").UIDValidity {
+		t.Errorf("invalid uidvalidity %d", mbox.UIDValidity)
+	}
+}
+
+func checkLocalMailbox(t *testing.T, store Store, name string, expected map[uint32][]string) {
+	t.Helper()
+
+	msgs, err := store.Messages(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := map[uint32][]string{}
+	for _, msg := range msgs {
+		flags[msg.UID] = mergeFlags(nil, msg.Flags, nil)
+	}
+
+	if !reflect.DeepEqual(flags, expected) {
+		t.Errorf("local mailbox %q contains %v instead of %v",
+			name, flags, expected)
+	}
+}
+
+func checkRemoteMailbox(t *testing.T, srv *imaptest.Server, name string, expected map[uint32][]string) {
+	t.Helper()
+
+	flags := map[uint32][]string{}
+	for _, msg := range srv.Mailbox(name).Messages {
+		flags[msg.UID] = mergeFlags(nil, msg.Flags, nil)
+	}
+
+	if !reflect.DeepEqual(flags, expected) {
+		t.Errorf("remote mailbox %q contains %v instead of %v",
+			name, flags, expected)
+	}
+}
+
+func TestSyncerReplayChangesDeletedMailbox(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	archive := srv.Mailbox("Archive")
+	archive.Append(testMessageData("foo"), nil, time.Time{})
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	var buf bytes.Buffer
+
+	store := NewMemoryStore()
+	syncer := NewSyncer(client, store)
+	syncer.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+
+	if err := syncer.Sync(); err != nil {
+		t.Fatalf("cannot synchronize: %v", err)
+	}
+
+	err := syncer.AddFlags("Archive", []uint32{1},
+		[]string{imapc.MessageFlagFlagged})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = syncer.AddFlags("INBOX", []uint32{2},
+		[]string{imapc.MessageFlagFlagged})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.SendCommandDelete("Archive"); err != nil {
+		t.Fatalf("cannot delete mailbox: %v", err)
+	}
+
+	// The change to Archive cannot be applied anymore; it must not
+	// prevent other changes from being replayed and mailboxes from being
+	// synchronized.
+	if err := syncer.Sync(); err != nil {
+		t.Fatalf("cannot synchronize: %v", err)
+	}
+
+	if changes, err := store.Changes(); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Errorf("%d changes left after replay", len(changes))
+	}
+
+	if !strings.Contains(buf.String(), "mailbox=Archive") {
+		t.Errorf("dropped change not logged:\n%s", buf.String())
+	}
+
+	flags := map[uint32][]string{
+		1: {imapc.MessageFlagSeen},
+		2: {imapc.MessageFlagFlagged},
+		3: {},
+	}
+	checkRemoteMailbox(t, srv, "INBOX", flags)
+	checkLocalMailbox(t, store, "INBOX", flags)
+
+	if mbox, err := store.Mailbox("Archive"); err != nil {
+		t.Fatal(err)
+	} else if mbox != nil {
+		t.Errorf("deleted mailbox still present in the store")
+	}
+}
@@ -0,0 +1,1471 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imaptest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/galdor/go-imapc"
+)
+
+type commandHandler struct {
+	fn       func(*Session, *Command) *Status
+	auth     bool // requires the authenticated state
+	selected bool // requires a selected mailbox
+	uid      bool // can be used with the UID prefix
+}
+
+var commandHandlers map[string]commandHandler
+
+func init() {
+	commandHandlers = map[string]commandHandler{
+		"CAPABILITY":   {fn: (*Session).cmdCapability},
+		"NOOP":         {fn: (*Session).cmdNoop},
+		"LOGOUT":       {fn: (*Session).cmdLogout},
+		"LOGIN":        {fn: (*Session).cmdLogin},
+		"AUTHENTICATE": {fn: (*Session).cmdAuthenticate},
+
+		"ENABLE":      {fn: (*Session).cmdEnable, auth: true},
+		"LIST":        {fn: (*Session).cmdList, auth: true},
+		"LSUB":        {fn: (*Session).cmdLSub, auth: true},
+		"STATUS":      {fn: (*Session).cmdStatus, auth: true},
+		"CREATE":      {fn: (*Session).cmdCreate, auth: true},
+		"DELETE":      {fn: (*Session).cmdDelete, auth: true},
+		"RENAME":      {fn: (*Session).cmdRename, auth: true},
+		"SUBSCRIBE":   {fn: (*Session).cmdSubscribe, auth: true},
+		"UNSUBSCRIBE": {fn: (*Session).cmdUnsubscribe, auth: true},
+		"SELECT":      {fn: (*Session).cmdSelect, auth: true},
+		"EXAMINE":     {fn: (*Session).cmdExamine, auth: true},
+		"APPEND":      {fn: (*Session).cmdAppend, auth: true},
+
+		"CLOSE": {fn: (*Session).cmdClose, auth: true,
+			selected: true},
+		"UNSELECT": {fn: (*Session).cmdUnselect, auth: true,
+			selected: true},
+		"EXPUNGE": {fn: (*Session).cmdExpunge, auth: true,
+			selected: true, uid: true},
+		"SEARCH": {fn: (*Session).cmdSearch, auth: true,
+			selected: true, uid: true},
+		"SORT": {fn: (*Session).cmdSort, auth: true,
+			selected: true, uid: true},
+		"THREAD": {fn: (*Session).cmdThread, auth: true,
+			selected: true, uid: true},
+		"FETCH": {fn: (*Session).cmdFetch, auth: true,
+			selected: true, uid: true},
+		"STORE": {fn: (*Session).cmdStore, auth: true,
+			selected: true, uid: true},
+		"COPY": {fn: (*Session).cmdCopy, auth: true,
+			selected: true, uid: true},
+		"MOVE": {fn: (*Session).cmdMove, auth: true,
+			selected: true, uid: true},
+	}
+}
+
+// ---------------------------------------------------------------------------
+//  Any state
+// ---------------------------------------------------------------------------
+func (sess *Session) cmdCapability(cmd *Command) *Status {
+	sess.WriteLine("* CAPABILITY %s", strings.Join(sess.Server.Caps, " "))
+	return nil
+}
+
+func (sess *Session) cmdNoop(cmd *Command) *Status {
+	return nil
+}
+
+func (sess *Session) cmdLogout(cmd *Command) *Status {
+	sess.WriteLine("* BYE logging out")
+	sess.WriteLine("%s OK LOGOUT completed", cmd.Tag)
+
+	sess.Close()
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Not authenticated state
+// ---------------------------------------------------------------------------
+func (sess *Session) cmdLogin(cmd *Command) *Status {
+	if len(cmd.Args) != 2 {
+		return Bad("invalid arguments")
+	}
+
+	return sess.login(cmd.String(0), cmd.String(1))
+}
+
+func (sess *Session) cmdAuthenticate(cmd *Command) *Status {
+	if !strings.EqualFold(cmd.String(0), "PLAIN") ||
+		!sess.Server.HasCap("AUTH=PLAIN") {
+		return No("", "unsupported authentication mechanism")
+	}
+
+	var response string
+
+	if len(cmd.Args) > 1 {
+		// Initial response (RFC 4959)
+		response = cmd.String(1)
+	} else {
+		sess.WriteLine("+ ")
+		if err := sess.w.Flush(); err != nil {
+			sess.Close()
+			return nil
+		}
+
+		line, err := sess.readLine()
+		if err != nil {
+			sess.Close()
+			return nil
+		}
+
+		response = strings.TrimRight(string(line), "\r\n")
+	}
+
+	if response == "*" {
+		return Bad("authentication cancelled")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return Bad("invalid base64 data")
+	}
+
+	// authzid NUL authcid NUL password
+	parts := strings.Split(string(data), "\x00")
+	if len(parts) != 3 {
+		return Bad("invalid credentials")
+	}
+
+	return sess.login(parts[1], parts[2])
+}
+
+func (sess *Session) login(login, password string) *Status {
+	if sess.authenticated {
+		return Bad("already authenticated")
+	}
+
+	users := sess.Server.Users
+	if len(users) > 0 {
+		if expected, found := users[login]; !found || expected != password {
+			return No("AUTHENTICATIONFAILED", "invalid credentials")
+		}
+	}
+
+	sess.authenticated = true
+	sess.Login = login
+
+	caps := strings.Join(sess.Server.Caps, " ")
+	return OK("CAPABILITY "+caps, "authenticated")
+}
+
+// ---------------------------------------------------------------------------
+//  Authenticated state
+// ---------------------------------------------------------------------------
+func (sess *Session) cmdEnable(cmd *Command) *Status {
+	enabled := []string{}
+
+	for i := range cmd.Args {
+		ext := cmd.String(i)
+		if !sess.Server.HasCap(ext) {
+			continue
+		}
+
+		switch strings.ToUpper(ext) {
+		case "IMAP4REV2":
+			sess.rev2 = true
+			sess.utf8 = true
+		case "UTF8=ACCEPT":
+			sess.utf8 = true
+		case "CONDSTORE":
+			sess.condStore = true
+		case "QRESYNC":
+			sess.condStore = true
+			sess.qresync = true
+		default:
+			continue
+		}
+
+		enabled = append(enabled, ext)
+	}
+
+	sess.WriteLine("* ENABLED %s", strings.Join(enabled, " "))
+	return nil
+}
+
+func (sess *Session) cmdList(cmd *Command) *Status {
+	args := cmd.Args
+	subscribedOnly := false
+
+	// Selection options (RFC 5258)
+	if len(args) > 0 {
+		if options, ok := args[0].([]interface{}); ok {
+			for _, option := range options {
+				name, _ := option.([]byte)
+				if strings.EqualFold(string(name), "SUBSCRIBED") {
+					subscribedOnly = true
+				}
+			}
+
+			args = args[1:]
+		}
+	}
+
+	if len(args) < 2 {
+		return Bad("invalid arguments")
+	}
+
+	var statusItems []interface{}
+
+	// Return options (RFC 5258, RFC 5819)
+	if len(args) == 4 {
+		options, _ := args[3].([]interface{})
+		for i, option := range options {
+			name, _ := option.([]byte)
+			if strings.EqualFold(string(name), "STATUS") &&
+				i+1 < len(options) {
+				statusItems, _ = options[i+1].([]interface{})
+			}
+		}
+	}
+
+	return sess.list(args[0], args[1], subscribedOnly, statusItems)
+}
+
+func (sess *Session) cmdLSub(cmd *Command) *Status {
+	if len(cmd.Args) != 2 {
+		return Bad("invalid arguments")
+	}
+
+	return sess.list(cmd.Args[0], cmd.Args[1], true, nil)
+}
+
+func (sess *Session) list(refArg, patternArg interface{}, subscribedOnly bool, statusItems []interface{}) *Status {
+	refData, _ := refArg.([]byte)
+	patternData, _ := patternArg.([]byte)
+
+	ref, err := sess.decodeMailboxName(refData)
+	if err != nil {
+		return Bad("invalid reference")
+	}
+
+	pattern, err := sess.decodeMailboxName(patternData)
+	if err != nil {
+		return Bad("invalid pattern")
+	}
+
+	delimiter := string(sess.Server.HierarchyDelimiter)
+
+	if pattern == "" {
+		sess.WriteLine("* LIST (\\Noselect) %s \"\"",
+			imapc.QuotedStringEncode(delimiter))
+		return nil
+	}
+
+	re := patternRegexp(ref+pattern, sess.Server.HierarchyDelimiter)
+
+	names := []string{}
+	for name := range sess.Server.mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		mbox := sess.Server.mailboxes[name]
+
+		if !re.MatchString(name) {
+			continue
+		}
+
+		if subscribedOnly && !mbox.Subscribed {
+			continue
+		}
+
+		flags := append([]string{}, mbox.Flags...)
+
+		if sess.hasChildren(name) {
+			flags = append(flags, "\\HasChildren")
+		} else {
+			flags = append(flags, "\\HasNoChildren")
+		}
+
+		if subscribedOnly {
+			flags = append(flags, "\\Subscribed")
+		}
+
+		sess.WriteLine("* LIST (%s) %s %s", strings.Join(flags, " "),
+			imapc.QuotedStringEncode(delimiter),
+			sess.encodeMailboxName(name))
+
+		if statusItems != nil {
+			status, err := sess.statusItems(mbox, statusItems)
+			if err != nil {
+				return Bad(err.Error())
+			}
+
+			sess.WriteLine("* STATUS %s %s",
+				sess.encodeMailboxName(name), status)
+		}
+	}
+
+	return nil
+}
+
+func (sess *Session) hasChildren(name string) bool {
+	prefix := name + string(sess.Server.HierarchyDelimiter)
+
+	for child := range sess.Server.mailboxes {
+		if strings.HasPrefix(child, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// patternRegexp converts a LIST pattern to a regular expression: '*' matches
+// any sequence of characters while '%' does not match the hierarchy
+// delimiter.
+func patternRegexp(pattern string, delimiter rune) *regexp.Regexp {
+	var buf bytes.Buffer
+
+	buf.WriteString("^")
+
+	if strings.HasPrefix(strings.ToUpper(pattern), "INBOX") {
+		buf.WriteString("(?i:INBOX)")
+		pattern = pattern[5:]
+	}
+
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			buf.WriteString(".*")
+		case '%':
+			buf.WriteString("[^" + regexp.QuoteMeta(string(delimiter)) +
+				"]*")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	buf.WriteString("$")
+
+	return regexp.MustCompile(buf.String())
+}
+
+func (sess *Session) cmdStatus(cmd *Command) *Status {
+	if len(cmd.Args) != 2 {
+		return Bad("invalid arguments")
+	}
+
+	mbox, status := sess.mailboxArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	statusData, err := sess.statusItems(mbox, cmd.List(1))
+	if err != nil {
+		return Bad(err.Error())
+	}
+
+	sess.WriteLine("* STATUS %s %s", sess.encodeMailboxName(mbox.Name),
+		statusData)
+	return nil
+}
+
+func (sess *Session) statusItems(mbox *Mailbox, items []interface{}) (string, error) {
+	values := []string{}
+
+	for _, item := range items {
+		name, _ := item.([]byte)
+
+		var value uint64
+
+		switch strings.ToUpper(string(name)) {
+		case "MESSAGES":
+			value = uint64(len(mbox.Messages))
+		case "RECENT":
+			value = 0
+		case "UIDNEXT":
+			value = uint64(mbox.UIDNext)
+		case "UIDVALIDITY":
+			value = uint64(mbox.UIDValidity)
+		case "UNSEEN":
+			value = uint64(mbox.unseen())
+		case "DELETED":
+			value = uint64(mbox.deleted())
+		case "SIZE":
+			value = mbox.size()
+		case "HIGHESTMODSEQ":
+			value = mbox.HighestModSeq
+		default:
+			return "", fmt.Errorf("unknown status item %q", name)
+		}
+
+		values = append(values, fmt.Sprintf("%s %d",
+			strings.ToUpper(string(name)), value))
+	}
+
+	return "(" + strings.Join(values, " ") + ")", nil
+}
+
+func (sess *Session) cmdCreate(cmd *Command) *Status {
+	if len(cmd.Args) != 1 {
+		return Bad("invalid arguments")
+	}
+
+	name, status := sess.mailboxNameArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	name = strings.TrimSuffix(name, string(sess.Server.HierarchyDelimiter))
+
+	if sess.Server.mailbox(name) != nil {
+		return No("ALREADYEXISTS", "mailbox already exists")
+	}
+
+	sess.Server.createMailbox(name, nil)
+	return nil
+}
+
+func (sess *Session) cmdDelete(cmd *Command) *Status {
+	if len(cmd.Args) != 1 {
+		return Bad("invalid arguments")
+	}
+
+	mbox, status := sess.mailboxArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	if mbox.Name == "INBOX" {
+		return No("CANNOT", "INBOX cannot be deleted")
+	}
+
+	if sess.mailbox == mbox {
+		sess.mailbox = nil
+	}
+
+	delete(sess.Server.mailboxes, mbox.Name)
+	return nil
+}
+
+func (sess *Session) cmdRename(cmd *Command) *Status {
+	if len(cmd.Args) != 2 {
+		return Bad("invalid arguments")
+	}
+
+	mbox, status := sess.mailboxArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	newName, status := sess.mailboxNameArg(cmd, 1)
+	if status != nil {
+		return status
+	}
+
+	if mbox.Name == "INBOX" {
+		return No("CANNOT", "INBOX cannot be renamed")
+	}
+
+	if sess.Server.mailbox(newName) != nil {
+		return No("ALREADYEXISTS", "mailbox already exists")
+	}
+
+	// Children are renamed with their parent
+	prefix := mbox.Name + string(sess.Server.HierarchyDelimiter)
+
+	for name, child := range sess.Server.mailboxes {
+		if strings.HasPrefix(name, prefix) {
+			delete(sess.Server.mailboxes, name)
+			child.Name = newName + name[len(mbox.Name):]
+			sess.Server.mailboxes[child.Name] = child
+		}
+	}
+
+	delete(sess.Server.mailboxes, mbox.Name)
+	mbox.Name = newName
+	sess.Server.mailboxes[newName] = mbox
+
+	return nil
+}
+
+func (sess *Session) cmdSubscribe(cmd *Command) *Status {
+	if len(cmd.Args) != 1 {
+		return Bad("invalid arguments")
+	}
+
+	mbox, status := sess.mailboxArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	mbox.Subscribed = true
+	return nil
+}
+
+func (sess *Session) cmdUnsubscribe(cmd *Command) *Status {
+	if len(cmd.Args) != 1 {
+		return Bad("invalid arguments")
+	}
+
+	mbox, status := sess.mailboxArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	mbox.Subscribed = false
+	return nil
+}
+
+func (sess *Session) cmdSelect(cmd *Command) *Status {
+	return sess.selectMailbox(cmd, false)
+}
+
+func (sess *Session) cmdExamine(cmd *Command) *Status {
+	return sess.selectMailbox(cmd, true)
+}
+
+func (sess *Session) selectMailbox(cmd *Command, readOnly bool) *Status {
+	if len(cmd.Args) < 1 {
+		return Bad("invalid arguments")
+	}
+
+	// Selecting a mailbox deselects the current one, even if the command
+	// fails.
+	sess.mailbox = nil
+	sess.searchResult = nil
+
+	mbox, status := sess.mailboxArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	// CONDSTORE and QRESYNC parameters (RFC 7162)
+	var qresync []interface{}
+
+	if len(cmd.Args) > 1 {
+		params := cmd.List(1)
+
+		for i := 0; i < len(params); i++ {
+			name, _ := params[i].([]byte)
+
+			switch strings.ToUpper(string(name)) {
+			case "CONDSTORE":
+				sess.condStore = true
+
+			case "QRESYNC":
+				if !sess.qresync {
+					return Bad("QRESYNC not enabled")
+				}
+
+				if i+1 < len(params) {
+					qresync, _ = params[i+1].([]interface{})
+					i++
+				}
+
+				if len(qresync) < 2 {
+					return Bad("invalid QRESYNC parameters")
+				}
+
+			default:
+				return Bad("invalid select parameter")
+			}
+		}
+	}
+
+	sess.mailbox = mbox
+	sess.readOnly = readOnly
+
+	flags := "\\Answered \\Flagged \\Deleted \\Seen \\Draft"
+
+	sess.WriteLine("* FLAGS (%s)", flags)
+	sess.WriteLine("* %d EXISTS", len(mbox.Messages))
+	if !sess.rev2 {
+		sess.WriteLine("* 0 RECENT")
+	}
+	sess.WriteLine("* OK [UIDVALIDITY %d] UIDs valid", mbox.UIDValidity)
+	sess.WriteLine("* OK [UIDNEXT %d] predicted next UID", mbox.UIDNext)
+
+	if sess.Server.HasCap("CONDSTORE") {
+		sess.WriteLine("* OK [HIGHESTMODSEQ %d] highest mod-sequence",
+			mbox.HighestModSeq)
+	}
+
+	if qresync != nil {
+		if status := sess.resync(qresync); status != nil {
+			return status
+		}
+	}
+
+	if !sess.rev2 {
+		for i, msg := range mbox.Messages {
+			if !msg.HasFlag("\\Seen") {
+				sess.WriteLine("* OK [UNSEEN %d] first unseen "+
+					"message", i+1)
+				break
+			}
+		}
+	}
+
+	if readOnly {
+		sess.WriteLine("* OK [PERMANENTFLAGS ()] read-only mailbox")
+		return OK("READ-ONLY", cmd.Name+" completed")
+	}
+
+	sess.WriteLine("* OK [PERMANENTFLAGS (%s \\*)] flags permitted", flags)
+	return OK("READ-WRITE", cmd.Name+" completed")
+}
+
+// resync reports the changes which occurred in the selected mailbox since
+// the mod-sequence of the QRESYNC parameters, i.e. the UIDs of the messages
+// expunged and the flags of the messages modified (RFC 7162 3.2.5.).
+func (sess *Session) resync(params []interface{}) *Status {
+	mbox := sess.mailbox
+
+	uidValidity, _ := params[0].([]byte)
+	modSeqData, _ := params[1].([]byte)
+
+	modSeq, err := strconv.ParseUint(string(modSeqData), 10, 64)
+	if err != nil {
+		return Bad("invalid QRESYNC mod-sequence")
+	}
+
+	// Nothing can be reported if UIDs changed
+	if string(uidValidity) != strconv.FormatUint(uint64(mbox.UIDValidity), 10) {
+		return nil
+	}
+
+	var knownUIDs imapc.SequenceSet
+
+	if len(params) > 2 {
+		data, _ := params[2].([]byte)
+
+		knownUIDs, err = imapc.ParseSequenceSet(string(data))
+		if err != nil {
+			return Bad("invalid QRESYNC known uids")
+		}
+	}
+
+	if uids := mbox.vanished(knownUIDs, modSeq); len(uids) > 0 {
+		sess.WriteLine("* VANISHED (EARLIER) %s",
+			imapc.NewSequenceSetFromNumbers(uids))
+	}
+
+	for i, msg := range mbox.Messages {
+		if msg.ModSeq > modSeq {
+			flagsValue, _, _ := fetchItem(msg, "FLAGS")
+			sess.WriteLine("* %d FETCH (UID %d %s MODSEQ (%d))", i+1,
+				msg.UID, flagsValue, msg.ModSeq)
+		}
+	}
+
+	return nil
+}
+
+func (sess *Session) cmdAppend(cmd *Command) *Status {
+	if len(cmd.Args) < 2 {
+		return Bad("invalid arguments")
+	}
+
+	name, status := sess.mailboxNameArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	var flags []string
+	var date time.Time
+
+	for _, arg := range cmd.Args[1 : len(cmd.Args)-1] {
+		switch targ := arg.(type) {
+		case []interface{}:
+			flags = stringList(targ)
+
+		case []byte:
+			var err error
+			date, err = time.Parse(imapc.IMAPDateTimeFormat,
+				string(targ))
+			if err != nil {
+				return Bad("invalid date")
+			}
+		}
+	}
+
+	data, ok := cmd.Args[len(cmd.Args)-1].([]byte)
+	if !ok {
+		return Bad("invalid message")
+	}
+
+	mbox := sess.Server.mailbox(name)
+	if mbox == nil {
+		return No("TRYCREATE", "mailbox does not exist")
+	}
+
+	msg := mbox.Append(append([]byte{}, data...), flags, date)
+
+	if sess.Server.HasCap("UIDPLUS") {
+		code := fmt.Sprintf("APPENDUID %d %d", mbox.UIDValidity, msg.UID)
+		return OK(code, "APPEND completed")
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Selected state
+// ---------------------------------------------------------------------------
+func (sess *Session) cmdClose(cmd *Command) *Status {
+	if !sess.readOnly {
+		sess.expunge(nil, false)
+	}
+
+	sess.mailbox = nil
+	return nil
+}
+
+func (sess *Session) cmdUnselect(cmd *Command) *Status {
+	sess.mailbox = nil
+	return nil
+}
+
+func (sess *Session) cmdExpunge(cmd *Command) *Status {
+	if sess.readOnly {
+		return No("READ-ONLY", "mailbox is read-only")
+	}
+
+	var set imapc.SequenceSet
+
+	if cmd.UID {
+		if !sess.Server.HasCap("UIDPLUS") {
+			return Bad("UID EXPUNGE not supported")
+		}
+
+		var err error
+		set, err = imapc.ParseSequenceSet(cmd.String(0))
+		if err != nil {
+			return Bad(err.Error())
+		}
+	}
+
+	sess.expunge(set, true)
+	return nil
+}
+
+// expunge removes messages flagged as deleted, restricted to the UIDs of set
+// if it is not nil.
+func (sess *Session) expunge(set imapc.SequenceSet, notify bool) {
+	maxUID := sess.mailbox.maxUID()
+
+	sess.removeMessages(func(i int, msg *Message) bool {
+		return msg.HasFlag("\\Deleted") &&
+			(set == nil || set.Contains(msg.UID, maxUID))
+	}, notify)
+}
+
+// removeMessages removes the messages of the selected mailbox for which fn
+// returns true. If notify is true, the client is sent EXPUNGE responses, or
+// a VANISHED response if QRESYNC is enabled.
+func (sess *Session) removeMessages(fn func(int, *Message) bool, notify bool) {
+	mbox := sess.mailbox
+
+	kept := []*Message{}
+	removed := []uint32{}
+
+	for i, msg := range mbox.Messages {
+		if !fn(i, msg) {
+			kept = append(kept, msg)
+			continue
+		}
+
+		if notify && !sess.qresync {
+			sess.WriteLine("* %d EXPUNGE", i+1-len(removed))
+		}
+
+		removed = append(removed, msg.UID)
+
+		mbox.expunged = append(mbox.expunged, expungedMessage{
+			uid:    msg.UID,
+			modSeq: mbox.nextModSeq(),
+		})
+	}
+
+	mbox.Messages = kept
+
+	if notify && sess.qresync && len(removed) > 0 {
+		sess.WriteLine("* VANISHED %s",
+			imapc.NewSequenceSetFromNumbers(removed))
+	}
+}
+
+func (sess *Session) cmdSearch(cmd *Command) *Status {
+	args := cmd.Args
+
+	// ESEARCH (RFC 4731)
+	var options []string
+
+	if len(args) >= 2 && strings.EqualFold(cmd.String(0), "RETURN") {
+		list, ok := args[1].([]interface{})
+		if !ok {
+			return Bad("invalid search return options")
+		}
+
+		options = []string{}
+		for _, option := range stringList(list) {
+			option = strings.ToUpper(option)
+
+			switch option {
+			case "MIN", "MAX", "COUNT", "ALL", "SAVE":
+				options = append(options, option)
+			default:
+				return Bad("unknown search return option")
+			}
+		}
+
+		if len(options) == 0 {
+			options = append(options, "ALL")
+		}
+
+		args = args[2:]
+	} else if sess.rev2 {
+		options = []string{"ALL"}
+	}
+
+	hasOption := func(option string) bool {
+		for _, o := range options {
+			if o == option {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	save := hasOption("SAVE")
+	if save {
+		// A failed search resets the saved result (RFC 5182 2.1.)
+		sess.searchResult = nil
+	}
+
+	if len(args) >= 2 && strings.EqualFold(cmd.String(0), "CHARSET") {
+		var status *Status
+		args, status = sess.decodeSearchArgs(cmd.String(1), args[2:])
+		if status != nil {
+			return status
+		}
+	}
+
+	match, err := sess.parseSearchKeys(args)
+	if err != nil {
+		return Bad(err.Error())
+	}
+
+	ids := []uint32{}
+	uids := []uint32{}
+
+	for i, msg := range sess.mailbox.Messages {
+		seq := uint32(i + 1)
+
+		if match(seq, msg) {
+			if cmd.UID {
+				ids = append(ids, msg.UID)
+			} else {
+				ids = append(ids, seq)
+			}
+
+			uids = append(uids, msg.UID)
+		}
+	}
+
+	if save {
+		// When combined with MIN and/or MAX only, SAVE only keeps the
+		// corresponding messages (RFC 5182 2.1.)
+		if len(uids) > 0 && !hasOption("ALL") && !hasOption("COUNT") &&
+			(hasOption("MIN") || hasOption("MAX")) {
+			saved := []uint32{}
+			if hasOption("MIN") {
+				saved = append(saved, uids[0])
+			}
+			if hasOption("MAX") && len(uids) > 1 {
+				saved = append(saved, uids[len(uids)-1])
+			}
+
+			uids = saved
+		}
+
+		sess.searchResult = uids
+
+		// No ESEARCH response is sent if SAVE is the only option
+		if len(options) == 1 {
+			return nil
+		}
+	}
+
+	if options != nil {
+		line := fmt.Sprintf("* ESEARCH (TAG %s)",
+			imapc.QuotedStringEncode(cmd.Tag))
+		if cmd.UID {
+			line += " UID"
+		}
+		if len(ids) > 0 && hasOption("MIN") {
+			line += fmt.Sprintf(" MIN %d", ids[0])
+		}
+		if len(ids) > 0 && hasOption("MAX") {
+			line += fmt.Sprintf(" MAX %d", ids[len(ids)-1])
+		}
+		if hasOption("COUNT") {
+			line += fmt.Sprintf(" COUNT %d", len(ids))
+		}
+		if len(ids) > 0 && hasOption("ALL") {
+			set, _ := imapc.NewSequenceSetFromNumbers(ids).MarshalText()
+			line += " ALL " + string(set)
+		}
+
+		sess.WriteLine("%s", line)
+		return nil
+	}
+
+	if len(ids) == 0 {
+		sess.WriteLine("* SEARCH")
+	} else {
+		sess.WriteLine("* SEARCH %s", joinNumbers(ids, " "))
+	}
+
+	return nil
+}
+
+func (sess *Session) cmdFetch(cmd *Command) *Status {
+	if len(cmd.Args) < 2 {
+		return Bad("invalid arguments")
+	}
+
+	indexes, status := sess.messageArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	var items []string
+	if list := cmd.List(1); list != nil {
+		items = stringList(list)
+	} else {
+		items = expandFetchMacro(cmd.String(1))
+	}
+
+	if cmd.UID && !containsFold(items, "UID") {
+		items = append([]string{"UID"}, items...)
+	}
+
+	// CHANGEDSINCE and VANISHED modifiers (RFC 7162)
+	var changedSince uint64
+	vanished := false
+
+	modifiers := cmd.List(2)
+
+	for i := 0; i < len(modifiers); i++ {
+		name, _ := modifiers[i].([]byte)
+
+		switch strings.ToUpper(string(name)) {
+		case "CHANGEDSINCE":
+			if i+1 >= len(modifiers) {
+				return Bad("missing CHANGEDSINCE mod-sequence")
+			}
+
+			data, _ := modifiers[i+1].([]byte)
+			i++
+
+			var err error
+			changedSince, err = strconv.ParseUint(string(data), 10, 64)
+			if err != nil {
+				return Bad("invalid CHANGEDSINCE mod-sequence")
+			}
+
+		case "VANISHED":
+			if !sess.qresync || !cmd.UID {
+				return Bad("VANISHED requires QRESYNC and UID")
+			}
+
+			vanished = true
+
+		default:
+			return Bad("invalid fetch modifier")
+		}
+	}
+
+	if vanished && changedSince == 0 {
+		return Bad("VANISHED requires CHANGEDSINCE")
+	}
+
+	if changedSince > 0 {
+		sess.condStore = true
+
+		if !containsFold(items, "MODSEQ") {
+			items = append(items, "MODSEQ")
+		}
+	}
+
+	for _, item := range items {
+		if !isFetchItemSupported(item) {
+			return Bad("unsupported fetch item " + item)
+		}
+
+		if strings.EqualFold(item, "MODSEQ") {
+			sess.condStore = true
+		}
+	}
+
+	if vanished {
+		set, _ := imapc.ParseSequenceSet(cmd.String(0))
+
+		uids := sess.mailbox.vanished(set, changedSince)
+		if len(uids) > 0 {
+			sess.WriteLine("* VANISHED (EARLIER) %s",
+				imapc.NewSequenceSetFromNumbers(uids))
+		}
+	}
+
+	for _, i := range indexes {
+		msg := sess.mailbox.Messages[i]
+
+		if msg.ModSeq <= changedSince {
+			continue
+		}
+
+		values := []string{}
+		markSeen := false
+
+		for _, item := range items {
+			value, seen, err := fetchItem(msg, item)
+			if err != nil {
+				return Bad(err.Error())
+			}
+
+			values = append(values, value)
+			markSeen = markSeen || seen
+		}
+
+		if markSeen && !sess.readOnly && !msg.HasFlag("\\Seen") {
+			msg.AddFlags([]string{"\\Seen"})
+
+			if !containsFold(items, "FLAGS") {
+				value, _, _ := fetchItem(msg, "FLAGS")
+				values = append(values, value)
+			}
+		}
+
+		sess.WriteLine("* %d FETCH (%s)", i+1, strings.Join(values, " "))
+	}
+
+	return nil
+}
+
+func (sess *Session) cmdStore(cmd *Command) *Status {
+	if sess.readOnly {
+		return No("READ-ONLY", "mailbox is read-only")
+	}
+
+	indexes, status := sess.messageArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	args := cmd.Args[1:]
+
+	// UNCHANGEDSINCE modifier (RFC 7162)
+	unchangedSince := uint64(math.MaxUint64)
+
+	if len(args) > 0 {
+		if modifiers, ok := args[0].([]interface{}); ok {
+			if len(modifiers) != 2 {
+				return Bad("invalid store modifier")
+			}
+
+			name, _ := modifiers[0].([]byte)
+			if !strings.EqualFold(string(name), "UNCHANGEDSINCE") {
+				return Bad("invalid store modifier")
+			}
+
+			data, _ := modifiers[1].([]byte)
+
+			var err error
+			unchangedSince, err = strconv.ParseUint(string(data), 10, 64)
+			if err != nil {
+				return Bad("invalid UNCHANGEDSINCE mod-sequence")
+			}
+
+			sess.condStore = true
+			args = args[1:]
+		}
+	}
+
+	if len(args) < 1 {
+		return Bad("invalid arguments")
+	}
+
+	item, _ := args[0].([]byte)
+	mode := strings.ToUpper(string(item))
+
+	silent := strings.HasSuffix(mode, ".SILENT")
+	mode = strings.TrimSuffix(mode, ".SILENT")
+
+	var flags []string
+	if len(args) == 2 {
+		if list, ok := args[1].([]interface{}); ok {
+			flags = stringList(list)
+		} else {
+			flags = stringList(args[1:])
+		}
+	} else {
+		flags = stringList(args[1:])
+	}
+
+	modified := []uint32{}
+
+	for _, i := range indexes {
+		msg := sess.mailbox.Messages[i]
+
+		if msg.ModSeq > unchangedSince {
+			if cmd.UID {
+				modified = append(modified, msg.UID)
+			} else {
+				modified = append(modified, uint32(i+1))
+			}
+
+			continue
+		}
+
+		oldFlags := strings.Join(msg.Flags, " ")
+
+		switch mode {
+		case "FLAGS":
+			msg.SetFlags(flags)
+		case "+FLAGS":
+			msg.AddFlags(flags)
+		case "-FLAGS":
+			msg.RemoveFlags(flags)
+		default:
+			return Bad("invalid store item")
+		}
+
+		if strings.Join(msg.Flags, " ") != oldFlags {
+			msg.ModSeq = sess.mailbox.nextModSeq()
+		}
+
+		if silent && !sess.condStore {
+			continue
+		}
+
+		values := []string{}
+
+		if cmd.UID {
+			values = append(values, fmt.Sprintf("UID %d", msg.UID))
+		}
+
+		if !silent {
+			flagsValue, _, _ := fetchItem(msg, "FLAGS")
+			values = append(values, flagsValue)
+		}
+
+		if sess.condStore {
+			values = append(values, fmt.Sprintf("MODSEQ (%d)",
+				msg.ModSeq))
+		}
+
+		sess.WriteLine("* %d FETCH (%s)", i+1, strings.Join(values, " "))
+	}
+
+	if len(modified) > 0 {
+		set := imapc.NewSequenceSetFromNumbers(modified)
+		return OK("MODIFIED "+set.String(), "conditional STORE failed")
+	}
+
+	return nil
+}
+
+func (sess *Session) cmdCopy(cmd *Command) *Status {
+	code, status := sess.copyMessages(cmd)
+	if status != nil {
+		return status
+	}
+
+	return OK(code, "COPY completed")
+}
+
+func (sess *Session) cmdMove(cmd *Command) *Status {
+	if !sess.Server.HasCap("MOVE") {
+		return Bad("unknown command MOVE")
+	}
+
+	if sess.readOnly {
+		return No("READ-ONLY", "mailbox is read-only")
+	}
+
+	indexes, status := sess.messageArg(cmd, 0)
+	if status != nil {
+		return status
+	}
+
+	code, status := sess.copyMessages(cmd)
+	if status != nil {
+		return status
+	}
+
+	if code != "" {
+		sess.WriteLine("* OK [%s] moved", code)
+	}
+
+	moved := map[int]bool{}
+	for _, i := range indexes {
+		moved[i] = true
+	}
+
+	sess.removeMessages(func(i int, msg *Message) bool {
+		return moved[i]
+	}, true)
+
+	return nil
+}
+
+// copyMessages copies messages to the mailbox in the second argument and
+// returns the COPYUID response code (RFC 4315) if UIDPLUS is supported.
+func (sess *Session) copyMessages(cmd *Command) (string, *Status) {
+	if len(cmd.Args) != 2 {
+		return "", Bad("invalid arguments")
+	}
+
+	indexes, status := sess.messageArg(cmd, 0)
+	if status != nil {
+		return "", status
+	}
+
+	name, status := sess.mailboxNameArg(cmd, 1)
+	if status != nil {
+		return "", status
+	}
+
+	dst := sess.Server.mailbox(name)
+	if dst == nil {
+		return "", No("TRYCREATE", "mailbox does not exist")
+	}
+
+	srcUIDs := []uint32{}
+	dstUIDs := []uint32{}
+
+	for _, i := range indexes {
+		msg := sess.mailbox.Messages[i]
+
+		flags := append([]string{}, msg.Flags...)
+		dstMsg := dst.Append(msg.Data, flags, msg.InternalDate)
+
+		srcUIDs = append(srcUIDs, msg.UID)
+		dstUIDs = append(dstUIDs, dstMsg.UID)
+	}
+
+	if !sess.Server.HasCap("UIDPLUS") || len(srcUIDs) == 0 {
+		return "", nil
+	}
+
+	code := fmt.Sprintf("COPYUID %d %s %s", dst.UIDValidity,
+		joinNumbers(srcUIDs, ","), joinNumbers(dstUIDs, ","))
+
+	return code, nil
+}
+
+// ---------------------------------------------------------------------------
+//  Utils
+// ---------------------------------------------------------------------------
+func (sess *Session) mailboxNameArg(cmd *Command, i int) (string, *Status) {
+	if i >= len(cmd.Args) {
+		return "", Bad("missing mailbox name")
+	}
+
+	data, ok := cmd.Args[i].([]byte)
+	if !ok {
+		return "", Bad("invalid mailbox name")
+	}
+
+	name, err := sess.decodeMailboxName(data)
+	if err != nil {
+		return "", Bad("invalid mailbox name")
+	}
+
+	return name, nil
+}
+
+func (sess *Session) mailboxArg(cmd *Command, i int) (*Mailbox, *Status) {
+	name, status := sess.mailboxNameArg(cmd, i)
+	if status != nil {
+		return nil, status
+	}
+
+	mbox := sess.Server.mailbox(name)
+	if mbox == nil {
+		return nil, No("NONEXISTENT", "mailbox does not exist")
+	}
+
+	return mbox, nil
+}
+
+// messageArg returns the indexes of the messages matching the sequence set
+// at position i; the set contains UIDs for UID commands.
+func (sess *Session) messageArg(cmd *Command, i int) ([]int, *Status) {
+	set, err := imapc.ParseSequenceSet(cmd.String(i))
+	if err != nil {
+		return nil, Bad(err.Error())
+	}
+
+	set = sess.resolveSearchResult(set, cmd.UID)
+
+	mbox := sess.mailbox
+	indexes := []int{}
+
+	for i, msg := range mbox.Messages {
+		if cmd.UID {
+			if set.Contains(msg.UID, mbox.maxUID()) {
+				indexes = append(indexes, i)
+			}
+		} else {
+			if set.Contains(uint32(i+1), uint32(len(mbox.Messages))) {
+				indexes = append(indexes, i)
+			}
+		}
+	}
+
+	if !cmd.UID {
+		// Sequence numbers must be valid (RFC 3501 9.)
+		n := uint32(len(mbox.Messages))
+
+		for _, e := range set {
+			numbers := []imapc.SequenceNumber{}
+
+			switch te := e.(type) {
+			case imapc.SequenceNumber:
+				numbers = append(numbers, te)
+			case imapc.SequenceRange:
+				numbers = append(numbers, te.First, te.Last)
+			}
+
+			for _, number := range numbers {
+				if uint32(number) > n {
+					return nil, Bad("invalid sequence number")
+				}
+			}
+		}
+	}
+
+	return indexes, nil
+}
+
+// resolveSearchResult replaces '$' in a sequence set by the saved search
+// result, using either UIDs or sequence numbers.
+func (sess *Session) resolveSearchResult(set imapc.SequenceSet, uid bool) imapc.SequenceSet {
+	if len(set) != 1 {
+		return set
+	}
+
+	if _, ok := set[0].(imapc.SequenceSearchResult); !ok {
+		return set
+	}
+
+	if uid {
+		return imapc.NewSequenceSetFromNumbers(sess.searchResult)
+	}
+
+	seqs := []uint32{}
+
+	for i, msg := range sess.mailbox.Messages {
+		for _, uid := range sess.searchResult {
+			if msg.UID == uid {
+				seqs = append(seqs, uint32(i+1))
+				break
+			}
+		}
+	}
+
+	return imapc.NewSequenceSetFromNumbers(seqs)
+}
+
+// decodeSearchArgs checks that the charset of a search command is supported
+// and converts ISO-8859-1 strings to UTF-8.
+func (sess *Session) decodeSearchArgs(charset string, args []interface{}) ([]interface{}, *Status) {
+	if !containsFold(sess.Server.Charsets, charset) {
+		code := "BADCHARSET (" + strings.Join(sess.Server.Charsets, " ") + ")"
+		return nil, No(code, "unsupported charset")
+	}
+
+	if !strings.EqualFold(charset, "ISO-8859-1") {
+		return args, nil
+	}
+
+	dargs := make([]interface{}, len(args))
+
+	for i, arg := range args {
+		switch targ := arg.(type) {
+		case []byte:
+			data := make([]byte, 0, len(targ))
+			for _, b := range targ {
+				data = utf8.AppendRune(data, rune(b))
+			}
+
+			dargs[i] = data
+
+		case []interface{}:
+			dargs[i], _ = sess.decodeSearchArgs(charset, targ)
+
+		default:
+			dargs[i] = arg
+		}
+	}
+
+	return dargs, nil
+}
+
+func stringList(values []interface{}) []string {
+	strs := []string{}
+
+	for _, value := range values {
+		if data, ok := value.([]byte); ok {
+			strs = append(strs, string(data))
+		}
+	}
+
+	return strs
+}
+
+func containsFold(strs []string, s string) bool {
+	for _, str := range strs {
+		if strings.EqualFold(str, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func joinNumbers(ns []uint32, sep string) string {
+	strs := make([]string, len(ns))
+	for i, n := range ns {
+		strs[i] = strconv.FormatUint(uint64(n), 10)
+	}
+
+	return strings.Join(strs, sep)
+}
@@ -0,0 +1,216 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imaptest
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/go-imapc"
+)
+
+func expandFetchMacro(item string) []string {
+	switch strings.ToUpper(item) {
+	case "ALL":
+		return []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE",
+			"ENVELOPE"}
+	case "FAST":
+		return []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+	case "FULL":
+		return []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE",
+			"ENVELOPE", "BODY"}
+	}
+
+	return []string{item}
+}
+
+func isFetchItemSupported(item string) bool {
+	name := strings.ToUpper(item)
+
+	switch name {
+	case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "RFC822",
+		"RFC822.HEADER", "RFC822.TEXT", "MODSEQ":
+		return true
+	}
+
+	return strings.HasPrefix(name, "BODY[") ||
+		strings.HasPrefix(name, "BODY.PEEK[")
+}
+
+// fetchItem returns the value of a fetch item, and whether fetching it sets
+// the \Seen flag.
+func fetchItem(msg *Message, item string) (string, bool, error) {
+	name := strings.ToUpper(item)
+
+	switch name {
+	case "UID":
+		return fmt.Sprintf("UID %d", msg.UID), false, nil
+
+	case "FLAGS":
+		return "FLAGS (" + strings.Join(msg.Flags, " ") + ")", false, nil
+
+	case "INTERNALDATE":
+		date := msg.InternalDate.Format(imapc.IMAPDateTimeFormat)
+		return "INTERNALDATE " + string(imapc.QuotedStringEncode(date)),
+			false, nil
+
+	case "RFC822.SIZE":
+		return fmt.Sprintf("RFC822.SIZE %d", len(msg.Data)), false, nil
+
+	case "RFC822":
+		return "RFC822 " + literal(msg.Data), true, nil
+
+	case "RFC822.HEADER":
+		return "RFC822.HEADER " + literal(msg.header()), false, nil
+
+	case "RFC822.TEXT":
+		return "RFC822.TEXT " + literal(msg.body()), true, nil
+
+	case "MODSEQ":
+		return fmt.Sprintf("MODSEQ (%d)", msg.ModSeq), false, nil
+	}
+
+	return fetchBodySection(msg, item)
+}
+
+// fetchBodySection handles BODY[<section>]<<partial>> and its .PEEK variant.
+func fetchBodySection(msg *Message, item string) (string, bool, error) {
+	start := strings.IndexByte(item, '[')
+	end := strings.LastIndexByte(item, ']')
+	if start == -1 || end < start {
+		return "", false, fmt.Errorf("invalid fetch item %q", item)
+	}
+
+	peek := strings.EqualFold(item[:start], "BODY.PEEK")
+	section := item[start+1 : end]
+	partial := item[end+1:]
+
+	data, err := messageSection(msg, section)
+	if err != nil {
+		return "", false, err
+	}
+
+	name := "BODY[" + section + "]"
+
+	if partial != "" {
+		if !strings.HasPrefix(partial, "<") ||
+			!strings.HasSuffix(partial, ">") {
+			return "", false, fmt.Errorf("invalid partial %q", partial)
+		}
+
+		parts := strings.SplitN(partial[1:len(partial)-1], ".", 2)
+
+		offset, err := strconv.Atoi(parts[0])
+		if err != nil || offset < 0 {
+			return "", false, fmt.Errorf("invalid partial %q", partial)
+		}
+
+		length := len(data)
+		if len(parts) == 2 {
+			length, err = strconv.Atoi(parts[1])
+			if err != nil || length < 0 {
+				return "", false,
+					fmt.Errorf("invalid partial %q", partial)
+			}
+		}
+
+		if offset > len(data) {
+			offset = len(data)
+		}
+		if offset+length > len(data) {
+			length = len(data) - offset
+		}
+
+		data = data[offset : offset+length]
+		name += fmt.Sprintf("<%d>", offset)
+	}
+
+	return name + " " + literal(data), !peek, nil
+}
+
+func messageSection(msg *Message, section string) ([]byte, error) {
+	spec := strings.ToUpper(section)
+
+	switch {
+	case spec == "":
+		return msg.Data, nil
+
+	case spec == "HEADER":
+		return msg.header(), nil
+
+	case spec == "TEXT":
+		return msg.body(), nil
+
+	case strings.HasPrefix(spec, "HEADER.FIELDS.NOT "):
+		fields := headerFieldNames(spec[len("HEADER.FIELDS.NOT "):])
+		return filterHeader(msg.header(), fields, false), nil
+
+	case strings.HasPrefix(spec, "HEADER.FIELDS "):
+		fields := headerFieldNames(spec[len("HEADER.FIELDS "):])
+		return filterHeader(msg.header(), fields, true), nil
+	}
+
+	return nil, fmt.Errorf("unsupported body section %q", section)
+}
+
+func headerFieldNames(s string) map[string]bool {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "(")
+	s = strings.TrimSuffix(s, ")")
+
+	names := map[string]bool{}
+	for _, name := range strings.Fields(s) {
+		names[strings.ToUpper(name)] = true
+	}
+
+	return names
+}
+
+// filterHeader returns the header fields whose name is (or is not, if keep
+// is false) in names, followed by an empty line.
+func filterHeader(header []byte, names map[string]bool, keep bool) []byte {
+	var buf bytes.Buffer
+
+	selected := false
+
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			continue
+		}
+
+		if trimmed[0] != ' ' && trimmed[0] != '\t' {
+			name := trimmed
+			if idx := bytes.IndexByte(trimmed, ':'); idx >= 0 {
+				name = trimmed[:idx]
+			}
+
+			name = bytes.ToUpper(bytes.TrimSpace(name))
+			selected = names[string(name)] == keep
+		}
+
+		if selected {
+			buf.Write(trimmed)
+			buf.WriteString("\r\n")
+		}
+	}
+
+	buf.WriteString("\r\n")
+
+	return buf.Bytes()
+}
@@ -0,0 +1,236 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imaptest
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/galdor/go-imapc"
+)
+
+// ---------------------------------------------------------------------------
+//  Mailbox
+// ---------------------------------------------------------------------------
+type Mailbox struct {
+	Name string
+
+	// Mailbox flags returned by LIST in addition to \HasChildren and
+	// \HasNoChildren, e.g. special use flags.
+	Flags []string
+
+	Subscribed bool
+
+	UIDValidity uint32
+	UIDNext     uint32
+
+	// The mod-sequence of the last change in the mailbox (RFC 7162)
+	HighestModSeq uint64
+
+	Messages []*Message
+
+	// Messages expunged from the mailbox, reported in VANISHED responses
+	// (RFC 7162)
+	expunged []expungedMessage
+}
+
+type expungedMessage struct {
+	uid    uint32
+	modSeq uint64
+}
+
+// Append adds a message at the end of the mailbox and returns it. If date is
+// zero, the current time is used as internal date.
+func (mbox *Mailbox) Append(data []byte, flags []string, date time.Time) *Message {
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	msg := &Message{
+		UID:          mbox.UIDNext,
+		InternalDate: date,
+		Data:         data,
+		ModSeq:       mbox.nextModSeq(),
+	}
+
+	msg.AddFlags(flags)
+
+	mbox.UIDNext++
+	mbox.Messages = append(mbox.Messages, msg)
+
+	return msg
+}
+
+// Message returns the message with a specific UID or nil if there is none.
+func (mbox *Mailbox) Message(uid uint32) *Message {
+	for _, msg := range mbox.Messages {
+		if msg.UID == uid {
+			return msg
+		}
+	}
+
+	return nil
+}
+
+func (mbox *Mailbox) unseen() uint32 {
+	var n uint32
+
+	for _, msg := range mbox.Messages {
+		if !msg.HasFlag("\\Seen") {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (mbox *Mailbox) deleted() uint32 {
+	var n uint32
+
+	for _, msg := range mbox.Messages {
+		if msg.HasFlag("\\Deleted") {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (mbox *Mailbox) size() uint64 {
+	var n uint64
+
+	for _, msg := range mbox.Messages {
+		n += uint64(len(msg.Data))
+	}
+
+	return n
+}
+
+// nextModSeq returns the mod-sequence to assign to a new change in the
+// mailbox.
+func (mbox *Mailbox) nextModSeq() uint64 {
+	mbox.HighestModSeq++
+	return mbox.HighestModSeq
+}
+
+// vanished returns the UIDs of the messages in set expunged after modSeq.
+func (mbox *Mailbox) vanished(set imapc.SequenceSet, modSeq uint64) []uint32 {
+	uids := []uint32{}
+
+	for _, msg := range mbox.expunged {
+		if msg.modSeq <= modSeq {
+			continue
+		}
+
+		if set != nil && !set.Contains(msg.uid, math.MaxUint32) {
+			continue
+		}
+
+		uids = append(uids, msg.uid)
+	}
+
+	return uids
+}
+
+func (mbox *Mailbox) maxUID() uint32 {
+	if len(mbox.Messages) == 0 {
+		return 0
+	}
+
+	return mbox.Messages[len(mbox.Messages)-1].UID
+}
+
+// ---------------------------------------------------------------------------
+//  Message
+// ---------------------------------------------------------------------------
+type Message struct {
+	UID          uint32
+	Flags        []string
+	InternalDate time.Time
+	Data         []byte
+	ModSeq       uint64
+}
+
+func (msg *Message) HasFlag(flag string) bool {
+	for _, f := range msg.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (msg *Message) AddFlags(flags []string) {
+	for _, flag := range flags {
+		if !msg.HasFlag(flag) {
+			msg.Flags = append(msg.Flags, flag)
+		}
+	}
+}
+
+func (msg *Message) RemoveFlags(flags []string) {
+	kept := []string{}
+
+	for _, f := range msg.Flags {
+		removed := false
+
+		for _, flag := range flags {
+			if strings.EqualFold(f, flag) {
+				removed = true
+				break
+			}
+		}
+
+		if !removed {
+			kept = append(kept, f)
+		}
+	}
+
+	msg.Flags = kept
+}
+
+func (msg *Message) SetFlags(flags []string) {
+	msg.Flags = nil
+	msg.AddFlags(flags)
+}
+
+// header returns the header of the message, including the empty line
+// separating it from the body.
+func (msg *Message) header() []byte {
+	header, _ := splitMessage(msg.Data)
+	return header
+}
+
+func (msg *Message) body() []byte {
+	_, body := splitMessage(msg.Data)
+	return body
+}
+
+func splitMessage(data []byte) ([]byte, []byte) {
+	s := string(data)
+
+	if idx := strings.Index(s, "\r\n\r\n"); idx >= 0 {
+		return data[:idx+4], data[idx+4:]
+	}
+
+	if idx := strings.Index(s, "\n\n"); idx >= 0 {
+		return data[:idx+2], data[idx+2:]
+	}
+
+	return data, nil
+}
@@ -0,0 +1,267 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imaptest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Command is a command sent by the client. Arguments are either byte slices
+// (atoms, quoted strings and literals) or lists of arguments
+// ([]interface{}).
+type Command struct {
+	Tag  string
+	Name string // upper case, without the UID prefix
+	UID  bool
+	Args []interface{}
+}
+
+// String returns the argument at position i as a string, or an empty string
+// if it does not exist or is a list.
+func (cmd *Command) String(i int) string {
+	if i >= len(cmd.Args) {
+		return ""
+	}
+
+	data, _ := cmd.Args[i].([]byte)
+	return string(data)
+}
+
+// List returns the argument at position i as a list, or nil if it does not
+// exist or is not a list.
+func (cmd *Command) List(i int) []interface{} {
+	if i >= len(cmd.Args) {
+		return nil
+	}
+
+	list, _ := cmd.Args[i].([]interface{})
+	return list
+}
+
+func parseCommand(data []byte) (*Command, error) {
+	p := &parser{data: data}
+
+	tag := p.atom()
+	if tag == "" {
+		return nil, fmt.Errorf("missing tag")
+	}
+
+	cmd := &Command{Tag: tag}
+
+	p.skipSpaces()
+	cmd.Name = strings.ToUpper(p.atom())
+	if cmd.Name == "" {
+		return cmd, fmt.Errorf("missing command name")
+	}
+
+	if cmd.Name == "UID" {
+		p.skipSpaces()
+		cmd.Name = strings.ToUpper(p.atom())
+		cmd.UID = true
+	}
+
+	args, err := p.values(0)
+	if err != nil {
+		return cmd, err
+	}
+
+	cmd.Args = args
+
+	return cmd, nil
+}
+
+type parser struct {
+	data []byte
+	pos  int
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.data) && p.data[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *parser) atEnd() bool {
+	return p.pos >= len(p.data) ||
+		p.data[p.pos] == '\r' || p.data[p.pos] == '\n'
+}
+
+// values reads values until the end of the command, or until the end of the
+// current list if depth is greater than zero.
+func (p *parser) values(depth int) ([]interface{}, error) {
+	values := []interface{}{}
+
+	for {
+		p.skipSpaces()
+
+		if p.atEnd() {
+			if depth > 0 {
+				return nil, fmt.Errorf("truncated list")
+			}
+
+			return values, nil
+		}
+
+		if p.data[p.pos] == ')' {
+			if depth == 0 {
+				return nil, fmt.Errorf("unexpected ')'")
+			}
+
+			p.pos++
+			return values, nil
+		}
+
+		value, err := p.value(depth)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+}
+
+func (p *parser) value(depth int) (interface{}, error) {
+	switch p.data[p.pos] {
+	case '(':
+		p.pos++
+		return p.values(depth + 1)
+
+	case '"':
+		return p.quotedString()
+
+	case '{':
+		return p.literal()
+	}
+
+	atom := p.atom()
+	if atom == "" {
+		return nil, fmt.Errorf("invalid character %q", p.data[p.pos])
+	}
+
+	return []byte(atom), nil
+}
+
+// atom reads an atom. Brackets are included with their content so that fetch
+// items such as BODY[HEADER.FIELDS (SUBJECT)] are read as a single atom.
+func (p *parser) atom() string {
+	start := p.pos
+	brackets := 0
+
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+
+		if c == '[' {
+			brackets++
+		} else if c == ']' && brackets > 0 {
+			brackets--
+		} else if brackets == 0 && (c == ' ' || c == '(' ||
+			c == ')' || c == '\r' || c == '\n') {
+			break
+		}
+
+		p.pos++
+	}
+
+	return string(p.data[start:p.pos])
+}
+
+func (p *parser) quotedString() ([]byte, error) {
+	p.pos++
+
+	value := []byte{}
+
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+
+		switch c {
+		case '"':
+			return value, nil
+
+		case '\\':
+			if p.pos >= len(p.data) {
+				return nil, fmt.Errorf("truncated quoted string")
+			}
+
+			value = append(value, p.data[p.pos])
+			p.pos++
+
+		default:
+			value = append(value, c)
+		}
+	}
+
+	return nil, fmt.Errorf("truncated quoted string")
+}
+
+func (p *parser) literal() ([]byte, error) {
+	end := strings.IndexByte(string(p.data[p.pos:]), '}')
+	if end == -1 {
+		return nil, fmt.Errorf("truncated literal")
+	}
+
+	sizeString := strings.TrimSuffix(string(p.data[p.pos+1:p.pos+end]), "+")
+
+	size, err := strconv.Atoi(sizeString)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid literal size")
+	}
+
+	p.pos += end + 1
+
+	if !strings.HasPrefix(string(p.data[p.pos:]), "\r\n") {
+		return nil, fmt.Errorf("missing \\r\\n after literal size")
+	}
+	p.pos += 2
+
+	if p.pos+size > len(p.data) {
+		return nil, fmt.Errorf("truncated literal")
+	}
+
+	value := p.data[p.pos : p.pos+size]
+	p.pos += size
+
+	return value, nil
+}
+
+// literalSize returns the size of the literal at the end of a command line,
+// or -1 if there is none. The second value indicates whether the literal is
+// a non-synchronizing one (RFC 7888).
+func literalSize(line []byte) (int, bool) {
+	s := strings.TrimRight(string(line), "\r\n")
+	if !strings.HasSuffix(s, "}") {
+		return -1, false
+	}
+
+	start := strings.LastIndexByte(s, '{')
+	if start == -1 {
+		return -1, false
+	}
+
+	sizeString := s[start+1 : len(s)-1]
+
+	nonSync := strings.HasSuffix(sizeString, "+")
+	sizeString = strings.TrimSuffix(sizeString, "+")
+
+	size, err := strconv.Atoi(sizeString)
+	if err != nil || size < 0 {
+		return -1, false
+	}
+
+	return size, nonSync
+}
@@ -0,0 +1,65 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imaptest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		data string
+		cmd  *Command
+	}{
+		{"a1 NOOP\r\n",
+			&Command{Tag: "a1", Name: "NOOP",
+				Args: []interface{}{}}},
+		{"a2 uid fetch 1:* (UID BODY.PEEK[HEADER.FIELDS (SUBJECT)])\r\n",
+			&Command{Tag: "a2", Name: "FETCH", UID: true,
+				Args: []interface{}{
+					[]byte("1:*"),
+					[]interface{}{
+						[]byte("UID"),
+						[]byte("BODY.PEEK[HEADER.FIELDS (SUBJECT)]"),
+					},
+				}}},
+		{"a3 APPEND \"a \\\"b\\\"\" () {3}\r\nfoo\r\n",
+			&Command{Tag: "a3", Name: "APPEND",
+				Args: []interface{}{
+					[]byte("a \"b\""),
+					[]interface{}{},
+					[]byte("foo"),
+				}}},
+		{"a4 SEARCH ( ALL )\r\n",
+			&Command{Tag: "a4", Name: "SEARCH",
+				Args: []interface{}{
+					[]interface{}{[]byte("ALL")},
+				}}},
+	}
+
+	for _, test := range tests {
+		cmd, err := parseCommand([]byte(test.data))
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", test.data, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(cmd, test.cmd) {
+			t.Errorf("%q was parsed as %#v", test.data, cmd)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imaptest
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galdor/go-imapc"
+)
+
+type searchFunc func(seq uint32, msg *Message) bool
+
+func (sess *Session) parseSearchKeys(args []interface{}) (searchFunc, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing search key")
+	}
+
+	fns := []searchFunc{}
+
+	for len(args) > 0 {
+		fn, rest, err := sess.parseSearchKey(args)
+		if err != nil {
+			return nil, err
+		}
+
+		fns = append(fns, fn)
+		args = rest
+	}
+
+	return func(seq uint32, msg *Message) bool {
+		for _, fn := range fns {
+			if !fn(seq, msg) {
+				return false
+			}
+		}
+
+		return true
+	}, nil
+}
+
+func (sess *Session) parseSearchKey(args []interface{}) (searchFunc, []interface{}, error) {
+	if list, ok := args[0].([]interface{}); ok {
+		fn, err := sess.parseSearchKeys(list)
+		return fn, args[1:], err
+	}
+
+	data, _ := args[0].([]byte)
+	key := strings.ToUpper(string(data))
+	args = args[1:]
+
+	stringArg := func() (string, error) {
+		if len(args) == 0 {
+			return "", fmt.Errorf("missing argument for %s", key)
+		}
+
+		data, ok := args[0].([]byte)
+		if !ok {
+			return "", fmt.Errorf("invalid argument for %s", key)
+		}
+
+		args = args[1:]
+		return string(data), nil
+	}
+
+	dateArg := func() (time.Time, error) {
+		s, err := stringArg()
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		date, err := time.Parse("2-Jan-2006", s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date %q", s)
+		}
+
+		return date, nil
+	}
+
+	flag := func(flag string, set bool) searchFunc {
+		return func(seq uint32, msg *Message) bool {
+			return msg.HasFlag(flag) == set
+		}
+	}
+
+	var fn searchFunc
+
+	switch key {
+	case "ALL", "OLD":
+		fn = func(uint32, *Message) bool { return true }
+
+	case "NEW", "RECENT":
+		// The server never sets \Recent
+		fn = func(uint32, *Message) bool { return false }
+
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "SEEN":
+		fn = flag("\\"+key, true)
+
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		fn = flag("\\"+key[2:], false)
+
+	case "KEYWORD", "UNKEYWORD":
+		keyword, err := stringArg()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fn = flag(keyword, key == "KEYWORD")
+
+	case "BCC", "CC", "FROM", "SUBJECT", "TO":
+		value, err := stringArg()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fn = headerContains(key, value)
+
+	case "HEADER":
+		name, err := stringArg()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value, err := stringArg()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fn = headerContains(name, value)
+
+	case "BODY", "TEXT":
+		value, err := stringArg()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fn = func(seq uint32, msg *Message) bool {
+			data := msg.Data
+			if key == "BODY" {
+				data = msg.body()
+			}
+
+			return containsFoldBytes(data, value)
+		}
+
+	case "BEFORE", "ON", "SINCE":
+		date, err := dateArg()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fn = func(seq uint32, msg *Message) bool {
+			return compareDate(msg.InternalDate, date, key)
+		}
+
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		date, err := dateArg()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fn = func(seq uint32, msg *Message) bool {
+			sentDate, err := messageHeader(msg).Date()
+			if err != nil {
+				return false
+			}
+
+			return compareDate(sentDate, date, key[4:])
+		}
+
+	case "LARGER", "SMALLER":
+		s, err := stringArg()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		size, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid size %q", s)
+		}
+
+		fn = func(seq uint32, msg *Message) bool {
+			if key == "LARGER" {
+				return uint64(len(msg.Data)) > size
+			}
+
+			return uint64(len(msg.Data)) < size
+		}
+
+	case "UID":
+		s, err := stringArg()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		set, err := imapc.ParseSequenceSet(s)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		set = sess.resolveSearchResult(set, true)
+
+		maxUID := sess.mailbox.maxUID()
+
+		fn = func(seq uint32, msg *Message) bool {
+			return set.Contains(msg.UID, maxUID)
+		}
+
+	case "NOT":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("missing argument for NOT")
+		}
+
+		keyFn, rest, err := sess.parseSearchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		args = rest
+
+		fn = func(seq uint32, msg *Message) bool {
+			return !keyFn(seq, msg)
+		}
+
+	case "OR":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("missing argument for OR")
+		}
+
+		keyFn1, rest, err := sess.parseSearchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(rest) == 0 {
+			return nil, nil, fmt.Errorf("missing argument for OR")
+		}
+
+		keyFn2, rest, err := sess.parseSearchKey(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		args = rest
+
+		fn = func(seq uint32, msg *Message) bool {
+			return keyFn1(seq, msg) || keyFn2(seq, msg)
+		}
+
+	default:
+		set, err := imapc.ParseSequenceSet(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unsupported search key %q",
+				key)
+		}
+
+		set = sess.resolveSearchResult(set, false)
+
+		n := uint32(len(sess.mailbox.Messages))
+
+		fn = func(seq uint32, msg *Message) bool {
+			return set.Contains(seq, n)
+		}
+	}
+
+	return fn, args, nil
+}
+
+func messageHeader(msg *Message) mail.Header {
+	m, err := mail.ReadMessage(bytes.NewReader(msg.Data))
+	if err != nil {
+		return mail.Header{}
+	}
+
+	return m.Header
+}
+
+func headerContains(name, value string) searchFunc {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+
+	return func(seq uint32, msg *Message) bool {
+		values, found := messageHeader(msg)[name]
+		if !found {
+			return false
+		}
+
+		for _, v := range values {
+			if containsFoldBytes([]byte(v), value) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+func containsFoldBytes(data []byte, s string) bool {
+	return bytes.Contains(bytes.ToLower(data), bytes.ToLower([]byte(s)))
+}
+
+// compareDate compares the date part of t with date, ignoring time and
+// timezone as required by RFC 3501 6.4.4.
+func compareDate(t, date time.Time, op string) bool {
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+
+	switch op {
+	case "BEFORE":
+		return day.Before(date)
+	case "ON":
+		return day.Equal(date)
+	case "SINCE":
+		return !day.Before(date)
+	}
+
+	return false
+}
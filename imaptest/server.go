@@ -0,0 +1,503 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+// Package imaptest provides a fake IMAP server used to test IMAP clients
+// without a real server. The server keeps mailboxes in memory and implements
+// the subset of IMAP4rev1 used by go-imapc; handlers can be replaced to
+// script specific responses, e.g. to test error paths.
+package imaptest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/galdor/go-imapc"
+)
+
+var DefaultCaps = []string{
+	"IMAP4rev1",
+	"AUTH=PLAIN",
+	"ENABLE",
+	"UIDPLUS",
+	"MOVE",
+	"SPECIAL-USE",
+	"LIST-EXTENDED",
+	"LIST-STATUS",
+	"ESEARCH",
+	"SEARCHRES",
+	"SORT",
+	"SORT=DISPLAY",
+	"THREAD=REFERENCES",
+}
+
+var DefaultCharsets = []string{"US-ASCII", "UTF-8"}
+
+// HandlerFunc handles a command. It can write untagged responses with
+// Session.WriteLine and returns the tagged status response; nil means a
+// successful completion.
+type HandlerFunc func(*Session, *Command) *Status
+
+// Server is a fake IMAP server. Configuration fields must be set before the
+// server starts serving connections. Mailboxes must not be modified directly
+// while clients are connected; the server does not send notifications for
+// changes made by other sessions.
+type Server struct {
+	Caps               []string
+	HierarchyDelimiter rune
+
+	// Users maps logins to passwords. If it is empty, all credentials are
+	// accepted.
+	Users map[string]string
+
+	// PreAuth makes the server send a PREAUTH greeting
+	PreAuth bool
+
+	// Greeting, if set, replaces the greeting line
+	Greeting string
+
+	// Charsets supported by SEARCH, SORT and THREAD commands. Strings
+	// using ISO-8859-1 are converted to UTF-8, other charsets are used as
+	// is.
+	Charsets []string
+
+	mutex       sync.Mutex
+	mailboxes   map[string]*Mailbox
+	handlers    map[string]HandlerFunc
+	uidValidity uint32
+
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+func NewServer() *Server {
+	s := &Server{
+		Caps:               append([]string{}, DefaultCaps...),
+		HierarchyDelimiter: '/',
+		Charsets:           append([]string{}, DefaultCharsets...),
+
+		Users: map[string]string{},
+
+		mailboxes: map[string]*Mailbox{},
+		handlers:  map[string]HandlerFunc{},
+
+		conns: map[net.Conn]struct{}{},
+	}
+
+	s.AddMailbox("INBOX")
+
+	return s
+}
+
+func (s *Server) AddUser(login, password string) {
+	s.Users[login] = password
+}
+
+// AddMailbox creates a mailbox if it does not already exist and returns it.
+func (s *Server) AddMailbox(name string, flags ...string) *Mailbox {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if mbox := s.mailbox(name); mbox != nil {
+		return mbox
+	}
+
+	return s.createMailbox(name, flags)
+}
+
+func (s *Server) Mailbox(name string) *Mailbox {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.mailbox(name)
+}
+
+// Handle replaces the handler of a command. The name is case insensitive
+// and does not include the UID prefix, e.g. "FETCH" handles both FETCH and
+// UID FETCH.
+func (s *Server) Handle(name string, fn HandlerFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.handlers[strings.ToUpper(name)] = fn
+}
+
+func (s *Server) HasCap(cap string) bool {
+	for _, c := range s.Caps {
+		if strings.EqualFold(c, cap) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Start listens on a random port of the loopback interface and serves
+// connections in the background.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+// Addr returns the address the server listens on; it is only valid after a
+// successful call to Start.
+func (s *Server) Addr() *net.TCPAddr {
+	return s.listener.Addr().(*net.TCPAddr)
+}
+
+// NewClient returns a client configured to connect to the server.
+func (s *Server) NewClient() *imapc.Client {
+	addr := s.Addr()
+
+	client := imapc.NewClient()
+	client.Host = addr.IP.String()
+	client.Port = addr.Port
+
+	return client
+}
+
+// Pipe returns one end of an in-memory connection whose other end is served
+// in the background. It can be used with imapc.Client.ConnectConn without
+// calling Start.
+func (s *Server) Pipe() net.Conn {
+	clientConn, serverConn := net.Pipe()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.ServeConn(serverConn)
+	}()
+
+	return clientConn
+}
+
+// ServeConn serves a connection until the client logs out or the connection
+// is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mutex.Lock()
+	s.conns[conn] = struct{}{}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+
+		conn.Close()
+	}()
+
+	sess := newSession(s, conn)
+	sess.serve()
+}
+
+// Close stops listening, closes all connections and waits for sessions to
+// terminate.
+func (s *Server) Close() error {
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+
+	return err
+}
+
+func (s *Server) mailbox(name string) *Mailbox {
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+
+	return s.mailboxes[name]
+}
+
+func (s *Server) createMailbox(name string, flags []string) *Mailbox {
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+
+	s.uidValidity++
+
+	mbox := &Mailbox{
+		Name:  name,
+		Flags: flags,
+
+		UIDValidity:   s.uidValidity,
+		UIDNext:       1,
+		HighestModSeq: 1,
+	}
+
+	s.mailboxes[name] = mbox
+
+	return mbox
+}
+
+// ---------------------------------------------------------------------------
+//  Status
+// ---------------------------------------------------------------------------
+type Status struct {
+	Name string // OK, NO or BAD
+	Code string // optional, without brackets
+	Text string
+}
+
+func OK(code, text string) *Status {
+	return &Status{Name: "OK", Code: code, Text: text}
+}
+
+func No(code, text string) *Status {
+	return &Status{Name: "NO", Code: code, Text: text}
+}
+
+func Bad(text string) *Status {
+	return &Status{Name: "BAD", Text: text}
+}
+
+func (s *Status) String() string {
+	if s.Code == "" {
+		return fmt.Sprintf("%s %s", s.Name, s.Text)
+	}
+
+	return fmt.Sprintf("%s [%s] %s", s.Name, s.Code, s.Text)
+}
+
+// ---------------------------------------------------------------------------
+//  Session
+// ---------------------------------------------------------------------------
+type Session struct {
+	Server *Server
+
+	// Login is set once the client is authenticated
+	Login string
+
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	authenticated bool
+	utf8          bool
+	rev2          bool
+	closed        bool
+
+	// CONDSTORE and QRESYNC (RFC 7162)
+	condStore bool
+	qresync   bool
+
+	mailbox  *Mailbox
+	readOnly bool
+
+	// UIDs of the messages saved with SEARCH RETURN (SAVE), referred to
+	// as '$' (RFC 5182)
+	searchResult []uint32
+}
+
+func newSession(server *Server, conn net.Conn) *Session {
+	return &Session{
+		Server: server,
+
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+}
+
+// WriteLine writes a response line; the line terminator is added
+// automatically.
+func (sess *Session) WriteLine(format string, args ...interface{}) {
+	fmt.Fprintf(sess.w, format, args...)
+	sess.w.WriteString("\r\n")
+}
+
+// Close closes the connection once the current command has been processed;
+// no tagged response is sent for the command.
+func (sess *Session) Close() {
+	sess.closed = true
+}
+
+func (sess *Session) serve() {
+	s := sess.Server
+
+	caps := strings.Join(s.Caps, " ")
+
+	switch {
+	case s.Greeting != "":
+		sess.WriteLine("%s", s.Greeting)
+	case s.PreAuth:
+		sess.authenticated = true
+		sess.WriteLine("* PREAUTH [CAPABILITY %s] imaptest ready", caps)
+	default:
+		sess.WriteLine("* OK [CAPABILITY %s] imaptest ready", caps)
+	}
+
+	if err := sess.w.Flush(); err != nil {
+		return
+	}
+
+	for !sess.closed {
+		data, err := sess.readCommand()
+		if err != nil {
+			return
+		}
+
+		cmd, err := parseCommand(data)
+		if err != nil {
+			if cmd == nil {
+				sess.WriteLine("* BAD %v", err)
+			} else {
+				sess.WriteLine("%s BAD %v", cmd.Tag, err)
+			}
+		} else {
+			s.mutex.Lock()
+			status := sess.execute(cmd)
+			s.mutex.Unlock()
+
+			if !sess.closed {
+				if status == nil {
+					status = OK("", cmd.Name+" completed")
+				}
+
+				sess.WriteLine("%s %v", cmd.Tag, status)
+			}
+		}
+
+		if err := sess.w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads a command line, including literals.
+func (sess *Session) readCommand() ([]byte, error) {
+	var data []byte
+
+	for {
+		line, err := sess.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, line...)
+
+		size, nonSync := literalSize(line)
+		if size < 0 {
+			return data, nil
+		}
+
+		if !nonSync {
+			sess.WriteLine("+ Ready for literal data")
+			if err := sess.w.Flush(); err != nil {
+				return nil, err
+			}
+		}
+
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(sess.r, literal); err != nil {
+			return nil, err
+		}
+
+		data = append(data, literal...)
+	}
+}
+
+func (sess *Session) readLine() ([]byte, error) {
+	return sess.r.ReadBytes('\n')
+}
+
+func (sess *Session) execute(cmd *Command) *Status {
+	if fn, found := sess.Server.handlers[cmd.Name]; found {
+		return fn(sess, cmd)
+	}
+
+	handler, found := commandHandlers[cmd.Name]
+	if !found {
+		return Bad("unknown command " + cmd.Name)
+	}
+
+	if cmd.UID && !handler.uid {
+		return Bad("invalid UID command")
+	}
+
+	if handler.auth && !sess.authenticated {
+		return Bad("not authenticated")
+	}
+
+	if handler.selected && sess.mailbox == nil {
+		return Bad("no mailbox selected")
+	}
+
+	return handler.fn(sess, cmd)
+}
+
+// Mailbox returns the selected mailbox or nil if there is none.
+func (sess *Session) Mailbox() *Mailbox {
+	return sess.mailbox
+}
+
+func (sess *Session) encodeMailboxName(name string) string {
+	return string(imapc.MailboxNameEncode(name, sess.utf8))
+}
+
+func (sess *Session) decodeMailboxName(data []byte) (string, error) {
+	if sess.utf8 {
+		return string(data), nil
+	}
+
+	name, err := imapc.ModifiedUTF7Decode(data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(name), nil
+}
+
+func literal(data []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
@@ -0,0 +1,279 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imaptest
+
+import (
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/galdor/go-imapc"
+)
+
+type sortFunc func(msg1, msg2 *Message) int
+
+func (sess *Session) cmdSort(cmd *Command) *Status {
+	if len(cmd.Args) < 3 {
+		return Bad("invalid arguments")
+	}
+
+	list, ok := cmd.Args[0].([]interface{})
+	if !ok || len(list) == 0 {
+		return Bad("invalid sort criteria")
+	}
+
+	fns := []sortFunc{}
+	reverse := false
+
+	for _, name := range stringList(list) {
+		name = strings.ToUpper(name)
+
+		if name == "REVERSE" {
+			reverse = !reverse
+			continue
+		}
+
+		fn := sortCriterion(name)
+		if fn == nil {
+			return Bad("unknown sort criterion")
+		}
+
+		if reverse {
+			fn = reverseSortFunc(fn)
+			reverse = false
+		}
+
+		fns = append(fns, fn)
+	}
+
+	args, status := sess.decodeSearchArgs(cmd.String(1), cmd.Args[2:])
+	if status != nil {
+		return status
+	}
+
+	match, err := sess.parseSearchKeys(args)
+	if err != nil {
+		return Bad(err.Error())
+	}
+
+	// Sequence numbers are used as the final tie-breaker (RFC 5256 3.)
+	type entry struct {
+		seq uint32
+		msg *Message
+	}
+
+	entries := []entry{}
+
+	for i, msg := range sess.mailbox.Messages {
+		seq := uint32(i + 1)
+
+		if match(seq, msg) {
+			entries = append(entries, entry{seq, msg})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		for _, fn := range fns {
+			if c := fn(entries[i].msg, entries[j].msg); c != 0 {
+				return c < 0
+			}
+		}
+
+		return entries[i].seq < entries[j].seq
+	})
+
+	ids := make([]uint32, len(entries))
+	for i, e := range entries {
+		if cmd.UID {
+			ids[i] = e.msg.UID
+		} else {
+			ids[i] = e.seq
+		}
+	}
+
+	if len(ids) == 0 {
+		sess.WriteLine("* SORT")
+	} else {
+		sess.WriteLine("* SORT %s", joinNumbers(ids, " "))
+	}
+
+	return nil
+}
+
+func sortCriterion(name string) sortFunc {
+	switch name {
+	case "ARRIVAL":
+		return func(msg1, msg2 *Message) int {
+			return compareTimes(msg1.InternalDate, msg2.InternalDate)
+		}
+
+	case "DATE":
+		return func(msg1, msg2 *Message) int {
+			return compareTimes(sentDate(msg1), sentDate(msg2))
+		}
+
+	case "SIZE":
+		return func(msg1, msg2 *Message) int {
+			return len(msg1.Data) - len(msg2.Data)
+		}
+
+	case "SUBJECT":
+		return func(msg1, msg2 *Message) int {
+			return strings.Compare(baseSubject(msg1),
+				baseSubject(msg2))
+		}
+
+	case "CC", "FROM", "TO":
+		return func(msg1, msg2 *Message) int {
+			return strings.Compare(addressMailbox(msg1, name),
+				addressMailbox(msg2, name))
+		}
+
+	case "DISPLAYFROM", "DISPLAYTO":
+		return func(msg1, msg2 *Message) int {
+			return strings.Compare(addressDisplay(msg1, name[7:]),
+				addressDisplay(msg2, name[7:]))
+		}
+	}
+
+	return nil
+}
+
+func (sess *Session) cmdThread(cmd *Command) *Status {
+	if len(cmd.Args) < 3 {
+		return Bad("invalid arguments")
+	}
+
+	if !strings.EqualFold(cmd.String(0), "REFERENCES") {
+		return Bad("unsupported threading algorithm")
+	}
+
+	args, status := sess.decodeSearchArgs(cmd.String(1), cmd.Args[2:])
+	if status != nil {
+		return status
+	}
+
+	match, err := sess.parseSearchKeys(args)
+	if err != nil {
+		return Bad(err.Error())
+	}
+
+	msgs := []*imapc.ThreadMessage{}
+
+	for i, msg := range sess.mailbox.Messages {
+		seq := uint32(i + 1)
+
+		if !match(seq, msg) {
+			continue
+		}
+
+		id := seq
+		if cmd.UID {
+			id = msg.UID
+		}
+
+		tmsg := imapc.NewThreadMessage(id, messageHeader(msg))
+		tmsg.Date = sentDate(msg)
+
+		msgs = append(msgs, tmsg)
+	}
+
+	line := "* THREAD"
+	for i, thread := range imapc.ThreadByReferences(msgs) {
+		if i == 0 {
+			line += " "
+		}
+
+		line += thread.String()
+	}
+
+	sess.WriteLine("%s", line)
+	return nil
+}
+
+func reverseSortFunc(fn sortFunc) sortFunc {
+	return func(msg1, msg2 *Message) int {
+		return fn(msg2, msg1)
+	}
+}
+
+func compareTimes(t1, t2 time.Time) int {
+	switch {
+	case t1.Before(t2):
+		return -1
+	case t1.After(t2):
+		return 1
+	}
+
+	return 0
+}
+
+// sentDate returns the date of the Date header field or the internal date if
+// the header is missing or invalid (RFC 5256 2.2.)
+func sentDate(msg *Message) time.Time {
+	date, err := messageHeader(msg).Date()
+	if err != nil {
+		return msg.InternalDate
+	}
+
+	return date
+}
+
+func baseSubject(msg *Message) string {
+	subject := messageHeader(msg).Get("Subject")
+	return strings.ToLower(imapc.BaseSubject(subject))
+}
+
+func firstAddress(msg *Message, field string) *mail.Address {
+	addrs, err := messageHeader(msg).AddressList(field)
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+
+	return addrs[0]
+}
+
+// addressMailbox returns the local part of the first address of a header
+// field (RFC 5256 3.)
+func addressMailbox(msg *Message, field string) string {
+	addr := firstAddress(msg, field)
+	if addr == nil {
+		return ""
+	}
+
+	mailbox := addr.Address
+	if i := strings.LastIndexByte(mailbox, '@'); i >= 0 {
+		mailbox = mailbox[:i]
+	}
+
+	return strings.ToLower(mailbox)
+}
+
+// addressDisplay returns the display name of the first address of a header
+// field, or its address if there is no display name (RFC 5957 2.)
+func addressDisplay(msg *Message, field string) string {
+	addr := firstAddress(msg, field)
+	if addr == nil {
+		return ""
+	}
+
+	if addr.Name != "" {
+		return strings.ToLower(addr.Name)
+	}
+
+	return strings.ToLower(addr.Address)
+}
@@ -0,0 +1,431 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imaptest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/galdor/go-imapc"
+)
+
+// Transcripts are text files containing one entry per line. Each entry
+// starts with a three character prefix:
+//
+//   "C: " data sent by the client
+//   "S: " data sent by the server
+//   "C* " data sent by the client which was redacted
+//   "C+ ", "S+ " data not terminated by a line feed; the line feed following
+//   the data is not part of it
+//
+// Data are stored verbatim, including carriage returns. Lines starting with
+// '#' are comments.
+
+type transcriptEntry struct {
+	client   bool
+	redacted bool
+	data     []byte
+}
+
+func readTranscript(r io.Reader) ([]transcriptEntry, error) {
+	br := bufio.NewReader(r)
+
+	entries := []transcriptEntry{}
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 || line[0] == '#' {
+			continue
+		}
+
+		if len(line) < 3 || line[2] != ' ' {
+			return nil, fmt.Errorf("invalid entry on line %d",
+				lineNumber)
+		}
+
+		entry := transcriptEntry{data: line[3:]}
+
+		switch string(line[:2]) {
+		case "C:":
+			entry.client = true
+		case "S:":
+		case "C*":
+			entry.client = true
+			entry.redacted = true
+		case "C+":
+			entry.client = true
+			entry.data = bytes.TrimSuffix(entry.data, []byte("\n"))
+		case "S+":
+			entry.data = bytes.TrimSuffix(entry.data, []byte("\n"))
+		default:
+			return nil, fmt.Errorf("invalid entry prefix on line %d",
+				lineNumber)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// ---------------------------------------------------------------------------
+//  Recorder
+// ---------------------------------------------------------------------------
+
+// Recorder is a connection writing a transcript of all data exchanged on the
+// underlying connection. Credentials sent with LOGIN and AUTHENTICATE are
+// redacted. A typical use is:
+//
+//   conn, err := tls.Dial("tcp", "imap.example.com:993", nil)
+//   ...
+//   client := imapc.NewClient()
+//   err = client.ConnectConn(imaptest.Record(conn, file))
+type Recorder struct {
+	net.Conn
+
+	w io.Writer
+
+	mutex     sync.Mutex
+	clientBuf []byte
+	serverBuf []byte
+	redactor  imapc.Redactor
+	err       error
+}
+
+func Record(conn net.Conn, w io.Writer) *Recorder {
+	return &Recorder{
+		Conn: conn,
+		w:    w,
+	}
+}
+
+func (r *Recorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		r.record(false, p[:n])
+	}
+
+	return n, err
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.record(true, p)
+	return r.Conn.Write(p)
+}
+
+// Close writes data not terminated by a line feed and closes the underlying
+// connection.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+
+	if len(r.clientBuf) > 0 {
+		r.writeEntry("C+", r.clientBuf)
+		r.writeEntry("", []byte("\n"))
+		r.clientBuf = nil
+	}
+
+	if len(r.serverBuf) > 0 {
+		r.writeEntry("S+", r.serverBuf)
+		r.writeEntry("", []byte("\n"))
+		r.serverBuf = nil
+	}
+
+	r.mutex.Unlock()
+
+	return r.Conn.Close()
+}
+
+// Err returns the first error which occurred while writing the transcript.
+func (r *Recorder) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.err
+}
+
+func (r *Recorder) record(client bool, data []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	buf := &r.serverBuf
+	if client {
+		buf = &r.clientBuf
+	}
+
+	*buf = append(*buf, data...)
+
+	for {
+		idx := bytes.IndexByte(*buf, '\n')
+		if idx == -1 {
+			break
+		}
+
+		line := append([]byte{}, (*buf)[:idx+1]...)
+		*buf = (*buf)[idx+1:]
+
+		if client {
+			r.recordClientLine(line)
+		} else {
+			r.recordServerLine(line)
+		}
+	}
+}
+
+func (r *Recorder) recordClientLine(line []byte) {
+	if redactedLine, redacted := r.redactor.ClientLine(string(line)); redacted {
+		r.writeEntry("C*", []byte(redactedLine+"\n"))
+		return
+	}
+
+	r.writeEntry("C:", line)
+}
+
+func (r *Recorder) recordServerLine(line []byte) {
+	r.redactor.ServerLine(string(line))
+
+	r.writeEntry("S:", line)
+}
+
+func (r *Recorder) writeEntry(prefix string, data []byte) {
+	if r.err != nil {
+		return
+	}
+
+	if prefix != "" {
+		if _, err := io.WriteString(r.w, prefix+" "); err != nil {
+			r.err = err
+			return
+		}
+	}
+
+	if _, err := r.w.Write(data); err != nil {
+		r.err = err
+	}
+}
+
+// ---------------------------------------------------------------------------
+//  Replay
+// ---------------------------------------------------------------------------
+
+// ReplayConn is a connection playing back the server side of a transcript.
+// Data written by the client are compared to the data recorded; redacted
+// entries match any line. Server data are only sent once the client has sent
+// all the data preceding them in the transcript.
+type ReplayConn struct {
+	entries []transcriptEntry
+
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	pos       int
+	pending   []byte
+	clientBuf []byte
+	closed    bool
+	err       error
+}
+
+// Replay reads a transcript and returns a connection playing it back.
+func Replay(r io.Reader) (*ReplayConn, error) {
+	entries, err := readTranscript(r)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &ReplayConn{
+		entries: entries,
+	}
+
+	conn.cond = sync.NewCond(&conn.mutex)
+
+	return conn, nil
+}
+
+func (c *ReplayConn) Read(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for {
+		if c.closed {
+			return 0, io.ErrClosedPipe
+		}
+
+		if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+
+		if c.pos >= len(c.entries) {
+			return 0, io.EOF
+		}
+
+		entry := c.entries[c.pos]
+		if !entry.client {
+			c.pending = entry.data
+			c.pos++
+			continue
+		}
+
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		// Wait for the client to send the data expected before the
+		// next server entry.
+		c.matchClientData()
+		if c.pos < len(c.entries) && c.entries[c.pos].client &&
+			c.err == nil {
+			c.cond.Wait()
+		}
+	}
+}
+
+func (c *ReplayConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	c.clientBuf = append(c.clientBuf, p...)
+	c.matchClientData()
+
+	c.cond.Broadcast()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return len(p), nil
+}
+
+func (c *ReplayConn) matchClientData() {
+	for len(c.clientBuf) > 0 && c.err == nil {
+		if c.pos >= len(c.entries) {
+			c.err = fmt.Errorf("unexpected client data %q "+
+				"after the end of the transcript", c.clientBuf)
+			return
+		}
+
+		entry := c.entries[c.pos]
+		if !entry.client {
+			return
+		}
+
+		if entry.redacted {
+			idx := bytes.IndexByte(c.clientBuf, '\n')
+			if idx == -1 {
+				return
+			}
+
+			c.clientBuf = c.clientBuf[idx+1:]
+			c.pos++
+			continue
+		}
+
+		n := len(entry.data)
+		if len(c.clientBuf) < n {
+			if !bytes.HasPrefix(entry.data, c.clientBuf) {
+				c.err = fmt.Errorf("unexpected client data "+
+					"%q, expected %q", c.clientBuf,
+					entry.data)
+			}
+
+			return
+		}
+
+		if !bytes.Equal(c.clientBuf[:n], entry.data) {
+			c.err = fmt.Errorf("unexpected client data %q, "+
+				"expected %q", c.clientBuf[:n], entry.data)
+			return
+		}
+
+		c.clientBuf = c.clientBuf[n:]
+		c.pos++
+	}
+}
+
+// Err returns the first mismatch between the data sent by the client and
+// the transcript.
+func (c *ReplayConn) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.err
+}
+
+// Done indicates whether the whole transcript was played back.
+func (c *ReplayConn) Done() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.pos >= len(c.entries) && len(c.pending) == 0
+}
+
+func (c *ReplayConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *ReplayConn) LocalAddr() net.Addr {
+	return replayAddr{}
+}
+
+func (c *ReplayConn) RemoteAddr() net.Addr {
+	return replayAddr{}
+}
+
+func (c *ReplayConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *ReplayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *ReplayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string {
+	return "replay"
+}
+
+func (replayAddr) String() string {
+	return "replay"
+}
@@ -0,0 +1,129 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imaptest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/go-imapc"
+)
+
+func runTranscriptSession(t *testing.T, client *imapc.Client) []*imapc.Message {
+	if _, err := client.SendCommandSelect("INBOX"); err != nil {
+		t.Fatalf("cannot select mailbox: %v", err)
+	}
+
+	set := imapc.SequenceSet{imapc.NewSequenceRange(1, imapc.SequenceStar)}
+
+	rs, err := client.SendCommandFetch(set, []string{"FLAGS", "BODY.PEEK[]"})
+	if err != nil {
+		t.Fatalf("cannot fetch messages: %v", err)
+	}
+
+	if err := client.SendCommandLogout(); err != nil {
+		t.Fatalf("cannot logout: %v", err)
+	}
+
+	return rs.Messages
+}
+
+func TestRecordReplay(t *testing.T) {
+	srv := NewServer()
+	srv.AddUser("alice", "secret")
+	defer srv.Close()
+
+	date := time.Date(2016, 10, 4, 12, 30, 0, 0, time.UTC)
+	srv.Mailbox("INBOX").Append([]byte("Subject: foo\r\n\r\nfoo\r\n"),
+		[]string{"\\Seen"}, date)
+
+	// Record
+	var transcript bytes.Buffer
+
+	client := imapc.NewClient()
+	client.Login = "alice"
+	client.Password = "secret"
+
+	if err := client.ConnectConn(Record(srv.Pipe(), &transcript)); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	recordedMsgs := runTranscriptSession(t, client)
+
+	data := transcript.String()
+
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret"))
+	if strings.Contains(data, "secret") || strings.Contains(data, creds) {
+		t.Errorf("credentials found in transcript:\n%s", data)
+	}
+
+	// Replay
+	conn, err := Replay(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("cannot read transcript: %v", err)
+	}
+
+	client = imapc.NewClient()
+	client.Login = "alice"
+	client.Password = "another password"
+
+	if err := client.ConnectConn(conn); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	replayedMsgs := runTranscriptSession(t, client)
+
+	if err := conn.Err(); err != nil {
+		t.Errorf("replay error: %v", err)
+	}
+
+	if !conn.Done() {
+		t.Errorf("transcript not entirely played back")
+	}
+
+	if !reflect.DeepEqual(recordedMsgs, replayedMsgs) {
+		t.Errorf("replayed messages differ from recorded messages")
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	data := "# Greeting\n" +
+		"S: * PREAUTH [CAPABILITY IMAP4rev1] ready\r\n" +
+		"C: c0000001 SELECT \"Archives\"\r\n" +
+		"S: c0000001 OK done\r\n"
+
+	conn, err := Replay(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("cannot read transcript: %v", err)
+	}
+
+	client := imapc.NewClient()
+	if err := client.ConnectConn(conn); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	if _, err := client.SendCommandSelect("INBOX"); err == nil {
+		t.Errorf("command succeeded despite the transcript mismatch")
+	}
+
+	if conn.Err() == nil {
+		t.Errorf("mismatch not detected")
+	}
+}
@@ -0,0 +1,101 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"fmt"
+	"io"
+)
+
+// Default limits applied to data sent by the server. They are large enough
+// for any legitimate response but prevent a broken or malicious server from
+// making the client allocate unbounded amounts of memory.
+const (
+	DefaultMaxLineLength  = 1024 * 1024
+	DefaultMaxLiteralSize = 256 * 1024 * 1024
+)
+
+// Default limits on the responses to a single command. All responses are kept
+// in memory until the command completes; commands expected to return large
+// amounts of data, e.g. FETCH commands for message bodies, should be sent
+// for small batches of messages.
+const (
+	DefaultMaxResponsesPerCommand = 4 * 1024 * 1024
+	DefaultMaxBytesPerCommand     = 1024 * 1024 * 1024
+)
+
+// The default maximum number of nested parenthesized lists. Lists are read
+// recursively, so the limit also protects the stack; legitimate responses
+// such as body structures of multipart messages rarely go beyond a few
+// levels.
+const DefaultMaxNestingDepth = 100
+
+// The default maximum length of command lines. RFC 7162 recommends that
+// clients limit lines to 8192 bytes, and some servers reject longer lines.
+const DefaultMaxCommandLength = 8000
+
+// The maximum size of non-synchronizing literals when the server supports
+// LITERAL- (RFC 7888 4.)
+const MaxNonSyncLiteralSize = 4096
+
+// LimitError is returned when the server sends data exceeding one of the
+// limits configured on the client. The client cannot resynchronize with the
+// server after such an error, so the connection is closed.
+type LimitError struct {
+	Limit string
+	Max   int64
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("%s limit exceeded (maximum: %d)", err.Limit, err.Max)
+}
+
+// commandReader returns an error as soon as more than a fixed number of
+// bytes have been read for the current command. A negative remaining count
+// disables the limit.
+type commandReader struct {
+	r         io.Reader
+	max       int64
+	remaining int64
+}
+
+func (r *commandReader) reset(max int) {
+	r.max = int64(max)
+
+	if max > 0 {
+		r.remaining = int64(max)
+	} else {
+		r.remaining = -1
+	}
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return r.r.Read(p)
+	}
+
+	if r.remaining == 0 {
+		return 0, &LimitError{Limit: "command size", Max: r.max}
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
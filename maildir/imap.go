@@ -0,0 +1,368 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/galdor/go-imapc"
+)
+
+// The number of messages fetched with a single command
+const fetchBatchSize = 50
+
+const uidListFileName = "imapc-uidlist"
+
+// Export mirrors an IMAP mailbox in a maildir. The mapping between UIDs and
+// maildir messages is stored in the maildir so that subsequent exports only
+// download new messages, update flags and remove expunged messages. If the
+// UID validity of the mailbox changed, the maildir is rebuilt.
+func Export(client *imapc.Client, mailboxName, path string) error {
+	md := New(path)
+	if err := md.Create(); err != nil {
+		return err
+	}
+
+	rs, err := client.SendCommandExamine(mailboxName)
+	if err != nil {
+		return err
+	}
+
+	uidListPath := filepath.Join(path, uidListFileName)
+
+	list, err := loadUIDList(uidListPath)
+	if err != nil {
+		return err
+	}
+
+	localMsgs, err := md.Messages()
+	if err != nil {
+		return err
+	}
+
+	locals := map[string]*Message{}
+	for _, msg := range localMsgs {
+		locals[msg.Key] = msg
+	}
+
+	if list.UIDValidity != rs.UIDValidity {
+		for _, key := range list.Keys {
+			if msg, found := locals[key]; found {
+				if err := md.Remove(msg); err != nil {
+					return err
+				}
+			}
+		}
+
+		list = &uidList{
+			UIDValidity: rs.UIDValidity,
+			Keys:        map[uint32]string{},
+		}
+	}
+
+	remotes := map[uint32][]string{}
+
+	if rs.Exists > 0 {
+		set := imapc.SequenceSet{
+			imapc.NewSequenceRange(1, imapc.SequenceStar),
+		}
+
+		frs, err := client.SendCommandFetch(set, []string{"UID", "FLAGS"})
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range frs.Messages {
+			remotes[msg.UID] = msg.Flags
+		}
+	}
+
+	// Known messages
+	for uid, key := range list.Keys {
+		msg := locals[key]
+		flags, found := remotes[uid]
+
+		if !found {
+			if msg != nil {
+				if err := md.Remove(msg); err != nil {
+					return err
+				}
+			}
+
+			delete(list.Keys, uid)
+			continue
+		}
+
+		if msg == nil {
+			// The file was removed, download it again
+			delete(list.Keys, uid)
+			continue
+		}
+
+		if err := md.SetFlags(msg, flags); err != nil {
+			return err
+		}
+	}
+
+	// New messages
+	uids := []uint32{}
+	for uid := range remotes {
+		if _, found := list.Keys[uid]; !found {
+			uids = append(uids, uid)
+		}
+	}
+
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+
+	items := []string{"UID", "FLAGS", "INTERNALDATE", "BODY.PEEK[]"}
+
+	for len(uids) > 0 {
+		n := fetchBatchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+
+		set := imapc.NewSequenceSetFromNumbers(uids[:n])
+
+		frs, err := client.SendCommandFetch(set, items)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range frs.Messages {
+			data := msg.Section("BODY.PEEK[]")
+			if data == nil {
+				continue
+			}
+
+			key := NewKey()
+
+			_, err := md.Deliver(key, data, msg.Flags, msg.InternalDate)
+			if err != nil {
+				return err
+			}
+
+			list.Keys[msg.UID] = key
+		}
+
+		// Save the list after each batch so that an interrupted
+		// export does not download messages twice.
+		if err := list.save(uidListPath); err != nil {
+			return err
+		}
+
+		uids = uids[n:]
+	}
+
+	return list.save(uidListPath)
+}
+
+// ExportAccount exports all selectable mailboxes to a tree of maildirs, one
+// directory per level of the mailbox hierarchy.
+func ExportAccount(client *imapc.Client, path string) error {
+	rs, err := client.SendCommandList("", "*")
+	if err != nil {
+		return err
+	}
+
+	for _, mbox := range rs.Mailboxes {
+		if !mbox.IsSelectable() {
+			continue
+		}
+
+		mboxPath := filepath.Join(path, MailboxPath(&mbox))
+
+		if err := Export(client, mbox.Name, mboxPath); err != nil {
+			return fmt.Errorf("cannot export mailbox %q: %v",
+				mbox.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// MailboxPath returns the relative path of the maildir used for a mailbox.
+// Each part of the mailbox name is escaped so that it cannot conflict with
+// maildir subdirectories or contain path separators.
+func MailboxPath(mbox *imapc.MailboxList) string {
+	parts := []string{mbox.Name}
+	if mbox.HierarchyDelimiter != 0 {
+		parts = strings.Split(mbox.Name,
+			string(mbox.HierarchyDelimiter))
+	}
+
+	for i, part := range parts {
+		parts[i] = escapePathPart(part)
+	}
+
+	return filepath.Join(parts...)
+}
+
+func escapePathPart(part string) string {
+	var buf bytes.Buffer
+
+	for i := 0; i < len(part); i++ {
+		c := part[i]
+
+		escape := c == '%' || c == '/' || c == os.PathSeparator ||
+			(i == 0 && c == '.')
+		if escape {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+
+	s := buf.String()
+
+	switch s {
+	case "":
+		return "%00"
+	case "cur", "new", "tmp":
+		return fmt.Sprintf("%%%02X", s[0]) + s[1:]
+	}
+
+	return s
+}
+
+// Import appends all messages of a maildir to an IMAP mailbox, creating it
+// if it does not exist.
+func Import(client *imapc.Client, path, mailboxName string) error {
+	md := New(path)
+
+	msgs, err := md.Messages()
+	if err != nil {
+		return err
+	}
+
+	if err := client.SendCommandCreateIfMissing(mailboxName); err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		data, err := ioutil.ReadFile(msg.Path)
+		if err != nil {
+			return err
+		}
+
+		_, err = client.SendCommandAppend(mailboxName, msg.Flags,
+			msg.Date, data)
+		if err != nil {
+			return fmt.Errorf("cannot append %s: %v", msg.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  UID list
+// ---------------------------------------------------------------------------
+
+// uidList associates the UIDs of an IMAP mailbox with the keys of maildir
+// messages. It is stored as a text file whose first line contains the UID
+// validity, with one "<uid> <key>" line per message.
+type uidList struct {
+	UIDValidity uint32
+	Keys        map[uint32]string
+}
+
+func loadUIDList(path string) (*uidList, error) {
+	list := &uidList{
+		Keys: map[uint32]string{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return list, nil
+		}
+
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+
+		if lineNumber == 1 {
+			n, err := strconv.ParseUint(line, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid uid "+
+					"validity", path)
+			}
+
+			list.UIDValidity = uint32(n)
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid line",
+				path, lineNumber)
+		}
+
+		uid, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid uid",
+				path, lineNumber)
+		}
+
+		list.Keys[uint32(uid)] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (list *uidList) save(path string) error {
+	uids := make([]uint32, 0, len(list.Keys))
+	for uid := range list.Keys {
+		uids = append(uids, uid)
+	}
+
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%d\n", list.UIDValidity)
+	for _, uid := range uids {
+		fmt.Fprintf(&buf, "%d %s\n", uid, list.Keys[uid])
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,142 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/galdor/go-imapc"
+	"github.com/galdor/go-imapc/imaptest"
+)
+
+func newTestServer(t *testing.T) *imaptest.Server {
+	srv := imaptest.NewServer()
+	srv.AddUser("alice", "secret")
+
+	inbox := srv.Mailbox("INBOX")
+	zone := time.FixedZone("", 2*3600)
+
+	inbox.Append([]byte("Subject: foo\r\n\r\nfoo\r\n"),
+		[]string{imapc.MessageFlagSeen},
+		time.Date(2016, 10, 4, 12, 30, 0, 0, time.UTC))
+	inbox.Append([]byte("Subject: bar\r\n\r\nbar\r\n"),
+		[]string{imapc.MessageFlagFlagged, imapc.MessageFlagAnswered},
+		time.Date(2017, 3, 1, 8, 0, 15, 0, zone))
+	inbox.Append([]byte("Subject: baz\r\n\r\nbaz\r\n"), nil,
+		time.Date(2018, 12, 31, 23, 59, 59, 0, time.UTC))
+
+	srv.AddMailbox("Archive")
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+
+	return srv
+}
+
+func connectTestClient(t *testing.T, srv *imaptest.Server) *imapc.Client {
+	client := srv.NewClient()
+	client.Login = "alice"
+	client.Password = "secret"
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	return client
+}
+
+func TestExportImport(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	dirPath, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	if err := Export(client, "INBOX", dirPath); err != nil {
+		t.Fatalf("cannot export mailbox: %v", err)
+	}
+
+	// "Arch%" matches "Archive" when used as a LIST pattern
+	if err := Import(client, dirPath, "Arch%"); err != nil {
+		t.Fatalf("cannot import mailbox: %v", err)
+	}
+
+	checkMessages(t, srv.Mailbox("INBOX").Messages,
+		srv.Mailbox("Arch%").Messages)
+
+	if n := len(srv.Mailbox("Archive").Messages); n != 0 {
+		t.Errorf("%d messages imported in Archive", n)
+	}
+
+	// Importing in an existing mailbox
+	if err := Import(client, dirPath, "Archive"); err != nil {
+		t.Fatalf("cannot import mailbox: %v", err)
+	}
+
+	checkMessages(t, srv.Mailbox("INBOX").Messages,
+		srv.Mailbox("Archive").Messages)
+}
+
+func checkMessages(t *testing.T, expected, msgs []*imaptest.Message) {
+	t.Helper()
+
+	if len(msgs) != len(expected) {
+		t.Fatalf("%d messages instead of %d", len(msgs), len(expected))
+	}
+
+	index := map[string]*imaptest.Message{}
+	for _, msg := range msgs {
+		index[string(msg.Data)] = msg
+	}
+
+	for _, emsg := range expected {
+		msg := index[string(emsg.Data)]
+		if msg == nil {
+			t.Errorf("message %q not found", emsg.Data)
+			continue
+		}
+
+		flags := sortedFlags(msg.Flags)
+		if eflags := sortedFlags(emsg.Flags); !reflect.DeepEqual(flags,
+			eflags) {
+			t.Errorf("message %q has flags %v instead of %v",
+				msg.Data, flags, eflags)
+		}
+
+		if !msg.InternalDate.Equal(emsg.InternalDate) {
+			t.Errorf("message %q has date %v instead of %v",
+				msg.Data, msg.InternalDate, emsg.InternalDate)
+		}
+	}
+}
+
+func sortedFlags(flags []string) []string {
+	flags = append([]string{}, flags...)
+	sort.Strings(flags)
+	return flags
+}
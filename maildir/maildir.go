@@ -0,0 +1,240 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package maildir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/galdor/go-imapc"
+)
+
+// Maildir is a directory containing messages stored one per file in the
+// "tmp", "new" and "cur" subdirectories. See
+// https://cr.yp.to/proto/maildir.html.
+type Maildir struct {
+	Path string
+}
+
+type Message struct {
+	// The unique part of the file name, without the info suffix
+	Key string
+
+	// The current path of the file
+	Path string
+
+	Flags []string
+	Date  time.Time
+}
+
+func New(path string) *Maildir {
+	return &Maildir{Path: path}
+}
+
+func (m *Maildir) Create() error {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.Path, dir), 0700); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Messages returns all messages in the "new" and "cur" directories.
+func (m *Maildir) Messages() ([]*Message, error) {
+	msgs := []*Message{}
+
+	for _, dir := range []string{"new", "cur"} {
+		dirPath := filepath.Join(m.Path, dir)
+
+		entries, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			key, info := splitFileName(entry.Name())
+
+			msg := &Message{
+				Key:   key,
+				Path:  filepath.Join(dirPath, entry.Name()),
+				Flags: InfoToFlags(info),
+				Date:  entry.ModTime(),
+			}
+
+			msgs = append(msgs, msg)
+		}
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Key < msgs[j].Key
+	})
+
+	return msgs, nil
+}
+
+// Deliver writes a message in the "tmp" directory then moves it to the "cur"
+// directory. The modification time of the file is set to date if it is not
+// zero.
+func (m *Maildir) Deliver(key string, data []byte, flags []string, date time.Time) (*Message, error) {
+	tmpPath := filepath.Join(m.Path, "tmp", key)
+
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return nil, err
+	}
+
+	if !date.IsZero() {
+		if err := os.Chtimes(tmpPath, date, date); err != nil {
+			os.Remove(tmpPath)
+			return nil, err
+		}
+	}
+
+	msg := &Message{
+		Key:   key,
+		Path:  m.messagePath(key, flags),
+		Flags: flags,
+		Date:  date,
+	}
+
+	if err := os.Rename(tmpPath, msg.Path); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// SetFlags renames the file of a message to match a new set of flags. The
+// message is moved to the "cur" directory if necessary.
+func (m *Maildir) SetFlags(msg *Message, flags []string) error {
+	path := m.messagePath(msg.Key, flags)
+	if path == msg.Path {
+		return nil
+	}
+
+	if err := os.Rename(msg.Path, path); err != nil {
+		return err
+	}
+
+	msg.Path = path
+	msg.Flags = flags
+
+	return nil
+}
+
+func (m *Maildir) Remove(msg *Message) error {
+	err := os.Remove(msg.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (m *Maildir) messagePath(key string, flags []string) string {
+	fileName := key + ":2," + FlagsToInfo(flags)
+	return filepath.Join(m.Path, "cur", fileName)
+}
+
+var keyCounter uint64
+
+// NewKey generates a unique key for a message.
+func NewKey() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+
+	// Slashes and colons are not allowed in file names
+	hostname = strings.Replace(hostname, "/", "\\057", -1)
+	hostname = strings.Replace(hostname, ":", "\\072", -1)
+
+	now := time.Now()
+	n := atomic.AddUint64(&keyCounter, 1)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), n, hostname)
+}
+
+// ---------------------------------------------------------------------------
+//  Flags
+// ---------------------------------------------------------------------------
+var flagInfoChars = []struct {
+	Char byte
+	Flag string
+}{
+	// Info characters must be sorted
+	{'D', imapc.MessageFlagDraft},
+	{'F', imapc.MessageFlagFlagged},
+	{'P', "$Forwarded"},
+	{'R', imapc.MessageFlagAnswered},
+	{'S', imapc.MessageFlagSeen},
+	{'T', imapc.MessageFlagDeleted},
+}
+
+// FlagsToInfo returns the maildir info flags matching a list of IMAP
+// flags. Flags which cannot be represented are ignored.
+func FlagsToInfo(flags []string) string {
+	info := []byte{}
+
+	for _, fc := range flagInfoChars {
+		for _, flag := range flags {
+			if strings.EqualFold(flag, fc.Flag) {
+				info = append(info, fc.Char)
+				break
+			}
+		}
+	}
+
+	return string(info)
+}
+
+func InfoToFlags(info string) []string {
+	flags := []string{}
+
+	for _, fc := range flagInfoChars {
+		if strings.IndexByte(info, fc.Char) >= 0 {
+			flags = append(flags, fc.Flag)
+		}
+	}
+
+	return flags
+}
+
+func splitFileName(name string) (string, string) {
+	idx := strings.LastIndex(name, ":2,")
+	if idx == -1 {
+		return name, ""
+	}
+
+	return name[:idx], name[idx+3:]
+}
@@ -0,0 +1,122 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/galdor/go-imapc"
+)
+
+func TestFlagsToInfo(t *testing.T) {
+	tests := []struct {
+		flags []string
+		info  string
+	}{
+		{[]string{}, ""},
+		{[]string{"\\Seen"}, "S"},
+		{[]string{"\\Seen", "\\Answered", "\\Draft"}, "DRS"},
+		{[]string{"\\Deleted", "$Forwarded", "\\Flagged"}, "FPT"},
+		{[]string{"\\Recent", "$Junk"}, ""},
+	}
+
+	for _, test := range tests {
+		info := FlagsToInfo(test.flags)
+		if info != test.info {
+			t.Errorf("%v was converted to %q instead of %q",
+				test.flags, info, test.info)
+		}
+	}
+}
+
+func TestMaildir(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	md := New(dirPath)
+	if err := md.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2016, 11, 25, 10, 0, 0, 0, time.UTC)
+	flags := []string{imapc.MessageFlagSeen}
+
+	msg, err := md.Deliver(NewKey(), []byte("foo"), flags, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Base(msg.Path) != msg.Key+":2,S" {
+		t.Errorf("invalid file name %q", filepath.Base(msg.Path))
+	}
+
+	flags = []string{imapc.MessageFlagSeen, imapc.MessageFlagAnswered}
+	if err := md.SetFlags(msg, flags); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := md.Messages()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 1 {
+		t.Fatalf("found %d messages instead of 1", len(msgs))
+	}
+
+	if msgs[0].Key != msg.Key || !msgs[0].Date.Equal(date) {
+		t.Errorf("invalid message %#v", msgs[0])
+	}
+
+	expectedFlags := []string{imapc.MessageFlagAnswered,
+		imapc.MessageFlagSeen}
+	if !reflect.DeepEqual(msgs[0].Flags, expectedFlags) {
+		t.Errorf("invalid flags %v", msgs[0].Flags)
+	}
+}
+
+func TestMailboxPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		delimiter rune
+		path      string
+	}{
+		{"INBOX", '/', "INBOX"},
+		{"foo/bar", '/', filepath.Join("foo", "bar")},
+		{"foo.bar/baz", '.', filepath.Join("foo", "bar%2Fbaz")},
+		{"cur/.hidden", '/', filepath.Join("%63ur", "%2Ehidden")},
+		{"a%b", 0, "a%25b"},
+	}
+
+	for _, test := range tests {
+		mbox := &imapc.MailboxList{
+			Name:               test.name,
+			HierarchyDelimiter: test.delimiter,
+		}
+
+		path := MailboxPath(mbox)
+		if path != test.path {
+			t.Errorf("%q was mapped to %q instead of %q",
+				test.name, path, test.path)
+		}
+	}
+}
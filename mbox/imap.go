@@ -0,0 +1,194 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package mbox
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/galdor/go-imapc"
+	"github.com/galdor/go-imapc/maildir"
+)
+
+// The number of messages fetched with a single command
+const fetchBatchSize = 50
+
+// Export writes all the messages of an IMAP mailbox to an mbox stream.
+func Export(client *imapc.Client, mailboxName string, w io.Writer) error {
+	rs, err := client.SendCommandExamine(mailboxName)
+	if err != nil {
+		return err
+	} else if rs.Exists == 0 {
+		return nil
+	}
+
+	set := imapc.SequenceSet{
+		imapc.NewSequenceRange(1, imapc.SequenceStar),
+	}
+
+	srs, err := client.SendCommandFetch(set, []string{"UID"})
+	if err != nil {
+		return err
+	}
+
+	uids := []uint32{}
+	for _, msg := range srs.Messages {
+		uids = append(uids, msg.UID)
+	}
+
+	mw := NewWriter(w)
+	items := []string{"UID", "FLAGS", "INTERNALDATE", "BODY.PEEK[]"}
+
+	for len(uids) > 0 {
+		n := fetchBatchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+
+		set := imapc.NewSequenceSetFromNumbers(uids[:n])
+
+		frs, err := client.SendCommandFetch(set, items)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range frs.Messages {
+			data := msg.Section("BODY.PEEK[]")
+			if data == nil {
+				continue
+			}
+
+			mmsg := &Message{
+				Sender: returnPath(data),
+				Date:   msg.InternalDate,
+				Flags:  msg.Flags,
+				Data:   data,
+			}
+
+			if err := mw.WriteMessage(mmsg); err != nil {
+				return err
+			}
+		}
+
+		uids = uids[n:]
+	}
+
+	return nil
+}
+
+// ExportFile writes all the messages of an IMAP mailbox to an mbox file,
+// replacing it if it already exists.
+func ExportFile(client *imapc.Client, mailboxName, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := Export(client, mailboxName, file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// ExportAccount exports each selectable mailbox to its own mbox file, using
+// the same hierarchy as maildir.ExportAccount.
+func ExportAccount(client *imapc.Client, path string) error {
+	rs, err := client.SendCommandList("", "*")
+	if err != nil {
+		return err
+	}
+
+	for _, mbox := range rs.Mailboxes {
+		if !mbox.IsSelectable() {
+			continue
+		}
+
+		mboxPath := filepath.Join(path,
+			maildir.MailboxPath(&mbox)+".mbox")
+
+		if err := os.MkdirAll(filepath.Dir(mboxPath), 0700); err != nil {
+			return err
+		}
+
+		if err := ExportFile(client, mbox.Name, mboxPath); err != nil {
+			return fmt.Errorf("cannot export mailbox %q: %v",
+				mbox.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Import appends all the messages of an mbox stream to an IMAP mailbox,
+// creating it if it does not exist.
+func Import(client *imapc.Client, r io.Reader, mailboxName string) error {
+	if err := client.SendCommandCreateIfMissing(mailboxName); err != nil {
+		return err
+	}
+
+	mr := NewReader(r)
+
+	for i := 1; ; i++ {
+		msg, err := mr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		flags := []string{}
+		for _, flag := range msg.Flags {
+			if flag != imapc.MessageFlagRecent {
+				flags = append(flags, flag)
+			}
+		}
+
+		_, err = client.SendCommandAppend(mailboxName, flags, msg.Date,
+			msg.Data)
+		if err != nil {
+			return fmt.Errorf("cannot append message %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// returnPath extracts the address in the Return-Path header field of a
+// message, if there is one.
+func returnPath(data []byte) string {
+	header, _ := splitMessage(normalizeLineEndings(data))
+
+	for _, field := range unfoldHeader(header) {
+		name, value := splitHeaderField(field)
+		if !strings.EqualFold(name, "Return-Path") {
+			continue
+		}
+
+		value = strings.Trim(value, "<>")
+		if value == "" || strings.ContainsAny(value, " \t") {
+			return ""
+		}
+
+		return value
+	}
+
+	return ""
+}
@@ -0,0 +1,230 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package mbox
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/galdor/go-imapc"
+	"github.com/galdor/go-imapc/imaptest"
+)
+
+func newTestServer(t *testing.T) *imaptest.Server {
+	srv := imaptest.NewServer()
+	srv.AddUser("alice", "secret")
+
+	inbox := srv.Mailbox("INBOX")
+	zone := time.FixedZone("", 2*3600)
+
+	inbox.Append([]byte("Return-Path: <bob@example.com>\r\n"+
+		"Subject: foo\r\n\r\nFrom here\r\n>From there\r\n"),
+		[]string{imapc.MessageFlagSeen, "$Work"},
+		time.Date(2016, 10, 4, 12, 30, 0, 0, time.UTC))
+	inbox.Append([]byte("Subject: bar\r\n\r\nbar\r\n"),
+		[]string{imapc.MessageFlagFlagged, imapc.MessageFlagAnswered},
+		time.Date(2017, 3, 1, 8, 0, 15, 0, zone))
+	inbox.Append([]byte("Subject: baz\r\n\r\nbaz\r\n"), nil,
+		time.Date(2018, 12, 31, 23, 59, 59, 0, time.UTC))
+
+	srv.AddMailbox("Archive")
+
+	projects := srv.AddMailbox("Work/Projects")
+	projects.Append([]byte("Subject: project\r\n\r\nproject\r\n"), nil,
+		time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC))
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+
+	return srv
+}
+
+func connectTestClient(t *testing.T, srv *imaptest.Server) *imapc.Client {
+	client := srv.NewClient()
+	client.Login = "alice"
+	client.Password = "secret"
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	return client
+}
+
+func TestExportImport(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	dirPath, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	filePath := filepath.Join(dirPath, "inbox.mbox")
+
+	if err := ExportFile(client, "INBOX", filePath); err != nil {
+		t.Fatalf("cannot export mailbox: %v", err)
+	}
+
+	importFile := func(mailboxName string) {
+		file, err := os.Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		if err := Import(client, file, mailboxName); err != nil {
+			t.Fatalf("cannot import mailbox: %v", err)
+		}
+	}
+
+	// "Arch%" matches "Archive" when used as a LIST pattern
+	importFile("Arch%")
+
+	checkMessages(t, srv.Mailbox("INBOX").Messages,
+		srv.Mailbox("Arch%").Messages)
+
+	if n := len(srv.Mailbox("Archive").Messages); n != 0 {
+		t.Errorf("%d messages imported in Archive", n)
+	}
+
+	// Importing in an existing mailbox
+	importFile("Archive")
+
+	checkMessages(t, srv.Mailbox("INBOX").Messages,
+		srv.Mailbox("Archive").Messages)
+}
+
+func TestExportAccount(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	client := connectTestClient(t, srv)
+	defer client.SendCommandLogout()
+
+	dirPath, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	if err := ExportAccount(client, dirPath); err != nil {
+		t.Fatalf("cannot export account: %v", err)
+	}
+
+	tests := []struct {
+		path        string
+		mailboxName string
+	}{
+		{"INBOX.mbox", "INBOX"},
+		{"Archive.mbox", "Archive"},
+		{"Work/Projects.mbox", "Work/Projects"},
+	}
+
+	for _, test := range tests {
+		msgs := readMessages(t, filepath.Join(dirPath, test.path))
+
+		expected := srv.Mailbox(test.mailboxName).Messages
+
+		if len(msgs) != len(expected) {
+			t.Errorf("%s contains %d messages instead of %d",
+				test.path, len(msgs), len(expected))
+			continue
+		}
+
+		for i, msg := range msgs {
+			if string(msg.Data) != string(expected[i].Data) {
+				t.Errorf("%s contains message %q instead of %q",
+					test.path, msg.Data, expected[i].Data)
+			}
+		}
+	}
+}
+
+func readMessages(t *testing.T, path string) []*Message {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	mr := NewReader(file)
+
+	msgs := []*Message{}
+
+	for {
+		msg, err := mr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			t.Fatalf("cannot read %s: %v", path, err)
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs
+}
+
+func checkMessages(t *testing.T, expected, msgs []*imaptest.Message) {
+	t.Helper()
+
+	if len(msgs) != len(expected) {
+		t.Fatalf("%d messages instead of %d", len(msgs), len(expected))
+	}
+
+	for i, msg := range msgs {
+		emsg := expected[i]
+
+		if string(msg.Data) != string(emsg.Data) {
+			t.Errorf("message %d is %q instead of %q",
+				i+1, msg.Data, emsg.Data)
+		}
+
+		flags := sortedFlags(msg.Flags)
+		if eflags := sortedFlags(emsg.Flags); !reflect.DeepEqual(flags,
+			eflags) {
+			t.Errorf("message %d has flags %v instead of %v",
+				i+1, flags, eflags)
+		}
+
+		if !msg.InternalDate.Equal(emsg.InternalDate) {
+			t.Errorf("message %d has date %v instead of %v",
+				i+1, msg.InternalDate, emsg.InternalDate)
+		}
+	}
+}
+
+func sortedFlags(flags []string) []string {
+	flags = append([]string{}, flags...)
+	sort.Strings(flags)
+	return flags
+}
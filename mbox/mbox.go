@@ -0,0 +1,408 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/galdor/go-imapc"
+)
+
+// This package reads and writes mboxrd files: each message starts with a
+// "From " line containing the envelope sender and the date of the message,
+// and lines of the message matching /^>*From / are quoted with an
+// additional '>'. See https://www.loc.gov/preservation/digital/formats/fdd/fdd000385.shtml.
+//
+// Flags are stored using the Status, X-Status and X-Keywords headers used by
+// most mail user agents.
+
+const fromLineDateFormat = "Mon Jan _2 15:04:05 2006"
+
+const defaultSender = "MAILER-DAEMON"
+
+type Message struct {
+	Sender string
+	Date   time.Time
+	Flags  []string
+
+	// The message with CRLF line endings and without flag headers
+	Data []byte
+}
+
+// ---------------------------------------------------------------------------
+//  Writer
+// ---------------------------------------------------------------------------
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: bufio.NewWriter(w),
+	}
+}
+
+func (w *Writer) WriteMessage(msg *Message) error {
+	sender := msg.Sender
+	if sender == "" {
+		sender = defaultSender
+	}
+
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	fmt.Fprintf(w.w, "From %s %s\n", sender,
+		date.UTC().Format(fromLineDateFormat))
+
+	header, body := splitMessage(normalizeLineEndings(msg.Data))
+	header = removeHeaderFields(header, flagHeaderFields)
+	header = append(header, flagHeaders(msg.Flags)...)
+
+	lines := append(header, "")
+	lines = append(lines, body...)
+
+	for _, line := range lines {
+		if isFromLine(line) {
+			w.w.WriteByte('>')
+		}
+
+		w.w.WriteString(line)
+		w.w.WriteByte('\n')
+	}
+
+	// Messages are separated by an empty line
+	w.w.WriteByte('\n')
+
+	return w.w.Flush()
+}
+
+// ---------------------------------------------------------------------------
+//  Reader
+// ---------------------------------------------------------------------------
+type Reader struct {
+	r *bufio.Reader
+
+	fromLine string
+	lineNum  int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Next returns the next message, or io.EOF if there are no more messages.
+func (r *Reader) Next() (*Message, error) {
+	if r.fromLine == "" {
+		// Skip anything before the first From line
+		for {
+			line, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+
+			if strings.HasPrefix(line, "From ") {
+				r.fromLine = line
+				break
+			}
+		}
+	}
+
+	msg, err := parseFromLine(r.fromLine)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", r.lineNum, err)
+	}
+
+	lines := []string{}
+
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			r.fromLine = ""
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(line, "From ") {
+			r.fromLine = line
+			break
+		}
+
+		if strings.HasPrefix(line, ">") && isFromLine(line[1:]) {
+			line = line[1:]
+		}
+
+		lines = append(lines, line)
+	}
+
+	// Remove the empty line separating messages
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	header, body := splitLines(lines)
+	msg.Flags = parseFlagHeaders(header)
+	header = removeHeaderFields(header, flagHeaderFields)
+
+	var buf bytes.Buffer
+	for _, line := range header {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+
+	if body != nil {
+		buf.WriteString("\r\n")
+		for _, line := range body {
+			buf.WriteString(line)
+			buf.WriteString("\r\n")
+		}
+	}
+
+	msg.Data = buf.Bytes()
+
+	return msg, nil
+}
+
+func (r *Reader) readLine() (string, error) {
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			err = nil
+		} else {
+			return "", err
+		}
+	}
+
+	r.lineNum++
+
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+
+	return line, nil
+}
+
+func parseFromLine(line string) (*Message, error) {
+	parts := strings.SplitN(strings.TrimPrefix(line, "From "), " ", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid From line")
+	}
+
+	msg := &Message{
+		Sender: parts[0],
+	}
+
+	dateString := strings.TrimSpace(parts[1])
+
+	date, err := time.Parse(fromLineDateFormat, dateString)
+	if err != nil {
+		// Some writers add a time zone
+		date, err = time.Parse(time.UnixDate, dateString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date in From line")
+		}
+	}
+
+	msg.Date = date
+
+	return msg, nil
+}
+
+// ---------------------------------------------------------------------------
+//  Flags
+// ---------------------------------------------------------------------------
+var flagHeaderFields = []string{"Status", "X-Status", "X-Keywords"}
+
+var statusFlags = []struct {
+	Char   byte
+	Flag   string
+	Header string
+}{
+	{'R', imapc.MessageFlagSeen, "Status"},
+	{'A', imapc.MessageFlagAnswered, "X-Status"},
+	{'F', imapc.MessageFlagFlagged, "X-Status"},
+	{'T', imapc.MessageFlagDraft, "X-Status"},
+	{'D', imapc.MessageFlagDeleted, "X-Status"},
+}
+
+func flagHeaders(flags []string) []string {
+	status := "O"
+	xstatus := ""
+	keywords := []string{}
+
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, "\\") {
+			for _, sf := range statusFlags {
+				if !strings.EqualFold(flag, sf.Flag) {
+					continue
+				}
+
+				if sf.Header == "Status" {
+					status = string(sf.Char) + status
+				} else {
+					xstatus += string(sf.Char)
+				}
+			}
+		} else {
+			keywords = append(keywords, flag)
+		}
+	}
+
+	headers := []string{"Status: " + status}
+
+	if xstatus != "" {
+		headers = append(headers, "X-Status: "+xstatus)
+	}
+
+	if len(keywords) > 0 {
+		sort.Strings(keywords)
+		headers = append(headers,
+			"X-Keywords: "+strings.Join(keywords, " "))
+	}
+
+	return headers
+}
+
+func parseFlagHeaders(header []string) []string {
+	flags := []string{}
+
+	for _, field := range unfoldHeader(header) {
+		name, value := splitHeaderField(field)
+
+		switch strings.ToLower(name) {
+		case "status", "x-status":
+			for _, sf := range statusFlags {
+				if !strings.EqualFold(name, sf.Header) {
+					continue
+				}
+
+				if strings.IndexByte(value, sf.Char) >= 0 {
+					flags = append(flags, sf.Flag)
+				}
+			}
+
+		case "x-keywords":
+			keywords := strings.FieldsFunc(value, func(c rune) bool {
+				return c == ' ' || c == ',' || c == '\t'
+			})
+
+			flags = append(flags, keywords...)
+		}
+	}
+
+	return flags
+}
+
+// ---------------------------------------------------------------------------
+//  Utils
+// ---------------------------------------------------------------------------
+func isFromLine(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, ">"), "From ")
+}
+
+func normalizeLineEndings(data []byte) []string {
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	text = strings.TrimSuffix(text, "\n")
+
+	return strings.Split(text, "\n")
+}
+
+func splitMessage(lines []string) ([]string, []string) {
+	header, body := splitLines(lines)
+	if body == nil {
+		body = []string{}
+	}
+
+	return header, body
+}
+
+// splitLines splits a message in its header and body. The body is nil if the
+// message does not contain an empty line.
+func splitLines(lines []string) ([]string, []string) {
+	for i, line := range lines {
+		if line == "" {
+			return lines[:i], lines[i+1:]
+		}
+	}
+
+	return lines, nil
+}
+
+// removeHeaderFields removes fields, including their continuation lines.
+func removeHeaderFields(header []string, names []string) []string {
+	result := []string{}
+	removing := false
+
+	for _, line := range header {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if !removing {
+				result = append(result, line)
+			}
+
+			continue
+		}
+
+		name, _ := splitHeaderField(line)
+
+		removing = false
+		for _, n := range names {
+			if strings.EqualFold(name, n) {
+				removing = true
+				break
+			}
+		}
+
+		if !removing {
+			result = append(result, line)
+		}
+	}
+
+	return result
+}
+
+func unfoldHeader(header []string) []string {
+	fields := []string{}
+
+	for _, line := range header {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') &&
+			len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+
+		fields = append(fields, line)
+	}
+
+	return fields
+}
+
+func splitHeaderField(field string) (string, string) {
+	idx := strings.IndexByte(field, ':')
+	if idx == -1 {
+		return "", ""
+	}
+
+	return strings.TrimSpace(field[:idx]), strings.TrimSpace(field[idx+1:])
+}
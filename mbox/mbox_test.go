@@ -0,0 +1,105 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package mbox
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteRead(t *testing.T) {
+	date1 := time.Date(2016, 11, 25, 10, 0, 0, 0, time.UTC)
+	date2 := time.Date(2016, 11, 26, 8, 30, 0, 0, time.UTC)
+
+	msgs := []*Message{
+		{
+			Sender: "bob@example.com",
+			Date:   date1,
+			Flags:  []string{"\\Seen", "\\Answered", "$Work"},
+			Data: []byte("Subject: foo\r\n" +
+				"Status: U\r\n" +
+				"\r\n" +
+				"From here\r\n" +
+				">From there\r\n" +
+				"\r\n"),
+		},
+		{
+			Sender: "MAILER-DAEMON",
+			Date:   date2,
+			Flags:  []string{},
+			Data:   []byte("Subject: bar\r\n\r\nbar\r\n"),
+		},
+	}
+
+	var buf bytes.Buffer
+
+	w := NewWriter(&buf)
+	for _, msg := range msgs {
+		if err := w.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := "From bob@example.com Fri Nov 25 10:00:00 2016\n" +
+		"Subject: foo\n" +
+		"Status: RO\n" +
+		"X-Status: A\n" +
+		"X-Keywords: $Work\n" +
+		"\n" +
+		">From here\n" +
+		">>From there\n" +
+		"\n" +
+		"\n" +
+		"From MAILER-DAEMON Sat Nov 26 08:30:00 2016\n" +
+		"Subject: bar\n" +
+		"Status: O\n" +
+		"\n" +
+		"bar\n" +
+		"\n"
+
+	if buf.String() != expected {
+		t.Fatalf("invalid mbox data:\n%s", buf.String())
+	}
+
+	r := NewReader(&buf)
+	for i, msg := range msgs {
+		msg2, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg2.Sender != msg.Sender || !msg2.Date.Equal(msg.Date) {
+			t.Errorf("message %d: invalid From line data", i)
+		}
+
+		expectedData := bytes.Replace(msg.Data,
+			[]byte("Status: U\r\n"), nil, 1)
+		if !bytes.Equal(msg2.Data, expectedData) {
+			t.Errorf("message %d: invalid data %q", i, msg2.Data)
+		}
+
+		if !reflect.DeepEqual(msg2.Flags, msg.Flags) {
+			t.Errorf("message %d: invalid flags %v", i, msg2.Flags)
+		}
+	}
+
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("read data after the last message")
+	}
+}
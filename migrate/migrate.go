@@ -0,0 +1,480 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/galdor/go-imapc"
+)
+
+// The number of messages fetched with a single command
+const fetchBatchSize = 50
+
+// Migration copies all mailboxes and messages from a source account to a
+// destination account. Mailbox hierarchies are translated when both servers
+// use different hierarchy delimiters, and special use mailboxes (RFC 6154)
+// are mapped to the mailboxes with the same role on the destination server.
+//
+// Messages already present in the destination mailbox, identified by their
+// Message-ID header field, are not copied again. Progress is saved in a
+// state file after each batch of messages so that an interrupted migration
+// can be resumed.
+type Migration struct {
+	Source      *imapc.Client
+	Destination *imapc.Client
+
+	// StatePath is the path of the state file; if empty, progress is
+	// not saved.
+	StatePath string
+
+	// Mailboxes maps source mailbox names to destination mailbox names.
+	// Mailboxes not listed are mapped automatically.
+	Mailboxes map[string]string
+
+	// Log, if set, is called to report progress
+	Log func(format string, args ...interface{})
+
+	state *State
+}
+
+type State struct {
+	Mailboxes map[string]*MailboxState
+}
+
+type MailboxState struct {
+	UIDValidity uint32
+	LastUID     uint32 // the last UID copied or skipped
+}
+
+func NewMigration(source, destination *imapc.Client) *Migration {
+	return &Migration{
+		Source:      source,
+		Destination: destination,
+
+		Mailboxes: map[string]string{},
+	}
+}
+
+func (m *Migration) Run() error {
+	if err := m.loadState(); err != nil {
+		return err
+	}
+
+	srcRs, err := m.Source.SendCommandList("", "*")
+	if err != nil {
+		return fmt.Errorf("cannot list source mailboxes: %v", err)
+	}
+
+	dstRs, err := m.Destination.SendCommandList("", "*")
+	if err != nil {
+		return fmt.Errorf("cannot list destination mailboxes: %v", err)
+	}
+
+	delimiter, err := m.destinationDelimiter()
+	if err != nil {
+		return err
+	}
+
+	mapping := MapMailboxes(srcRs.Mailboxes, dstRs.Mailboxes, delimiter)
+	for src, dst := range m.Mailboxes {
+		mapping[src] = dst
+	}
+
+	existing := map[string]bool{}
+	for _, mbox := range dstRs.Mailboxes {
+		existing[mbox.Name] = true
+	}
+
+	// Sort source mailboxes so that parents are created before their
+	// children.
+	srcMboxes := append([]imapc.MailboxList{}, srcRs.Mailboxes...)
+	sort.Slice(srcMboxes, func(i, j int) bool {
+		return srcMboxes[i].Name < srcMboxes[j].Name
+	})
+
+	for _, mbox := range srcMboxes {
+		dstName := mapping[mbox.Name]
+
+		if !existing[dstName] {
+			m.log("creating mailbox %q", dstName)
+
+			err := m.Destination.SendCommandCreate(dstName)
+			if err != nil {
+				return fmt.Errorf("cannot create mailbox %q: %v",
+					dstName, err)
+			}
+
+			existing[dstName] = true
+		}
+
+		if !mbox.IsSelectable() {
+			continue
+		}
+
+		m.log("copying mailbox %q to %q", mbox.Name, dstName)
+
+		if err := m.migrateMailbox(mbox.Name, dstName); err != nil {
+			return fmt.Errorf("cannot migrate mailbox %q: %v",
+				mbox.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Migration) destinationDelimiter() (rune, error) {
+	// LIST "" "" returns the hierarchy delimiter (RFC 3501 6.3.8)
+	rs, err := m.Destination.SendCommandList("", "")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, mbox := range rs.Mailboxes {
+		if mbox.HierarchyDelimiter != 0 {
+			return mbox.HierarchyDelimiter, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func (m *Migration) migrateMailbox(srcName, dstName string) error {
+	srcRs, err := m.Source.SendCommandExamine(srcName)
+	if err != nil {
+		return err
+	}
+
+	mboxState := m.state.Mailboxes[srcName]
+	if mboxState == nil || mboxState.UIDValidity != srcRs.UIDValidity {
+		mboxState = &MailboxState{UIDValidity: srcRs.UIDValidity}
+		m.state.Mailboxes[srcName] = mboxState
+	}
+
+	if srcRs.Exists == 0 {
+		return m.saveState()
+	}
+
+	// Source UIDs not copied yet
+	set := imapc.SequenceSet{
+		imapc.NewSequenceRange(imapc.SequenceNumber(mboxState.LastUID+1),
+			imapc.SequenceStar),
+	}
+
+	frs, err := m.Source.SendCommandFetch(set, []string{"UID"})
+	if err != nil {
+		return err
+	}
+
+	uids := []uint32{}
+	for _, msg := range frs.Messages {
+		if msg.UID > mboxState.LastUID {
+			uids = append(uids, msg.UID)
+		}
+	}
+
+	if len(uids) == 0 {
+		return m.saveState()
+	}
+
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+
+	knownIds, err := m.destinationMessageIds(dstName)
+	if err != nil {
+		return err
+	}
+
+	for len(uids) > 0 {
+		n := fetchBatchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+
+		if err := m.copyMessages(uids[:n], dstName, knownIds); err != nil {
+			return err
+		}
+
+		mboxState.LastUID = uids[n-1]
+		if err := m.saveState(); err != nil {
+			return err
+		}
+
+		uids = uids[n:]
+	}
+
+	return nil
+}
+
+func (m *Migration) copyMessages(uids []uint32, dstName string, knownIds map[string]bool) error {
+	set := imapc.NewSequenceSetFromNumbers(uids)
+
+	// Fetch Message-ID fields first to avoid downloading duplicates
+	items := []string{"UID", messageIdItem}
+
+	hrs, err := m.Source.SendCommandFetch(set, items)
+	if err != nil {
+		return err
+	}
+
+	copySet := imapc.NewSequenceSet()
+
+	for _, msg := range hrs.Messages {
+		id := MessageId(msg.Section(messageIdItem))
+		if id != "" && knownIds[id] {
+			continue
+		}
+
+		copySet.Append(imapc.SequenceNumber(msg.UID))
+	}
+
+	if len(copySet) == 0 {
+		return nil
+	}
+
+	items = []string{"UID", "FLAGS", "INTERNALDATE", "BODY.PEEK[]"}
+
+	rs, err := m.Source.SendCommandFetch(copySet, items)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(rs.Messages, func(i, j int) bool {
+		return rs.Messages[i].UID < rs.Messages[j].UID
+	})
+
+	for _, msg := range rs.Messages {
+		data := msg.Section("BODY.PEEK[]")
+		if data == nil {
+			continue
+		}
+
+		flags := []string{}
+		for _, flag := range msg.Flags {
+			if flag != imapc.MessageFlagRecent {
+				flags = append(flags, flag)
+			}
+		}
+
+		_, err := m.Destination.SendCommandAppend(dstName, flags,
+			msg.InternalDate, data)
+		if err != nil {
+			return fmt.Errorf("cannot append message %d: %v",
+				msg.UID, err)
+		}
+
+		if id := MessageId(data); id != "" {
+			knownIds[id] = true
+		}
+	}
+
+	return nil
+}
+
+const messageIdItem = "BODY.PEEK[HEADER.FIELDS (MESSAGE-ID)]"
+
+func (m *Migration) destinationMessageIds(mailboxName string) (map[string]bool, error) {
+	ids := map[string]bool{}
+
+	rs, err := m.Destination.SendCommandExamine(mailboxName)
+	if err != nil {
+		return nil, err
+	} else if rs.Exists == 0 {
+		return ids, nil
+	}
+
+	set := imapc.SequenceSet{
+		imapc.NewSequenceRange(1, imapc.SequenceStar),
+	}
+
+	frs, err := m.Destination.SendCommandFetch(set, []string{messageIdItem})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range frs.Messages {
+		if id := MessageId(msg.Section(messageIdItem)); id != "" {
+			ids[id] = true
+		}
+	}
+
+	return ids, nil
+}
+
+func (m *Migration) loadState() error {
+	m.state = &State{
+		Mailboxes: map[string]*MailboxState{},
+	}
+
+	if m.StatePath == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(m.StatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if err := json.Unmarshal(data, m.state); err != nil {
+		return fmt.Errorf("cannot decode %s: %v", m.StatePath, err)
+	}
+
+	if m.state.Mailboxes == nil {
+		m.state.Mailboxes = map[string]*MailboxState{}
+	}
+
+	return nil
+}
+
+func (m *Migration) saveState() error {
+	if m.StatePath == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(m.state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := m.StatePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, m.StatePath)
+}
+
+func (m *Migration) log(format string, args ...interface{}) {
+	if m.Log != nil {
+		m.Log(format, args...)
+	}
+}
+
+// ---------------------------------------------------------------------------
+//  Mailbox mapping
+// ---------------------------------------------------------------------------
+
+// MapMailboxes returns the name of the destination mailbox for each source
+// mailbox. Special use mailboxes are mapped to the destination mailbox with
+// the same role if there is one; other mailboxes keep their hierarchy, with
+// the source delimiter replaced by dstDelimiter.
+func MapMailboxes(srcMboxes, dstMboxes []imapc.MailboxList, dstDelimiter rune) map[string]string {
+	roles := map[string]string{}
+	for _, mbox := range dstMboxes {
+		if role := mbox.SpecialUse(); role != "" {
+			if _, found := roles[role]; !found {
+				roles[role] = mbox.Name
+			}
+		}
+	}
+
+	mapping := map[string]string{}
+
+	for _, mbox := range srcMboxes {
+		if role := mbox.SpecialUse(); role != "" {
+			if name, found := roles[role]; found {
+				mapping[mbox.Name] = name
+				continue
+			}
+		}
+
+		mapping[mbox.Name] = MapMailboxName(mbox.Name,
+			mbox.HierarchyDelimiter, dstDelimiter)
+	}
+
+	return mapping
+}
+
+// MapMailboxName translates a mailbox name from a hierarchy delimiter to
+// another one. Occurrences of the destination delimiter in the parts of the
+// name are replaced by '_'.
+func MapMailboxName(name string, srcDelimiter, dstDelimiter rune) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+
+	parts := []string{name}
+	if srcDelimiter != 0 {
+		parts = strings.Split(name, string(srcDelimiter))
+	}
+
+	if dstDelimiter == 0 {
+		// Flat namespace
+		return strings.Join(parts, "_")
+	}
+
+	for i, part := range parts {
+		parts[i] = strings.Replace(part, string(dstDelimiter), "_", -1)
+	}
+
+	// Children of INBOX keep the INBOX prefix in upper case
+	if len(parts) > 1 && strings.EqualFold(parts[0], "INBOX") {
+		parts[0] = "INBOX"
+	}
+
+	return strings.Join(parts, string(dstDelimiter))
+}
+
+// MessageId returns the value of the Message-ID header field of a message or
+// message header, or an empty string if there is none.
+func MessageId(data []byte) string {
+	lines := bytes.Split(data, []byte("\n"))
+
+	for i := 0; i < len(lines); i++ {
+		line := bytes.TrimRight(lines[i], "\r")
+		if len(line) == 0 {
+			break
+		}
+
+		idx := bytes.IndexByte(line, ':')
+		if idx == -1 {
+			continue
+		}
+
+		name := bytes.TrimSpace(line[:idx])
+		if !bytes.EqualFold(name, []byte("Message-ID")) {
+			continue
+		}
+
+		value := append([]byte{}, line[idx+1:]...)
+
+		// Continuation lines
+		for i+1 < len(lines) {
+			next := bytes.TrimRight(lines[i+1], "\r")
+			if len(next) == 0 || (next[0] != ' ' && next[0] != '\t') {
+				break
+			}
+
+			value = append(value, next...)
+			i++
+		}
+
+		return string(bytes.TrimSpace(value))
+	}
+
+	return ""
+}
@@ -0,0 +1,227 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package migrate
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/go-imapc"
+	"github.com/galdor/go-imapc/imaptest"
+)
+
+func TestMapMailboxName(t *testing.T) {
+	tests := []struct {
+		name         string
+		srcDelimiter rune
+		dstDelimiter rune
+		dstName      string
+	}{
+		{"INBOX", '.', '/', "INBOX"},
+		{"inbox", '.', '/', "INBOX"},
+		{"INBOX.foo", '.', '/', "INBOX/foo"},
+		{"foo.bar.baz", '.', '/', "foo/bar/baz"},
+		{"foo/bar.baz", '.', '/', "foo_bar/baz"},
+		{"foo/bar", '/', 0, "foo_bar"},
+		{"foo", 0, '.', "foo"},
+	}
+
+	for _, test := range tests {
+		name := MapMailboxName(test.name, test.srcDelimiter,
+			test.dstDelimiter)
+		if name != test.dstName {
+			t.Errorf("%q was mapped to %q instead of %q",
+				test.name, name, test.dstName)
+		}
+	}
+}
+
+func TestMapMailboxes(t *testing.T) {
+	srcMboxes := []imapc.MailboxList{
+		{Name: "INBOX", HierarchyDelimiter: '.'},
+		{Name: "INBOX.Sent", HierarchyDelimiter: '.',
+			Flags: []string{imapc.MailboxFlagSent}},
+		{Name: "INBOX.Archives.2016", HierarchyDelimiter: '.'},
+	}
+
+	dstMboxes := []imapc.MailboxList{
+		{Name: "INBOX", HierarchyDelimiter: '/'},
+		{Name: "Sent Items", HierarchyDelimiter: '/',
+			Flags: []string{"\\HasNoChildren", "\\sent"}},
+	}
+
+	expected := map[string]string{
+		"INBOX":               "INBOX",
+		"INBOX.Sent":          "Sent Items",
+		"INBOX.Archives.2016": "INBOX/Archives/2016",
+	}
+
+	mapping := MapMailboxes(srcMboxes, dstMboxes, '/')
+	if !reflect.DeepEqual(mapping, expected) {
+		t.Errorf("invalid mapping %v", mapping)
+	}
+}
+
+func TestMessageId(t *testing.T) {
+	tests := []struct {
+		data string
+		id   string
+	}{
+		{"", ""},
+		{"Subject: foo\r\n\r\nMessage-ID: <a@b>\r\n", ""},
+		{"Subject: foo\r\nMessage-Id: <a@b>\r\n\r\n", "<a@b>"},
+		{"message-id:\r\n <a@b>\r\n\r\n", "<a@b>"},
+	}
+
+	for _, test := range tests {
+		id := MessageId([]byte(test.data))
+		if id != test.id {
+			t.Errorf("found id %q instead of %q in %q",
+				id, test.id, test.data)
+		}
+	}
+}
+
+func newTestServer(t *testing.T, delimiter rune, setup func(*imaptest.Server)) *imaptest.Server {
+	srv := imaptest.NewServer()
+	srv.HierarchyDelimiter = delimiter
+	srv.AddUser("alice", "secret")
+
+	setup(srv)
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("cannot start server: %v", err)
+	}
+
+	return srv
+}
+
+func connectTestClient(t *testing.T, srv *imaptest.Server) *imapc.Client {
+	client := srv.NewClient()
+	client.Login = "alice"
+	client.Password = "secret"
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	return client
+}
+
+func testMessageData(id string) []byte {
+	return []byte("Message-ID: <" + id + "@example.com>\r\n" +
+		"Subject: " + id + "\r\n\r\n" + id + "\r\n")
+}
+
+func TestMigrationRun(t *testing.T) {
+	date := time.Date(2016, 10, 4, 12, 30, 0, 0, time.UTC)
+
+	src := newTestServer(t, '/', func(srv *imaptest.Server) {
+		inbox := srv.Mailbox("INBOX")
+		inbox.Append(testMessageData("foo"),
+			[]string{imapc.MessageFlagSeen}, date)
+		inbox.Append(testMessageData("bar"),
+			[]string{imapc.MessageFlagFlagged}, date)
+		inbox.Append(testMessageData("baz"), nil, date)
+
+		sent := srv.AddMailbox("Sent", imapc.MailboxFlagSent)
+		sent.Append(testMessageData("sent"),
+			[]string{imapc.MessageFlagSeen}, date)
+
+		srv.AddMailbox("Work")
+		projects := srv.AddMailbox("Work/Projects")
+		projects.Append(testMessageData("project"), nil, date)
+	})
+	defer src.Close()
+
+	dst := newTestServer(t, '.', func(srv *imaptest.Server) {
+		// Already copied, e.g. by a previous migration tool
+		srv.Mailbox("INBOX").Append(testMessageData("bar"), nil, date)
+
+		srv.AddMailbox("Sent Items", imapc.MailboxFlagSent)
+	})
+	defer dst.Close()
+
+	srcClient := connectTestClient(t, src)
+	defer srcClient.SendCommandLogout()
+
+	dstClient := connectTestClient(t, dst)
+	defer dstClient.SendCommandLogout()
+
+	expected := map[string][]string{
+		"INBOX":         {"bar", "baz", "foo"},
+		"Sent Items":    {"sent"},
+		"Work":          {},
+		"Work.Projects": {"project"},
+	}
+
+	// The second migration does not have any saved state; messages
+	// already copied are identified by their Message-ID.
+	for i := 0; i < 2; i++ {
+		migration := NewMigration(srcClient, dstClient)
+
+		if err := migration.Run(); err != nil {
+			t.Fatalf("cannot run migration %d: %v", i+1, err)
+		}
+
+		for name, subjects := range expected {
+			checkMailbox(t, dst, name, subjects)
+		}
+	}
+
+	flags := map[string][]string{}
+	for _, msg := range dst.Mailbox("INBOX").Messages {
+		flags[messageSubject(msg)] = msg.Flags
+	}
+
+	if !reflect.DeepEqual(flags["foo"], []string{imapc.MessageFlagSeen}) {
+		t.Errorf("invalid flags %v for message foo", flags["foo"])
+	}
+}
+
+func checkMailbox(t *testing.T, srv *imaptest.Server, name string, expected []string) {
+	t.Helper()
+
+	mbox := srv.Mailbox(name)
+	if mbox == nil {
+		t.Errorf("mailbox %q not found", name)
+		return
+	}
+
+	subjects := []string{}
+	for _, msg := range mbox.Messages {
+		subjects = append(subjects, messageSubject(msg))
+	}
+
+	sort.Strings(subjects)
+
+	if !reflect.DeepEqual(subjects, expected) {
+		t.Errorf("mailbox %q contains %v instead of %v",
+			name, subjects, expected)
+	}
+}
+
+func messageSubject(msg *imaptest.Message) string {
+	data := string(msg.Data)
+
+	start := strings.Index(data, "Subject: ") + 9
+	end := strings.Index(data[start:], "\r\n")
+
+	return data[start : start+end]
+}
@@ -79,18 +79,35 @@ loop:
 func ModifiedUTF7Decode(data []byte) ([]byte, error) {
 	buf := bytes.NewBuffer([]byte{})
 
+	// Directly encoded characters should be printable ASCII characters,
+	// but some servers send UTF-8 names; we accept them as long as they
+	// are valid so that decoded names are always valid UTF-8.
+	writeDirect := func(data []byte) error {
+		if !utf8.Valid(data) {
+			return fmt.Errorf("invalid modified utf7 encoding")
+		}
+
+		buf.Write(data)
+		return nil
+	}
+
 loop:
 	for len(data) > 0 {
 		// Find the next encoded sequence
 		end := bytes.IndexByte(data, byte('&'))
 
 		if end == -1 {
-			buf.Write(data)
+			if err := writeDirect(data); err != nil {
+				return nil, err
+			}
+
 			break
 		}
 
 		// Write and skip directly encoded characters
-		buf.Write(data[:end])
+		if err := writeDirect(data[:end]); err != nil {
+			return nil, err
+		}
 
 		data = data[end:]
 
@@ -262,12 +279,12 @@ func ModifiedBase64Decode(data []byte) ([]byte, error) {
 	}
 
 	// Decode utf16-be to utf8
-	nbchars := len(data)
-	if nbchars%2 != 0 {
+	u16data := u16buf.Bytes()
+	if len(u16data)%2 != 0 {
 		return nil, fmt.Errorf("invalid utf16 data")
 	}
 
-	return UTF16BEToUTF8(u16buf.Bytes()), nil
+	return UTF16BEToUTF8(u16data), nil
 }
 
 func UTF8ToUTF16BE(data []byte) []byte {
@@ -293,7 +310,7 @@ func UTF16BEToUTF8(data []byte) []byte {
 	nbchars := len(data)
 
 	u16s := make([]uint16, nbchars/2)
-	for i := 0; i < nbchars; i += 2 {
+	for i := 0; i+1 < nbchars; i += 2 {
 		u16s[i/2] = (uint16(data[i]) << 8) | uint16(data[i+1])
 	}
 
@@ -0,0 +1,154 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// CommandInfo describes a command processed by the client. The same value is
+// passed to Observer.CommandStarted and Observer.CommandDone; fields after
+// Start are only set when the command is done.
+type CommandInfo struct {
+	Name  string // e.g. "SELECT" or "UID FETCH"
+	Tag   string
+	Start time.Time
+
+	Duration     time.Duration
+	BytesWritten int64
+	BytesRead    int64
+
+	// The status of the tagged response ("OK", "NO" or "BAD") and its
+	// response code if there is one. Status is empty if the command
+	// failed before a status response was received, in which case Error
+	// is set.
+	Status     string
+	StatusCode string
+	StatusText string
+	Error      error
+}
+
+// Observer is notified before and after each command sent by the client,
+// e.g. to export metrics or traces. Methods are called from the goroutine
+// processing commands and should not block.
+type Observer interface {
+	CommandStarted(*CommandInfo)
+	CommandDone(*CommandInfo)
+}
+
+func (c *Client) observeCommand(cmd Command) *CommandResponse {
+	if c.Observer == nil {
+		return c.processCommand(cmd)
+	}
+
+	info := &CommandInfo{
+		Name:  commandName(cmd),
+		Tag:   formatTag(c.Tag + 1),
+		Start: time.Now(),
+	}
+
+	written := atomic.LoadInt64(&c.bytesWritten)
+	read := atomic.LoadInt64(&c.bytesRead)
+
+	c.Observer.CommandStarted(info)
+
+	cmdResp := c.processCommand(cmd)
+
+	info.Duration = time.Since(info.Start)
+	info.BytesWritten = atomic.LoadInt64(&c.bytesWritten) - written
+	info.BytesRead = atomic.LoadInt64(&c.bytesRead) - read
+	info.Error = cmdResp.Error
+
+	if status := cmdResp.Status; status != nil {
+		info.Status = status.ResponseName
+
+		var text *ResponseText
+
+		switch tresp := status.Response.(type) {
+		case *ResponseOk:
+			text = tresp.Text
+		case *ResponseNo:
+			text = tresp.Text
+		case *ResponseBad:
+			text = tresp.Text
+		}
+
+		if text != nil {
+			info.StatusCode = text.Code
+			info.StatusText = text.Text
+		}
+	}
+
+	c.Observer.CommandDone(info)
+
+	return cmdResp
+}
+
+// commandName returns the name of a command, including the UID prefix.
+func commandName(cmd Command) string {
+	args := cmd.Args()
+
+	name := commandArgString(args, 0)
+	if name == "UID" {
+		name += " " + commandArgString(args, 1)
+	}
+
+	return name
+}
+
+func commandArgString(args []interface{}, i int) string {
+	if i >= len(args) {
+		return ""
+	}
+
+	switch targ := args[i].(type) {
+	case string:
+		return targ
+	case []byte:
+		return string(targ)
+	}
+
+	return ""
+}
+
+func formatTag(n int) string {
+	return fmt.Sprintf("c%07d", n)
+}
+
+type countingReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.count, int64(n))
+	return n, err
+}
@@ -0,0 +1,140 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+// Package otelobserver provides an imapc.Observer creating a span for each
+// command. It does not depend on OpenTelemetry: Tracer and Span mirror the
+// subset of the OpenTelemetry tracing API used, so that an OpenTelemetry
+// tracer can be plugged in with a small wrapper.
+package otelobserver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/galdor/go-imapc"
+)
+
+type Attribute struct {
+	Key   string
+	Value interface{} // string or int64
+}
+
+type Span interface {
+	SetAttributes(...Attribute)
+	RecordError(error)
+	SetError(description string)
+	End()
+}
+
+type Tracer interface {
+	Start(ctx context.Context, spanName string) (context.Context, Span)
+}
+
+// Observer creates a span named "imap <command>" for each command.
+// Attributes follow the naming conventions of OpenTelemetry:
+//
+//   imap.command        command name, e.g. "UID FETCH"
+//   imap.tag            command tag
+//   imap.bytes_written  number of bytes sent
+//   imap.bytes_read     number of bytes received
+//   imap.status         status of the tagged response (OK, NO or BAD)
+//   imap.status_code    response code of the tagged response, if any
+//
+// Commands whose status is not OK are marked as errors.
+type Observer struct {
+	Tracer Tracer
+
+	// Context is the parent context of all spans
+	Context context.Context
+
+	mutex    sync.Mutex
+	spans    map[*imapc.CommandInfo]Span
+	inFlight int64
+}
+
+func New(ctx context.Context, tracer Tracer) *Observer {
+	return &Observer{
+		Tracer:  tracer,
+		Context: ctx,
+
+		spans: map[*imapc.CommandInfo]Span{},
+	}
+}
+
+// InFlight returns the number of commands started and not done yet, for all
+// clients using the observer.
+func (o *Observer) InFlight() int64 {
+	return atomic.LoadInt64(&o.inFlight)
+}
+
+func (o *Observer) CommandStarted(info *imapc.CommandInfo) {
+	atomic.AddInt64(&o.inFlight, 1)
+
+	ctx := o.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	_, span := o.Tracer.Start(ctx, "imap "+info.Name)
+
+	span.SetAttributes(
+		Attribute{Key: "imap.command", Value: info.Name},
+		Attribute{Key: "imap.tag", Value: info.Tag},
+	)
+
+	o.mutex.Lock()
+	o.spans[info] = span
+	o.mutex.Unlock()
+}
+
+func (o *Observer) CommandDone(info *imapc.CommandInfo) {
+	atomic.AddInt64(&o.inFlight, -1)
+
+	o.mutex.Lock()
+	span, found := o.spans[info]
+	delete(o.spans, info)
+	o.mutex.Unlock()
+
+	if !found {
+		return
+	}
+
+	attrs := []Attribute{
+		{Key: "imap.bytes_written", Value: info.BytesWritten},
+		{Key: "imap.bytes_read", Value: info.BytesRead},
+	}
+
+	if info.Status != "" {
+		attrs = append(attrs,
+			Attribute{Key: "imap.status", Value: info.Status})
+	}
+
+	if info.StatusCode != "" {
+		attrs = append(attrs,
+			Attribute{Key: "imap.status_code", Value: info.StatusCode})
+	}
+
+	span.SetAttributes(attrs...)
+
+	if info.Error != nil {
+		span.RecordError(info.Error)
+		span.SetError(info.Error.Error())
+	} else if info.Status != "OK" {
+		span.SetError(info.StatusText)
+	}
+
+	span.End()
+}
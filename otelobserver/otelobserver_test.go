@@ -0,0 +1,114 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package otelobserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/galdor/go-imapc"
+	"github.com/galdor/go-imapc/imaptest"
+)
+
+type testSpan struct {
+	name  string
+	attrs map[string]interface{}
+	err   string
+	ended bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) {
+}
+
+func (s *testSpan) SetError(description string) {
+	s.err = description
+}
+
+func (s *testSpan) End() {
+	s.ended = true
+}
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &testSpan{name: name, attrs: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func TestObserver(t *testing.T) {
+	srv := imaptest.NewServer()
+	srv.PreAuth = true
+	defer srv.Close()
+
+	tracer := &testTracer{}
+	observer := New(context.Background(), tracer)
+
+	client := imapc.NewClient()
+	client.Observer = observer
+
+	if err := client.ConnectConn(srv.Pipe()); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	if _, err := client.SendCommandSelect("Unknown"); err == nil {
+		t.Fatalf("selected a mailbox which does not exist")
+	}
+
+	if err := client.SendCommandLogout(); err != nil {
+		t.Fatalf("cannot logout: %v", err)
+	}
+
+	if n := observer.InFlight(); n != 0 {
+		t.Errorf("%d commands still in flight", n)
+	}
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("%d spans created", len(tracer.spans))
+	}
+
+	span := tracer.spans[0]
+
+	if span.name != "imap SELECT" || !span.ended {
+		t.Errorf("invalid span %#v", span)
+	}
+
+	if span.attrs["imap.tag"] != "c0000001" ||
+		span.attrs["imap.status"] != "NO" ||
+		span.attrs["imap.status_code"] != "NONEXISTENT" {
+		t.Errorf("invalid span attributes %v", span.attrs)
+	}
+
+	if span.err == "" {
+		t.Errorf("span not marked as failed")
+	}
+
+	if n, _ := span.attrs["imap.bytes_written"].(int64); n == 0 {
+		t.Errorf("no bytes written")
+	}
+
+	if tracer.spans[1].name != "imap LOGOUT" || tracer.spans[1].err != "" {
+		t.Errorf("invalid span %#v", tracer.spans[1])
+	}
+}
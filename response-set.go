@@ -15,6 +15,10 @@
 
 package imapc
 
+import (
+	"fmt"
+)
+
 type ResponseSet interface {
 	Init([]Response, *ResponseStatus) error
 }
@@ -29,16 +33,24 @@ type ResponseSetList struct {
 func (rs *ResponseSetList) Init(resps []Response, status *ResponseStatus) error {
 	rs.Mailboxes = []MailboxList{}
 
+	statuses := map[string]MailboxStatus{}
+
 	for _, resp := range resps {
 		switch tresp := resp.(type) {
 		case *ResponseList:
-			mbox := MailboxList{
-				Flags:              tresp.Flags,
-				HierarchyDelimiter: tresp.HierarchyDelimiter,
-				Name:               tresp.Name,
-			}
+			rs.Mailboxes = append(rs.Mailboxes, MailboxList(*tresp))
 
-			rs.Mailboxes = append(rs.Mailboxes, mbox)
+		case *ResponseMailboxStatus:
+			// LIST-STATUS (RFC 5819)
+			statuses[tresp.MailboxName] = tresp.Status
+		}
+	}
+
+	for i := range rs.Mailboxes {
+		mbox := &rs.Mailboxes[i]
+
+		if status, found := statuses[mbox.Name]; found {
+			mbox.Status = &status
 		}
 	}
 
@@ -71,17 +83,73 @@ func (rs *ResponseSetLSub) Init(resps []Response, status *ResponseStatus) error
 	return nil
 }
 
+// ---------------------------------------------------------------------------
+//  Response set: STATUS
+// ---------------------------------------------------------------------------
+type ResponseSetStatus struct {
+	MailboxName string
+	Status      MailboxStatus
+}
+
+func (rs *ResponseSetStatus) Init(resps []Response, status *ResponseStatus) error {
+	found := false
+
+	for _, resp := range resps {
+		switch tresp := resp.(type) {
+		case *ResponseMailboxStatus:
+			rs.MailboxName = tresp.MailboxName
+			rs.Status = tresp.Status
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("missing STATUS response")
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Response set: ENABLE
+// ---------------------------------------------------------------------------
+type ResponseSetEnable struct {
+	Extensions []string
+}
+
+func (rs *ResponseSetEnable) Init(resps []Response, status *ResponseStatus) error {
+	rs.Extensions = []string{}
+
+	for _, resp := range resps {
+		switch tresp := resp.(type) {
+		case *ResponseEnabled:
+			rs.Extensions = append(rs.Extensions, tresp.Extensions...)
+		}
+	}
+
+	return nil
+}
+
 // ---------------------------------------------------------------------------
 //  Response set: EXAMINE
 // ---------------------------------------------------------------------------
 type ResponseSetExamine struct {
 	Flags          []string
 	Exists         uint32
-	Recent         uint32
+	Recent         uint32 // never sent with IMAP4rev2
 	Unseen         uint32
 	PermanentFlags []string
 	UIDNext        uint32
 	UIDValidity    uint32
+
+	// CONDSTORE (RFC 7162)
+	HighestModSeq uint64
+	NoModSeq      bool
+
+	// QRESYNC (RFC 7162): UIDs of the messages expunged and messages
+	// changed since the mod-sequence sent with the command.
+	Vanished SequenceSet
+	Changed  []*Message
 }
 
 func (rs *ResponseSetExamine) Init(resps []Response, status *ResponseStatus) error {
@@ -93,22 +161,33 @@ func (rs *ResponseSetExamine) Init(resps []Response, status *ResponseStatus) err
 			rs.Exists = tresp.Count
 		case *ResponseRecent:
 			rs.Recent = tresp.Count
+		case *ResponseVanished:
+			if tresp.Earlier {
+				rs.Vanished = append(rs.Vanished,
+					tresp.UIDs...)
+			}
 		case *ResponseOk:
 			codeData := tresp.Text.CodeData
 
 			switch tresp.Text.Code {
 			case "UNSEEN":
-				rs.Unseen = codeData.(uint32)
+				rs.Unseen, _ = codeData.(uint32)
 			case "PERMANENTFLAGS":
-				rs.PermanentFlags = codeData.([]string)
+				rs.PermanentFlags, _ = codeData.([]string)
 			case "UIDNEXT":
-				rs.UIDNext = codeData.(uint32)
+				rs.UIDNext, _ = codeData.(uint32)
 			case "UIDVALIDITY":
-				rs.UIDValidity = codeData.(uint32)
+				rs.UIDValidity, _ = codeData.(uint32)
+			case "HIGHESTMODSEQ":
+				rs.HighestModSeq, _ = codeData.(uint64)
+			case "NOMODSEQ":
+				rs.NoModSeq = true
 			}
 		}
 	}
 
+	rs.Changed = fetchMessages(resps)
+
 	return nil
 }
 
@@ -118,11 +197,20 @@ func (rs *ResponseSetExamine) Init(resps []Response, status *ResponseStatus) err
 type ResponseSetSelect struct {
 	Flags          []string
 	Exists         uint32
-	Recent         uint32
+	Recent         uint32 // never sent with IMAP4rev2
 	Unseen         uint32
 	PermanentFlags []string
 	UIDNext        uint32
 	UIDValidity    uint32
+
+	// CONDSTORE (RFC 7162)
+	HighestModSeq uint64
+	NoModSeq      bool
+
+	// QRESYNC (RFC 7162): UIDs of the messages expunged and messages
+	// changed since the mod-sequence sent with the command.
+	Vanished SequenceSet
+	Changed  []*Message
 }
 
 func (rs *ResponseSetSelect) Init(resps []Response, status *ResponseStatus) error {
@@ -134,22 +222,33 @@ func (rs *ResponseSetSelect) Init(resps []Response, status *ResponseStatus) erro
 			rs.Exists = tresp.Count
 		case *ResponseRecent:
 			rs.Recent = tresp.Count
+		case *ResponseVanished:
+			if tresp.Earlier {
+				rs.Vanished = append(rs.Vanished,
+					tresp.UIDs...)
+			}
 		case *ResponseOk:
 			codeData := tresp.Text.CodeData
 
 			switch tresp.Text.Code {
 			case "UNSEEN":
-				rs.Unseen = codeData.(uint32)
+				rs.Unseen, _ = codeData.(uint32)
 			case "PERMANENTFLAGS":
-				rs.PermanentFlags = codeData.([]string)
+				rs.PermanentFlags, _ = codeData.([]string)
 			case "UIDNEXT":
-				rs.UIDNext = codeData.(uint32)
+				rs.UIDNext, _ = codeData.(uint32)
 			case "UIDVALIDITY":
-				rs.UIDValidity = codeData.(uint32)
+				rs.UIDValidity, _ = codeData.(uint32)
+			case "HIGHESTMODSEQ":
+				rs.HighestModSeq, _ = codeData.(uint64)
+			case "NOMODSEQ":
+				rs.NoModSeq = true
 			}
 		}
 	}
 
+	rs.Changed = fetchMessages(resps)
+
 	return nil
 }
 
@@ -158,6 +257,15 @@ func (rs *ResponseSetSelect) Init(resps []Response, status *ResponseStatus) erro
 // ---------------------------------------------------------------------------
 type ResponseSetSearch struct {
 	MessageIds SequenceSet
+
+	// ESEARCH (RFC 4731), only set if the matching return option was
+	// used and at least one message matched
+	Min   uint32
+	Max   uint32
+	Count uint32
+
+	// CONDSTORE (RFC 7162), only set if the search key contained MODSEQ
+	ModSeq uint64
 }
 
 func (rs *ResponseSetSearch) Init(resps []Response, status *ResponseStatus) error {
@@ -169,10 +277,207 @@ func (rs *ResponseSetSearch) Init(resps []Response, status *ResponseStatus) erro
 			for _, id := range tresp.MessageIds {
 				ids.Append(SequenceNumber(id))
 			}
+
+			rs.ModSeq = tresp.ModSeq
+
+		case *ResponseESearch:
+			// IMAP4rev2 servers always use ESEARCH responses
+			for _, e := range tresp.All {
+				ids.Append(e)
+			}
+
+			rs.Min = tresp.Min
+			rs.Max = tresp.Max
+			rs.Count = tresp.Count
+			rs.ModSeq = tresp.ModSeq
 		}
 	}
 
-	rs.MessageIds = ids
+	rs.MessageIds = ids.Compact()
+
+	return nil
+}
+
+func (rs *ResponseSetSearch) merge(rs2 *ResponseSetSearch) {
+	rs.MessageIds = rs.MessageIds.Union(rs2.MessageIds)
+
+	if rs2.Min > 0 && (rs.Min == 0 || rs2.Min < rs.Min) {
+		rs.Min = rs2.Min
+	}
+
+	if rs2.Max > rs.Max {
+		rs.Max = rs2.Max
+	}
+
+	rs.Count += rs2.Count
+
+	if rs2.ModSeq > rs.ModSeq {
+		rs.ModSeq = rs2.ModSeq
+	}
+}
+
+// ---------------------------------------------------------------------------
+//  Response set: SORT
+// ---------------------------------------------------------------------------
+type ResponseSetSort struct {
+	// MessageIds is ordered according to the sort criteria
+	MessageIds []uint32
+
+	// CONDSTORE (RFC 7162), only set if the search key contained MODSEQ
+	ModSeq uint64
+}
+
+func (rs *ResponseSetSort) Init(resps []Response, status *ResponseStatus) error {
+	rs.MessageIds = []uint32{}
+
+	for _, resp := range resps {
+		switch tresp := resp.(type) {
+		case *ResponseSort:
+			rs.MessageIds = append(rs.MessageIds, tresp.MessageIds...)
+			rs.ModSeq = tresp.ModSeq
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Response set: THREAD
+// ---------------------------------------------------------------------------
+type ResponseSetThread struct {
+	Threads []*Thread
+}
+
+func (rs *ResponseSetThread) Init(resps []Response, status *ResponseStatus) error {
+	rs.Threads = []*Thread{}
+
+	for _, resp := range resps {
+		switch tresp := resp.(type) {
+		case *ResponseThread:
+			rs.Threads = append(rs.Threads, tresp.Threads...)
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+//  Response set: FETCH
+// ---------------------------------------------------------------------------
+type ResponseSetFetch struct {
+	Messages []*Message
+
+	// QRESYNC (RFC 7162), only set when using the VANISHED modifier
+	Vanished SequenceSet
+}
+
+func (rs *ResponseSetFetch) Init(resps []Response, status *ResponseStatus) error {
+	rs.Messages = fetchMessages(resps)
+
+	for _, resp := range resps {
+		switch tresp := resp.(type) {
+		case *ResponseVanished:
+			if tresp.Earlier {
+				rs.Vanished = append(rs.Vanished,
+					tresp.UIDs...)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (rs *ResponseSetFetch) merge(rs2 *ResponseSetFetch) {
+	rs.Messages = append(rs.Messages, rs2.Messages...)
+	rs.Vanished = append(rs.Vanished, rs2.Vanished...)
+}
+
+// fetchMessages collects the data from FETCH responses. The data for a single
+// message can be split in several responses, e.g. when the server sends
+// unsolicited flag updates, so we merge them.
+func fetchMessages(resps []Response) []*Message {
+	messages := []*Message{}
+	index := map[uint32]*Message{}
+
+	for _, resp := range resps {
+		tresp, ok := resp.(*ResponseFetch)
+		if !ok {
+			continue
+		}
+
+		msg, found := index[tresp.SequenceNumber]
+		if !found {
+			msg = &Message{SequenceNumber: tresp.SequenceNumber}
+			index[tresp.SequenceNumber] = msg
+			messages = append(messages, msg)
+		}
+
+		msg.merge((*Message)(tresp))
+	}
+
+	return messages
+}
+
+// ---------------------------------------------------------------------------
+//  Response set: STORE
+// ---------------------------------------------------------------------------
+type ResponseSetStore struct {
+	Messages []*Message
+
+	// CONDSTORE (RFC 7162): messages which were not updated because they
+	// were modified after the UNCHANGEDSINCE mod-sequence.
+	Modified SequenceSet
+}
+
+func (rs *ResponseSetStore) Init(resps []Response, status *ResponseStatus) error {
+	rs.Messages = fetchMessages(resps)
+	rs.Modified = NewSequenceSet()
+
+	if status != nil {
+		if tresp, ok := status.Response.(*ResponseOk); ok {
+			if tresp.Text.Code == "MODIFIED" {
+				set, _ := tresp.Text.CodeData.(SequenceSet)
+				rs.Modified = set
+			}
+		}
+	}
+
+	return nil
+}
+
+func (rs *ResponseSetStore) merge(rs2 *ResponseSetStore) {
+	rs.Messages = append(rs.Messages, rs2.Messages...)
+	rs.Modified = append(rs.Modified, rs2.Modified...)
+}
+
+// ---------------------------------------------------------------------------
+//  Response set: APPEND
+// ---------------------------------------------------------------------------
+type ResponseSetAppend struct {
+	// UIDPLUS (RFC 4315), zero if not supported by the server
+	UIDValidity uint32
+	UID         uint32
+}
+
+func (rs *ResponseSetAppend) Init(resps []Response, status *ResponseStatus) error {
+	if status == nil {
+		return nil
+	}
+
+	tresp, ok := status.Response.(*ResponseOk)
+	if !ok || tresp.Text.Code != "APPENDUID" {
+		return nil
+	}
+
+	data, ok := tresp.Text.CodeData.(*AppendUIDData)
+	if !ok || len(data.UIDs) != 1 {
+		return nil
+	}
+
+	if uid, ok := data.UIDs[0].(SequenceNumber); ok {
+		rs.UIDValidity = data.UIDValidity
+		rs.UID = uint32(uid)
+	}
 
 	return nil
 }
@@ -18,7 +18,10 @@ package imapc
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Response interface {
@@ -198,17 +201,28 @@ func ReadResponseData(s *Stream) (Response, error) {
 		}
 		count := uint32(n)
 
-		rest, err := s.ReadUntil([]byte("\r\n"))
+		name, err := s.ReadWhile(func(b byte) bool {
+			return b >= 'A' && b <= 'Z'
+		})
 		if err != nil {
 			return nil, err
 		}
-		tag := string(rest)
+
+		if _, err := s.SkipByte(' '); err != nil {
+			return nil, err
+		}
+
+		tag := string(name)
 
 		switch tag {
 		case "EXISTS":
 			r = &ResponseExists{Count: count}
 		case "RECENT":
 			r = &ResponseRecent{Count: count}
+		case "EXPUNGE":
+			r = &ResponseExpunge{SequenceNumber: count}
+		case "FETCH":
+			r = &ResponseFetch{SequenceNumber: count}
 		default:
 			return nil, fmt.Errorf("unknown response %q", tag)
 		}
@@ -232,6 +246,18 @@ func ReadResponseData(s *Stream) (Response, error) {
 			r = &ResponseFlags{}
 		case "SEARCH":
 			r = &ResponseSearch{}
+		case "ESEARCH":
+			r = &ResponseESearch{}
+		case "STATUS":
+			r = &ResponseMailboxStatus{}
+		case "ENABLED":
+			r = &ResponseEnabled{}
+		case "VANISHED":
+			r = &ResponseVanished{}
+		case "SORT":
+			r = &ResponseSort{}
+		case "THREAD":
+			r = &ResponseThread{}
 		default:
 			return nil, fmt.Errorf("unknown response %q", tag)
 		}
@@ -283,14 +309,22 @@ func (r *ResponseCapability) Read(s *Stream) error {
 		return err
 	}
 
-	parts := bytes.Split(data, []byte{' '})
+	r.Caps = parseCapabilities(data)
+
+	return nil
+}
+
+func parseCapabilities(data []byte) []string {
+	// Some servers send trailing or repeated spaces; empty capability
+	// names are never valid so we just ignore them.
+	parts := bytes.Fields(data)
 
-	r.Caps = make([]string, len(parts))
+	caps := make([]string, len(parts))
 	for i, cap := range parts {
-		r.Caps[i] = string(cap)
+		caps[i] = string(cap)
 	}
 
-	return nil
+	return caps
 }
 
 // LIST
@@ -410,6 +444,9 @@ func (r *ResponseRecent) Read(s *Stream) error {
 // SEARCH
 type ResponseSearch struct {
 	MessageIds []uint32
+
+	// CONDSTORE (RFC 7162)
+	ModSeq uint64
 }
 
 func (r *ResponseSearch) GoString() string {
@@ -428,11 +465,24 @@ func (r *ResponseSearch) Read(s *Stream) error {
 	data, err := s.ReadUntilAndSkip([]byte("\r\n"))
 	if err != nil {
 		return err
-	} else if len(data) == 0 {
-		return nil
 	}
 
-	parts := bytes.Split(data, []byte{' '})
+	// CONDSTORE (RFC 7162 3.1.5)
+	if idx := bytes.Index(data, []byte("(MODSEQ ")); idx >= 0 {
+		modSeqData := bytes.TrimSuffix(data[idx+8:], []byte{')'})
+
+		r.ModSeq, err = strconv.ParseUint(string(modSeqData), 10, 63)
+		if err != nil {
+			return fmt.Errorf("invalid mod-sequence value")
+		}
+
+		data = data[:idx]
+	}
+
+	parts := bytes.Fields(data)
+	if len(parts) == 0 {
+		return nil
+	}
 
 	r.MessageIds = make([]uint32, len(parts))
 	for i, part := range parts {
@@ -447,6 +497,508 @@ func (r *ResponseSearch) Read(s *Stream) error {
 	return nil
 }
 
+// EXPUNGE
+type ResponseExpunge struct {
+	SequenceNumber uint32
+}
+
+func (r *ResponseExpunge) GoString() string {
+	return fmt.Sprintf("#<response-expunge %d>", r.SequenceNumber)
+}
+
+func (r *ResponseExpunge) Read(s *Stream) error {
+	// End
+	if ok, err := s.SkipBytes([]byte("\r\n")); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("invalid character after EXPUNGE")
+	}
+
+	return nil
+}
+
+// ESEARCH (RFC 4731, RFC 9051)
+type ResponseESearch struct {
+	Tag string
+	UID bool
+
+	// Min, Max and All are only set if at least one message matched
+	Min      uint32
+	Max      uint32
+	All      SequenceSet
+	Count    uint32
+	HasCount bool
+
+	// CONDSTORE (RFC 7162)
+	ModSeq uint64
+}
+
+func (r *ResponseESearch) GoString() string {
+	return fmt.Sprintf("#<response-esearch %q uid:%v min:%d max:%d "+
+		"count:%d all:%v>", r.Tag, r.UID, r.Min, r.Max, r.Count, r.All)
+}
+
+func (r *ResponseESearch) Read(s *Stream) error {
+	// The search correlator (RFC 4466)
+	if found, err := s.SkipBytes([]byte("(TAG ")); err != nil {
+		return err
+	} else if found {
+		tag, err := s.ReadIMAPAstring()
+		if err != nil {
+			return err
+		}
+		r.Tag = string(tag)
+
+		if found, err := s.SkipByte(')'); err != nil {
+			return err
+		} else if !found {
+			return fmt.Errorf("invalid search correlator")
+		}
+
+		if _, err := s.SkipByte(' '); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if found, err := s.SkipBytes([]byte("\r\n")); err != nil {
+			return err
+		} else if found {
+			return nil
+		}
+
+		name, err := s.ReadWhile(func(b byte) bool {
+			return b != ' ' && b != '\r'
+		})
+		if err != nil {
+			return err
+		}
+
+		if string(bytes.ToUpper(name)) == "UID" {
+			r.UID = true
+		} else {
+			if found, err := s.SkipByte(' '); err != nil {
+				return err
+			} else if !found {
+				return fmt.Errorf("missing value for %s "+
+					"search return data", name)
+			}
+
+			err := r.readReturnData(s, string(bytes.ToUpper(name)))
+			if err != nil {
+				return fmt.Errorf("invalid %s search return "+
+					"data: %w", name, err)
+			}
+		}
+
+		if _, err := s.SkipByte(' '); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *ResponseESearch) readReturnData(s *Stream, name string) error {
+	var err error
+
+	switch name {
+	case "MIN":
+		r.Min, err = s.ReadIMAPNumber()
+	case "MAX":
+		r.Max, err = s.ReadIMAPNumber()
+	case "COUNT":
+		r.Count, err = s.ReadIMAPNumber()
+		r.HasCount = true
+	case "ALL":
+		r.All, err = s.ReadIMAPSequenceSet()
+	case "MODSEQ":
+		r.ModSeq, err = s.ReadIMAPNumber64()
+	default:
+		// Return data added by extensions we do not support
+		_, err = s.ReadIMAPValue()
+	}
+
+	return err
+}
+
+// STATUS
+type ResponseMailboxStatus struct {
+	MailboxName string
+	Status      MailboxStatus
+}
+
+func (r *ResponseMailboxStatus) GoString() string {
+	return fmt.Sprintf("#<response-mailbox-status %q %+v>",
+		r.MailboxName, r.Status)
+}
+
+func (r *ResponseMailboxStatus) Read(s *Stream) error {
+	name, err := s.ReadIMAPMailboxName()
+	if err != nil {
+		return err
+	}
+	r.MailboxName = name
+
+	if found, err := s.SkipByte(' '); err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("missing space after mailbox name")
+	}
+
+	value, err := s.ReadIMAPValue()
+	if err != nil {
+		return err
+	}
+
+	items, ok := value.([]interface{})
+	if !ok || len(items)%2 != 0 {
+		return fmt.Errorf("invalid status attribute list")
+	}
+
+	for i := 0; i < len(items); i += 2 {
+		name, ok1 := items[i].([]byte)
+		data, ok2 := items[i+1].([]byte)
+		if !ok1 || !ok2 {
+			return fmt.Errorf("invalid status attribute list")
+		}
+
+		n, err := strconv.ParseUint(string(data), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s status value", name)
+		}
+
+		status := &r.Status
+
+		var field *uint32
+
+		switch string(bytes.ToUpper(name)) {
+		case "MESSAGES":
+			field = &status.Messages
+		case "RECENT":
+			field = &status.Recent
+		case "UIDNEXT":
+			field = &status.UIDNext
+		case "UIDVALIDITY":
+			field = &status.UIDValidity
+		case "UNSEEN":
+			field = &status.Unseen
+		case "DELETED":
+			field = &status.Deleted
+		case "SIZE":
+			status.Size = n
+		}
+
+		if field != nil {
+			if n > math.MaxUint32 {
+				return fmt.Errorf("invalid %s status value",
+					name)
+			}
+
+			*field = uint32(n)
+		}
+	}
+
+	// Some servers send a trailing space before the end of the line
+	if _, err := s.SkipByte(' '); err != nil {
+		return err
+	}
+
+	if ok, err := s.SkipBytes([]byte("\r\n")); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("invalid character after status " +
+			"attribute list")
+	}
+
+	return nil
+}
+
+// VANISHED (RFC 7162)
+type ResponseVanished struct {
+	// Earlier is set when the response is sent as a reply to a command
+	// with QRESYNC or VANISHED modifiers, as opposed to an unsolicited
+	// response replacing EXPUNGE.
+	Earlier bool
+	UIDs    SequenceSet
+}
+
+func (r *ResponseVanished) GoString() string {
+	return fmt.Sprintf("#<response-vanished earlier:%v %v>",
+		r.Earlier, r.UIDs)
+}
+
+func (r *ResponseVanished) Read(s *Stream) error {
+	if found, err := s.SkipBytes([]byte("(EARLIER) ")); err != nil {
+		return err
+	} else if found {
+		r.Earlier = true
+	}
+
+	uids, err := s.ReadIMAPSequenceSet()
+	if err != nil {
+		return err
+	}
+	r.UIDs = uids
+
+	if ok, err := s.SkipBytes([]byte("\r\n")); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("invalid character after VANISHED")
+	}
+
+	return nil
+}
+
+// SORT (RFC 5256)
+type ResponseSort struct {
+	MessageIds []uint32
+
+	// CONDSTORE (RFC 7162)
+	ModSeq uint64
+}
+
+func (r *ResponseSort) GoString() string {
+	return fmt.Sprintf("#<response-sort %v>", r.MessageIds)
+}
+
+func (r *ResponseSort) Read(s *Stream) error {
+	// SORT responses use the same format as SEARCH responses
+	return (*ResponseSearch)(r).Read(s)
+}
+
+// THREAD (RFC 5256)
+type ResponseThread struct {
+	Threads []*Thread
+}
+
+func (r *ResponseThread) GoString() string {
+	buf := bytes.NewBuffer([]byte{})
+	for _, t := range r.Threads {
+		buf.WriteString(t.String())
+	}
+
+	return fmt.Sprintf("#<response-thread %s>", buf.String())
+}
+
+func (r *ResponseThread) Read(s *Stream) error {
+	for {
+		if found, err := s.SkipBytes([]byte("\r\n")); err != nil {
+			return err
+		} else if found {
+			return nil
+		}
+
+		t, err := s.ReadIMAPThread()
+		if err != nil {
+			return err
+		}
+
+		r.Threads = append(r.Threads, t)
+	}
+}
+
+// ENABLED (RFC 5161)
+type ResponseEnabled struct {
+	Extensions []string
+}
+
+func (r *ResponseEnabled) GoString() string {
+	return fmt.Sprintf("#<response-enabled %v>", r.Extensions)
+}
+
+func (r *ResponseEnabled) Read(s *Stream) error {
+	data, err := s.ReadUntilAndSkip([]byte("\r\n"))
+	if err != nil {
+		return err
+	}
+
+	r.Extensions = parseCapabilities(data)
+
+	return nil
+}
+
+// FETCH
+type ResponseFetch Message
+
+func (r *ResponseFetch) GoString() string {
+	return fmt.Sprintf("#<response-fetch %d uid:%d flags:%v>",
+		r.SequenceNumber, r.UID, r.Flags)
+}
+
+func (r *ResponseFetch) Read(s *Stream) error {
+	if found, err := s.SkipByte('('); err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("missing '(' for message attribute list")
+	}
+
+	for i := 0; ; i++ {
+		if found, err := s.SkipByte(')'); err != nil {
+			return err
+		} else if found {
+			break
+		}
+
+		if i > 0 {
+			if found, err := s.SkipByte(' '); err != nil {
+				return err
+			} else if !found {
+				return fmt.Errorf("missing space between " +
+					"message attributes")
+			}
+		}
+
+		// Item names can contain spaces in section specifications,
+		// e.g. "BODY[HEADER.FIELDS (FROM TO)]".
+		depth := 0
+		nameData, err := s.ReadWhile(func(b byte) bool {
+			switch b {
+			case '[':
+				depth++
+			case ']':
+				depth--
+			case ' ':
+				return depth > 0
+			case '\r', '\n', ')':
+				return depth > 0
+			}
+
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		if found, err := s.SkipByte(' '); err != nil {
+			return err
+		} else if !found {
+			return fmt.Errorf("missing value for message "+
+				"attribute %q", nameData)
+		}
+
+		value, err := s.ReadIMAPValue()
+		if err != nil {
+			return err
+		}
+
+		name := string(bytes.ToUpper(nameData))
+		if err := r.setItem(name, value); err != nil {
+			return fmt.Errorf("invalid %s message attribute: %v",
+				name, err)
+		}
+	}
+
+	if ok, err := s.SkipBytes([]byte("\r\n")); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("invalid character after message " +
+			"attribute list")
+	}
+
+	return nil
+}
+
+func (r *ResponseFetch) setItem(name string, value interface{}) error {
+	switch {
+	case name == "UID":
+		n, err := fetchValueNumber(value, 32)
+		if err != nil {
+			return err
+		}
+
+		r.UID = uint32(n)
+
+	case name == "FLAGS":
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("invalid flag list")
+		}
+
+		r.Flags = make([]string, 0, len(list))
+		for _, v := range list {
+			flag, ok := v.([]byte)
+			if !ok {
+				return fmt.Errorf("invalid flag")
+			}
+
+			r.Flags = append(r.Flags, string(flag))
+		}
+
+	case name == "INTERNALDATE":
+		data, ok := value.([]byte)
+		if !ok {
+			return fmt.Errorf("invalid date")
+		}
+
+		date, err := time.Parse(IMAPDateTimeFormat, string(data))
+		if err != nil {
+			return fmt.Errorf("invalid date")
+		}
+
+		r.InternalDate = date
+
+	case name == "RFC822.SIZE":
+		n, err := fetchValueNumber(value, 32)
+		if err != nil {
+			return err
+		}
+
+		r.Size = uint32(n)
+
+	case name == "MODSEQ":
+		list, ok := value.([]interface{})
+		if !ok || len(list) != 1 {
+			return fmt.Errorf("invalid mod-sequence value")
+		}
+
+		n, err := fetchValueNumber(list[0], 63)
+		if err != nil {
+			return err
+		}
+
+		r.ModSeq = n
+
+	case strings.HasPrefix(name, "BODY[") ||
+		strings.HasPrefix(name, "BINARY[") ||
+		name == "RFC822" || name == "RFC822.HEADER" ||
+		name == "RFC822.TEXT":
+		if value == nil {
+			break
+		}
+
+		data, ok := value.([]byte)
+		if !ok {
+			return fmt.Errorf("invalid section data")
+		}
+
+		if r.Sections == nil {
+			r.Sections = map[string][]byte{}
+		}
+		r.Sections[name] = data
+
+	default:
+		if r.Items == nil {
+			r.Items = map[string]interface{}{}
+		}
+		r.Items[name] = value
+	}
+
+	return nil
+}
+
+func fetchValueNumber(value interface{}, bitSize int) (uint64, error) {
+	data, ok := value.([]byte)
+	if !ok {
+		return 0, fmt.Errorf("invalid number")
+	}
+
+	n, err := strconv.ParseUint(string(data), 10, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number")
+	}
+
+	return n, nil
+}
+
 // ---------------------------------------------------------------------------
 //  Command continuation responses
 // ---------------------------------------------------------------------------
@@ -494,11 +1046,16 @@ func (r *ResponseText) Read(s *Stream) error {
 	if err != nil {
 		return err
 	} else if found {
-		// Response text code
-		codeBytes, err := s.ReadUntilAndSkip([]byte("] "))
+		// Response text code. The space after the code is mandatory,
+		// but some servers omit it when there is no text.
+		codeBytes, err := s.ReadUntilByteAndSkip(']')
 		if err != nil {
 			return err
 		}
+
+		if _, err := s.SkipByte(' '); err != nil {
+			return err
+		}
 		r.CodeString = string(codeBytes)
 
 		var codeData []byte
@@ -537,16 +1094,48 @@ func (r *ResponseText) ReadCodeData(data []byte) error {
 			return err
 		}
 
-		parts := bytes.Split(capsData, []byte{' '})
-		caps := make([]string, len(parts))
-		for i, cap := range parts {
-			caps[i] = string(cap)
+		r.CodeData = parseCapabilities(capsData)
+
+	case "HIGHESTMODSEQ":
+		n, err := s.ReadIMAPNumber64()
+		if err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("invalid zero value")
+		}
+
+		r.CodeData = n
+
+	case "APPENDUID":
+		uidValidity, err := s.ReadIMAPNumber()
+		if err != nil {
+			return err
 		}
 
-		r.CodeData = caps
+		if found, err := s.SkipByte(' '); err != nil {
+			return err
+		} else if !found {
+			return fmt.Errorf("missing space after uid validity")
+		}
+
+		uids, err := s.ReadIMAPSequenceSet()
+		if err != nil {
+			return err
+		}
+
+		r.CodeData = &AppendUIDData{
+			UIDValidity: uidValidity,
+			UIDs:        uids,
+		}
+
+	case "MODIFIED":
+		set, err := s.ReadIMAPSequenceSet()
+		if err != nil {
+			return err
+		}
+
+		r.CodeData = set
 
-	case "HIGHESTMODSEQ":
-		fallthrough
 	case "UIDNEXT":
 		fallthrough
 	case "UIDVALIDITY":
@@ -569,6 +1158,35 @@ func (r *ResponseText) ReadCodeData(data []byte) error {
 
 		r.CodeData = flags
 
+	case "BADCHARSET":
+		// The list of supported charsets is optional
+		charsets := []string{}
+
+		if empty, err := s.IsEmpty(); err != nil {
+			return err
+		} else if !empty {
+			value, err := s.ReadIMAPValue()
+			if err != nil {
+				return err
+			}
+
+			values, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("invalid charset list")
+			}
+
+			for _, value := range values {
+				charset, ok := value.([]byte)
+				if !ok {
+					return fmt.Errorf("invalid charset")
+				}
+
+				charsets = append(charsets, string(charset))
+			}
+		}
+
+		r.CodeData = charsets
+
 	default:
 		codeData, err := s.ReadAll()
 		if err != nil {
@@ -588,6 +1206,12 @@ func (r *ResponseText) ReadCodeData(data []byte) error {
 	return nil
 }
 
+// UIDPLUS (RFC 4315)
+type AppendUIDData struct {
+	UIDValidity uint32
+	UIDs        SequenceSet
+}
+
 func (r *ResponseText) GoString() string {
 	if r.Code == "" {
 		return fmt.Sprintf("#<response-text %q>", r.Text)
@@ -0,0 +1,339 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type readResponseTest struct {
+	data string
+	resp Response
+
+	// Read mailbox names as UTF-8 (IMAP4rev2, UTF8=ACCEPT)
+	utf8 bool
+}
+
+func testReadResponse(t *testing.T, tests []readResponseTest) {
+	t.Helper()
+
+	for _, test := range tests {
+		s := NewStream(bytes.NewReader([]byte(test.data)))
+		s.MailboxNameUTF8 = test.utf8
+
+		resp, err := ReadResponse(s)
+		if err != nil {
+			t.Errorf("cannot read response %q: %v", test.data, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(resp, test.resp) {
+			t.Errorf("%q was read as %#v instead of %#v",
+				test.data, resp, test.resp)
+		}
+	}
+}
+
+func TestReadResponseIMAP4rev2(t *testing.T) {
+	testReadResponse(t, []readResponseTest{
+		// EXPUNGE
+		{data: "* 44 EXPUNGE\r\n",
+			resp: &ResponseExpunge{SequenceNumber: 44}},
+
+		// ESEARCH
+		{data: "* ESEARCH (TAG \"A282\") MIN 2 COUNT 3\r\n",
+			resp: &ResponseESearch{Tag: "A282", Min: 2,
+				Count: 3, HasCount: true}},
+		{data: "* ESEARCH (TAG \"A283\") ALL 2,10:11\r\n",
+			resp: &ResponseESearch{Tag: "A283",
+				All: SequenceSet{
+					SequenceNumber(2),
+					NewSequenceRange(10, 11),
+				}}},
+		{data: "* ESEARCH (TAG \"A284\") MIN 4\r\n",
+			resp: &ResponseESearch{Tag: "A284", Min: 4}},
+		{data: "* ESEARCH (TAG \"A285\") UID MIN 7 MAX 3800\r\n",
+			resp: &ResponseESearch{Tag: "A285", UID: true,
+				Min: 7, Max: 3800}},
+		{data: "* ESEARCH (TAG \"A286\") COUNT 0\r\n",
+			resp: &ResponseESearch{Tag: "A286", HasCount: true}},
+		{data: "* ESEARCH (TAG \"A287\") UID\r\n",
+			resp: &ResponseESearch{Tag: "A287", UID: true}},
+		{data: "* ESEARCH UID COUNT 17 ALL 4:18,21,28\r\n",
+			resp: &ResponseESearch{UID: true, Count: 17,
+				HasCount: true,
+				All: SequenceSet{
+					NewSequenceRange(4, 18),
+					SequenceNumber(21),
+					SequenceNumber(28),
+				}}},
+		{data: "* ESEARCH (TAG \"A288\") PARTIAL (1:10 NIL) MAX 5\r\n",
+			resp: &ResponseESearch{Tag: "A288", Max: 5}},
+
+		// STATUS
+		{data: "* STATUS blurdybloop (MESSAGES 231 UIDNEXT 44292)\r\n",
+			resp: &ResponseMailboxStatus{
+				MailboxName: "blurdybloop",
+				Status: MailboxStatus{
+					Messages: 231,
+					UIDNext:  44292,
+				}}},
+		{data: "* STATUS INBOX (DELETED 3 SIZE 8589934592 " +
+			"UIDVALIDITY 42) \r\n",
+			resp: &ResponseMailboxStatus{
+				MailboxName: "INBOX",
+				Status: MailboxStatus{
+					UIDValidity: 42,
+					Deleted:     3,
+					Size:        8589934592,
+				}}},
+		{data: "* STATUS \"Caf&AOk-\" (UNSEEN 1)\r\n",
+			resp: &ResponseMailboxStatus{
+				MailboxName: "Café",
+				Status:      MailboxStatus{Unseen: 1}}},
+		{data: "* STATUS \"Café\" (UNSEEN 1)\r\n", utf8: true,
+			resp: &ResponseMailboxStatus{
+				MailboxName: "Café",
+				Status:      MailboxStatus{Unseen: 1}}},
+
+		// LIST
+		{data: "* LIST (\\Noselect) \"/\" foo\r\n",
+			resp: &ResponseList{
+				Flags:              []string{`\Noselect`},
+				HierarchyDelimiter: '/',
+				Name:               "foo"}},
+		{data: "* LIST () NIL inbox\r\n",
+			resp: &ResponseList{
+				Flags: []string{},
+				Name:  "inbox"}},
+		{data: "* LIST () \"/\" \"Foo/Bar\" (\"OLDNAME\" (\"Bar\"))\r\n",
+			resp: &ResponseList{
+				Flags:              []string{},
+				HierarchyDelimiter: '/',
+				Name:               "Foo/Bar",
+				OldName:            "Bar"}},
+		{data: "* LIST (\\NonExistent) \".\" Foo " +
+			"(CHILDINFO (\"SUBSCRIBED\"))\r\n",
+			resp: &ResponseList{
+				Flags:              []string{`\NonExistent`},
+				HierarchyDelimiter: '.',
+				Name:               "Foo",
+				ChildInfo:          []string{"SUBSCRIBED"}}},
+		{data: "* LIST () \"/\" \"Caf&AOk-\" (OLDNAME (\"&AOk-t&AOk-\"))\r\n",
+			resp: &ResponseList{
+				Flags:              []string{},
+				HierarchyDelimiter: '/',
+				Name:               "Café",
+				OldName:            "été"}},
+		{data: "* LIST () \"/\" \"Café\" (OLDNAME (\"été\"))\r\n",
+			utf8: true,
+			resp: &ResponseList{
+				Flags:              []string{},
+				HierarchyDelimiter: '/',
+				Name:               "Café",
+				OldName:            "été"}},
+
+		// ENABLED
+		{data: "* ENABLED IMAP4rev2\r\n",
+			resp: &ResponseEnabled{
+				Extensions: []string{"IMAP4rev2"}}},
+	})
+}
+
+func TestReadResponseInvalid(t *testing.T) {
+	tests := []string{
+		"* STATUS INBOX (MESSAGES 4294967296)\r\n",
+		"* STATUS INBOX (UIDNEXT -1)\r\n",
+		"* STATUS INBOX (SIZE 18446744073709551616)\r\n",
+	}
+
+	for _, data := range tests {
+		s := NewStream(bytes.NewReader([]byte(data)))
+
+		if resp, err := ReadResponse(s); err == nil {
+			t.Errorf("%q was read as %#v", data, resp)
+		}
+	}
+}
+
+func TestReadResponseEnabled(t *testing.T) {
+	testReadResponse(t, []readResponseTest{
+		{data: "* ENABLED\r\n",
+			resp: &ResponseEnabled{Extensions: []string{}}},
+		{data: "* ENABLED CONDSTORE QRESYNC\r\n",
+			resp: &ResponseEnabled{
+				Extensions: []string{"CONDSTORE", "QRESYNC"}}},
+		{data: "* ENABLED  UTF8=ACCEPT \r\n",
+			resp: &ResponseEnabled{
+				Extensions: []string{"UTF8=ACCEPT"}}},
+	})
+}
+
+func TestResponseSetEnable(t *testing.T) {
+	resps := []Response{
+		&ResponseEnabled{Extensions: []string{"CONDSTORE"}},
+		&ResponseExists{Count: 3},
+		&ResponseEnabled{Extensions: []string{"QRESYNC"}},
+	}
+
+	var rs ResponseSetEnable
+	if err := rs.Init(resps, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	extensions := []string{"CONDSTORE", "QRESYNC"}
+	if !reflect.DeepEqual(rs.Extensions, extensions) {
+		t.Errorf("extensions are %v instead of %v",
+			rs.Extensions, extensions)
+	}
+}
+
+func TestReadResponseCondStore(t *testing.T) {
+	testReadResponse(t, []readResponseTest{
+		// FETCH
+		{data: "* 7 FETCH (MODSEQ (12121231000))\r\n",
+			resp: &ResponseFetch{SequenceNumber: 7,
+				ModSeq: 12121231000}},
+		{data: "* 50 FETCH (UID 4 MODSEQ (65402) FLAGS (\\Seen))\r\n",
+			resp: &ResponseFetch{SequenceNumber: 50, UID: 4,
+				ModSeq: 65402, Flags: []string{`\Seen`}}},
+
+		// SEARCH, SORT and ESEARCH
+		{data: "* SEARCH 2 5 6 7 11 12 18 19 20 23 (MODSEQ 917162500)\r\n",
+			resp: &ResponseSearch{
+				MessageIds: []uint32{
+					2, 5, 6, 7, 11, 12, 18, 19, 20, 23},
+				ModSeq: 917162500}},
+		{data: "* SORT 3 1 (MODSEQ 42)\r\n",
+			resp: &ResponseSort{MessageIds: []uint32{3, 1},
+				ModSeq: 42}},
+		{data: "* ESEARCH (TAG \"a\") ALL 1:3,5 MODSEQ 1236\r\n",
+			resp: &ResponseESearch{Tag: "a",
+				All: SequenceSet{
+					NewSequenceRange(1, 3),
+					SequenceNumber(5),
+				},
+				ModSeq: 1236}},
+
+		// Response codes
+		{data: "* OK [HIGHESTMODSEQ 715194045007] Highest\r\n",
+			resp: &ResponseOk{Text: &ResponseText{
+				Text:       "Highest",
+				Code:       "HIGHESTMODSEQ",
+				CodeString: "HIGHESTMODSEQ 715194045007",
+				CodeData:   uint64(715194045007)}}},
+		{data: "d105 OK [MODIFIED 7,9] Conditional STORE failed\r\n",
+			resp: &ResponseStatus{
+				Tag:          "d105",
+				ResponseName: "OK",
+				Response: &ResponseOk{Text: &ResponseText{
+					Text:       "Conditional STORE failed",
+					Code:       "MODIFIED",
+					CodeString: "MODIFIED 7,9",
+					CodeData: SequenceSet{
+						SequenceNumber(7),
+						SequenceNumber(9),
+					}}}}},
+	})
+}
+
+func TestReadResponseQResync(t *testing.T) {
+	testReadResponse(t, []readResponseTest{
+		{data: "* VANISHED 405,407,410,425\r\n",
+			resp: &ResponseVanished{
+				UIDs: SequenceSet{
+					SequenceNumber(405),
+					SequenceNumber(407),
+					SequenceNumber(410),
+					SequenceNumber(425),
+				}}},
+		{data: "* VANISHED (EARLIER) 41,43:116,118,120:211,214:540\r\n",
+			resp: &ResponseVanished{
+				Earlier: true,
+				UIDs: SequenceSet{
+					SequenceNumber(41),
+					NewSequenceRange(43, 116),
+					SequenceNumber(118),
+					NewSequenceRange(120, 211),
+					NewSequenceRange(214, 540),
+				}}},
+	})
+}
+
+func TestResponseSetSelectQResync(t *testing.T) {
+	data := "* 314 EXISTS\r\n" +
+		"* OK [UIDVALIDITY 67890007] UIDVALIDITY\r\n" +
+		"* OK [UIDNEXT 567] Predicted next UID\r\n" +
+		"* OK [HIGHESTMODSEQ 90060128194045007] Highest\r\n" +
+		"* VANISHED (EARLIER) 41,43:116\r\n" +
+		"* VANISHED 300\r\n" +
+		"* 49 FETCH (UID 117 FLAGS (\\Seen \\Answered) " +
+		"MODSEQ (90060115194045001))\r\n" +
+		"* 50 FETCH (UID 119 FLAGS (\\Draft $MDNSent) " +
+		"MODSEQ (90060115194045308))\r\n"
+
+	s := NewStream(bytes.NewReader([]byte(data)))
+
+	var resps []Response
+	for {
+		if empty, err := s.IsEmpty(); err != nil {
+			t.Fatal(err)
+		} else if empty {
+			break
+		}
+
+		resp, err := ReadResponse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resps = append(resps, resp)
+	}
+
+	var rs ResponseSetSelect
+	if err := rs.Init(resps, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.HighestModSeq != 90060128194045007 {
+		t.Errorf("highest mod-sequence is %d", rs.HighestModSeq)
+	}
+
+	// Unsolicited VANISHED responses are not part of the resynchronization
+	vanished := SequenceSet{
+		SequenceNumber(41),
+		NewSequenceRange(43, 116),
+	}
+	if !reflect.DeepEqual(rs.Vanished, vanished) {
+		t.Errorf("vanished messages are %v instead of %v",
+			rs.Vanished, vanished)
+	}
+
+	changed := []*Message{
+		{SequenceNumber: 49, UID: 117,
+			Flags:  []string{`\Seen`, `\Answered`},
+			ModSeq: 90060115194045001},
+		{SequenceNumber: 50, UID: 119,
+			Flags:  []string{`\Draft`, `$MDNSent`},
+			ModSeq: 90060115194045308},
+	}
+	if !reflect.DeepEqual(rs.Changed, changed) {
+		t.Errorf("changed messages are %v instead of %v",
+			rs.Changed, changed)
+	}
+}
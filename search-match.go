@@ -0,0 +1,261 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// SearchMessage contains the data of a message used to evaluate search
+// queries locally, e.g. on messages stored in a cache.
+type SearchMessage struct {
+	SequenceNumber uint32
+	UID            uint32
+	Flags          []string
+	InternalDate   time.Time
+	Size           uint32
+	Header         mail.Header
+	Body           []byte
+
+	// CONDSTORE (RFC 7162)
+	ModSeq uint64
+
+	// The largest sequence number and UID in the mailbox, i.e. the values
+	// of '*' in sequence sets.
+	MaxSequenceNumber uint32
+	MaxUID            uint32
+}
+
+// NewSearchMessage returns a message whose size, header and body are read
+// from the raw data of the message.
+func NewSearchMessage(data []byte) (*SearchMessage, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+
+	body, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read message body: %v", err)
+	}
+
+	msg := &SearchMessage{
+		Size:   uint32(len(data)),
+		Header: m.Header,
+		Body:   body,
+	}
+
+	return msg, nil
+}
+
+func (msg *SearchMessage) HasFlag(flag string) bool {
+	for _, f := range msg.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchSearchKey indicates whether a message matches a search key.
+func MatchSearchKey(key SearchKey, msg *SearchMessage) (bool, error) {
+	node, err := NewSearchNode(key)
+	if err != nil {
+		return false, err
+	}
+
+	return MatchSearchNode(node, msg)
+}
+
+// MatchSearchNode indicates whether a message matches a search query,
+// following the semantics of RFC 3501: strings are matched as
+// case-insensitive substrings, and dates are compared with the date part of
+// the internal date or Date header field, ignoring time and time zone. An
+// error is returned for queries which cannot be evaluated locally.
+func MatchSearchNode(node SearchNode, msg *SearchMessage) (bool, error) {
+	switch n := node.(type) {
+	case *SearchAll:
+		return true, nil
+
+	case *SearchAnd:
+		for _, child := range n.Nodes {
+			match, err := MatchSearchNode(child, msg)
+			if err != nil || !match {
+				return false, err
+			}
+		}
+
+		return true, nil
+
+	case *SearchOr:
+		match, err := MatchSearchNode(n.Left, msg)
+		if err != nil || match {
+			return match, err
+		}
+
+		return MatchSearchNode(n.Right, msg)
+
+	case *SearchNot:
+		match, err := MatchSearchNode(n.Node, msg)
+		return !match, err
+
+	case *SearchField:
+		return matchSearchField(n, msg)
+
+	case *SearchDate:
+		var date time.Time
+
+		if strings.HasPrefix(n.Key, "SENT") {
+			var err error
+
+			date, err = msg.Header.Date()
+			if err != nil {
+				return false, nil
+			}
+		} else {
+			date = msg.InternalDate
+		}
+
+		return compareSearchDate(date, n.Date,
+			strings.TrimPrefix(n.Key, "SENT")), nil
+
+	case *SearchSize:
+		if n.Key == "LARGER" {
+			return msg.Size > n.Size, nil
+		}
+
+		return msg.Size < n.Size, nil
+
+	case *SearchInterval:
+		age := time.Since(msg.InternalDate)
+		interval := time.Duration(n.Interval) * time.Second
+
+		if n.Key == "OLDER" {
+			return age >= interval, nil
+		}
+
+		return age < interval, nil
+
+	case *SearchFlag:
+		return msg.HasFlag(n.Flag) != n.Unset, nil
+
+	case *SearchSequenceSet:
+		for _, e := range n.Set {
+			if _, ok := e.(SequenceSearchResult); ok {
+				return false, fmt.Errorf("saved search result " +
+					"cannot be evaluated locally")
+			}
+		}
+
+		if n.UID {
+			return n.Set.Contains(msg.UID, msg.MaxUID), nil
+		}
+
+		return n.Set.Contains(msg.SequenceNumber,
+			msg.MaxSequenceNumber), nil
+
+	case *SearchModSeq:
+		return msg.ModSeq >= n.ModSeq, nil
+	}
+
+	return false, fmt.Errorf("search query %v cannot be evaluated locally",
+		node)
+}
+
+func matchSearchField(n *SearchField, msg *SearchMessage) (bool, error) {
+	switch n.Key {
+	case "BODY":
+		return containsFold(string(msg.Body), n.Value), nil
+
+	case "TEXT":
+		for name, values := range msg.Header {
+			for _, value := range values {
+				line := name + ": " + decodeHeaderValue(value)
+				if containsFold(line, n.Value) {
+					return true, nil
+				}
+			}
+		}
+
+		return containsFold(string(msg.Body), n.Value), nil
+
+	case "X-GM-RAW":
+		return false, fmt.Errorf("search query %v cannot be evaluated "+
+			"locally", n)
+	}
+
+	name := n.Key
+	if name == "HEADER" {
+		name = n.Header
+	}
+
+	values, found := msg.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	if !found {
+		return false, nil
+	}
+
+	for _, value := range values {
+		if containsFold(decodeHeaderValue(value), n.Value) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// decodeHeaderValue decodes the MIME encoded words (RFC 2047) of a header
+// field value.
+func decodeHeaderValue(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+
+	return decoded
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// compareSearchDate compares the date part of t with date, ignoring time and
+// time zone as required by RFC 3501 6.4.4; op is either BEFORE, ON or SINCE.
+func compareSearchDate(t, date time.Time, op string) bool {
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+
+	y, m, d = date.Date()
+	date = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+
+	switch op {
+	case "BEFORE":
+		return day.Before(date)
+	case "ON":
+		return day.Equal(date)
+	case "SINCE":
+		return !day.Before(date)
+	}
+
+	return false
+}
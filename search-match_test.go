@@ -0,0 +1,115 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchSearchKey(t *testing.T) {
+	data := "From: Bob <bob@example.com>\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: =?utf-8?q?Caf=C3=A9_menu?=\r\n" +
+		"Date: Tue, 04 Oct 2016 23:30:00 -0700\r\n" +
+		"X-Priority: 1\r\n" +
+		"\r\n" +
+		"Lunch is ready.\r\n"
+
+	msg, err := NewSearchMessage([]byte(data))
+	if err != nil {
+		t.Fatalf("cannot parse message: %v", err)
+	}
+
+	msg.SequenceNumber = 2
+	msg.UID = 42
+	msg.MaxSequenceNumber = 3
+	msg.MaxUID = 50
+	msg.Flags = []string{"\\Seen", "$Forwarded"}
+	msg.ModSeq = 100
+
+	// Late in the evening in Tokyo, i.e. on the previous day in UTC
+	tz := time.FixedZone("JST", 9*3600)
+	msg.InternalDate = time.Date(2016, 10, 6, 1, 0, 0, 0, tz)
+
+	tests := []struct {
+		str   string
+		match bool
+	}{
+		{"ALL", true},
+		{"FROM BOB", true},
+		{"FROM alice", false},
+		{"SUBJECT café", true},
+		{"SUBJECT CAFÉ", true},
+		{"HEADER X-Priority 1", true},
+		{"HEADER X-Priority \"\"", true},
+		{"HEADER X-Mailer \"\"", false},
+		{"BODY lunch", true},
+		{"BODY menu", false},
+		{"TEXT menu", true},
+		{"SEEN", true},
+		{"UNSEEN", false},
+		{"KEYWORD $forwarded", true},
+		{"UNKEYWORD $Junk", true},
+		{"ON 2016-10-06", true},
+		{"BEFORE 2016-10-06", false},
+		{"SINCE 2016-10-06 BEFORE 2016-10-07", true},
+		{"SENTON 2016-10-04", true},
+		{"SENTBEFORE 2016-10-05", true},
+		{"SENTSINCE 2016-10-05", false},
+		{"LARGER 100 SMALLER 1000", true},
+		{"LARGER 1000", false},
+		{"OLDER 3600", true},
+		{"YOUNGER 3600", false},
+		{"2", true},
+		{"3:*", false},
+		{"UID 40:*", true},
+		{"UID 1:41", false},
+		{"MODSEQ 100", true},
+		{"MODSEQ 101", false},
+		{"NOT SEEN", false},
+		{"OR DRAFT (FROM bob SEEN)", true},
+		{"OR DRAFT (FROM bob UNSEEN)", false},
+	}
+
+	for _, test := range tests {
+		key, err := ParseSearchString(test.str)
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", test.str, err)
+			continue
+		}
+
+		match, err := MatchSearchKey(key, msg)
+		if err != nil {
+			t.Errorf("cannot evaluate %q: %v", test.str, err)
+			continue
+		}
+
+		if match != test.match {
+			t.Errorf("%q evaluated to %v", test.str, match)
+		}
+	}
+
+	key := SearchKeyGmailRaw("has:attachment")
+	if _, err := MatchSearchKey(key, msg); err == nil {
+		t.Errorf("evaluated X-GM-RAW search key")
+	}
+
+	key = SearchKeyUID(NewSequenceSetSearchResult())
+	if _, err := MatchSearchKey(key, msg); err == nil {
+		t.Errorf("evaluated saved search result")
+	}
+}
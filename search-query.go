@@ -0,0 +1,768 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SearchNode is a node of a typed search query. Nodes are converted to
+// search keys to be sent to the server, and to search strings which can be
+// parsed with ParseSearchQuery.
+type SearchNode interface {
+	fmt.Stringer
+	SearchKey() SearchKey
+}
+
+// ---------------------------------------------------------------------------
+//  Nodes
+// ---------------------------------------------------------------------------
+
+// SearchAll matches all messages
+type SearchAll struct{}
+
+func (n *SearchAll) SearchKey() SearchKey {
+	return SearchKey{"ALL"}
+}
+
+func (n *SearchAll) String() string {
+	return "ALL"
+}
+
+// SearchAnd matches messages matching all its nodes
+type SearchAnd struct {
+	Nodes []SearchNode
+}
+
+func (n *SearchAnd) SearchKey() SearchKey {
+	switch len(n.Nodes) {
+	case 0:
+		return SearchKeyAll()
+	case 1:
+		key := SearchKey{"("}
+		key = append(key, searchNodeKey(n.Nodes[0])...)
+		return append(key, ")")
+	}
+
+	key := SearchKey{}
+	for _, node := range n.Nodes {
+		key = append(key, searchNodeKey(node)...)
+	}
+
+	return key
+}
+
+func (n *SearchAnd) String() string {
+	switch len(n.Nodes) {
+	case 0:
+		return "ALL"
+	case 1:
+		return "(" + searchNodeString(n.Nodes[0]) + ")"
+	}
+
+	strs := make([]string, len(n.Nodes))
+	for i, node := range n.Nodes {
+		strs[i] = searchNodeString(node)
+	}
+
+	return strings.Join(strs, " ")
+}
+
+// SearchOr matches messages matching at least one of its nodes
+type SearchOr struct {
+	Left, Right SearchNode
+}
+
+func (n *SearchOr) SearchKey() SearchKey {
+	key := SearchKey{"OR"}
+	key = append(key, searchNodeKey(n.Left)...)
+	return append(key, searchNodeKey(n.Right)...)
+}
+
+func (n *SearchOr) String() string {
+	return "OR " + searchNodeString(n.Left) + " " +
+		searchNodeString(n.Right)
+}
+
+// SearchNot matches messages not matching its node
+type SearchNot struct {
+	Node SearchNode
+}
+
+func (n *SearchNot) SearchKey() SearchKey {
+	return append(SearchKey{"NOT"}, searchNodeKey(n.Node)...)
+}
+
+func (n *SearchNot) String() string {
+	return "NOT " + searchNodeString(n.Node)
+}
+
+// SearchField matches messages whose field contains a string. Key is one of
+// BCC, BODY, CC, FROM, HEADER, SUBJECT, TEXT, TO or X-GM-RAW; Header is the
+// name of the header field for HEADER.
+type SearchField struct {
+	Key    string
+	Header string
+	Value  string
+}
+
+func (n *SearchField) SearchKey() SearchKey {
+	key := SearchKey{n.Key}
+	if n.Key == "HEADER" {
+		key = append(key, AStringArg(n.Header))
+	}
+
+	return append(key, AStringArg(n.Value))
+}
+
+func (n *SearchField) String() string {
+	str := n.Key
+	if n.Key == "HEADER" {
+		str += " " + searchStringArg(n.Header)
+	}
+
+	return str + " " + searchStringArg(n.Value)
+}
+
+// SearchDate matches messages by date. Key is one of BEFORE, ON, SINCE,
+// SENTBEFORE, SENTON or SENTSINCE; only the day of the date is used.
+type SearchDate struct {
+	Key  string
+	Date time.Time
+}
+
+func (n *SearchDate) SearchKey() SearchKey {
+	return SearchKey{n.Key, n.Date.Format(IMAPDateFormat)}
+}
+
+func (n *SearchDate) String() string {
+	return n.Key + " " + n.Date.Format(IMAPDateFormat)
+}
+
+// SearchSize matches messages by size. Key is either LARGER or SMALLER.
+type SearchSize struct {
+	Key  string
+	Size uint32
+}
+
+func (n *SearchSize) SearchKey() SearchKey {
+	return SearchKey{n.Key, strconv.FormatUint(uint64(n.Size), 10)}
+}
+
+func (n *SearchSize) String() string {
+	return n.Key + " " + strconv.FormatUint(uint64(n.Size), 10)
+}
+
+// SearchInterval matches messages by age (WITHIN, RFC 5032). Key is either
+// OLDER or YOUNGER, and Interval is a number of seconds.
+type SearchInterval struct {
+	Key      string
+	Interval uint32
+}
+
+func (n *SearchInterval) SearchKey() SearchKey {
+	return SearchKey{n.Key, strconv.FormatUint(uint64(n.Interval), 10)}
+}
+
+func (n *SearchInterval) String() string {
+	return n.Key + " " + strconv.FormatUint(uint64(n.Interval), 10)
+}
+
+// SearchFlag matches messages which have a flag set, or unset if Unset is
+// true. Flag is either a system flag, e.g. \Seen, or a keyword.
+type SearchFlag struct {
+	Flag  string
+	Unset bool
+}
+
+// searchFlagKeys associates system flags with the keys used to search for
+// messages where they are set and unset.
+var searchFlagKeys = map[string][2]string{
+	MessageFlagAnswered: {"ANSWERED", "UNANSWERED"},
+	MessageFlagDeleted:  {"DELETED", "UNDELETED"},
+	MessageFlagDraft:    {"DRAFT", "UNDRAFT"},
+	MessageFlagFlagged:  {"FLAGGED", "UNFLAGGED"},
+	MessageFlagRecent:   {"RECENT", "OLD"},
+	MessageFlagSeen:     {"SEEN", "UNSEEN"},
+}
+
+func (n *SearchFlag) SearchKey() SearchKey {
+	if keys, found := searchFlagKeys[n.Flag]; found {
+		if n.Unset {
+			return SearchKey{keys[1]}
+		}
+
+		return SearchKey{keys[0]}
+	}
+
+	if n.Unset {
+		return SearchKeyUnkeyword(n.Flag)
+	}
+
+	return SearchKeyKeyword(n.Flag)
+}
+
+func (n *SearchFlag) String() string {
+	key := n.SearchKey()
+	if len(key) == 1 {
+		return key[0].(string)
+	}
+
+	return key[0].(string) + " " + searchStringArg(n.Flag)
+}
+
+// SearchSequenceSet matches messages whose sequence number, or UID if UID is
+// true, is contained in a set.
+type SearchSequenceSet struct {
+	Set SequenceSet
+	UID bool
+}
+
+func (n *SearchSequenceSet) SearchKey() SearchKey {
+	if n.UID {
+		return SearchKeyUID(n.Set)
+	}
+
+	return SearchKeySequenceSet(n.Set)
+}
+
+func (n *SearchSequenceSet) String() string {
+	if n.UID {
+		return "UID " + n.Set.String()
+	}
+
+	return n.Set.String()
+}
+
+// SearchModSeq matches messages whose mod-sequence is greater than or equal
+// to ModSeq (CONDSTORE, RFC 7162). Entry and EntryType optionally restrict
+// the search to the metadata item of a flag, e.g. "/flags/\Seen" and "all".
+type SearchModSeq struct {
+	ModSeq    uint64
+	Entry     string
+	EntryType string
+}
+
+func (n *SearchModSeq) SearchKey() SearchKey {
+	if n.Entry == "" {
+		return SearchKeyModSeq(n.ModSeq)
+	}
+
+	return SearchKey{"MODSEQ", QuotedStringEncode(n.Entry), n.EntryType,
+		strconv.FormatUint(n.ModSeq, 10)}
+}
+
+func (n *SearchModSeq) String() string {
+	modSeq := strconv.FormatUint(n.ModSeq, 10)
+
+	if n.Entry == "" {
+		return "MODSEQ " + modSeq
+	}
+
+	return "MODSEQ " + string(QuotedStringEncode(n.Entry)) + " " +
+		n.EntryType + " " + modSeq
+}
+
+// searchNodeKey returns the search key of a node, lists being enclosed in
+// parentheses; lists containing a single node always are so that the
+// structure of the query is preserved.
+func searchNodeKey(node SearchNode) SearchKey {
+	if and, ok := node.(*SearchAnd); ok && len(and.Nodes) > 1 {
+		key := SearchKey{"("}
+		key = append(key, and.SearchKey()...)
+		return append(key, ")")
+	}
+
+	return node.SearchKey()
+}
+
+func searchNodeString(node SearchNode) string {
+	if and, ok := node.(*SearchAnd); ok && len(and.Nodes) > 1 {
+		return "(" + and.String() + ")"
+	}
+
+	return node.String()
+}
+
+// searchStringArg encodes a string argument in a search string.
+func searchStringArg(str string) string {
+	if str != "" && isQuotableString(str) &&
+		!strings.ContainsAny(str, "(){") {
+		return string(AStringEncode(str))
+	}
+
+	if isQuotableString(str) {
+		return string(QuotedStringEncode(str))
+	}
+
+	return fmt.Sprintf("{%d}\r\n%s", len(str), str)
+}
+
+// ---------------------------------------------------------------------------
+//  Parsing
+// ---------------------------------------------------------------------------
+
+// ParseSearchQuery parses a search string, see ParseSearchString, and returns
+// the corresponding query.
+func ParseSearchQuery(str string) (SearchNode, error) {
+	key, err := ParseSearchString(str)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSearchNode(key)
+}
+
+// NewSearchNode builds a query from a search key, e.g. one built with
+// SearchKey functions. Lists of several keys are returned as *SearchAnd
+// nodes.
+func NewSearchNode(key SearchKey) (SearchNode, error) {
+	p := &searchKeyParser{key: key}
+
+	nodes := []SearchNode{}
+
+	for p.i < len(p.key) {
+		node, err := p.parseNode()
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	switch len(nodes) {
+	case 0:
+		return nil, fmt.Errorf("empty search key")
+	case 1:
+		return nodes[0], nil
+	}
+
+	return &SearchAnd{Nodes: nodes}, nil
+}
+
+type searchKeyParser struct {
+	key SearchKey
+	i   int
+}
+
+func (p *searchKeyParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid search key element %d: %s", p.i,
+		fmt.Sprintf(format, args...))
+}
+
+// next returns the value of the next element of the key; quoted strings are
+// decoded.
+func (p *searchKeyParser) next() (string, error) {
+	if p.i >= len(p.key) {
+		return "", p.errorf("truncated search key")
+	}
+
+	var data []byte
+
+	switch v := p.key[p.i].(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	case Literal:
+		p.i++
+		return string(v), nil
+	default:
+		return "", p.errorf("invalid value %#v", v)
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		s := NewStream(bytes.NewReader(data))
+
+		str, err := s.ReadIMAPQuotedString()
+		if err != nil {
+			return "", p.errorf("invalid quoted string: %v", err)
+		}
+
+		data = str
+	}
+
+	p.i++
+	return string(data), nil
+}
+
+func (p *searchKeyParser) nextNumber(bitSize int) (uint64, error) {
+	str, err := p.next()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseUint(str, 10, bitSize)
+	if err != nil {
+		return 0, p.errorf("invalid number %q", str)
+	}
+
+	return n, nil
+}
+
+func (p *searchKeyParser) parseNode() (SearchNode, error) {
+	name, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	name = strings.ToUpper(name)
+
+	switch name {
+	case "ALL":
+		return &SearchAll{}, nil
+
+	case "NEW":
+		return &SearchAnd{Nodes: []SearchNode{
+			&SearchFlag{Flag: MessageFlagRecent},
+			&SearchFlag{Flag: MessageFlagSeen, Unset: true},
+		}}, nil
+
+	case "(":
+		nodes := []SearchNode{}
+
+		for {
+			if p.i >= len(p.key) {
+				return nil, p.errorf("missing ')'")
+			}
+
+			if v, ok := p.key[p.i].(string); ok && v == ")" {
+				p.i++
+				break
+			}
+
+			node, err := p.parseNode()
+			if err != nil {
+				return nil, err
+			}
+
+			nodes = append(nodes, node)
+		}
+
+		return &SearchAnd{Nodes: nodes}, nil
+
+	case "NOT":
+		node, err := p.parseNode()
+		if err != nil {
+			return nil, err
+		}
+
+		return &SearchNot{Node: node}, nil
+
+	case "OR":
+		left, err := p.parseNode()
+		if err != nil {
+			return nil, err
+		}
+
+		right, err := p.parseNode()
+		if err != nil {
+			return nil, err
+		}
+
+		return &SearchOr{Left: left, Right: right}, nil
+
+	case "BCC", "BODY", "CC", "FROM", "SUBJECT", "TEXT", "TO", "X-GM-RAW":
+		value, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		return &SearchField{Key: name, Value: value}, nil
+
+	case "HEADER":
+		header, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		return &SearchField{Key: name, Header: header, Value: value}, nil
+
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		str, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		date, err := time.Parse(IMAPDateFormat, str)
+		if err != nil {
+			date, err = time.Parse("2-Jan-2006", str)
+			if err != nil {
+				return nil, p.errorf("invalid date %q", str)
+			}
+		}
+
+		return &SearchDate{Key: name, Date: date}, nil
+
+	case "LARGER", "SMALLER":
+		size, err := p.nextNumber(32)
+		if err != nil {
+			return nil, err
+		}
+
+		return &SearchSize{Key: name, Size: uint32(size)}, nil
+
+	case "OLDER", "YOUNGER":
+		interval, err := p.nextNumber(32)
+		if err != nil {
+			return nil, err
+		}
+
+		return &SearchInterval{Key: name, Interval: uint32(interval)},
+			nil
+
+	case "KEYWORD", "UNKEYWORD":
+		keyword, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		return &SearchFlag{Flag: keyword, Unset: name == "UNKEYWORD"},
+			nil
+
+	case "UID":
+		str, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+
+		set, err := ParseSequenceSet(str)
+		if err != nil {
+			return nil, p.errorf("invalid sequence set: %v", err)
+		}
+
+		return &SearchSequenceSet{Set: set, UID: true}, nil
+
+	case "MODSEQ":
+		node := &SearchModSeq{}
+
+		// The entry name is always a quoted string
+		if p.i < len(p.key) {
+			if data, ok := p.key[p.i].([]byte); ok &&
+				len(data) > 0 && data[0] == '"' {
+				if node.Entry, err = p.next(); err != nil {
+					return nil, err
+				}
+
+				if node.Entry == "" {
+					p.i--
+					return nil, p.errorf("empty entry name")
+				}
+
+				if node.EntryType, err = p.next(); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if node.ModSeq, err = p.nextNumber(63); err != nil {
+			return nil, err
+		}
+
+		return node, nil
+	}
+
+	for flag, keys := range searchFlagKeys {
+		if name == keys[0] || name == keys[1] {
+			return &SearchFlag{Flag: flag, Unset: name == keys[1]}, nil
+		}
+	}
+
+	if set, err := ParseSequenceSet(name); err == nil {
+		return &SearchSequenceSet{Set: set}, nil
+	}
+
+	p.i--
+	return nil, p.errorf("unknown search key %q", name)
+}
+
+// ---------------------------------------------------------------------------
+//  Validation and simplification
+// ---------------------------------------------------------------------------
+
+// ValidateSearchNode checks that a query is well formed and that the
+// capabilities it requires are supported by the server.
+func ValidateSearchNode(node SearchNode, caps CapabilitySet) error {
+	requireCap := func(key, cap string) error {
+		if !caps.Has(cap) {
+			return fmt.Errorf("%s search key requires the %s "+
+				"capability", key, cap)
+		}
+
+		return nil
+	}
+
+	switch n := node.(type) {
+	case *SearchAll:
+		return nil
+
+	case *SearchAnd:
+		for _, child := range n.Nodes {
+			if err := ValidateSearchNode(child, caps); err != nil {
+				return err
+			}
+		}
+
+	case *SearchOr:
+		if n.Left == nil || n.Right == nil {
+			return fmt.Errorf("missing node in OR search key")
+		}
+
+		if err := ValidateSearchNode(n.Left, caps); err != nil {
+			return err
+		}
+
+		return ValidateSearchNode(n.Right, caps)
+
+	case *SearchNot:
+		if n.Node == nil {
+			return fmt.Errorf("missing node in NOT search key")
+		}
+
+		return ValidateSearchNode(n.Node, caps)
+
+	case *SearchField:
+		switch n.Key {
+		case "BCC", "BODY", "CC", "FROM", "SUBJECT", "TEXT", "TO":
+		case "HEADER":
+			if n.Header == "" {
+				return fmt.Errorf("missing header field name in " +
+					"HEADER search key")
+			}
+		case "X-GM-RAW":
+			return requireCap(n.Key, "X-GM-EXT-1")
+		default:
+			return fmt.Errorf("invalid field search key %q", n.Key)
+		}
+
+	case *SearchDate:
+		switch n.Key {
+		case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		default:
+			return fmt.Errorf("invalid date search key %q", n.Key)
+		}
+
+	case *SearchSize:
+		if n.Key != "LARGER" && n.Key != "SMALLER" {
+			return fmt.Errorf("invalid size search key %q", n.Key)
+		}
+
+	case *SearchInterval:
+		if n.Key != "OLDER" && n.Key != "YOUNGER" {
+			return fmt.Errorf("invalid interval search key %q", n.Key)
+		}
+
+		if n.Interval == 0 {
+			return fmt.Errorf("invalid null interval in %s search "+
+				"key", n.Key)
+		}
+
+		return requireCap(n.Key, "WITHIN")
+
+	case *SearchFlag:
+		if n.Flag == "" {
+			return fmt.Errorf("missing flag in search key")
+		}
+
+		if _, found := searchFlagKeys[n.Flag]; !found &&
+			strings.HasPrefix(n.Flag, "\\") {
+			return fmt.Errorf("invalid system flag %q in search key",
+				n.Flag)
+		}
+
+	case *SearchSequenceSet:
+		if len(n.Set) == 0 {
+			return fmt.Errorf("empty sequence set in search key")
+		}
+
+	case *SearchModSeq:
+		if n.Entry != "" {
+			switch n.EntryType {
+			case "priv", "shared", "all":
+			default:
+				return fmt.Errorf("invalid entry type %q in "+
+					"MODSEQ search key", n.EntryType)
+			}
+		}
+
+		return requireCap("MODSEQ", "CONDSTORE")
+
+	case nil:
+		return fmt.Errorf("missing search key")
+
+	default:
+		return fmt.Errorf("unknown search node %#v", node)
+	}
+
+	return nil
+}
+
+// SimplifySearchNode returns an equivalent query where double negations are
+// removed, nested lists are flattened and lists containing a single node are
+// replaced by this node.
+func SimplifySearchNode(node SearchNode) SearchNode {
+	switch n := node.(type) {
+	case *SearchAnd:
+		nodes := []SearchNode{}
+
+		for _, child := range n.Nodes {
+			child = SimplifySearchNode(child)
+
+			if and, ok := child.(*SearchAnd); ok {
+				nodes = append(nodes, and.Nodes...)
+			} else if _, ok := child.(*SearchAll); ok {
+				continue
+			} else {
+				nodes = append(nodes, child)
+			}
+		}
+
+		switch len(nodes) {
+		case 0:
+			return &SearchAll{}
+		case 1:
+			return nodes[0]
+		}
+
+		return &SearchAnd{Nodes: nodes}
+
+	case *SearchOr:
+		return &SearchOr{
+			Left:  SimplifySearchNode(n.Left),
+			Right: SimplifySearchNode(n.Right),
+		}
+
+	case *SearchNot:
+		child := SimplifySearchNode(n.Node)
+
+		if not, ok := child.(*SearchNot); ok {
+			return not.Node
+		}
+
+		return &SearchNot{Node: child}
+	}
+
+	return node
+}
@@ -0,0 +1,162 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearchQuery(t *testing.T) {
+	date := time.Date(2016, 10, 4, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		node SearchNode
+		str  string
+	}{
+		{&SearchAll{}, "ALL"},
+		{&SearchAnd{Nodes: []SearchNode{
+			&SearchField{Key: "FROM", Value: "alice"},
+			&SearchDate{Key: "SINCE", Date: date},
+		}}, "FROM alice SINCE 04-Oct-2016"},
+		{&SearchOr{
+			Left: &SearchFlag{Flag: MessageFlagSeen, Unset: true},
+			Right: &SearchAnd{Nodes: []SearchNode{
+				&SearchFlag{Flag: "$Forwarded"},
+				&SearchSize{Key: "LARGER", Size: 1024},
+			}},
+		}, "OR UNSEEN (KEYWORD $Forwarded LARGER 1024)"},
+		{&SearchNot{Node: &SearchField{Key: "HEADER",
+			Header: "X-Spam", Value: "yes (maybe)"}},
+			"NOT HEADER X-Spam \"yes (maybe)\""},
+		{&SearchField{Key: "SUBJECT", Value: "café"},
+			"SUBJECT {5}\r\ncafé"},
+		{&SearchAnd{Nodes: []SearchNode{
+			&SearchSequenceSet{Set: SequenceSet{
+				NewSequenceRange(100, 200)}, UID: true},
+			&SearchSequenceSet{Set: SequenceSet{
+				NewSequenceRange(1, SequenceStar)}},
+			&SearchInterval{Key: "YOUNGER", Interval: 3600},
+		}}, "UID 100:200 1:* YOUNGER 3600"},
+		{&SearchModSeq{ModSeq: 620162338, Entry: "/flags/\\Draft",
+			EntryType: "all"},
+			"MODSEQ \"/flags/\\\\Draft\" all 620162338"},
+	}
+
+	for _, test := range tests {
+		str := test.node.String()
+		if str != test.str {
+			t.Errorf("%#v was formatted as %q instead of %q",
+				test.node, str, test.str)
+			continue
+		}
+
+		node, err := ParseSearchQuery(str)
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", str, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(node, test.node) {
+			t.Errorf("%q was parsed as %#v instead of %#v",
+				str, node, test.node)
+		}
+
+		node, err = NewSearchNode(test.node.SearchKey())
+		if err != nil {
+			t.Errorf("cannot decode key %#v: %v",
+				test.node.SearchKey(), err)
+			continue
+		}
+
+		if !reflect.DeepEqual(node, test.node) {
+			t.Errorf("key %#v was decoded as %#v instead of %#v",
+				test.node.SearchKey(), node, test.node)
+		}
+	}
+}
+
+func TestSimplifySearchNode(t *testing.T) {
+	tests := []struct {
+		str    string
+		result string
+	}{
+		{"NOT NOT SEEN", "SEEN"},
+		{"NOT NOT NOT SEEN", "NOT SEEN"},
+		{"(SEEN)", "SEEN"},
+		{"((SEEN) (FLAGGED (DRAFT)))", "SEEN FLAGGED DRAFT"},
+		{"OR (NOT NOT SEEN) (ALL FLAGGED)", "OR SEEN FLAGGED"},
+		{"NEW", "RECENT UNSEEN"},
+	}
+
+	for _, test := range tests {
+		node, err := ParseSearchQuery(test.str)
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", test.str, err)
+			continue
+		}
+
+		result := SimplifySearchNode(node).String()
+		if result != test.result {
+			t.Errorf("%q was simplified as %q instead of %q",
+				test.str, result, test.result)
+		}
+	}
+}
+
+func TestValidateSearchNode(t *testing.T) {
+	caps := NewCapabilitySet([]string{"IMAP4rev1", "CONDSTORE"})
+
+	tests := []struct {
+		str   string
+		valid bool
+	}{
+		{"FROM alice OR SEEN MODSEQ 42", true},
+		{"NOT YOUNGER 3600", false},
+		{"X-GM-RAW \"has:attachment\"", false},
+	}
+
+	for _, test := range tests {
+		node, err := ParseSearchQuery(test.str)
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", test.str, err)
+			continue
+		}
+
+		err = ValidateSearchNode(node, caps)
+		if test.valid && err != nil {
+			t.Errorf("%q is invalid: %v", test.str, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%q is valid", test.str)
+		}
+	}
+
+	invalidNodes := []SearchNode{
+		&SearchField{Key: "SENDER", Value: "bob"},
+		&SearchFlag{Flag: "\\Unknown"},
+		&SearchNot{},
+		&SearchAnd{Nodes: []SearchNode{
+			&SearchSequenceSet{Set: SequenceSet{}},
+		}},
+	}
+
+	for _, node := range invalidNodes {
+		if err := ValidateSearchNode(node, caps); err == nil {
+			t.Errorf("%#v is valid", node)
+		}
+	}
+}
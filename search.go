@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -33,7 +34,7 @@ func SearchKeyAnswered() SearchKey {
 }
 
 func SearchKeyBCC(str string) SearchKey {
-	return SearchKey{"BCC", AStringEncode(str)}
+	return SearchKey{"BCC", AStringArg(str)}
 }
 
 func SearchKeyBefore(date time.Time) SearchKey {
@@ -41,11 +42,11 @@ func SearchKeyBefore(date time.Time) SearchKey {
 }
 
 func SearchKeyBody(str string) SearchKey {
-	return SearchKey{"BODY", AStringEncode(str)}
+	return SearchKey{"BODY", AStringArg(str)}
 }
 
 func SearchKeyCC(str string) SearchKey {
-	return SearchKey{"CC", AStringEncode(str)}
+	return SearchKey{"CC", AStringArg(str)}
 }
 
 func SearchKeyDeleted() SearchKey {
@@ -57,7 +58,7 @@ func SearchKeyFlagged() SearchKey {
 }
 
 func SearchKeyFrom(str string) SearchKey {
-	return SearchKey{"FROM", AStringEncode(str)}
+	return SearchKey{"FROM", AStringArg(str)}
 }
 
 func SearchKeyKeyword(keyword string) SearchKey {
@@ -89,15 +90,15 @@ func SearchKeySince(date time.Time) SearchKey {
 }
 
 func SearchKeySubject(str string) SearchKey {
-	return SearchKey{"SUBJECT", AStringEncode(str)}
+	return SearchKey{"SUBJECT", AStringArg(str)}
 }
 
 func SearchKeyText(str string) SearchKey {
-	return SearchKey{"TEXT", AStringEncode(str)}
+	return SearchKey{"TEXT", AStringArg(str)}
 }
 
 func SearchKeyTo(str string) SearchKey {
-	return SearchKey{"TO", AStringEncode(str)}
+	return SearchKey{"TO", AStringArg(str)}
 }
 
 func SearchKeyUnanswered() SearchKey {
@@ -125,7 +126,7 @@ func SearchKeyDraft() SearchKey {
 }
 
 func SearchKeyHeader(name, str string) SearchKey {
-	return SearchKey{"HEADER", AStringEncode(name), AStringEncode(str)}
+	return SearchKey{"HEADER", AStringArg(name), AStringArg(str)}
 }
 
 func SearchKeyLarger(size uint32) SearchKey {
@@ -141,7 +142,7 @@ func SearchKeyOr(key1, key2 SearchKey) SearchKey {
 }
 
 func SearchKeySentBefore(date time.Time) SearchKey {
-	return SearchKey{"BEFORE", date.Format(IMAPDateFormat)}
+	return SearchKey{"SENTBEFORE", date.Format(IMAPDateFormat)}
 }
 
 func SearchKeySentOn(date time.Time) SearchKey {
@@ -161,6 +162,35 @@ func SearchKeyUID(set SequenceSet) SearchKey {
 	return SearchKey{"UID", str}
 }
 
+// CONDSTORE (RFC 7162)
+func SearchKeyModSeq(modSeq uint64) SearchKey {
+	return SearchKey{"MODSEQ", strconv.FormatUint(modSeq, 10)}
+}
+
+// entryType is one of "priv", "shared" or "all"
+func SearchKeyModSeqFlag(flag, entryType string, modSeq uint64) SearchKey {
+	entry := QuotedStringEncode("/flags/" + flag)
+	return SearchKey{"MODSEQ", entry, entryType,
+		strconv.FormatUint(modSeq, 10)}
+}
+
+// WITHIN (RFC 5032), the interval is rounded down to the second
+func SearchKeyOlder(interval time.Duration) SearchKey {
+	return SearchKey{"OLDER",
+		strconv.FormatInt(int64(interval.Seconds()), 10)}
+}
+
+// WITHIN (RFC 5032), the interval is rounded down to the second
+func SearchKeyYounger(interval time.Duration) SearchKey {
+	return SearchKey{"YOUNGER",
+		strconv.FormatInt(int64(interval.Seconds()), 10)}
+}
+
+// Gmail (X-GM-EXT-1)
+func SearchKeyGmailRaw(str string) SearchKey {
+	return SearchKey{"X-GM-RAW", AStringArg(str)}
+}
+
 func SearchKeyUndraft() SearchKey {
 	return SearchKey{"UNDRAFT"}
 }
@@ -178,262 +208,490 @@ func SearchKeyList(list []SearchKey) SearchKey {
 	return append(key, ")")
 }
 
+// SearchStringError is returned by ParseSearchString for invalid search
+// strings. Pos is the byte offset of the error in the string.
+type SearchStringError struct {
+	Pos     int
+	Message string
+}
+
+func (err *SearchStringError) Error() string {
+	return fmt.Sprintf("%s at position %d", err.Message, err.Pos)
+}
+
+// Argument types of search keys
+const (
+	searchArgString = iota
+	searchArgDate
+	searchArgNumber
+	searchArgNumber64
+	searchArgSequenceSet
+	searchArgKey
+	searchArgModSeq
+)
+
+// searchKeyArgs contains the type of the arguments of each search key
+var searchKeyArgs = map[string][]int{
+	"ALL":        {},
+	"ANSWERED":   {},
+	"BCC":        {searchArgString},
+	"BEFORE":     {searchArgDate},
+	"BODY":       {searchArgString},
+	"CC":         {searchArgString},
+	"DELETED":    {},
+	"DRAFT":      {},
+	"FLAGGED":    {},
+	"FROM":       {searchArgString},
+	"HEADER":     {searchArgString, searchArgString},
+	"KEYWORD":    {searchArgString},
+	"LARGER":     {searchArgNumber},
+	"NEW":        {},
+	"NOT":        {searchArgKey},
+	"OLD":        {},
+	"ON":         {searchArgDate},
+	"OR":         {searchArgKey, searchArgKey},
+	"RECENT":     {},
+	"SEEN":       {},
+	"SENTBEFORE": {searchArgDate},
+	"SENTON":     {searchArgDate},
+	"SENTSINCE":  {searchArgDate},
+	"SINCE":      {searchArgDate},
+	"SMALLER":    {searchArgNumber},
+	"SUBJECT":    {searchArgString},
+	"TEXT":       {searchArgString},
+	"TO":         {searchArgString},
+	"UID":        {searchArgSequenceSet},
+	"UNANSWERED": {},
+	"UNDELETED":  {},
+	"UNDRAFT":    {},
+	"UNFLAGGED":  {},
+	"UNKEYWORD":  {searchArgString},
+	"UNSEEN":     {},
+
+	// CONDSTORE (RFC 7162)
+	"MODSEQ": {searchArgModSeq},
+
+	// WITHIN (RFC 5032)
+	"OLDER":   {searchArgNumber},
+	"YOUNGER": {searchArgNumber},
+
+	// Gmail
+	"X-GM-RAW": {searchArgString},
+}
+
+// ParseSearchString parses a search string using the syntax of IMAP search
+// keys, e.g. "UID 100:200 (OR FROM alice SUBJECT x)". Dates are written
+// either as "2006-01-02" or "2-Jan-2006"; strings are atoms, quoted strings
+// or literals. An empty string matches all messages.
 func ParseSearchString(str string) (SearchKey, error) {
-	data := bytes.TrimSpace([]byte(str))
-	if len(data) == 0 {
+	p := &searchStringParser{data: []byte(str)}
+
+	p.skipSpaces()
+	if p.eof() {
 		return SearchKeyAll(), nil
 	}
 
 	key := SearchKey{}
 
-loop:
-	for data != nil {
-		k, rest, err := parseSearchStringKey(data)
+	for !p.eof() {
+		k, err := p.parseKey()
 		if err != nil {
 			return nil, err
-		} else if k == nil {
-			break loop
 		}
 
 		key = append(key, k...)
-		data = rest
+		p.skipSpaces()
 	}
 
 	return key, nil
 }
 
-func parseSearchStringKey(data []byte) (SearchKey, []byte, error) {
-	data = bytes.TrimLeft(data, " \t")
-	if len(data) == 0 {
-		return nil, nil, nil
+type searchStringParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *searchStringParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *searchStringParser) errorf(pos int, format string, args ...interface{}) error {
+	return &SearchStringError{
+		Pos:     pos,
+		Message: fmt.Sprintf(format, args...),
 	}
+}
 
-	var tag []byte
-	idx := bytes.IndexAny(data, " \t")
-	if idx >= 0 {
-		tag = data[:idx]
-		data = data[idx+1:]
-	} else {
-		tag = data[:]
-		data = nil
+func (p *searchStringParser) skipSpaces() {
+	for !p.eof() && isSearchStringSpace(p.data[p.pos]) {
+		p.pos++
 	}
-	tag = bytes.ToUpper(tag)
-
-	// TODO UID sequence-set
-	// TODO sequence-set
-	// TODO ( key, ... )
-
-	const (
-		argString = iota
-		argDate
-		argSize
-		argKey
-	)
-
-	var specs []int
-
-	switch string(tag) {
-	case "ALL":
-		specs = []int{}
-	case "ANSWERED":
-		specs = []int{}
-	case "BCC":
-		specs = []int{argString}
-	case "BEFORE":
-		specs = []int{argDate}
-	case "BODY":
-		specs = []int{argString}
-	case "CC":
-		specs = []int{argString}
-	case "DELETED":
-		specs = []int{}
-	case "FLAGGED":
-		specs = []int{}
-	case "FROM":
-		specs = []int{argString}
-	case "KEYWORD":
-		specs = []int{argString}
-	case "NEW":
-		specs = []int{}
-	case "OLD":
-		specs = []int{}
-	case "ON":
-		specs = []int{argDate}
-	case "RECENT":
-		specs = []int{}
-	case "SEEN":
-		specs = []int{}
-	case "SINCE":
-		specs = []int{argDate}
-	case "SUBJECT":
-		specs = []int{argString}
-	case "TEXT":
-		specs = []int{argString}
-	case "TO":
-		specs = []int{argString}
-	case "UNANSWERED":
-		specs = []int{}
-	case "UNDELETED":
-		specs = []int{}
-	case "UNFLAGGED":
-		specs = []int{}
-	case "UNKEYWORD":
-		specs = []int{argString}
-	case "UNSEEN":
-		specs = []int{}
-	case "DRAFT":
-		specs = []int{}
-	case "HEADER":
-		specs = []int{argString, argString}
-	case "LARGER":
-		specs = []int{argSize}
-	case "NOT":
-		specs = []int{argKey}
-	case "OR":
-		specs = []int{argKey, argKey}
-	case "SENTBEFORE":
-		specs = []int{argDate}
-	case "SENTON":
-		specs = []int{argDate}
-	case "SENTSINCE":
-		specs = []int{argDate}
-	case "SMALLER":
-		specs = []int{argSize}
-	case "UNDRAFT":
-		specs = []int{}
-	default:
-		return nil, nil, fmt.Errorf("unknown key %q", tag)
+}
+
+// readWord reads characters up to the next space or parenthesis.
+func (p *searchStringParser) readWord() []byte {
+	start := p.pos
+
+	for !p.eof() {
+		c := p.data[p.pos]
+		if isSearchStringSpace(c) || c == '(' || c == ')' {
+			break
+		}
+
+		p.pos++
 	}
 
-	args := []interface{}{}
-	for _, spec := range specs {
-		data = bytes.TrimLeft(data, " \t")
-		if len(data) == 0 {
-			return nil, nil, fmt.Errorf("missing argument for "+
-				"%s key", tag)
+	return p.data[start:p.pos]
+}
+
+func isSearchStringSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func (p *searchStringParser) parseKey() (SearchKey, error) {
+	p.skipSpaces()
+	start := p.pos
+
+	if p.eof() {
+		return nil, p.errorf(start, "missing search key")
+	}
+
+	switch p.data[p.pos] {
+	case '(':
+		return p.parseKeyList()
+	case ')':
+		return nil, p.errorf(start, "unexpected ')'")
+	}
+
+	word := p.readWord()
+	name := strings.ToUpper(string(word))
+
+	if c := word[0]; c == '*' || c == '$' || IsDigitChar(c) {
+		set, err := ParseSequenceSet(string(word))
+		if err != nil {
+			return nil, p.errorf(start, "invalid sequence set: %v",
+				err)
 		}
 
-		var fn func([]byte) (interface{}, []byte, error)
+		setData, _ := set.MarshalText()
+		return SearchKey{setData}, nil
+	}
+
+	specs, found := searchKeyArgs[name]
+	if !found {
+		return nil, p.errorf(start, "unknown search key %q", word)
+	}
+
+	key := SearchKey{name}
 
-		if spec == argKey {
-			key, rest, err := parseSearchStringKey(data)
+	for _, spec := range specs {
+		p.skipSpaces()
+		argStart := p.pos
+
+		if p.eof() {
+			return nil, p.errorf(argStart,
+				"missing argument for %s key", name)
+		}
+
+		if spec == searchArgKey {
+			k, err := p.parseKey()
 			if err != nil {
-				return nil, nil, err
-			} else if key == nil {
-				return nil, nil,
-					fmt.Errorf("missing argument for "+
-						"%s key", tag)
+				return nil, err
 			}
 
-			args = append(args, key...)
-			data = rest
-		} else {
-			switch spec {
-			case argString:
-				fn = parseSearchStringArgString
-			case argDate:
-				fn = parseSearchStringArgDate
-			case argSize:
-				fn = parseSearchStringArgSize
-			}
+			key = append(key, k...)
+			continue
+		}
 
-			arg, rest, err := fn(data)
-			if err != nil {
-				return nil, nil,
-					fmt.Errorf("invalid argument for "+
-						"%s key: %v", tag, err)
+		args, err := p.parseArg(spec)
+		if err != nil {
+			return nil, p.errorf(argStart,
+				"invalid argument for %s key: %v", name, err)
+		}
+
+		key = append(key, args...)
+	}
+
+	return key, nil
+}
+
+func (p *searchStringParser) parseKeyList() (SearchKey, error) {
+	start := p.pos
+	p.pos++
+
+	key := SearchKey{"("}
+
+	for {
+		p.skipSpaces()
+
+		if p.eof() {
+			return nil, p.errorf(start, "missing ')'")
+		}
+
+		if p.data[p.pos] == ')' {
+			if len(key) == 1 {
+				return nil, p.errorf(start, "empty key list")
 			}
 
-			args = append(args, arg)
-			data = rest
+			p.pos++
+			return append(key, ")"), nil
+		}
+
+		k, err := p.parseKey()
+		if err != nil {
+			return nil, err
 		}
+
+		key = append(key, k...)
 	}
+}
+
+func (p *searchStringParser) parseArg(spec int) ([]interface{}, error) {
+	switch spec {
+	case searchArgString:
+		str, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+
+		return []interface{}{AStringArg(string(str))}, nil
+
+	case searchArgDate:
+		word := string(p.readWord())
+
+		for _, layout := range []string{"2006-01-02", IMAPDateFormat,
+			"2-Jan-2006"} {
+			if date, err := time.Parse(layout, word); err == nil {
+				dateString := date.Format(IMAPDateFormat)
+				return []interface{}{[]byte(dateString)}, nil
+			}
+		}
+
+		return nil, fmt.Errorf("invalid date")
+
+	case searchArgNumber:
+		n, err := strconv.ParseUint(string(p.readWord()), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number")
+		}
+
+		return []interface{}{[]byte(strconv.FormatUint(n, 10))}, nil
+
+	case searchArgNumber64:
+		n, err := strconv.ParseUint(string(p.readWord()), 10, 63)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number")
+		}
+
+		return []interface{}{[]byte(strconv.FormatUint(n, 10))}, nil
+
+	case searchArgSequenceSet:
+		set, err := ParseSequenceSet(string(p.readWord()))
+		if err != nil {
+			return nil, err
+		}
+
+		setData, _ := set.MarshalText()
+		return []interface{}{setData}, nil
+
+	case searchArgModSeq:
+		// The entry name and type are optional
+		args := []interface{}{}
+
+		if p.data[p.pos] == '"' {
+			entry, err := p.parseQuotedString()
+			if err != nil {
+				return nil, err
+			}
+
+			if len(entry) == 0 {
+				return nil, fmt.Errorf("empty entry name")
+			}
+
+			p.skipSpaces()
 
-	key := append(SearchKey{tag}, args...)
-	return key, data, nil
-}
-
-func parseSearchStringArgString(data []byte) (interface{}, []byte, error) {
-	var arg []byte
-
-	if data[0] == '"' {
-		data = data[1:]
-
-	loop:
-		for {
-			if len(data) == 0 {
-				return nil, nil,
-					fmt.Errorf("truncated quoted string")
-			} else if data[0] == '"' {
-				data = data[1:]
-				break loop
-			} else if data[0] == '\\' {
-				data = data[1:]
-
-				if data[0] == '\\' || data[0] == '"' {
-					arg = append(arg, data[0])
-				} else {
-					return nil, nil,
-						fmt.Errorf("invalid quoted " +
-							"character")
-				}
-			} else {
-				arg = append(arg, data[0])
+			entryType := strings.ToLower(string(p.readWord()))
+			switch entryType {
+			case "priv", "shared", "all":
+			default:
+				return nil, fmt.Errorf("invalid entry type")
 			}
 
-			data = data[1:]
+			p.skipSpaces()
+
+			args = append(args, QuotedStringEncodeByteString(entry),
+				entryType)
 		}
 
-	} else {
-		idx := bytes.IndexAny(data, " \t")
-		if idx >= 0 {
-			arg = data[:idx]
-			data = data[idx+1:]
-		} else {
-			arg = data[:]
-			data = nil
+		modSeq, err := p.parseArg(searchArgNumber64)
+		if err != nil {
+			return nil, err
 		}
+
+		return append(args, modSeq...), nil
 	}
 
-	return Literal(arg), data, nil
+	panic("invalid search key argument type")
 }
 
-func parseSearchStringArgDate(data []byte) (interface{}, []byte, error) {
-	var arg []byte
+func (p *searchStringParser) parseString() ([]byte, error) {
+	switch p.data[p.pos] {
+	case '"':
+		return p.parseQuotedString()
+	case '{':
+		return p.parseLiteral()
+	}
 
-	idx := bytes.IndexAny(data, " \t")
-	if idx >= 0 {
-		arg = data[:idx]
-		data = data[idx+1:]
-	} else {
-		arg = data[:]
-		data = nil
+	word := p.readWord()
+	if len(word) == 0 {
+		return nil, fmt.Errorf("empty string")
 	}
 
-	date, err := time.Parse("2006-01-02", string(arg))
+	return word, nil
+}
+
+func (p *searchStringParser) parseQuotedString() ([]byte, error) {
+	p.pos++
+
+	str := []byte{}
+
+	for {
+		if p.eof() {
+			return nil, fmt.Errorf("truncated quoted string")
+		}
+
+		c := p.data[p.pos]
+		p.pos++
+
+		switch c {
+		case '"':
+			return str, nil
+
+		case '\\':
+			if p.eof() {
+				return nil, fmt.Errorf("truncated quoted string")
+			}
+
+			c = p.data[p.pos]
+			p.pos++
+
+			if !IsQuotedSpecialChar(c) {
+				return nil, fmt.Errorf("invalid quoted character")
+			}
+		}
+
+		str = append(str, c)
+	}
+}
+
+// parseLiteral reads a literal string, i.e. "{<size>}" followed by the
+// characters of the string; the \r\n sequence after the size is optional.
+func (p *searchStringParser) parseLiteral() ([]byte, error) {
+	p.pos++
+
+	end := bytes.IndexByte(p.data[p.pos:], '}')
+	if end == -1 {
+		return nil, fmt.Errorf("missing '}' after literal size")
+	}
+
+	sizeString := strings.TrimSuffix(string(p.data[p.pos:p.pos+end]), "+")
+	p.pos += end + 1
+
+	size, err := strconv.ParseUint(sizeString, 10, 32)
 	if err != nil {
-		return nil, nil, fmt.Errorf("invalid date")
+		return nil, fmt.Errorf("invalid literal size")
 	}
 
-	return []byte(date.Format(IMAPDateFormat)), data, nil
+	if bytes.HasPrefix(p.data[p.pos:], []byte("\r\n")) {
+		p.pos += 2
+	}
+
+	if uint64(len(p.data)-p.pos) < size {
+		return nil, fmt.Errorf("truncated literal")
+	}
+
+	str := p.data[p.pos : p.pos+int(size)]
+	p.pos += int(size)
+
+	return str, nil
+}
+
+// searchKeyUIDIndex returns the index of the first UID key applying to the
+// whole search, i.e. which is not part of a OR, NOT or parenthesized key, or
+// -1 if there is none.
+func searchKeyUIDIndex(key SearchKey) int {
+	for i := 0; i < len(key); {
+		if strings.ToUpper(commandArgString(key, i)) == "UID" {
+			return i
+		}
+
+		i = skipSearchKey(key, i)
+		if i == -1 {
+			return -1
+		}
+	}
+
+	return -1
 }
 
-func parseSearchStringArgSize(data []byte) (interface{}, []byte, error) {
-	var arg []byte
+// skipSearchKey returns the index following the search key starting at
+// index i, or -1 if the key is unknown or incomplete.
+func skipSearchKey(key SearchKey, i int) int {
+	if i >= len(key) {
+		return -1
+	}
 
-	idx := bytes.IndexAny(data, " \t")
-	if idx >= 0 {
-		arg = data[:idx]
-		data = data[idx+1:]
-	} else {
-		arg = data[:]
-		data = nil
+	name := strings.ToUpper(commandArgString(key, i))
+	i++
+
+	switch name {
+	case "NOT":
+		return skipSearchKey(key, i)
+
+	case "OR":
+		if i = skipSearchKey(key, i); i == -1 {
+			return -1
+		}
+
+		return skipSearchKey(key, i)
+
+	case "(":
+		for i < len(key) && commandArgString(key, i) != ")" {
+			if i = skipSearchKey(key, i); i == -1 {
+				return -1
+			}
+		}
+
+		if i >= len(key) {
+			return -1
+		}
+
+		return i + 1
+
+	case "MODSEQ":
+		// The entry name and type are optional
+		if strings.HasPrefix(commandArgString(key, i), "\"") {
+			i += 2
+		}
+
+		i++
+
+	case "":
+		return -1
+
+	default:
+		if args, found := searchKeyArgs[name]; found {
+			i += len(args)
+		} else if _, err := ParseSequenceSet(name); err == nil {
+			// Sequence set
+		} else {
+			return -1
+		}
 	}
 
-	n, err := strconv.ParseUint(string(arg), 10, 32)
-	if err != nil || n < 0 {
-		return nil, nil, fmt.Errorf("invalid size")
+	if i > len(key) {
+		return -1
 	}
 
-	return []byte(strconv.FormatUint(n, 10)), data, nil
+	return i
 }
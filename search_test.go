@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSearchString(t *testing.T) {
+	tests := []struct {
+		str string
+		key SearchKey
+	}{
+		{"", SearchKey{"ALL"}},
+		{"seen", SearchKey{"SEEN"}},
+		{"FROM \"bob \\\"b\\\"\" SINCE 2016-10-04 NOT TO alice",
+			SearchKey{"FROM", []byte("\"bob \\\"b\\\"\""),
+				"SINCE", []byte("04-Oct-2016"),
+				"NOT", "TO", []byte("alice")}},
+		{"BEFORE 4-Oct-2016", SearchKey{"BEFORE", []byte("04-Oct-2016")}},
+		{"UID 100:200 (OR FROM alice SUBJECT x)",
+			SearchKey{"UID", []byte("100:200"),
+				"(", "OR", "FROM", []byte("alice"),
+				"SUBJECT", []byte("x"), ")"}},
+		{"OR (SEEN FLAGGED)(UNSEEN) 1:5,*",
+			SearchKey{"OR", "(", "SEEN", "FLAGGED", ")",
+				"(", "UNSEEN", ")", []byte("1:5,*")}},
+		{"UID $ $", SearchKey{"UID", []byte("$"), []byte("$")}},
+		{"BODY {5}\r\nhello TEXT {3+}a b",
+			SearchKey{"BODY", []byte("hello"),
+				"TEXT", []byte("\"a b\"")}},
+		{"BODY {4}\r\na\r\nb SUBJECT café",
+			SearchKey{"BODY", Literal("a\r\nb"),
+				"SUBJECT", Literal("café")}},
+		{"HEADER X-Spam yes LARGER 1024",
+			SearchKey{"HEADER", []byte("X-Spam"), []byte("yes"),
+				"LARGER", []byte("1024")}},
+		{"YOUNGER 3600 OLDER 60",
+			SearchKey{"YOUNGER", []byte("3600"),
+				"OLDER", []byte("60")}},
+		{"MODSEQ 42 MODSEQ \"/flags/\\\\Draft\" all 620162338",
+			SearchKey{"MODSEQ", []byte("42"),
+				"MODSEQ", []byte("\"/flags/\\\\Draft\""), "all",
+				[]byte("620162338")}},
+		{"X-GM-RAW \"has:attachment in:unread\"",
+			SearchKey{"X-GM-RAW",
+				[]byte("\"has:attachment in:unread\"")}},
+	}
+
+	for _, test := range tests {
+		key, err := ParseSearchString(test.str)
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", test.str, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(key, test.key) {
+			t.Errorf("%q was parsed as %#v instead of %#v",
+				test.str, key, test.key)
+		}
+	}
+}
+
+func TestParseSearchStringErrors(t *testing.T) {
+	tests := []struct {
+		str string
+		pos int
+	}{
+		{"FOO", 0},
+		{"SEEN FOO", 5},
+		{"FROM", 4},
+		{"SEEN SINCE yesterday", 11},
+		{"(SEEN", 0},
+		{"SEEN )", 5},
+		{"OR SEEN", 7},
+		{"(FROM alice OR SUBJECT x)", 24},
+		{"UID 1:x", 4},
+		{"NOT ()", 4},
+		{"FROM \"alice", 5},
+		{"BODY {10}\r\nhello", 5},
+		{"MODSEQ \"/flags/\\\\Seen\" everything 1", 7},
+		{"3:0", 0},
+	}
+
+	for _, test := range tests {
+		_, err := ParseSearchString(test.str)
+		if err == nil {
+			t.Errorf("parsed invalid search string %q", test.str)
+			continue
+		}
+
+		serr, ok := err.(*SearchStringError)
+		if !ok {
+			t.Errorf("unexpected error for %q: %v", test.str, err)
+			continue
+		}
+
+		if serr.Pos != test.pos {
+			t.Errorf("error %q for %q at position %d instead of %d",
+				serr.Message, test.str, serr.Pos, test.pos)
+		}
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"bytes"
 	"encoding"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 )
 
@@ -48,6 +50,31 @@ func (n SequenceNumber) GoString() string {
 // greater than zero.
 const SequenceStar SequenceNumber = 0
 
+// ---------------------------------------------------------------------------
+//  Search result
+// ---------------------------------------------------------------------------
+
+// SequenceSearchResult represents '$', i.e. the result of the last search
+// command saved with the SAVE return option (SEARCHRES, RFC 5182). It cannot
+// be combined with other entries in a sequence set.
+type SequenceSearchResult struct{}
+
+func NewSequenceSetSearchResult() SequenceSet {
+	return SequenceSet{SequenceSearchResult{}}
+}
+
+func (r SequenceSearchResult) String() string {
+	return "$"
+}
+
+func (r SequenceSearchResult) GoString() string {
+	return "$"
+}
+
+func (r SequenceSearchResult) MarshalText() ([]byte, error) {
+	return []byte("$"), nil
+}
+
 // ---------------------------------------------------------------------------
 //  Sequence range
 // ---------------------------------------------------------------------------
@@ -153,3 +180,374 @@ func (s SequenceSet) MarshalText() ([]byte, error) {
 func (s *SequenceSet) Append(e SequenceSetEntry) {
 	*s = append(*s, e)
 }
+
+// ParseSequenceSet parses a sequence set as defined in RFC 3501, e.g.
+// "2,4:7,9,12:*", or '$' for the saved search result (RFC 5182).
+func ParseSequenceSet(str string) (SequenceSet, error) {
+	set := NewSequenceSet()
+
+	if len(str) == 0 {
+		return nil, fmt.Errorf("empty sequence set")
+	} else if str == "$" {
+		return NewSequenceSetSearchResult(), nil
+	}
+
+	data := []byte(str)
+
+	for _, part := range bytes.Split(data, []byte{','}) {
+		idx := bytes.IndexByte(part, ':')
+		if idx == -1 {
+			n, err := parseSequenceNumber(part)
+			if err != nil {
+				return nil, err
+			}
+
+			set.Append(n)
+		} else {
+			first, err := parseSequenceNumber(part[:idx])
+			if err != nil {
+				return nil, err
+			}
+
+			last, err := parseSequenceNumber(part[idx+1:])
+			if err != nil {
+				return nil, err
+			}
+
+			set.Append(NewSequenceRange(first, last))
+		}
+	}
+
+	return set, nil
+}
+
+func parseSequenceNumber(data []byte) (SequenceNumber, error) {
+	if len(data) == 1 && data[0] == '*' {
+		return SequenceStar, nil
+	}
+
+	if len(data) == 0 || !ByteStringAll(data, IsDigitChar) {
+		return 0, fmt.Errorf("invalid sequence number %q", data)
+	}
+
+	n, err := strconv.ParseUint(string(data), 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid sequence number %q", data)
+	}
+
+	return SequenceNumber(n), nil
+}
+
+// NewSequenceSetFromNumbers returns a set containing a list of sequence
+// numbers or UIDs, consecutive numbers being merged into ranges.
+func NewSequenceSetFromNumbers(ns []uint32) SequenceSet {
+	intervals := make([]sequenceInterval, 0, len(ns))
+
+	for _, n := range ns {
+		if n > 0 {
+			intervals = append(intervals, sequenceInterval{n, n})
+		}
+	}
+
+	return newSequenceSetFromIntervals(mergeSequenceIntervals(intervals), 0)
+}
+
+// Compact returns an equivalent set where numbers are sorted, duplicates are
+// removed and consecutive numbers are merged into ranges. Entries containing
+// '*' or '$' are kept at the end of the set since their value depends on the
+// mailbox.
+func (s SequenceSet) Compact() SequenceSet {
+	intervals := []sequenceInterval{}
+	stars := NewSequenceSet()
+
+	appendStar := func(e SequenceSetEntry) {
+		for _, e2 := range stars {
+			if e2 == e {
+				return
+			}
+		}
+
+		stars.Append(e)
+	}
+
+	for _, e := range s {
+		switch te := e.(type) {
+		case SequenceNumber:
+			if te == SequenceStar {
+				appendStar(te)
+			} else {
+				intervals = append(intervals,
+					sequenceInterval{uint32(te), uint32(te)})
+			}
+
+		case SequenceRange:
+			first, last := te.First, te.Last
+			if first == SequenceStar {
+				first, last = last, first
+			}
+
+			if first == SequenceStar {
+				appendStar(SequenceStar)
+			} else if last == SequenceStar {
+				appendStar(NewSequenceRange(first, last))
+			} else {
+				intervals = append(intervals,
+					newSequenceInterval(uint32(first), uint32(last)))
+			}
+
+		default:
+			appendStar(e)
+		}
+	}
+
+	set := newSequenceSetFromIntervals(mergeSequenceIntervals(intervals), 0)
+	return append(set, stars...)
+}
+
+// Resolve returns a compact set where '*' has been replaced by max, i.e. the
+// largest sequence number or UID in use in the mailbox.
+func (s SequenceSet) Resolve(max uint32) SequenceSet {
+	return newSequenceSetFromIntervals(s.intervals(max), 0)
+}
+
+// Contains indicates whether the set contains a number, '*' having the value
+// max.
+func (s SequenceSet) Contains(n, max uint32) bool {
+	for _, e := range s {
+		i, ok := newSequenceIntervalFromEntry(e, max)
+		if ok && n >= i.first && n <= i.last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Len returns the number of distinct numbers in the set, '*' having the value
+// max.
+func (s SequenceSet) Len(max uint32) int {
+	n := 0
+
+	for _, i := range s.intervals(max) {
+		n += int(i.last-i.first) + 1
+	}
+
+	return n
+}
+
+// Numbers returns the sorted list of numbers in the set, '*' having the value
+// max.
+func (s SequenceSet) Numbers(max uint32) []uint32 {
+	ns := []uint32{}
+
+	for _, i := range s.intervals(max) {
+		for n := uint64(i.first); n <= uint64(i.last); n++ {
+			ns = append(ns, uint32(n))
+		}
+	}
+
+	return ns
+}
+
+// Union returns the compact set of numbers contained in either set.
+func (s SequenceSet) Union(s2 SequenceSet) SequenceSet {
+	set := append(append(NewSequenceSet(), s...), s2...)
+	return set.Compact()
+}
+
+// Intersect returns the compact set of numbers contained in both sets. Since
+// the value of '*' is unknown, it is considered to be larger than any other
+// number; use Resolve first if the largest number in use is known.
+func (s SequenceSet) Intersect(s2 SequenceSet) SequenceSet {
+	is1 := s.intervals(math.MaxUint32)
+	is2 := s2.intervals(math.MaxUint32)
+
+	intervals := []sequenceInterval{}
+
+	for len(is1) > 0 && len(is2) > 0 {
+		i1, i2 := is1[0], is2[0]
+
+		first, last := i1.first, i1.last
+		if i2.first > first {
+			first = i2.first
+		}
+		if i2.last < last {
+			last = i2.last
+		}
+
+		if first <= last {
+			intervals = append(intervals, sequenceInterval{first, last})
+		}
+
+		if i1.last < i2.last {
+			is1 = is1[1:]
+		} else {
+			is2 = is2[1:]
+		}
+	}
+
+	return newSequenceSetFromIntervals(intervals, math.MaxUint32)
+}
+
+// Difference returns the compact set of numbers contained in s but not in
+// s2. As for Intersect, '*' is considered to be larger than any other number.
+func (s SequenceSet) Difference(s2 SequenceSet) SequenceSet {
+	is2 := s2.intervals(math.MaxUint32)
+
+	intervals := []sequenceInterval{}
+
+	for _, i := range s.intervals(math.MaxUint32) {
+		first := uint64(i.first)
+
+		for _, i2 := range is2 {
+			if uint64(i2.last) < first || i2.first > i.last {
+				continue
+			}
+
+			if uint64(i2.first) > first {
+				intervals = append(intervals,
+					sequenceInterval{uint32(first), i2.first - 1})
+			}
+
+			first = uint64(i2.last) + 1
+		}
+
+		if first <= uint64(i.last) {
+			intervals = append(intervals,
+				sequenceInterval{uint32(first), i.last})
+		}
+	}
+
+	return newSequenceSetFromIntervals(intervals, math.MaxUint32)
+}
+
+// Split returns a list of compact sets containing the numbers of the set and
+// whose textual representation is at most max bytes long, except for sets
+// containing a single entry longer than max.
+func (s SequenceSet) Split(max int) []SequenceSet {
+	sets := []SequenceSet{}
+
+	set := NewSequenceSet()
+	length := 0
+
+	for _, e := range s.Compact() {
+		elength := len(e.String())
+
+		if len(set) > 0 && length+1+elength > max {
+			sets = append(sets, set)
+
+			set = NewSequenceSet()
+			length = 0
+		}
+
+		if len(set) > 0 {
+			length++
+		}
+
+		set.Append(e)
+		length += elength
+	}
+
+	return append(sets, set)
+}
+
+// intervals returns the sorted list of disjoint intervals contained in the
+// set, '*' having the value max.
+func (s SequenceSet) intervals(max uint32) []sequenceInterval {
+	intervals := make([]sequenceInterval, 0, len(s))
+
+	for _, e := range s {
+		if i, ok := newSequenceIntervalFromEntry(e, max); ok {
+			intervals = append(intervals, i)
+		}
+	}
+
+	return mergeSequenceIntervals(intervals)
+}
+
+type sequenceInterval struct {
+	first, last uint32
+}
+
+func newSequenceInterval(first, last uint32) sequenceInterval {
+	if first > last {
+		first, last = last, first
+	}
+
+	return sequenceInterval{first, last}
+}
+
+func newSequenceIntervalFromEntry(e SequenceSetEntry, max uint32) (sequenceInterval, bool) {
+	resolve := func(n SequenceNumber) uint32 {
+		if n == SequenceStar {
+			return max
+		}
+
+		return uint32(n)
+	}
+
+	var i sequenceInterval
+
+	switch te := e.(type) {
+	case SequenceNumber:
+		i = sequenceInterval{resolve(te), resolve(te)}
+	case SequenceRange:
+		i = newSequenceInterval(resolve(te.First), resolve(te.Last))
+	default:
+		return i, false
+	}
+
+	// '*' is zero in an empty mailbox
+	if i.first == 0 {
+		i.first = 1
+	}
+
+	return i, i.last > 0
+}
+
+func mergeSequenceIntervals(intervals []sequenceInterval) []sequenceInterval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].first < intervals[j].first
+	})
+
+	merged := []sequenceInterval{}
+
+	for _, i := range intervals {
+		n := len(merged)
+		if n > 0 && uint64(i.first) <= uint64(merged[n-1].last)+1 {
+			if i.last > merged[n-1].last {
+				merged[n-1].last = i.last
+			}
+
+			continue
+		}
+
+		merged = append(merged, i)
+	}
+
+	return merged
+}
+
+// newSequenceSetFromIntervals builds a set from a list of sorted disjoint
+// intervals. If star is not zero, it is encoded as '*'.
+func newSequenceSetFromIntervals(intervals []sequenceInterval, star uint32) SequenceSet {
+	set := NewSequenceSet()
+
+	number := func(n uint32) SequenceNumber {
+		if star != 0 && n == star {
+			return SequenceStar
+		}
+
+		return SequenceNumber(n)
+	}
+
+	for _, i := range intervals {
+		if i.first == i.last {
+			set.Append(number(i.first))
+		} else {
+			set.Append(NewSequenceRange(number(i.first), number(i.last)))
+		}
+	}
+
+	return set
+}
@@ -0,0 +1,208 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSequenceSet(t *testing.T) {
+	tests := []struct {
+		str string
+		set SequenceSet
+	}{
+		{"1", SequenceSet{SequenceNumber(1)}},
+		{"*", SequenceSet{SequenceStar}},
+		{"2,4:7,12:*", SequenceSet{
+			SequenceNumber(2),
+			NewSequenceRange(4, 7),
+			NewSequenceRange(12, SequenceStar),
+		}},
+		{"$", SequenceSet{SequenceSearchResult{}}},
+	}
+
+	for _, test := range tests {
+		set, err := ParseSequenceSet(test.str)
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", test.str, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(set, test.set) {
+			t.Errorf("%q was parsed as %#v instead of %#v",
+				test.str, set, test.set)
+		}
+	}
+
+	for _, str := range []string{"", "0", "1,", "1:", ":2", "a", "4294967296", "$,1"} {
+		if _, err := ParseSequenceSet(str); err == nil {
+			t.Errorf("parsed invalid sequence set %q", str)
+		}
+	}
+}
+
+func TestNewSequenceSetFromNumbers(t *testing.T) {
+	tests := []struct {
+		ns  []uint32
+		set string
+	}{
+		{[]uint32{}, ""},
+		{[]uint32{1}, "1"},
+		{[]uint32{3, 1, 2}, "1:3"},
+		{[]uint32{1, 2, 4, 6, 7, 8, 10}, "1:2,4,6:8,10"},
+		{[]uint32{5, 5, 4}, "4:5"},
+	}
+
+	for _, test := range tests {
+		set := NewSequenceSetFromNumbers(test.ns).String()
+		if set != test.set {
+			t.Errorf("%v was encoded as %q instead of %q",
+				test.ns, set, test.set)
+		}
+	}
+}
+
+func TestSequenceSetCompact(t *testing.T) {
+	tests := []struct {
+		set    string
+		result string
+	}{
+		{"1,2,3", "1:3"},
+		{"7:5,1,3:4,2", "1:7"},
+		{"10,*,2:3,*:8,*", "2:3,10,*,8:*"},
+		{"*:*", "*"},
+		{"$", "$"},
+	}
+
+	for _, test := range tests {
+		set, err := ParseSequenceSet(test.set)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %v", test.set, err)
+		}
+
+		if result := set.Compact().String(); result != test.result {
+			t.Errorf("%q was compacted as %q instead of %q",
+				test.set, result, test.result)
+		}
+	}
+}
+
+func TestSequenceSetContains(t *testing.T) {
+	set, err := ParseSequenceSet("2,4:5,8:*")
+	if err != nil {
+		t.Fatalf("cannot parse set: %v", err)
+	}
+
+	for n, expected := range map[uint32]bool{
+		1: false, 2: true, 3: false, 4: true, 5: true, 7: false,
+		8: true, 10: true, 11: false,
+	} {
+		if set.Contains(n, 10) != expected {
+			t.Errorf("invalid result for %d", n)
+		}
+	}
+
+	// '*' is smaller than the lower bound of the range
+	if !set.Contains(7, 6) || set.Contains(9, 6) {
+		t.Errorf("invalid result for a reversed range")
+	}
+
+	if n := set.Len(10); n != 6 {
+		t.Errorf("invalid length %d", n)
+	}
+
+	ns := set.Numbers(10)
+	if !reflect.DeepEqual(ns, []uint32{2, 4, 5, 8, 9, 10}) {
+		t.Errorf("invalid numbers %v", ns)
+	}
+
+	if resolved := set.Resolve(10).String(); resolved != "2,4:5,8:10" {
+		t.Errorf("invalid resolved set %q", resolved)
+	}
+}
+
+func TestSequenceSetAlgebra(t *testing.T) {
+	tests := []struct {
+		set1, set2   string
+		union        string
+		intersection string
+		difference   string
+	}{
+		{"1:5", "3:8", "1:8", "3:5", "1:2"},
+		{"1,3,5", "2,4", "1:5", "", "1,3,5"},
+		{"1:10", "2,4:5", "1:10", "2,4:5", "1,3,6:10"},
+		{"5:*", "1:7", "1:7,5:*", "5:7", "8:*"},
+		{"1:*", "*", "1:*,*", "*", "1:4294967294"},
+	}
+
+	for _, test := range tests {
+		set1, err := ParseSequenceSet(test.set1)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %v", test.set1, err)
+		}
+
+		set2, err := ParseSequenceSet(test.set2)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %v", test.set2, err)
+		}
+
+		if s := set1.Union(set2).String(); s != test.union {
+			t.Errorf("union of %q and %q is %q instead of %q",
+				test.set1, test.set2, s, test.union)
+		}
+
+		if s := set1.Intersect(set2).String(); s != test.intersection {
+			t.Errorf("intersection of %q and %q is %q instead of %q",
+				test.set1, test.set2, s, test.intersection)
+		}
+
+		if s := set1.Difference(set2).String(); s != test.difference {
+			t.Errorf("difference of %q and %q is %q instead of %q",
+				test.set1, test.set2, s, test.difference)
+		}
+	}
+}
+
+func TestSequenceSetSplit(t *testing.T) {
+	tests := []struct {
+		set   string
+		max   int
+		parts []string
+	}{
+		{"1:3", 10, []string{"1:3"}},
+		{"1,3,5,7,9", 5, []string{"1,3,5", "7,9"}},
+		{"1,3,5,7,9", 4, []string{"1,3", "5,7", "9"}},
+		{"100:200,1,3,*", 3, []string{"1,3", "100:200", "*"}},
+	}
+
+	for _, test := range tests {
+		set, err := ParseSequenceSet(test.set)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %v", test.set, err)
+		}
+
+		parts := []string{}
+		for _, part := range set.Split(test.max) {
+			parts = append(parts, part.String())
+		}
+
+		if !reflect.DeepEqual(parts, test.parts) {
+			t.Errorf("%q was split as %v instead of %v",
+				test.set, parts, test.parts)
+		}
+	}
+}
@@ -21,17 +21,36 @@ import (
 	"io"
 	"math"
 	"strconv"
+	"unicode/utf8"
 )
 
 type Stream struct {
 	Reader io.Reader
 	Buf    []byte
+
+	// MailboxNameUTF8 indicates that mailbox names are sent as UTF-8
+	// strings (IMAP4rev2, RFC 9051) instead of modified UTF-7.
+	MailboxNameUTF8 bool
+
+	// Maximum length of a line, excluding literals, and maximum size of a
+	// literal. Zero means no limit.
+	MaxLineLength  int
+	MaxLiteralSize int
+
+	// Maximum number of nested parenthesized lists. Zero means no limit,
+	// in which case deeply nested data can exhaust the stack.
+	MaxNestingDepth int
+
+	depth      int
+	lineLength int // number of bytes read since the last end of line
 }
 
 func NewStream(r io.Reader) *Stream {
 	return &Stream{
 		Reader: r,
 		Buf:    []byte{},
+
+		MaxNestingDepth: DefaultMaxNestingDepth,
 	}
 }
 
@@ -52,15 +71,29 @@ func (s *Stream) IsEmpty() (bool, error) {
 	return false, nil
 }
 
+// The maximum number of bytes read at once by Peek. The buffer grows as data
+// arrive so that a large size, e.g. the size of a literal sent by the server,
+// does not cause a large allocation before the data are actually available.
+const peekBlockSize = 64 * 1024
+
 func (s *Stream) Peek(n int) ([]byte, error) {
-	if len(s.Buf) < n {
+	if err := s.checkLineLength(0); err != nil {
+		return nil, err
+	}
+
+	for len(s.Buf) < n {
 		blen := len(s.Buf)
+
 		rest := n - blen
+		if rest > peekBlockSize {
+			rest = peekBlockSize
+		}
+
 		s.Buf = append(s.Buf, make([]byte, rest)...)
 
 		nbRead, err := io.ReadAtLeast(s.Reader, s.Buf[blen:], rest)
+		s.Buf = s.Buf[0 : blen+nbRead]
 		if err != nil {
-			s.Buf = s.Buf[0 : blen+nbRead]
 			return nil, err
 		}
 	}
@@ -105,7 +138,7 @@ func (s *Stream) Skip(n int) error {
 		return err
 	}
 
-	s.Buf = s.Buf[n:]
+	s.consume(n)
 	return nil
 }
 
@@ -116,7 +149,7 @@ func (s *Stream) SkipBytes(bs []byte) (bool, error) {
 	}
 
 	if bytes.Equal(data, bs) {
-		s.Buf = s.Buf[len(bs):]
+		s.consume(len(bs))
 		return true, nil
 	}
 
@@ -138,7 +171,7 @@ func (s *Stream) Read(n int) ([]byte, error) {
 		return nil, err
 	}
 
-	s.Buf = s.Buf[n:]
+	s.consume(n)
 	return data, nil
 }
 
@@ -153,7 +186,7 @@ loop:
 		}
 
 		buf.Write(data)
-		s.Buf = s.Buf[len(data):]
+		s.consume(len(data))
 
 		empty, err := s.IsEmpty()
 		if err != nil {
@@ -182,14 +215,14 @@ loop:
 
 		for i, b := range block {
 			if !fn(b) {
-				s.Buf = s.Buf[i:]
+				s.consume(i)
 				break loop
 			}
 
 			data = append(data, b)
 		}
 
-		s.Buf = s.Buf[len(block):]
+		s.consume(len(block))
 	}
 
 	return data, nil
@@ -203,6 +236,10 @@ func (s *Stream) PeekUntil(delim []byte) ([]byte, error) {
 		}
 
 		blen := len(s.Buf)
+		if err := s.checkLineLength(blen); err != nil {
+			return nil, err
+		}
+
 		s.Buf = append(s.Buf, make([]byte, 4096)...)
 
 		nread, err := s.Reader.Read(s.Buf[blen:])
@@ -223,7 +260,7 @@ func (s *Stream) ReadUntil(delim []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	s.Buf = s.Buf[len(data):]
+	s.consume(len(data))
 	return data, nil
 }
 
@@ -233,7 +270,7 @@ func (s *Stream) ReadUntilAndSkip(delim []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	s.Buf = s.Buf[len(data)+len(delim):]
+	s.consume(len(data) + len(delim))
 	return data, nil
 }
 
@@ -323,6 +360,9 @@ loop:
 }
 
 func (s *Stream) ReadIMAPLiteralString() ([]byte, error) {
+	// Literal data do not count in the length of the line
+	lineLength := s.lineLength
+
 	if found, err := s.SkipByte('{'); err != nil {
 		return nil, err
 	} else if !found {
@@ -345,6 +385,11 @@ func (s *Stream) ReadIMAPLiteralString() ([]byte, error) {
 		return nil, fmt.Errorf("literal string size too large")
 	}
 
+	if s.MaxLiteralSize > 0 && count > uint64(s.MaxLiteralSize) {
+		return nil, &LimitError{Limit: "literal size",
+			Max: int64(s.MaxLiteralSize)}
+	}
+
 	if found, err := s.SkipBytes([]byte("\r\n")); err != nil {
 		return nil, err
 	} else if !found {
@@ -357,6 +402,8 @@ func (s *Stream) ReadIMAPLiteralString() ([]byte, error) {
 		return nil, err
 	}
 
+	s.lineLength = lineLength + len(countData) + 4
+
 	return data, nil
 }
 
@@ -400,6 +447,20 @@ func (s *Stream) ReadIMAPNumber() (uint32, error) {
 	return uint32(n), err
 }
 
+func (s *Stream) ReadIMAPNumber64() (uint64, error) {
+	data, err := s.ReadWhile(IsDigitChar)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseUint(string(data), 10, 63)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, err
+}
+
 func (s *Stream) ReadIMAPMailboxList() (*MailboxList, error) {
 	mbox := &MailboxList{}
 
@@ -417,29 +478,29 @@ func (s *Stream) ReadIMAPMailboxList() (*MailboxList, error) {
 	}
 
 	// Hierarchy delimiter
-	if found, err := s.SkipByte('"'); err != nil {
-		return nil, err
-	} else if !found {
-		return nil,
-			fmt.Errorf("missing first '\"' for hierarchy delimiter")
-	}
-
 	if found, err := s.SkipBytes([]byte("NIL")); err != nil {
 		return nil, err
 	} else if !found {
+		if found, err := s.SkipByte('"'); err != nil {
+			return nil, err
+		} else if !found {
+			return nil, fmt.Errorf("missing first '\"' for " +
+				"hierarchy delimiter")
+		}
+
 		c, _, err := s.ReadIMAPQuotedChar()
 		if err != nil {
 			return nil, err
 		}
 
 		mbox.HierarchyDelimiter = rune(c)
-	}
 
-	if found, err := s.SkipByte('"'); err != nil {
-		return nil, err
-	} else if !found {
-		return nil,
-			fmt.Errorf("missing last '\"' for hierarchy delimiter")
+		if found, err := s.SkipByte('"'); err != nil {
+			return nil, err
+		} else if !found {
+			return nil, fmt.Errorf("missing last '\"' for " +
+				"hierarchy delimiter")
+		}
 	}
 
 	if found, err := s.SkipByte(' '); err != nil {
@@ -450,17 +511,210 @@ func (s *Stream) ReadIMAPMailboxList() (*MailboxList, error) {
 	}
 
 	// Name
+	name, err := s.ReadIMAPMailboxName()
+	if err != nil {
+		return nil, err
+	}
+	mbox.Name = name
+
+	// Extended data (RFC 5258)
+	if found, err := s.SkipByte(' '); err != nil {
+		return nil, err
+	} else if found {
+		value, err := s.ReadIMAPValue()
+		if err != nil {
+			return nil, err
+		}
+
+		items, ok := value.([]interface{})
+		if !ok || len(items)%2 != 0 {
+			return nil, fmt.Errorf("invalid mailbox list " +
+				"extended data")
+		}
+
+		for i := 0; i < len(items); i += 2 {
+			tag, ok := items[i].([]byte)
+			if !ok {
+				return nil, fmt.Errorf("invalid mailbox list " +
+					"extended data")
+			}
+
+			switch string(bytes.ToUpper(tag)) {
+			case "OLDNAME":
+				values, ok := items[i+1].([]interface{})
+				if !ok || len(values) != 1 {
+					return nil, fmt.Errorf("invalid " +
+						"OLDNAME data")
+				}
+
+				oldName, ok := values[0].([]byte)
+				if !ok {
+					return nil, fmt.Errorf("invalid " +
+						"OLDNAME data")
+				}
+
+				mbox.OldName, err = s.decodeMailboxName(oldName)
+				if err != nil {
+					return nil, err
+				}
+
+			case "CHILDINFO":
+				values, _ := items[i+1].([]interface{})
+				for _, value := range values {
+					if info, ok := value.([]byte); ok {
+						mbox.ChildInfo = append(
+							mbox.ChildInfo,
+							string(info))
+					}
+				}
+			}
+		}
+	}
+
+	return mbox, nil
+}
+
+func (s *Stream) ReadIMAPMailboxName() (string, error) {
 	encodedName, err := s.ReadIMAPAstring()
+	if err != nil {
+		return "", err
+	}
+
+	return s.decodeMailboxName(encodedName)
+}
+
+func (s *Stream) decodeMailboxName(data []byte) (string, error) {
+	if s.MailboxNameUTF8 {
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("invalid mailbox name: " +
+				"invalid utf-8 sequence")
+		}
+
+		return string(data), nil
+	}
+
+	name, err := ModifiedUTF7Decode(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid mailbox name: %v", err)
+	}
+
+	return string(name), nil
+}
+
+func (s *Stream) ReadIMAPSequenceSet() (SequenceSet, error) {
+	data, err := s.ReadWhile(func(b byte) bool {
+		return IsDigitChar(b) || b == ':' || b == ',' || b == '*'
+	})
 	if err != nil {
 		return nil, err
 	}
-	name, err := ModifiedUTF7Decode(encodedName)
+
+	return ParseSequenceSet(string(data))
+}
+
+// ReadIMAPValue reads a generic value: NIL, an atom, a number, a string or a
+// parenthesized list of values. NIL is returned as nil, atoms, numbers and
+// strings as byte slices, and lists as []interface{}. It is used to read
+// data whose structure we do not care about or do not know yet.
+func (s *Stream) ReadIMAPValue() (interface{}, error) {
+	c, err := s.Peek(1)
 	if err != nil {
-		return nil, fmt.Errorf("invalid mailbox name: %v", err)
+		return nil, err
 	}
-	mbox.Name = string(name)
 
-	return mbox, nil
+	switch c[0] {
+	case '(':
+		if err := s.Skip(1); err != nil {
+			return nil, err
+		}
+
+		s.depth++
+		defer func() { s.depth-- }()
+
+		if err := s.checkNestingDepth(); err != nil {
+			return nil, err
+		}
+
+		values := []interface{}{}
+
+		for {
+			if found, err := s.SkipByte(')'); err != nil {
+				return nil, err
+			} else if found {
+				return values, nil
+			}
+
+			if len(values) > 0 {
+				if found, err := s.SkipByte(' '); err != nil {
+					return nil, err
+				} else if !found {
+					return nil, fmt.Errorf("missing " +
+						"space between list values")
+				}
+			}
+
+			value, err := s.ReadIMAPValue()
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, value)
+		}
+
+	case '"':
+		return s.ReadIMAPQuotedString()
+
+	case '{':
+		return s.ReadIMAPLiteralString()
+	}
+
+	data, err := s.ReadWhile(func(b byte) bool {
+		return b != ' ' && b != '(' && b != ')' &&
+			b != '\r' && b != '\n'
+	})
+	if err != nil {
+		return nil, err
+	} else if len(data) == 0 {
+		return nil, fmt.Errorf("invalid character %q", c[0])
+	}
+
+	if bytes.Equal(bytes.ToUpper(data), []byte("NIL")) {
+		return nil, nil
+	}
+
+	return data, nil
+}
+
+// consume removes n bytes from the buffer and updates the length of the
+// current line.
+func (s *Stream) consume(n int) {
+	if idx := bytes.LastIndexByte(s.Buf[:n], '\n'); idx >= 0 {
+		s.lineLength = n - idx - 1
+	} else {
+		s.lineLength += n
+	}
+
+	s.Buf = s.Buf[n:]
+}
+
+// checkLineLength returns an error if the current line is longer than
+// MaxLineLength, counting n bytes not read yet.
+func (s *Stream) checkLineLength(n int) error {
+	if s.MaxLineLength > 0 && s.lineLength+n > s.MaxLineLength {
+		return &LimitError{Limit: "line length",
+			Max: int64(s.MaxLineLength)}
+	}
+
+	return nil
+}
+
+func (s *Stream) checkNestingDepth() error {
+	if s.MaxNestingDepth > 0 && s.depth > s.MaxNestingDepth {
+		return &LimitError{Limit: "nesting depth",
+			Max: int64(s.MaxNestingDepth)}
+	}
+
+	return nil
 }
 
 func dupBytes(data []byte) []byte {
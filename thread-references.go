@@ -0,0 +1,544 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+//  Thread message
+// ---------------------------------------------------------------------------
+
+// ThreadFetchItems are the items required to build a thread message from
+// the data returned by a FETCH command.
+var ThreadFetchItems = []string{
+	"UID",
+	"INTERNALDATE",
+	"BODY.PEEK[HEADER.FIELDS (MESSAGE-ID IN-REPLY-TO REFERENCES " +
+		"SUBJECT DATE)]",
+}
+
+// ThreadMessage contains the information used to thread messages on the
+// client side.
+type ThreadMessage struct {
+	// Either a sequence number or a UID
+	Id uint32
+
+	MessageId string
+
+	// The content of the References header field, or the first message
+	// identifier of the In-Reply-To header field if there is no
+	// References field (RFC 5256 4.)
+	References []string
+
+	Subject string
+	Date    time.Time
+}
+
+// NewThreadMessage extracts the information used for threading from the
+// header of a message. The date is zero if the header does not contain a
+// valid Date field.
+func NewThreadMessage(id uint32, header mail.Header) *ThreadMessage {
+	msg := &ThreadMessage{
+		Id:      id,
+		Subject: header.Get("Subject"),
+	}
+
+	if ids := parseMessageIds(header.Get("Message-Id")); len(ids) > 0 {
+		msg.MessageId = ids[0]
+	}
+
+	msg.References = parseMessageIds(header.Get("References"))
+	if len(msg.References) == 0 {
+		ids := parseMessageIds(header.Get("In-Reply-To"))
+		if len(ids) > 0 {
+			msg.References = ids[:1]
+		}
+	}
+
+	if date, err := header.Date(); err == nil {
+		msg.Date = date
+	}
+
+	return msg
+}
+
+// NewThreadMessageFromFetch builds a thread message from a message fetched
+// with ThreadFetchItems. The internal date is used if the message does not
+// have a valid Date header field.
+func NewThreadMessageFromFetch(fmsg *Message) (*ThreadMessage, error) {
+	data := fmsg.Section(ThreadFetchItems[2])
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse header of message %d: %v",
+			fmsg.UID, err)
+	}
+
+	msg := NewThreadMessage(fmsg.UID, m.Header)
+	if msg.Date.IsZero() {
+		msg.Date = fmsg.InternalDate
+	}
+
+	return msg, nil
+}
+
+// parseMessageIds returns the list of message identifiers, including angle
+// brackets, contained in a header field. Anything outside of angle brackets
+// is ignored.
+func parseMessageIds(value string) []string {
+	ids := []string{}
+
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			break
+		}
+
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			break
+		}
+
+		id := value[start : start+end+1]
+		if len(id) > 2 && !strings.ContainsAny(id[1:], " \t<") {
+			ids = append(ids, id)
+		}
+
+		value = value[start+end+1:]
+	}
+
+	return ids
+}
+
+// ---------------------------------------------------------------------------
+//  Base subject
+// ---------------------------------------------------------------------------
+
+// BaseSubject returns the base subject of a message as defined in RFC 5256
+// 2.1, i.e. the subject without reply and forward prefixes and trailers.
+// Encoded words are decoded and consecutive white space characters are
+// replaced by a single space.
+func BaseSubject(subject string) string {
+	s, _ := baseSubject(subject)
+	return s
+}
+
+// baseSubject extracts the base subject and indicates whether the subject
+// identified the message as a reply or a forward.
+func baseSubject(subject string) (string, bool) {
+	s := strings.Join(strings.Fields(decodeHeaderValue(subject)), " ")
+	reply := false
+
+	for {
+		// (2) Remove trailers
+		for {
+			s = strings.TrimRight(s, " ")
+
+			if !hasSuffixFold(s, "(fwd)") {
+				break
+			}
+
+			s = s[:len(s)-5]
+			reply = true
+		}
+
+		// (3) and (4) Remove leaders and blobs
+		for {
+			prev := s
+			s = strings.TrimLeft(s, " ")
+
+			if rest, ok := trimSubjectLeader(s); ok {
+				s = rest
+				reply = true
+			}
+
+			if rest, ok := trimSubjectBlob(s); ok && rest != "" {
+				s = rest
+			}
+
+			if s == prev {
+				break
+			}
+		}
+
+		// (5) Remove forward wrappers
+		if len(s) > 6 && hasPrefixFold(s, "[fwd:") && s[len(s)-1] == ']' {
+			s = s[5 : len(s)-1]
+			reply = true
+			continue
+		}
+
+		return s, reply
+	}
+}
+
+// trimSubjectLeader removes a reply or forward prefix, i.e. "re", "fw" or
+// "fwd" followed by an optional blob and a colon. The prefix can itself be
+// preceded by blobs.
+func trimSubjectLeader(s string) (string, bool) {
+	for {
+		rest, ok := trimSubjectBlob(s)
+		if !ok {
+			break
+		}
+
+		s = rest
+	}
+
+	switch {
+	case hasPrefixFold(s, "re"):
+		s = s[2:]
+	case hasPrefixFold(s, "fwd"):
+		s = s[3:]
+	case hasPrefixFold(s, "fw"):
+		s = s[2:]
+	default:
+		return "", false
+	}
+
+	s = strings.TrimLeft(s, " ")
+
+	if rest, ok := trimSubjectBlob(s); ok {
+		s = rest
+	}
+
+	if !strings.HasPrefix(s, ":") {
+		return "", false
+	}
+
+	return s[1:], true
+}
+
+// trimSubjectBlob removes a blob, i.e. a text between square brackets, and
+// the white space following it.
+func trimSubjectBlob(s string) (string, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return "", false
+	}
+
+	end := strings.IndexAny(s[1:], "[]")
+	if end < 0 || s[1+end] != ']' {
+		return "", false
+	}
+
+	return strings.TrimLeft(s[end+2:], " "), true
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) &&
+		strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// ---------------------------------------------------------------------------
+//  REFERENCES algorithm
+// ---------------------------------------------------------------------------
+type threadContainer struct {
+	msg      *ThreadMessage
+	parent   *threadContainer
+	children []*threadContainer
+}
+
+func (c *threadContainer) isDummy() bool {
+	return c.msg == nil
+}
+
+// firstMessage returns the message of the container, or the message of the
+// first child for dummy containers.
+func (c *threadContainer) firstMessage() *ThreadMessage {
+	for c.isDummy() {
+		if len(c.children) == 0 {
+			return nil
+		}
+
+		c = c.children[0]
+	}
+
+	return c.msg
+}
+
+// hasDescendant indicates whether c2 is c or one of its descendants.
+func (c *threadContainer) hasDescendant(c2 *threadContainer) bool {
+	for ; c2 != nil; c2 = c2.parent {
+		if c2 == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *threadContainer) addChild(child *threadContainer) {
+	child.parent = c
+	c.children = append(c.children, child)
+}
+
+func (c *threadContainer) removeChild(child *threadContainer) {
+	for i, c2 := range c.children {
+		if c2 == child {
+			c.children = append(c.children[:i], c.children[i+1:]...)
+			break
+		}
+	}
+
+	child.parent = nil
+}
+
+func (c *threadContainer) thread() *Thread {
+	t := &Thread{}
+
+	if c.msg != nil {
+		t.Id = c.msg.Id
+	}
+
+	for _, child := range c.children {
+		t.Children = append(t.Children, child.thread())
+	}
+
+	return t
+}
+
+// ThreadByReferences threads messages on the client side using the
+// REFERENCES algorithm (RFC 5256 4.). It returns the same threads as a
+// server would for the THREAD=REFERENCES extension.
+func ThreadByReferences(msgs []*ThreadMessage) []*Thread {
+	// (1) Link messages using their references
+	table := map[string]*threadContainer{}
+	containers := []*threadContainer{}
+
+	container := func(id string) *threadContainer {
+		c, found := table[id]
+		if !found {
+			c = &threadContainer{}
+			table[id] = c
+			containers = append(containers, c)
+		}
+
+		return c
+	}
+
+	for _, msg := range msgs {
+		// (A) Link references together, keeping existing links
+		for i := 1; i < len(msg.References); i++ {
+			parent := container(msg.References[i-1])
+			child := container(msg.References[i])
+
+			if child.parent == nil && !child.hasDescendant(parent) {
+				parent.addChild(child)
+			}
+		}
+
+		// (B) Create the container of the message; messages without
+		// identifier or with a duplicate identifier get a container of
+		// their own.
+		c, found := table[msg.MessageId]
+		if msg.MessageId == "" || (found && c.msg != nil) {
+			c = &threadContainer{}
+			containers = append(containers, c)
+		} else {
+			c = container(msg.MessageId)
+		}
+
+		c.msg = msg
+
+		// (C) The last reference is the parent of the message
+		if c.parent != nil {
+			c.parent.removeChild(c)
+		}
+
+		if n := len(msg.References); n > 0 {
+			parent := container(msg.References[n-1])
+
+			if !c.hasDescendant(parent) {
+				parent.addChild(c)
+			}
+		}
+	}
+
+	// (2) Gather the root set
+	roots := []*threadContainer{}
+	for _, c := range containers {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+
+	// (3) Prune dummy containers
+	roots = pruneThreadContainers(roots, true)
+
+	// (4) Sort the root set
+	sortThreadContainers(roots)
+
+	// (5) Group threads with the same base subject
+	roots = groupThreadContainers(roots)
+
+	// (6) Sort children
+	for _, c := range roots {
+		sortThreadContainers(c.children)
+	}
+
+	threads := make([]*Thread, len(roots))
+	for i, c := range roots {
+		threads[i] = c.thread()
+	}
+
+	return threads
+}
+
+func pruneThreadContainers(cs []*threadContainer, root bool) []*threadContainer {
+	result := []*threadContainer{}
+
+	for _, c := range cs {
+		c.children = pruneThreadContainers(c.children, false)
+
+		if c.isDummy() {
+			if len(c.children) == 0 {
+				continue
+			}
+
+			// Children are only promoted to the root set if there
+			// is a single one.
+			if !root || len(c.children) == 1 {
+				for _, child := range c.children {
+					child.parent = c.parent
+				}
+
+				result = append(result, c.children...)
+				continue
+			}
+		}
+
+		result = append(result, c)
+	}
+
+	return result
+}
+
+// sortThreadContainers sorts containers and their descendants by sent date,
+// using the date of the first child for dummy containers. Messages with the
+// same date are sorted by id.
+func sortThreadContainers(cs []*threadContainer) {
+	for _, c := range cs {
+		sortThreadContainers(c.children)
+	}
+
+	sort.SliceStable(cs, func(i, j int) bool {
+		msg1 := cs[i].firstMessage()
+		msg2 := cs[j].firstMessage()
+
+		if !msg1.Date.Equal(msg2.Date) {
+			return msg1.Date.Before(msg2.Date)
+		}
+
+		return msg1.Id < msg2.Id
+	})
+}
+
+func groupThreadContainers(roots []*threadContainer) []*threadContainer {
+	type subjectInfo struct {
+		key   string
+		reply bool
+	}
+
+	subjects := make([]subjectInfo, len(roots))
+	table := map[string]*threadContainer{}
+	replies := map[*threadContainer]bool{}
+
+	for i, c := range roots {
+		subject, reply := baseSubject(c.firstMessage().Subject)
+		if subject == "" {
+			continue
+		}
+
+		key := strings.ToLower(subject)
+		subjects[i] = subjectInfo{key, reply && !c.isDummy()}
+		replies[c] = subjects[i].reply
+
+		c2, found := table[key]
+		if !found ||
+			(c.isDummy() && !c2.isDummy()) ||
+			(!c2.isDummy() && replies[c2] && !subjects[i].reply) {
+			table[key] = c
+		}
+	}
+
+	removed := map[*threadContainer]bool{}
+	replaced := map[*threadContainer]*threadContainer{}
+
+	for i, c := range roots {
+		key := subjects[i].key
+		if key == "" {
+			continue
+		}
+
+		c2 := table[key]
+		if c2 == c || replaced[c] == c2 {
+			continue
+		}
+
+		removed[c] = true
+
+		switch {
+		case c.isDummy() && c2.isDummy():
+			for _, child := range c.children {
+				c2.addChild(child)
+			}
+
+		case c2.isDummy():
+			c2.addChild(c)
+
+		case subjects[i].reply && !replies[c2]:
+			c2.addChild(c)
+
+		default:
+			// The new dummy container takes the place of the one
+			// in the table, which is always a root container since
+			// dummy containers created here stay in the table.
+			dummy := &threadContainer{}
+			dummy.addChild(c2)
+			dummy.addChild(c)
+
+			replaced[c2] = dummy
+			table[key] = dummy
+		}
+	}
+
+	result := []*threadContainer{}
+
+	for _, c := range roots {
+		if removed[c] {
+			continue
+		}
+
+		if dummy := replaced[c]; dummy != nil {
+			c = dummy
+		}
+
+		result = append(result, c)
+	}
+
+	return result
+}
@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// Thread is a node of a thread tree as returned by the THREAD command (RFC
+// 5256). Id is either a sequence number or a UID depending on the command.
+// It is zero when the node represents a parent message which is not present
+// in the mailbox, in which case Children contains at least two threads.
+type Thread struct {
+	Id       uint32
+	Children []*Thread
+}
+
+// String returns the thread in the format used in THREAD responses, e.g.
+// "(3 6 (4 23)(44 7 96))".
+func (t *Thread) String() string {
+	buf := bytes.NewBuffer([]byte{})
+
+	buf.WriteByte('(')
+	t.writeMembers(buf)
+	buf.WriteByte(')')
+
+	return buf.String()
+}
+
+func (t *Thread) GoString() string {
+	return t.String()
+}
+
+func (t *Thread) writeMembers(buf *bytes.Buffer) {
+	if t.Id != 0 {
+		buf.WriteString(strconv.FormatUint(uint64(t.Id), 10))
+
+		if len(t.Children) == 1 && t.Children[0].Id != 0 {
+			buf.WriteByte(' ')
+			t.Children[0].writeMembers(buf)
+			return
+		}
+
+		if len(t.Children) > 0 {
+			buf.WriteByte(' ')
+		}
+	}
+
+	for _, child := range t.Children {
+		buf.WriteByte('(')
+		child.writeMembers(buf)
+		buf.WriteByte(')')
+	}
+}
+
+// MessageIds returns the identifiers of all messages in the thread, in
+// depth-first order.
+func (t *Thread) MessageIds() []uint32 {
+	ids := []uint32{}
+
+	if t.Id != 0 {
+		ids = append(ids, t.Id)
+	}
+
+	for _, child := range t.Children {
+		ids = append(ids, child.MessageIds()...)
+	}
+
+	return ids
+}
+
+// ReadIMAPThread reads a parenthesized thread list.
+func (s *Stream) ReadIMAPThread() (*Thread, error) {
+	if found, err := s.SkipByte('('); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, fmt.Errorf("missing '(' at the beginning of thread")
+	}
+
+	s.depth++
+	defer func() { s.depth-- }()
+
+	if err := s.checkNestingDepth(); err != nil {
+		return nil, err
+	}
+
+	ids := []uint32{}
+	nested := []*Thread{}
+
+	for {
+		c, err := s.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case c[0] == ')':
+			if err := s.Skip(1); err != nil {
+				return nil, err
+			}
+
+			return newThread(ids, nested)
+
+		case c[0] == '(':
+			child, err := s.ReadIMAPThread()
+			if err != nil {
+				return nil, err
+			}
+
+			nested = append(nested, child)
+
+		case IsDigitChar(c[0]) && len(nested) == 0:
+			id, err := s.ReadIMAPNumber()
+			if err != nil {
+				return nil, err
+			} else if id == 0 {
+				return nil, fmt.Errorf("invalid message id in thread")
+			}
+
+			ids = append(ids, id)
+
+			if _, err := s.SkipByte(' '); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, fmt.Errorf("invalid character %q in thread",
+				c[0])
+		}
+	}
+}
+
+// newThread builds a thread from a list of members, each one being the
+// parent of the next one, and a list of threads which are children of the
+// last member.
+func newThread(ids []uint32, nested []*Thread) (*Thread, error) {
+	if len(ids) == 0 && len(nested) == 0 {
+		return nil, fmt.Errorf("empty thread")
+	}
+
+	root := &Thread{}
+	last := root
+
+	for i, id := range ids {
+		if i == 0 {
+			root.Id = id
+		} else {
+			t := &Thread{Id: id}
+			last.Children = []*Thread{t}
+			last = t
+		}
+	}
+
+	if len(ids) == 0 && len(nested) == 1 {
+		return nested[0], nil
+	}
+
+	last.Children = append(last.Children, nested...)
+
+	return root, nil
+}
@@ -0,0 +1,224 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadResponseThread(t *testing.T) {
+	tests := []struct {
+		str     string
+		threads []*Thread
+	}{
+		{"", nil},
+		{"(2)(3 6 (4 23)(44 7 96))", []*Thread{
+			{Id: 2},
+			{Id: 3, Children: []*Thread{
+				{Id: 6, Children: []*Thread{
+					{Id: 4, Children: []*Thread{{Id: 23}}},
+					{Id: 44, Children: []*Thread{
+						{Id: 7, Children: []*Thread{
+							{Id: 96},
+						}},
+					}},
+				}},
+			}},
+		}},
+		{"((3)(5))", []*Thread{
+			{Children: []*Thread{{Id: 3}, {Id: 5}}},
+		}},
+		{"(1 ((2)(3 4)))", []*Thread{
+			{Id: 1, Children: []*Thread{
+				{Children: []*Thread{
+					{Id: 2},
+					{Id: 3, Children: []*Thread{{Id: 4}}},
+				}},
+			}},
+		}},
+	}
+
+	for _, test := range tests {
+		data := "* THREAD " + test.str + "\r\n"
+
+		resp, err := ReadResponse(NewStream(bytes.NewReader([]byte(data))))
+		if err != nil {
+			t.Errorf("cannot read %q: %v", data, err)
+			continue
+		}
+
+		threads := resp.(*ResponseThread).Threads
+		if !reflect.DeepEqual(threads, test.threads) {
+			t.Errorf("%q was parsed as %#v instead of %#v",
+				test.str, threads, test.threads)
+			continue
+		}
+
+		str := ""
+		for _, thread := range threads {
+			str += thread.String()
+		}
+
+		if str != test.str {
+			t.Errorf("%q was formatted as %q", test.str, str)
+		}
+	}
+
+	for _, str := range []string{"(", "()", "(0)", "(1 (2)(3) 4)", "(a)"} {
+		data := "* THREAD " + str + "\r\n"
+
+		if _, err := ReadResponse(NewStream(bytes.NewReader([]byte(data)))); err == nil {
+			t.Errorf("read invalid thread %q", str)
+		}
+	}
+}
+
+func TestThreadMessageIds(t *testing.T) {
+	thread := &Thread{Id: 3, Children: []*Thread{
+		{Id: 6, Children: []*Thread{{Id: 4}}},
+		{Children: []*Thread{{Id: 44}, {Id: 7}}},
+	}}
+
+	ids := thread.MessageIds()
+	if !reflect.DeepEqual(ids, []uint32{3, 6, 4, 44, 7}) {
+		t.Errorf("invalid message ids %v", ids)
+	}
+}
+
+func TestBaseSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		base    string
+		reply   bool
+	}{
+		{"foo", "foo", false},
+		{"Re: foo", "foo", true},
+		{"RE: [list] Re[2]: foo (fwd)", "foo", true},
+		{"[Fwd: Re: bar]", "bar", true},
+		{"[list] foo", "foo", false},
+		{"[list]", "[list]", false},
+		{"  Fwd:   foo\t bar  ", "foo bar", true},
+		{"=?UTF-8?Q?Re:_R=C3=A9union?=", "Réunion", true},
+		{"release: x", "release: x", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		base, reply := baseSubject(test.subject)
+		if base != test.base || reply != test.reply {
+			t.Errorf("base subject of %q is %q (reply: %v) instead "+
+				"of %q (reply: %v)", test.subject, base, reply,
+				test.base, test.reply)
+		}
+	}
+}
+
+func TestThreadByReferences(t *testing.T) {
+	date := time.Date(2016, 10, 4, 12, 0, 0, 0, time.UTC)
+
+	msg := func(id uint32, messageId string, refs []string, subject string, hours int) *ThreadMessage {
+		return &ThreadMessage{
+			Id:         id,
+			MessageId:  messageId,
+			References: refs,
+			Subject:    subject,
+			Date:       date.Add(time.Duration(hours) * time.Hour),
+		}
+	}
+
+	tests := []struct {
+		msgs    []*ThreadMessage
+		threads string
+	}{
+		{[]*ThreadMessage{}, ""},
+		{[]*ThreadMessage{
+			msg(1, "<a>", nil, "foo", 1),
+			msg(2, "<b>", []string{"<a>"}, "Re: foo", 2),
+			// Missing parent
+			msg(3, "<c>", []string{"<a>", "<x>"}, "Re: foo", 3),
+			msg(4, "<d>", nil, "bar", 4),
+			// Grouped by subject
+			msg(5, "<e>", []string{"<y>"}, "Re: bar", 5),
+			// Siblings without parent
+			msg(6, "<f>", []string{"<z>"}, "baz", 0),
+			msg(7, "<g>", []string{"<z>"}, "qux", 6),
+			// Duplicate message id
+			msg(8, "<a>", nil, "foo", 7),
+		}, "((6)(7))((1 (2)(3))(8))(4 5)"},
+		{[]*ThreadMessage{
+			msg(1, "<p>", []string{"<q>"}, "foo", 1),
+			msg(2, "<q>", []string{"<p>"}, "bar", 2),
+		}, "(2 1)"},
+		{[]*ThreadMessage{
+			msg(2, "", nil, "foo", 1),
+			msg(1, "", nil, "Re: foo", 1),
+			msg(3, "", nil, "", 0),
+		}, "(3)(2 1)"},
+	}
+
+	for _, test := range tests {
+		str := ""
+		for _, thread := range ThreadByReferences(test.msgs) {
+			str += thread.String()
+		}
+
+		if str != test.threads {
+			t.Errorf("messages were threaded as %q instead of %q",
+				str, test.threads)
+		}
+	}
+}
+
+func TestNewThreadMessage(t *testing.T) {
+	data := "Message-ID: <a@example.com>\r\n" +
+		"In-Reply-To: <b@example.com> (comment) <c@example.com>\r\n" +
+		"Subject: Re: foo\r\n" +
+		"Date: Tue, 4 Oct 2016 12:30:00 +0000\r\n" +
+		"\r\n"
+
+	fmsg := &Message{
+		UID: 42,
+		Sections: map[string][]byte{
+			FetchSectionName(ThreadFetchItems[2]): []byte(data),
+		},
+	}
+
+	msg, err := NewThreadMessageFromFetch(fmsg)
+	if err != nil {
+		t.Fatalf("cannot read thread message: %v", err)
+	}
+
+	expected := &ThreadMessage{
+		Id:         42,
+		MessageId:  "<a@example.com>",
+		References: []string{"<b@example.com>"},
+		Subject:    "Re: foo",
+		Date:       time.Date(2016, 10, 4, 12, 30, 0, 0, time.UTC),
+	}
+
+	if !msg.Date.Equal(expected.Date) {
+		t.Errorf("invalid date %v", msg.Date)
+	}
+
+	msg.Date = expected.Date
+
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("invalid thread message %#v", msg)
+	}
+}
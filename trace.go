@@ -0,0 +1,259 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLogMaxLiteralSize is the default number of bytes of each literal
+// included in protocol traces.
+const DefaultLogMaxLiteralSize = 64
+
+// protocolTrace logs data sent and received on a connection, one record per
+// line. Literals are logged separately and truncated; credentials sent with
+// LOGIN and AUTHENTICATE are redacted until the server sends the tagged
+// response of the command.
+type protocolTrace struct {
+	logger         *slog.Logger
+	maxLiteralSize int
+
+	mutex    sync.Mutex
+	redactor Redactor
+}
+
+type protocolTraceStream struct {
+	trace *protocolTrace
+	send  bool
+
+	buf         []byte
+	literalSize int // remaining bytes of the current literal
+	literal     []byte
+	literalLen  int
+}
+
+func newProtocolTrace(logger *slog.Logger, maxLiteralSize int) *protocolTrace {
+	return &protocolTrace{
+		logger:         logger,
+		maxLiteralSize: maxLiteralSize,
+	}
+}
+
+type traceReader struct {
+	r      io.Reader
+	stream *protocolTraceStream
+}
+
+func (r *traceReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.stream.process(p[:n])
+	}
+
+	return n, err
+}
+
+type traceWriter struct {
+	w      io.Writer
+	stream *protocolTraceStream
+}
+
+func (w *traceWriter) Write(p []byte) (int, error) {
+	w.stream.process(p)
+	return w.w.Write(p)
+}
+
+func (t *protocolTrace) Reader(r io.Reader) io.Reader {
+	return &traceReader{r: r, stream: &protocolTraceStream{trace: t}}
+}
+
+func (t *protocolTrace) Writer(w io.Writer) io.Writer {
+	return &traceWriter{
+		w:      w,
+		stream: &protocolTraceStream{trace: t, send: true},
+	}
+}
+
+func (s *protocolTraceStream) process(data []byte) {
+	for len(data) > 0 {
+		if s.literalSize > 0 {
+			n := s.literalSize
+			if n > len(data) {
+				n = len(data)
+			}
+
+			s.appendLiteral(data[:n])
+			s.literalSize -= n
+			data = data[n:]
+
+			if s.literalSize == 0 {
+				s.trace.logLiteral(s.send, s.literal, s.literalLen)
+				s.literal = nil
+			}
+
+			continue
+		}
+
+		idx := bytes.IndexByte(data, '\n')
+		if idx == -1 {
+			s.buf = append(s.buf, data...)
+			return
+		}
+
+		s.buf = append(s.buf, data[:idx+1]...)
+		data = data[idx+1:]
+
+		line := string(bytes.TrimRight(s.buf, "\r\n"))
+		s.buf = s.buf[:0]
+
+		if line != "" {
+			s.trace.logLine(s.send, line)
+		}
+
+		if size := traceLiteralSize(line); size > 0 {
+			s.literalSize = size
+			s.literalLen = size
+		}
+	}
+}
+
+func (s *protocolTraceStream) appendLiteral(data []byte) {
+	max := s.trace.maxLiteralSize - len(s.literal)
+	if max <= 0 {
+		return
+	}
+
+	if len(data) > max {
+		data = data[:max]
+	}
+
+	s.literal = append(s.literal, data...)
+}
+
+func (t *protocolTrace) logLine(send bool, line string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if send {
+		line, _ = t.redactor.ClientLine(line)
+		t.logger.Debug("send", "line", line)
+		return
+	}
+
+	t.redactor.ServerLine(line)
+
+	t.logger.Debug("receive", "line", line)
+}
+
+func (t *protocolTrace) logLiteral(send bool, data []byte, size int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	msg := "receive literal"
+	if send {
+		msg = "send literal"
+
+		if t.redactor.Active() {
+			t.logger.Debug(msg, "size", size, "data", "[redacted]")
+			return
+		}
+	}
+
+	t.logger.Debug(msg, "size", size, "data", string(data),
+		"truncated", len(data) < size)
+}
+
+// Redactor removes credentials from the lines sent by a client: the arguments
+// of LOGIN commands, and everything sent for AUTHENTICATE commands including
+// the initial response (RFC 4959). Redaction lasts until the server sends the
+// tagged response of the command. It is used for both protocol traces and
+// transcripts.
+type Redactor struct {
+	tag string
+}
+
+// Active returns true if data sent by the client are currently redacted.
+func (r *Redactor) Active() bool {
+	return r.tag != ""
+}
+
+// ClientLine returns a line sent by the client with credentials replaced by
+// "[redacted]", and true if the line was modified. Redacted lines never
+// contain the final line ending.
+func (r *Redactor) ClientLine(line string) (string, bool) {
+	if r.tag != "" {
+		return "[redacted]", true
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return line, false
+	}
+
+	tag := fields[0]
+
+	switch strings.ToUpper(fields[1]) {
+	case "LOGIN":
+		r.tag = tag
+		return tag + " " + fields[1] + " [redacted]", true
+
+	case "AUTHENTICATE":
+		r.tag = tag
+
+		if len(fields) > 3 {
+			// Initial response (RFC 4959)
+			return tag + " " + fields[1] + " " + fields[2] +
+				" [redacted]", true
+		}
+	}
+
+	return line, false
+}
+
+// ServerLine processes a line sent by the server, ending redaction if it is
+// the tagged response of the command being redacted.
+func (r *Redactor) ServerLine(line string) {
+	if r.tag != "" && strings.HasPrefix(line, r.tag+" ") {
+		r.tag = ""
+	}
+}
+
+// traceLiteralSize returns the size of the literal announced at the end of a
+// line, or zero if there is none.
+func traceLiteralSize(line string) int {
+	if !strings.HasSuffix(line, "}") {
+		return 0
+	}
+
+	start := strings.LastIndexByte(line, '{')
+	if start == -1 {
+		return 0
+	}
+
+	sizeString := strings.TrimSuffix(line[start+1:len(line)-1], "+")
+
+	size, err := strconv.Atoi(sizeString)
+	if err != nil || size < 0 {
+		return 0
+	}
+
+	return size
+}
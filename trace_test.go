@@ -0,0 +1,121 @@
+//
+// Copyright (c) 2016 Nicolas Martyanoff <khaelin@gmail.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package imapc_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galdor/go-imapc"
+)
+
+func TestClientTrace(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	var buf bytes.Buffer
+
+	handlerOptions := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	client := newTestClient(srv)
+	client.Logger = slog.New(slog.NewTextHandler(&buf, handlerOptions))
+	client.LogMaxLiteralSize = 8
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+
+	message := "Subject: trace\r\n\r\n" + strings.Repeat("x", 100) + "\r\n"
+
+	_, err := client.SendCommandAppend("INBOX", nil, time.Time{},
+		[]byte(message))
+	if err != nil {
+		t.Fatalf("cannot append message: %v", err)
+	}
+
+	if err := client.SendCommandLogout(); err != nil {
+		t.Fatalf("cannot logout: %v", err)
+	}
+
+	trace := buf.String()
+
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret"))
+	if strings.Contains(trace, "secret") || strings.Contains(trace, creds) {
+		t.Errorf("credentials found in trace:\n%s", trace)
+	}
+
+	if strings.Contains(trace, "xxxxxxxxxx") {
+		t.Errorf("literal not truncated in trace:\n%s", trace)
+	}
+
+	for _, s := range []string{
+		`msg=send line="c0000001 AUTHENTICATE PLAIN"`,
+		`msg=send line=[redacted]`,
+		`msg="send literal" size=120 data=Subject: truncated=true`,
+		`msg=receive line="c0000003 OK LOGOUT completed"`,
+	} {
+		if !strings.Contains(trace, s) {
+			t.Errorf("%q not found in trace:\n%s", s, trace)
+		}
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	var r imapc.Redactor
+
+	lines := []struct {
+		client   bool
+		line     string
+		expected string // only for client lines
+	}{
+		{true, "a1 CAPABILITY", "a1 CAPABILITY"},
+		{false, "a1 OK done", ""},
+		{true, "a2 login alice secret", "a2 login [redacted]"},
+		{false, "a2 OK logged in", ""},
+		{true, "a3 AUTHENTICATE PLAIN", "a3 AUTHENTICATE PLAIN"},
+		{false, "+ ", ""},
+		{true, "AGFsaWNlAHNlY3JldA==", "[redacted]"},
+		{false, "a3 OK authenticated", ""},
+		{true, "a4 AUTHENTICATE PLAIN AGFsaWNlAHNlY3JldA==",
+			"a4 AUTHENTICATE PLAIN [redacted]"},
+		{false, "* CAPABILITY IMAP4rev1", ""},
+		{true, "*", "[redacted]"},
+		{false, "a4 BAD authentication cancelled", ""},
+		{true, "a5 SELECT INBOX", "a5 SELECT INBOX"},
+	}
+
+	for _, l := range lines {
+		if !l.client {
+			r.ServerLine(l.line)
+			continue
+		}
+
+		line, redacted := r.ClientLine(l.line)
+		if line != l.expected {
+			t.Errorf("%q was redacted as %q instead of %q",
+				l.line, line, l.expected)
+		}
+
+		if redacted != (line != l.line) {
+			t.Errorf("%q was redacted as %q but redacted is %v",
+				l.line, line, redacted)
+		}
+	}
+}
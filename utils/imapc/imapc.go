@@ -17,10 +17,15 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
+	"strconv"
 
 	"github.com/galdor/go-cmdline"
 	"github.com/galdor/go-imapc"
+	"github.com/galdor/go-imapc/maildir"
+	"github.com/galdor/go-imapc/mbox"
+	"github.com/galdor/go-imapc/migrate"
 )
 
 func main() {
@@ -30,6 +35,7 @@ func main() {
 	cmdline.AddOption("l", "login", "login", "set the login")
 	cmdline.AddOption("m", "mailbox", "name", "select a mailbox")
 	cmdline.AddOption("p", "password", "password", "set the password")
+	cmdline.AddFlag("v", "verbose", "log all data sent and received")
 
 	cmdline.AddCommand("connect", "connect to a server")
 	cmdline.AddCommand("list", "list mailboxes")
@@ -41,6 +47,9 @@ func main() {
 	cmdline.AddCommand("unsubscribe", "unsubscribe from a mailbox")
 	cmdline.AddCommand("examine", "examine a mailbox")
 	cmdline.AddCommand("search", "search for messages")
+	cmdline.AddCommand("export", "export messages")
+	cmdline.AddCommand("import", "import messages")
+	cmdline.AddCommand("migrate", "copy all messages to another account")
 
 	cmdline.Parse(os.Args)
 
@@ -75,6 +84,12 @@ func main() {
 		cmdFn = CmdExamine
 	case "search":
 		cmdFn = CmdSearch
+	case "export":
+		cmdFn = CmdExport
+	case "import":
+		cmdFn = CmdImport
+	case "migrate":
+		cmdFn = CmdMigrate
 	default:
 		Die("unknown command")
 	}
@@ -84,6 +99,12 @@ func main() {
 	client.Login = login
 	client.Password = password
 
+	if cmdline.IsOptionSet("verbose") {
+		handlerOptions := &slog.HandlerOptions{Level: slog.LevelDebug}
+		client.Logger = slog.New(slog.NewTextHandler(os.Stderr,
+			handlerOptions))
+	}
+
 	if err := client.Connect(); err != nil {
 		Die("%v", err)
 	}
@@ -259,12 +280,18 @@ func CmdSearch(client *imapc.Client, args []string) {
 	charset := cmdline.OptionValue("charset")
 	searchString := cmdline.ArgumentValue("search")
 
-	keys, err := imapc.ParseSearchString(searchString)
+	query, err := imapc.ParseSearchQuery(searchString)
 	if err != nil {
 		Die("invalid search string: %v\n", err)
 	}
 
-	rs, err := client.SendCommandSearch(charset, keys)
+	if err := imapc.ValidateSearchNode(query, client.Caps); err != nil {
+		Die("invalid search query: %v\n", err)
+	}
+
+	query = imapc.SimplifySearchNode(query)
+
+	rs, err := client.SendCommandSearch(charset, query.SearchKey())
 	if err != nil {
 		Die("%v", err)
 	}
@@ -273,6 +300,129 @@ func CmdSearch(client *imapc.Client, args []string) {
 	fmt.Printf("%#v\n", rs)
 }
 
+func CmdExport(client *imapc.Client, args []string) {
+	cmdline := cmdline.New()
+	cmdline.AddOption("f", "format", "format",
+		"the output format (maildir, mbox)")
+	cmdline.AddOption("b", "mailbox", "name",
+		"the mailbox to export instead of all mailboxes")
+	cmdline.AddArgument("path",
+		"the output directory, or file for a single mbox mailbox")
+	cmdline.Parse(args)
+
+	format := cmdline.OptionValue("format")
+	mailboxName := cmdline.OptionValue("mailbox")
+	path := cmdline.ArgumentValue("path")
+
+	var err error
+
+	switch format {
+	case "", "maildir":
+		if mailboxName == "" {
+			err = maildir.ExportAccount(client, path)
+		} else {
+			err = maildir.Export(client, mailboxName, path)
+		}
+
+	case "mbox":
+		if mailboxName == "" {
+			err = mbox.ExportAccount(client, path)
+		} else {
+			err = mbox.ExportFile(client, mailboxName, path)
+		}
+
+	default:
+		Die("unknown format %q", format)
+	}
+
+	if err != nil {
+		Die("%v", err)
+	}
+}
+
+func CmdImport(client *imapc.Client, args []string) {
+	cmdline := cmdline.New()
+	cmdline.AddOption("f", "format", "format",
+		"the input format (maildir, mbox)")
+	cmdline.AddArgument("path", "the input directory or file")
+	cmdline.AddArgument("mailbox", "the destination mailbox")
+	cmdline.Parse(args)
+
+	format := cmdline.OptionValue("format")
+	path := cmdline.ArgumentValue("path")
+	mailboxName := cmdline.ArgumentValue("mailbox")
+
+	var err error
+
+	switch format {
+	case "", "maildir":
+		err = maildir.Import(client, path, mailboxName)
+
+	case "mbox":
+		var file *os.File
+
+		file, err = os.Open(path)
+		if err != nil {
+			break
+		}
+
+		err = mbox.Import(client, file, mailboxName)
+		file.Close()
+
+	default:
+		Die("unknown format %q", format)
+	}
+
+	if err != nil {
+		Die("%v", err)
+	}
+}
+
+func CmdMigrate(client *imapc.Client, args []string) {
+	cmdline := cmdline.New()
+	cmdline.AddOption("H", "host", "host", "the destination host")
+	cmdline.SetOptionDefault("host", "localhost")
+	cmdline.AddOption("P", "port", "port", "the destination port")
+	cmdline.SetOptionDefault("port", "143")
+	cmdline.AddFlag("t", "tls", "use tls for the destination")
+	cmdline.AddOption("l", "login", "login", "the destination login")
+	cmdline.AddOption("p", "password", "password",
+		"the destination password")
+	cmdline.AddOption("s", "state", "path",
+		"the file used to resume an interrupted migration")
+	cmdline.Parse(args)
+
+	port, err := strconv.Atoi(cmdline.OptionValue("port"))
+	if err != nil || port < 1 || port > 65535 {
+		Die("invalid port %q", cmdline.OptionValue("port"))
+	}
+
+	dst := imapc.NewClient()
+	dst.Host = cmdline.OptionValue("host")
+	dst.Port = port
+	dst.TLS = cmdline.IsOptionSet("tls")
+	dst.Login = cmdline.OptionValue("login")
+	dst.Password = cmdline.OptionValue("password")
+
+	if err := dst.Connect(); err != nil {
+		Die("cannot connect to destination: %v", err)
+	}
+
+	migration := migrate.NewMigration(client, dst)
+	migration.StatePath = cmdline.OptionValue("state")
+	migration.Log = func(format string, args ...interface{}) {
+		fmt.Printf(format+"\n", args...)
+	}
+
+	if err := migration.Run(); err != nil {
+		Die("%v", err)
+	}
+
+	if err := dst.SendCommandLogout(); err != nil {
+		Die("cannot logout from destination: %v", err)
+	}
+}
+
 func Error(format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
 	fmt.Fprintf(os.Stderr, "%s\n", msg)